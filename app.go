@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 
@@ -12,8 +13,15 @@ import (
 func main() {
 	var operation string
 	var configPath string
-	flag.StringVar(&operation, "op", "server", "operation: [sever|test]")
+	flag.StringVar(&operation, "op", "server", "operation: [server|test|query|bench|fake-upstream]")
 	flag.StringVar(&configPath, "config", "", "path to config file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %v [-config file] [-op server|test]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %v -op query [@server] name [type] [class] [+option...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %v -op bench [@server] queryfile [+option...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %v -op fake-upstream [host:port] [+latency=duration] [+ttl=seconds]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if configPath == "" {
@@ -26,6 +34,18 @@ func main() {
 		dohboy.Run(configPath)
 	} else if operation == "test" {
 		test.Run()
+	} else if operation == "query" {
+		if err := test.Query(flag.Args()); err != nil {
+			log.Fatalf("ERR: %v", err)
+		}
+	} else if operation == "bench" {
+		if err := test.Bench(flag.Args()); err != nil {
+			log.Fatalf("ERR: %v", err)
+		}
+	} else if operation == "fake-upstream" {
+		if err := test.FakeUpstream(flag.Args()); err != nil {
+			log.Fatalf("ERR: %v", err)
+		}
 	} else {
 		log.Fatalf("unknown operation: %v", operation)
 	}
@@ -0,0 +1,404 @@
+package dohboy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// adminAPI serves the json endpoints used to inspect and poke at a running
+// relay.
+type adminAPI struct {
+	router *router
+	config *Config
+	token  string
+}
+
+func (api *adminAPI) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.URL.Path == "/" || request.URL.Path == "/dashboard" {
+		if allowMethods(response, request, http.MethodGet) {
+			serveDashboard(response, request)
+		}
+		return
+	}
+
+	header := request.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) ||
+		subtle.ConstantTimeCompare([]byte(header[len(prefix):]), []byte(api.token)) != 1 {
+		response.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(response, http.StatusUnauthorized, "missing or bad admin token")
+		return
+	}
+
+	handlers := map[string]func(http.ResponseWriter, *http.Request){
+		"/api/upstreams": api.handleUpstreams,
+		"/api/cache":     api.handleCache,
+		"/api/ratelimit": api.handleRateLimit,
+		"/api/bans":      api.handleBans,
+		"/api/blocking":  api.handleBlocking,
+		"/api/config":    api.handleConfig,
+		"/api/metrics":   api.handleMetrics,
+		"/api/stats":     api.handleStats,
+		"/api/route":     api.handleRoute,
+	}
+
+	handler, exists := handlers[request.URL.Path]
+	if !exists {
+		writeJSONError(response, http.StatusNotFound, "no such endpoint")
+		return
+	}
+	handler(response, request)
+}
+
+func writeJSON(response http.ResponseWriter, status int, body interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(body)
+}
+
+func writeJSONError(response http.ResponseWriter, status int, message string) {
+	writeJSON(response, status, map[string]string{"error": message})
+}
+
+func allowMethods(response http.ResponseWriter, request *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if request.Method == method {
+			return true
+		}
+	}
+	response.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSONError(response, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+// endpointsFor picks the endpoints named by the `endpoint` query param, or all
+// of them if it isn't given.
+func (api *adminAPI) endpointsFor(response http.ResponseWriter, request *http.Request) ([]*endpoint, bool) {
+	path := request.URL.Query().Get("endpoint")
+	if path == "" {
+		return api.router.endpoints, true
+	}
+
+	if found := api.router.findEndpoint(path); found != nil {
+		return []*endpoint{found}, true
+	}
+
+	writeJSONError(response, http.StatusNotFound, fmt.Sprintf("no endpoint at [%v]", path))
+	return nil, false
+}
+
+func (api *adminAPI) handleUpstreams(response http.ResponseWriter, request *http.Request) {
+	if !allowMethods(response, request, http.MethodGet) {
+		return
+	}
+
+	endpoints, ok := api.endpointsFor(response, request)
+	if !ok {
+		return
+	}
+
+	retval := map[string][]upstreamStatus{}
+	for _, endpoint := range endpoints {
+		retval[endpoint.path] = endpoint.relay.upstreamStatuses()
+	}
+	writeJSON(response, http.StatusOK, retval)
+}
+
+// handleCache lists (GET) or flushes (DELETE) cached responses, for the name
+// in the `name` query param or for every name.
+func (api *adminAPI) handleCache(response http.ResponseWriter, request *http.Request) {
+	if !allowMethods(response, request, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	endpoints, ok := api.endpointsFor(response, request)
+	if !ok {
+		return
+	}
+
+	name := request.URL.Query().Get("name")
+
+	if request.Method == http.MethodDelete {
+		flushed := 0
+		for _, endpoint := range endpoints {
+			if endpoint.relay.cache != nil {
+				flushed += endpoint.relay.cache.flush(name)
+			}
+		}
+		writeJSON(response, http.StatusOK, map[string]int{"flushed": flushed})
+		return
+	}
+
+	limit := 100
+	if val, err := strconv.Atoi(request.URL.Query().Get("limit")); err == nil {
+		limit = val
+	}
+
+	retval := map[string][]cacheEntryInfo{}
+	for _, endpoint := range endpoints {
+		if endpoint.relay.cache != nil {
+			retval[endpoint.path] = endpoint.relay.cache.entries(name, limit)
+		}
+	}
+	writeJSON(response, http.StatusOK, retval)
+}
+
+// handleRateLimit shows the buckets of the client given by the `ip` and
+// `token` query params.
+func (api *adminAPI) handleRateLimit(response http.ResponseWriter, request *http.Request) {
+	if !allowMethods(response, request, http.MethodGet) {
+		return
+	}
+
+	endpoints, ok := api.endpointsFor(response, request)
+	if !ok {
+		return
+	}
+
+	query := request.URL.Query()
+	client := rateLimitClient{ip: query.Get("ip"), userKey: query.Get("token"), label: query.Get("label")}
+	if client.ip == "" {
+		writeJSONError(response, http.StatusBadRequest, "an ip is required")
+		return
+	}
+
+	retval := map[string][]bucketStatus{}
+	for _, endpoint := range endpoints {
+		retval[endpoint.path] = endpoint.rateLimiter.inspect(client)
+	}
+	writeJSON(response, http.StatusOK, retval)
+}
+
+type banRequest struct {
+	IP              string `json:"ip"`
+	Token           string `json:"token"`
+	DurationSeconds int64  `json:"duration_seconds"`
+}
+
+// handleBans lists (GET), adds (POST) or lifts (DELETE) bans on client
+// networks and tokens.
+func (api *adminAPI) handleBans(response http.ResponseWriter, request *http.Request) {
+	if !allowMethods(response, request, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+
+	bans := api.router.bans
+
+	switch request.Method {
+	case http.MethodGet:
+		writeJSON(response, http.StatusOK, bans.active())
+
+	case http.MethodPost:
+		body := banRequest{}
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			writeJSONError(response, http.StatusBadRequest, err.Error())
+			return
+		}
+		if (body.IP == "") == (body.Token == "") || body.DurationSeconds <= 0 {
+			writeJSONError(response, http.StatusBadRequest, "exactly one of ip or token, and a positive duration_seconds, are required")
+			return
+		}
+
+		duration := time.Duration(body.DurationSeconds) * time.Second
+		if body.IP != "" {
+			if err := bans.banNetwork(body.IP, duration); err != nil {
+				writeJSONError(response, http.StatusBadRequest, err.Error())
+				return
+			}
+		} else {
+			bans.banToken(body.Token, duration)
+		}
+		writeJSON(response, http.StatusOK, bans.active())
+
+	case http.MethodDelete:
+		query := request.URL.Query()
+		lifted := false
+		if ip := query.Get("ip"); ip != "" {
+			lifted = bans.unban("ip", ip)
+		} else if token := query.Get("token"); token != "" {
+			lifted = bans.unban("token", token)
+		}
+		writeJSON(response, http.StatusOK, map[string]bool{"lifted": lifted})
+	}
+}
+
+func (api *adminAPI) handleBlocking(response http.ResponseWriter, request *http.Request) {
+	if !allowMethods(response, request, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if request.Method == http.MethodPost {
+		body := struct {
+			Enabled *bool `json:"enabled"`
+		}{}
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil || body.Enabled == nil {
+			writeJSONError(response, http.StatusBadRequest, "expected {\"enabled\": true|false}")
+			return
+		}
+		api.router.setBlockingEnabled(*body.Enabled)
+	}
+
+	writeJSON(response, http.StatusOK, map[string]bool{"enabled": api.router.isBlockingEnabled()})
+}
+
+func (api *adminAPI) handleConfig(response http.ResponseWriter, request *http.Request) {
+	if !allowMethods(response, request, http.MethodGet) {
+		return
+	}
+
+	redacted, err := redactConfig(api.config)
+	if err != nil {
+		writeJSONError(response, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(response, http.StatusOK, redacted)
+}
+
+func (api *adminAPI) handleMetrics(response http.ResponseWriter, request *http.Request) {
+	if !allowMethods(response, request, http.MethodGet) {
+		return
+	}
+	writeJSON(response, http.StatusOK, api.router.metrics.snapshot())
+}
+
+// handleStats summarizes the query stats over the `window` query param (1h by
+// default, at most 24h).
+func (api *adminAPI) handleStats(response http.ResponseWriter, request *http.Request) {
+	if !allowMethods(response, request, http.MethodGet) {
+		return
+	}
+
+	window := time.Hour
+	if val := request.URL.Query().Get("window"); val != "" {
+		parsed, err := time.ParseDuration(val)
+		if err != nil || parsed <= 0 || parsed > statsBuckets*statsBucketWidth {
+			writeJSONError(response, http.StatusBadRequest, "window must be a duration of at most 24h")
+			return
+		}
+		window = parsed
+	}
+
+	top := 10
+	if val, err := strconv.Atoi(request.URL.Query().Get("top")); err == nil && val > 0 {
+		top = val
+	}
+
+	writeJSON(response, http.StatusOK, api.router.stats.summarize(window, top))
+}
+
+// handleRoute explains which upstream a query would be sent to, without
+// sending it. The query is given by the `name` and `type` (A by default) query
+// params, and the client by the `ip` and `label` query params.
+func (api *adminAPI) handleRoute(response http.ResponseWriter, request *http.Request) {
+	if !allowMethods(response, request, http.MethodGet) {
+		return
+	}
+
+	endpoints, ok := api.endpointsFor(response, request)
+	if !ok {
+		return
+	}
+
+	query := request.URL.Query()
+	name := query.Get("name")
+	if name == "" {
+		writeJSONError(response, http.StatusBadRequest, "a name is required")
+		return
+	}
+
+	qtype := dns.TypeA
+	if val := query.Get("type"); val != "" {
+		known := false
+		if qtype, known = dns.StringToType[strings.ToUpper(val)]; !known {
+			writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("unknown type [%v]", val))
+			return
+		}
+	}
+
+	client := queryClient{label: query.Get("label")}
+	if val := query.Get("ip"); val != "" {
+		if client.ip = net.ParseIP(val); client.ip == nil {
+			writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("bad ip [%v]", val))
+			return
+		}
+	}
+
+	dnsQuery := new(dns.Msg)
+	dnsQuery.SetQuestion(dns.Fqdn(name), qtype)
+
+	retval := map[string]routeExplanation{}
+	for _, endpoint := range endpoints {
+		retval[endpoint.path] = endpoint.relay.explain(dnsQuery, client)
+	}
+	writeJSON(response, http.StatusOK, retval)
+}
+
+var redactedConfigKeys = map[string]bool{
+	"password":      true,
+	"token":         true,
+	"key_whitelist": true,
+	"secrets":       true,
+}
+
+// redactConfig turns the config into a json friendly tree, keyed the same way
+// as the yaml file, with secrets blanked out.
+func redactConfig(config *Config) (interface{}, error) {
+	raw, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree interface{}
+	if err := yaml.Unmarshal(raw, &tree); err != nil {
+		return nil, err
+	}
+	return redactTree(tree), nil
+}
+
+func redactTree(node interface{}) interface{} {
+	switch val := node.(type) {
+	case map[interface{}]interface{}:
+		retval := make(map[string]interface{}, len(val))
+		for k, v := range val {
+			key := fmt.Sprintf("%v", k)
+			if redactedConfigKeys[key] && v != nil && v != "" {
+				retval[key] = "REDACTED"
+			} else {
+				retval[key] = redactTree(v)
+			}
+		}
+		return retval
+	case []interface{}:
+		retval := make([]interface{}, len(val))
+		for i, v := range val {
+			retval[i] = redactTree(v)
+		}
+		return retval
+	}
+	return node
+}
+
+func createAdminServer(config *Config, router *router) *http.Server {
+	api := &adminAPI{
+		router: router,
+		config: config,
+		token:  config.Admin.Token,
+	}
+
+	return &http.Server{
+		Addr:         fmt.Sprintf("%v:%v", config.Admin.Host, config.Admin.Port),
+		Handler:      api,
+		ReadTimeout:  time.Duration(config.Server.TimeoutMillis.Read) * time.Millisecond,
+		WriteTimeout: time.Duration(config.Server.TimeoutMillis.Write) * time.Millisecond,
+		IdleTimeout:  time.Duration(config.Server.TimeoutMillis.Idle) * time.Millisecond,
+	}
+}
@@ -0,0 +1,237 @@
+package dohboy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testAdminToken = "adm1n"
+
+func newTestAdminAPI(t *testing.T, yaml string) *adminAPI {
+	t.Helper()
+	config := newTestConfig(t, yaml)
+	router, err := createRouter(config)
+	if err != nil {
+		t.Fatalf("Could not create router: %v", err)
+	}
+	t.Cleanup(router.close)
+	return &adminAPI{router: router, config: config, token: config.Admin.Token}
+}
+
+// adminRequest sends a request to the admin api, with the admin token, and
+// decodes the json it answers with into body.
+func adminRequest(t *testing.T, api *adminAPI, method string, target string, requestBody string, body interface{}) int {
+	t.Helper()
+	var reader io.Reader
+	if requestBody != "" {
+		reader = strings.NewReader(requestBody)
+	}
+	request := httptest.NewRequest(method, target, reader)
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, request)
+	if body != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), body); err != nil {
+			t.Fatalf("Bad json [%v]: %v", recorder.Body.String(), err)
+		}
+	}
+	return recorder.Code
+}
+
+func TestAdminAuth(t *testing.T) {
+	api := newTestAdminAPI(t, "admin: {token: "+testAdminToken+"}\n")
+
+	for _, authorization := range []string{"", "Bearer nope", "Basic " + testAdminToken, testAdminToken} {
+		request := httptest.NewRequest(http.MethodGet, "/api/metrics", nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusUnauthorized || recorder.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%q: status = %v, want %v with a Bearer challenge", authorization, recorder.Code, http.StatusUnauthorized)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("dashboard status = %v, want %v without a token", recorder.Code, http.StatusOK)
+	}
+
+	if status := adminRequest(t, api, http.MethodGet, "/api/nothing", "", nil); status != http.StatusNotFound {
+		t.Errorf("status = %v, want %v", status, http.StatusNotFound)
+	}
+	if status := adminRequest(t, api, http.MethodPut, "/api/bans", "", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("status = %v, want %v", status, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAdminBans(t *testing.T) {
+	fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		return replyA(query, "192.0.2.1", 300)
+	})
+	tokensFile := filepath.Join(t.TempDir(), "tokens.yml")
+	if err := ioutil.WriteFile(tokensFile, []byte("- {label: alice, token: s3cret}\n"), 0600); err != nil {
+		t.Fatalf("Could not write tokens: %v", err)
+	}
+	api := newTestAdminAPI(t, upstreamYAML(fake.address)+fmt.Sprintf(`
+admin: {token: %v}
+auth: {tokens_filepath: %v}
+`, testAdminToken, tokensFile))
+
+	query := func(client string, token string) int {
+		request := newGetRequest("/dns-query", packTestQuery(t, "www.example.com.", dns.TypeA))
+		request.RemoteAddr = client + ":1234"
+		if token != "" {
+			request.URL.RawQuery += "&token=" + token
+		}
+		recorder, _ := serve(api.router, request)
+		return recorder.Code
+	}
+
+	t.Run("bad requests", func(t *testing.T) {
+		for _, body := range []string{
+			`not json`,
+			`{"duration_seconds": 60}`,
+			`{"ip": "198.51.100.0/24", "token": "t", "duration_seconds": 60}`,
+			`{"ip": "198.51.100.0/24"}`,
+			`{"ip": "198.51.100.0/24", "duration_seconds": -1}`,
+			`{"ip": "not an ip", "duration_seconds": 60}`,
+		} {
+			if status := adminRequest(t, api, http.MethodPost, "/api/bans", body, nil); status != http.StatusBadRequest {
+				t.Errorf("%v: status = %v, want %v", body, status, http.StatusBadRequest)
+			}
+		}
+	})
+
+	t.Run("network", func(t *testing.T) {
+		bans := []ban{}
+		if status := adminRequest(t, api, http.MethodPost, "/api/bans", `{"ip": "198.51.100.7/24", "duration_seconds": 60}`, &bans); status != http.StatusOK {
+			t.Fatalf("status = %v, want %v", status, http.StatusOK)
+		}
+		if len(bans) != 1 || bans[0].Target != "198.51.100.0/24" || bans[0].Kind != "ip" {
+			t.Errorf("bans = %+v, want the network banned", bans)
+		}
+
+		if status := query("198.51.100.9", ""); status != http.StatusForbidden {
+			t.Errorf("banned client: status = %v, want %v", status, http.StatusForbidden)
+		}
+		if status := query("203.0.113.9", ""); status != http.StatusOK {
+			t.Errorf("other client: status = %v, want %v", status, http.StatusOK)
+		}
+
+		lifted := map[string]bool{}
+		adminRequest(t, api, http.MethodDelete, "/api/bans?ip=198.51.100.0/24", "", &lifted)
+		if !lifted["lifted"] {
+			t.Errorf("the ban wasn't lifted")
+		}
+		if status := query("198.51.100.9", ""); status != http.StatusOK {
+			t.Errorf("unbanned client: status = %v, want %v", status, http.StatusOK)
+		}
+
+		adminRequest(t, api, http.MethodDelete, "/api/bans?ip=198.51.100.0/24", "", &lifted)
+		if lifted["lifted"] {
+			t.Errorf("lifted a ban that wasn't there")
+		}
+	})
+
+	t.Run("token", func(t *testing.T) {
+		if status := query("203.0.113.9", "s3cret"); status != http.StatusOK {
+			t.Fatalf("status = %v, want %v before the ban", status, http.StatusOK)
+		}
+		adminRequest(t, api, http.MethodPost, "/api/bans", `{"token": "s3cret", "duration_seconds": 60}`, nil)
+
+		if status := query("203.0.113.9", "s3cret"); status != http.StatusForbidden {
+			t.Errorf("banned token: status = %v, want %v", status, http.StatusForbidden)
+		}
+
+		bans := []ban{}
+		adminRequest(t, api, http.MethodGet, "/api/bans", "", &bans)
+		if len(bans) != 1 || bans[0].Target != "s3cret" || bans[0].Kind != "token" {
+			t.Errorf("bans = %+v, want the token banned", bans)
+		}
+	})
+
+	t.Run("label", func(t *testing.T) {
+		adminRequest(t, api, http.MethodDelete, "/api/bans?token=s3cret", "", nil)
+		adminRequest(t, api, http.MethodPost, "/api/bans", `{"token": "alice", "duration_seconds": 60}`, nil)
+
+		request := newGetRequest("/dns-query", packTestQuery(t, "www.example.com.", dns.TypeA))
+		request.Header.Set("Authorization", "Bearer s3cret")
+		if recorder, _ := serve(api.router, request); recorder.Code != http.StatusForbidden {
+			t.Errorf("banned label: status = %v, want %v", recorder.Code, http.StatusForbidden)
+		}
+	})
+}
+
+func TestAdminConfigRedaction(t *testing.T) {
+	api := newTestAdminAPI(t, `
+admin:
+  token: `+testAdminToken+`
+backend:
+  redis:
+    address: 192.0.2.6:6379
+    password: hunter2
+cookies:
+  secrets: ["000102030405060708090a0b0c0d0e0f"]
+ip_rate_limit:
+  key_whitelist: vip1,vip2
+`)
+
+	tree := map[string]interface{}{}
+	if status := adminRequest(t, api, http.MethodGet, "/api/config", "", &tree); status != http.StatusOK {
+		t.Fatalf("status = %v, want %v", status, http.StatusOK)
+	}
+
+	raw, _ := json.Marshal(tree)
+	for _, secret := range []string{testAdminToken, "hunter2", "000102030405060708090a0b0c0d0e0f", "vip1"} {
+		if strings.Contains(string(raw), secret) {
+			t.Errorf("config shows [%v]", secret)
+		}
+	}
+
+	redis := tree["backend"].(map[string]interface{})["redis"].(map[string]interface{})
+	if redis["password"] != "REDACTED" || redis["address"] != "192.0.2.6:6379" {
+		t.Errorf("redis = %v, want only the password redacted", redis)
+	}
+	if secrets := tree["cookies"].(map[string]interface{})["secrets"]; secrets != "REDACTED" {
+		t.Errorf("cookie secrets = %v, want them redacted", secrets)
+	}
+
+	// Secrets that aren't set are shown as such.
+	api.config.Backend.Redis.Password = ""
+	adminRequest(t, api, http.MethodGet, "/api/config", "", &tree)
+	if password := tree["backend"].(map[string]interface{})["redis"].(map[string]interface{})["password"]; password != "" {
+		t.Errorf("empty password = %v, want it left empty", password)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	api := newTestAdminAPI(t, "admin: {token: "+testAdminToken+"}\n")
+	api.router.stats.recordQuery(queryEvent{name: "www.example.com.", client: "198.51.100.1", rcode: "NOERROR"})
+
+	summary := statsSummary{}
+	if status := adminRequest(t, api, http.MethodGet, "/api/stats?window=2h&top=1", "", &summary); status != http.StatusOK {
+		t.Fatalf("status = %v, want %v", status, http.StatusOK)
+	}
+	if summary.WindowSeconds != 7200 || summary.Queries != 1 || len(summary.TopDomains) != 1 {
+		t.Errorf("summary = %+v, want the query over 2h", summary)
+	}
+
+	for _, window := range []string{"25h", "-1h", "soon"} {
+		if status := adminRequest(t, api, http.MethodGet, "/api/stats?window="+window, "", nil); status != http.StatusBadRequest {
+			t.Errorf("window %v: status = %v, want %v", window, status, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package dohboy
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type tokenEntry struct {
+	Label string `yaml:"label"`
+	Token string `yaml:"token"`
+}
+
+type authResult int
+
+const (
+	authAnonymous authResult = iota // no credentials presented
+	authAccepted
+	authRejected // credentials presented, but not valid
+)
+
+type authenticator struct {
+	tokens        []tokenEntry
+	allowBearer   bool
+	allowURLToken bool
+}
+
+func (auth *authenticator) lookupToken(token string) (string, bool) {
+	found, label := false, ""
+	for _, entry := range auth.tokens {
+		// Run through every entry regardless of a match to avoid leaking timing.
+		if subtle.ConstantTimeCompare([]byte(entry.Token), []byte(token)) == 1 {
+			found, label = true, entry.Label
+		}
+	}
+	return label, found
+}
+
+// authenticate checks the credentials presented with a request, in order of
+// client certificate, bearer token and then URL token. The first one found
+// decides the result. The returned label identifies the client in logs and
+// metrics.
+//
+// URL tokens double as rate-limit whitelist keys, so an unknown one is only
+// rejected when the endpoint requires auth and is otherwise treated as if no
+// credentials were given. Authorization headers of other schemes (e.g. Basic
+// auth added by a proxy) aren't meant for dohboy and are ignored.
+func (auth *authenticator) authenticate(request *http.Request, urlToken string, required bool) (authResult, string) {
+	if request.TLS != nil && len(request.TLS.VerifiedChains) > 0 {
+		return authAccepted, "cert:" + request.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+
+	if auth.allowBearer {
+		const prefix = "bearer "
+		if header := request.Header.Get("Authorization"); len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+			if label, ok := auth.lookupToken(strings.TrimSpace(header[len(prefix):])); ok {
+				return authAccepted, label
+			}
+			return authRejected, ""
+		}
+	}
+
+	if auth.allowURLToken && urlToken != "" {
+		if label, ok := auth.lookupToken(urlToken); ok {
+			return authAccepted, label
+		}
+		if required {
+			return authRejected, ""
+		}
+	}
+
+	return authAnonymous, ""
+}
+
+func readTokensFile(filepath string) ([]tokenEntry, error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tokens := []tokenEntry{}
+	if err := yaml.NewDecoder(file).Decode(&tokens); err != nil {
+		return nil, err
+	}
+
+	for i, entry := range tokens {
+		if entry.Token == "" {
+			return nil, fmt.Errorf("Entry %v in tokens file [%v] has no token.", i, filepath)
+		}
+		if entry.Label == "" {
+			return nil, fmt.Errorf("Entry %v in tokens file [%v] has no label.", i, filepath)
+		}
+	}
+
+	return tokens, nil
+}
+
+func newAuthenticator(config *AuthConfig) (*authenticator, error) {
+	tokens := []tokenEntry{}
+	if config.TokensFile != "" {
+		var err error
+		if tokens, err = readTokensFile(config.TokensFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return &authenticator{
+		tokens:        tokens,
+		allowBearer:   config.AllowBearer,
+		allowURLToken: config.AllowURLToken,
+	}, nil
+}
+
+// configureClientCerts sets up the tls config to ask for client certificates
+// signed by the configured CA. Certificates are optional at the TLS layer so
+// that token auth keeps working; whether one is required is up to the router.
+func configureClientCerts(tlsConfig *tls.Config, config *AuthConfig) error {
+	if config.ClientCAPath == "" {
+		return nil
+	}
+
+	pem, err := ioutil.ReadFile(config.ClientCAPath)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("No certificates found in client CA file [%v].", config.ClientCAPath)
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
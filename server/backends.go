@@ -0,0 +1,88 @@
+package dohboy
+
+import (
+	"log"
+	"time"
+)
+
+// backends hands out the rate-limit and cache backends picked in the config.
+// In-memory rate-limit backends are created per user, while the in-memory
+// cache and the redis backends are shared; entries are namespaced per user.
+type backends struct {
+	config        *Config
+	redis         *redisClient
+	memoryCache   *memoryCacheBackend
+	stopSnapshots chan struct{}
+}
+
+func newBackends(config *Config) *backends {
+	retval := &backends{config: config}
+
+	if config.Backend.RateLimit == "redis" || config.Backend.Cache == "redis" {
+		retval.redis = newRedisClient(&config.Backend.Redis)
+	}
+
+	if config.Backend.Cache == "memory" {
+		retval.memoryCache = newMemoryCacheBackend(config.Caching.MaxEntries)
+		if config.Caching.SnapshotPath != "" {
+			retval.startCacheSnapshots()
+		}
+	}
+
+	return retval
+}
+
+func (backends *backends) startCacheSnapshots() {
+	caching := &backends.config.Caching
+
+	restored, err := loadCacheSnapshot(backends.memoryCache, caching.SnapshotPath,
+		caching.KeepStale, time.Duration(caching.MaxStaleSeconds)*time.Second)
+	if err != nil {
+		log.Printf("ERR: could not load cache snapshot: %v", err)
+	} else if restored > 0 {
+		log.Printf("restored %v cache entries from [%v]", restored, caching.SnapshotPath)
+	}
+
+	backends.stopSnapshots = make(chan struct{})
+	go runCacheSnapshots(backends.memoryCache, caching.SnapshotPath,
+		time.Duration(caching.SnapshotIntervalSeconds)*time.Second, backends.stopSnapshots)
+}
+
+func (backends *backends) newRateLimitBackend(config *RateLimitConfig) rateLimitBackend {
+	if backends.config.Backend.RateLimit == "redis" {
+		return &redisRateLimitBackend{
+			client:    backends.redis,
+			keyPrefix: backends.config.Backend.Redis.KeyPrefix,
+		}
+	}
+	return newMemoryRateLimitBackend(config.MaxTrackedKeys, config.IdleEvictionSeconds)
+}
+
+func (backends *backends) newCacheBackend() cacheBackend {
+	if backends.config.Backend.Cache == "redis" {
+		return &redisCacheBackend{
+			client:    backends.redis,
+			keyPrefix: backends.config.Backend.Redis.KeyPrefix,
+		}
+	}
+	return backends.memoryCache
+}
+
+func (backends *backends) close() {
+	if backends.redis != nil {
+		backends.redis.close()
+	}
+
+	if backends.stopSnapshots != nil {
+		close(backends.stopSnapshots)
+		if err := saveCacheSnapshot(backends.memoryCache, backends.config.Caching.SnapshotPath); err != nil {
+			log.Printf("ERR: could not save cache snapshot: %v", err)
+		} else {
+			log.Printf("saved cache snapshot to [%v]", backends.config.Caching.SnapshotPath)
+		}
+	}
+}
+
+func logBackendError(what string, err error) {
+	log.Printf("ERR: %v backend: %v", what, err)
+}
@@ -0,0 +1,124 @@
+package dohboy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type ban struct {
+	Target string    `json:"target"`
+	Kind   string    `json:"kind"` // [ip|token]
+	Until  time.Time `json:"until"`
+}
+
+// banList holds temporary bans on client networks and tokens, set through the
+// admin api.
+type banList struct {
+	networks map[string]*net.IPNet
+	bans     map[string]ban
+	mu       sync.Mutex
+}
+
+func newBanList() *banList {
+	return &banList{
+		networks: make(map[string]*net.IPNet),
+		bans:     make(map[string]ban),
+	}
+}
+
+func banKey(kind string, target string) string {
+	return kind + ":" + target
+}
+
+func (list *banList) banNetwork(target string, duration time.Duration) error {
+	networks, err := parseCIDRs([]string{target})
+	if err != nil {
+		return err
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	key := banKey("ip", networks[0].String())
+	list.networks[key] = networks[0]
+	list.bans[key] = ban{Target: networks[0].String(), Kind: "ip", Until: time.Now().Add(duration)}
+	return nil
+}
+
+func (list *banList) banToken(token string, duration time.Duration) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	list.bans[banKey("token", token)] = ban{Target: token, Kind: "token", Until: time.Now().Add(duration)}
+}
+
+func (list *banList) unban(kind string, target string) bool {
+	if kind == "ip" {
+		if networks, err := parseCIDRs([]string{target}); err == nil {
+			target = networks[0].String()
+		}
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	key := banKey(kind, target)
+	_, existed := list.bans[key]
+	delete(list.bans, key)
+	delete(list.networks, key)
+	return existed
+}
+
+// isBanned checks a client's address and any token or label it came with.
+func (list *banList) isBanned(ip string, tokens ...string) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	if len(list.bans) == 0 {
+		return false
+	}
+
+	list.dropExpired(time.Now())
+
+	for _, token := range tokens {
+		if token == "" {
+			continue
+		}
+		if _, banned := list.bans[banKey("token", token)]; banned {
+			return true
+		}
+	}
+
+	if parsedIP := net.ParseIP(ip); parsedIP != nil {
+		for _, network := range list.networks {
+			if network.Contains(parsedIP) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (list *banList) active() []ban {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	list.dropExpired(time.Now())
+
+	retval := make([]ban, 0, len(list.bans))
+	for _, b := range list.bans {
+		retval = append(retval, b)
+	}
+	return retval
+}
+
+func (list *banList) dropExpired(now time.Time) {
+	for key, b := range list.bans {
+		if now.After(b.Until) {
+			delete(list.bans, key)
+			delete(list.networks, key)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package dohboy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// bootstrapDialer dials a DoH upstream's hostname without going through the
+// system resolver, which may well be dohboy itself. The hostname is resolved
+// through the configured bootstrap servers (or pinned to static IPs), and a
+// dial fails over across every address it resolved to.
+type bootstrapDialer struct {
+	host      string
+	servers   []string
+	staticIPs []net.IP
+	refresh   time.Duration
+	timeout   time.Duration
+	dialer    net.Dialer
+
+	ips         []net.IP
+	nextResolve time.Time
+	failures    int  // resolves failed in a row
+	resolving   bool // a resolve is under way, outside of mu
+	preferred   int  // index into ips of the last address that worked
+	mu          sync.Mutex
+}
+
+// The first retry after a failed resolve waits this long, and every further
+// failure doubles the wait, up to the refresh interval.
+const bootstrapRetryBackoff = time.Second
+
+func newBootstrapDialer(host string, config BootstrapConfig, timeout time.Duration) (*bootstrapDialer, error) {
+	staticIPs := make([]net.IP, 0, len(config.StaticIPs))
+	for _, addr := range config.StaticIPs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("Bad bootstrap static ip [%v].", addr)
+		}
+		staticIPs = append(staticIPs, ip)
+	}
+
+	servers := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		servers = append(servers, server)
+	}
+
+	refresh := time.Duration(config.RefreshSeconds) * time.Second
+	if refresh <= 0 {
+		refresh = 5 * time.Minute
+	}
+
+	return &bootstrapDialer{
+		host:      strings.ToLower(host),
+		servers:   servers,
+		staticIPs: staticIPs,
+		refresh:   refresh,
+		timeout:   timeout,
+		dialer:    net.Dialer{Timeout: timeout},
+	}, nil
+}
+
+func (bd *bootstrapDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || strings.ToLower(host) != bd.host {
+		return bd.dialer.DialContext(ctx, network, address)
+	}
+
+	ips, preferred, err := bd.addresses()
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for i := range ips {
+		idx := (preferred + i) % len(ips)
+		conn, err := bd.dialer.DialContext(ctx, network, net.JoinHostPort(ips[idx].String(), port))
+		if err == nil {
+			bd.mu.Lock()
+			bd.preferred = idx
+			bd.mu.Unlock()
+			return conn, nil
+		}
+		lastErr = err
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("Could not connect to any address of [%v]: %v", bd.host, lastErr)
+}
+
+// addresses returns the addresses to try, re-resolving them if they're due a
+// refresh. If the refresh fails, the previous addresses are kept, and the next
+// try backs off. Only a dial with no addresses at all to fall back on waits
+// for the bootstrap servers, the others carry on with the previous ones.
+func (bd *bootstrapDialer) addresses() ([]net.IP, int, error) {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+
+	if len(bd.servers) == 0 {
+		return bd.staticIPs, bd.preferred, nil
+	}
+
+	due := len(bd.ips) == 0 || !time.Now().Before(bd.nextResolve)
+	if !due || (bd.resolving && len(bd.ips) > 0) {
+		return bd.ips, bd.preferred, nil
+	}
+
+	bd.resolving = true
+	bd.mu.Unlock()
+	ips, err := bd.resolve()
+	bd.mu.Lock()
+	bd.resolving = false
+
+	if err == nil {
+		// Static ips stay in the mix as a fallback.
+		bd.ips = append(ips, bd.staticIPs...)
+		bd.nextResolve = time.Now().Add(bd.refresh)
+		bd.failures = 0
+		bd.preferred = 0
+		return bd.ips, bd.preferred, nil
+	}
+
+	backoff := bd.refresh
+	if bd.failures < 16 && bootstrapRetryBackoff<<uint(bd.failures) < backoff {
+		backoff = bootstrapRetryBackoff << uint(bd.failures)
+	}
+	bd.failures++
+	bd.nextResolve = time.Now().Add(backoff)
+
+	if len(bd.ips) == 0 {
+		if len(bd.staticIPs) == 0 {
+			return nil, 0, err
+		}
+		bd.ips = bd.staticIPs
+	}
+	return bd.ips, bd.preferred, nil
+}
+
+// resolve looks up the A and AAAA records of the host through the first
+// bootstrap server that answers.
+func (bd *bootstrapDialer) resolve() ([]net.IP, error) {
+	client := &dns.Client{Net: "udp", Timeout: bd.timeout}
+	fqdn := dns.Fqdn(bd.host)
+
+	var lastErr error
+	for _, server := range bd.servers {
+		ips := []net.IP{}
+
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			query := new(dns.Msg)
+			query.SetQuestion(fqdn, qtype)
+
+			resp, _, err := client.Exchange(query, server)
+			if err == nil && resp.Truncated {
+				resp, _, err = (&dns.Client{Net: "tcp", Timeout: bd.timeout}).Exchange(query, server)
+			}
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if resp.Rcode != dns.RcodeSuccess {
+				lastErr = fmt.Errorf("Bootstrap server [%v] answered %v for [%v].", server, dns.RcodeToString[resp.Rcode], bd.host)
+				continue
+			}
+
+			ips = append(ips, bootstrapAddresses(resp, fqdn)...)
+		}
+
+		if len(ips) > 0 {
+			return ips, nil
+		}
+		if lastErr == nil {
+			lastErr = fmt.Errorf("No addresses found for [%v] through bootstrap server [%v].", bd.host, server)
+		}
+	}
+
+	return nil, lastErr
+}
+
+// bootstrapAddresses picks the addresses of a name out of a response, along
+// with those of the names its CNAME chain leads to. Records for any other
+// name are ignored, whatever the server sent along.
+func bootstrapAddresses(resp *dns.Msg, fqdn string) []net.IP {
+	chain := map[string]bool{strings.ToLower(fqdn): true}
+	for followed := true; followed; {
+		followed = false
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && chain[strings.ToLower(cname.Hdr.Name)] && !chain[strings.ToLower(cname.Target)] {
+				chain[strings.ToLower(cname.Target)] = true
+				followed = true
+			}
+		}
+	}
+
+	ips := []net.IP{}
+	for _, rr := range resp.Answer {
+		if !chain[strings.ToLower(rr.Header().Name)] {
+			continue
+		}
+		switch record := rr.(type) {
+		case *dns.A:
+			ips = append(ips, record.A)
+		case *dns.AAAA:
+			ips = append(ips, record.AAAA)
+		}
+	}
+	return ips
+}
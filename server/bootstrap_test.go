@@ -0,0 +1,238 @@
+package dohboy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startFakeBootstrapServer answers queries with the given records, picking
+// the ones of the query's type (and CNAMEs) out of them. The rcode is loaded
+// from rcode for every query, so it can be changed along the way.
+func startFakeBootstrapServer(t *testing.T, rcode *int32, records ...string) *fakeDNSServer {
+	t.Helper()
+	rrs := mustRRs(t, records...)
+	return startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetRcode(query, int(atomic.LoadInt32(rcode)))
+		for _, rr := range rrs {
+			if rrtype := rr.Header().Rrtype; rrtype == query.Question[0].Qtype || rrtype == dns.TypeCNAME {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+		return resp
+	})
+}
+
+func newTestBootstrapDialer(t *testing.T, servers []string, staticIPs ...string) *bootstrapDialer {
+	t.Helper()
+	bd, err := newBootstrapDialer("doh.example", BootstrapConfig{Servers: servers, StaticIPs: staticIPs, RefreshSeconds: 300}, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return bd
+}
+
+func ipStrings(ips []net.IP) []string {
+	retval := []string{}
+	for _, ip := range ips {
+		retval = append(retval, ip.String())
+	}
+	return retval
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBootstrapAddresses(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer []string
+		want   []string
+	}{
+		{
+			name:   "addresses of the name",
+			answer: []string{"doh.example. 60 IN A 192.0.2.1", "DOH.example. 60 IN AAAA 2001:db8::1"},
+			want:   []string{"192.0.2.1", "2001:db8::1"},
+		},
+		{
+			name: "CNAME chain, in any order",
+			answer: []string{
+				"b.cdn.example. 60 IN A 192.0.2.2",
+				"a.cdn.example. 60 IN CNAME b.cdn.example.",
+				"doh.example. 60 IN CNAME a.cdn.example.",
+			},
+			want: []string{"192.0.2.2"},
+		},
+		{
+			name: "records of other names",
+			answer: []string{
+				"doh.example. 60 IN A 192.0.2.1",
+				"evil.example. 60 IN A 203.0.113.66",
+				"evil.example. 60 IN CNAME elsewhere.example.",
+				"elsewhere.example. 60 IN A 203.0.113.67",
+			},
+			want: []string{"192.0.2.1"},
+		},
+		{
+			name:   "CNAME loop",
+			answer: []string{"doh.example. 60 IN CNAME loop.example.", "loop.example. 60 IN CNAME doh.example."},
+			want:   []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := new(dns.Msg)
+			resp.Answer = mustRRs(t, test.answer...)
+
+			if got := ipStrings(bootstrapAddresses(resp, "doh.example.")); !equalStrings(got, test.want) {
+				t.Errorf("addresses = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBootstrapDialerResolve(t *testing.T) {
+	noError, nxDomain := int32(dns.RcodeSuccess), int32(dns.RcodeNameError)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	t.Run("dials what the name resolves to", func(t *testing.T) {
+		server := startFakeBootstrapServer(t, &noError,
+			"doh.example. 60 IN A 127.0.0.1",
+			"other.example. 60 IN A 203.0.113.66")
+		bd := newTestBootstrapDialer(t, []string{server.address})
+
+		conn, err := bd.DialContext(context.Background(), "tcp", net.JoinHostPort("doh.example", port))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		conn.Close()
+
+		if got := ipStrings(bd.ips); !equalStrings(got, []string{"127.0.0.1"}) {
+			t.Errorf("addresses = %v, want only those of the name", got)
+		}
+	})
+
+	t.Run("answers with an error rcode", func(t *testing.T) {
+		server := startFakeBootstrapServer(t, &nxDomain, "doh.example. 60 IN A 203.0.113.66")
+		bd := newTestBootstrapDialer(t, []string{server.address}, "192.0.2.53")
+
+		ips, _, err := bd.addresses()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got := ipStrings(ips); !equalStrings(got, []string{"192.0.2.53"}) {
+			t.Errorf("addresses = %v, want only the static ones", got)
+		}
+
+		bd = newTestBootstrapDialer(t, []string{server.address})
+		if _, _, err := bd.addresses(); err == nil {
+			t.Errorf("expected an error without any addresses to fall back on")
+		}
+	})
+}
+
+func TestBootstrapDialerBackoff(t *testing.T) {
+	rcode := int32(dns.RcodeServerFailure)
+	server := startFakeBootstrapServer(t, &rcode, "doh.example. 60 IN A 192.0.2.1")
+	bd := newTestBootstrapDialer(t, []string{server.address}, "192.0.2.53")
+
+	for i := 0; i < 3; i++ {
+		if ips, _, err := bd.addresses(); err != nil || !equalStrings(ipStrings(ips), []string{"192.0.2.53"}) {
+			t.Fatalf("addresses = %v, %v, want the static ones", ips, err)
+		}
+	}
+	if got := server.queryCount("udp"); got != 2 {
+		t.Errorf("bootstrap server got %v queries, want only the first failed attempt's", got)
+	}
+	if wait := time.Until(bd.nextResolve); wait > bootstrapRetryBackoff || wait <= 0 {
+		t.Errorf("next resolve in %v, want a retry within %v", wait, bootstrapRetryBackoff)
+	}
+
+	// Every failure in a row doubles the wait.
+	bd.nextResolve = time.Now()
+	bd.addresses()
+	if wait := time.Until(bd.nextResolve); wait > 2*bootstrapRetryBackoff || wait <= bootstrapRetryBackoff {
+		t.Errorf("next resolve in %v, want a retry within %v", wait, 2*bootstrapRetryBackoff)
+	}
+	bd.failures = 20
+	bd.nextResolve = time.Now()
+	bd.addresses()
+	if wait := time.Until(bd.nextResolve); wait > bd.refresh || wait <= bd.refresh-time.Minute {
+		t.Errorf("next resolve in %v, want the wait capped at %v", wait, bd.refresh)
+	}
+
+	atomic.StoreInt32(&rcode, dns.RcodeSuccess)
+	bd.nextResolve = time.Now()
+	if ips, _, _ := bd.addresses(); !equalStrings(ipStrings(ips), []string{"192.0.2.1", "192.0.2.53"}) {
+		t.Errorf("addresses = %v, want the resolved ones before the static ones", ips)
+	}
+	if bd.failures != 0 || time.Until(bd.nextResolve) <= bd.refresh-time.Minute {
+		t.Errorf("failures = %v, next resolve in %v, want a refresh after %v", bd.failures, time.Until(bd.nextResolve), bd.refresh)
+	}
+}
+
+func TestBootstrapDialerResolvesOutsideTheLock(t *testing.T) {
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	defer releaseOnce.Do(func() { close(release) })
+
+	server := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		<-release
+		if query.Question[0].Qtype != dns.TypeA {
+			return new(dns.Msg).SetReply(query)
+		}
+		return replyA(query, "192.0.2.2", 60)
+	})
+	bd := newTestBootstrapDialer(t, []string{server.address})
+	bd.ips = []net.IP{net.ParseIP("192.0.2.1")}
+	bd.nextResolve = time.Now()
+
+	refreshed := make(chan []net.IP)
+	go func() {
+		ips, _, _ := bd.addresses()
+		refreshed <- ips
+	}()
+	for server.queryCount("udp") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	answered := make(chan []net.IP)
+	go func() {
+		ips, _, _ := bd.addresses()
+		answered <- ips
+	}()
+	select {
+	case ips := <-answered:
+		if got := ipStrings(ips); !equalStrings(got, []string{"192.0.2.1"}) {
+			t.Errorf("addresses during the refresh = %v, want the previous ones", got)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatalf("a dial waited on the refresh under way")
+	}
+
+	releaseOnce.Do(func() { close(release) })
+	if got := ipStrings(<-refreshed); !equalStrings(got, []string{"192.0.2.2"}) {
+		t.Errorf("refreshed addresses = %v, want 192.0.2.2", got)
+	}
+}
@@ -0,0 +1,108 @@
+package dohboy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const cacheSnapshotVersion = 1
+
+type cacheSnapshot struct {
+	Version int           `json:"version"`
+	SavedAt time.Time     `json:"saved_at"`
+	Entries []*cacheEntry `json:"entries"`
+}
+
+// saveCacheSnapshot writes every entry of the cache to a file. The file is
+// written next to its final location and then renamed over it, so that a
+// crash mid-write never leaves a truncated snapshot behind.
+func saveCacheSnapshot(backend *memoryCacheBackend, path string) error {
+	entries, _ := backend.dump()
+	snapshot := cacheSnapshot{
+		Version: cacheSnapshotVersion,
+		SavedAt: time.Now(),
+		Entries: entries,
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(&snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadCacheSnapshot fills the cache from a snapshot file. Entries that expired
+// while the relay was down are either dropped, or kept as stale for up to
+// maxStale past their expiry. A missing snapshot isn't an error.
+func loadCacheSnapshot(backend *memoryCacheBackend, path string, keepStale bool, maxStale time.Duration) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	snapshot := cacheSnapshot{}
+	if err := json.NewDecoder(file).Decode(&snapshot); err != nil {
+		return 0, err
+	}
+
+	if snapshot.Version != cacheSnapshotVersion {
+		log.Printf("ignoring cache snapshot [%v] with unknown version %v", path, snapshot.Version)
+		return 0, nil
+	}
+
+	now := time.Now()
+	restored := 0
+	for _, entry := range snapshot.Entries {
+		keepFor := entry.ExpiresAt.Sub(now)
+		if keepFor <= 0 {
+			if !keepStale {
+				continue
+			}
+			entry.Stale = true
+			if keepFor += maxStale; keepFor <= 0 {
+				continue
+			}
+		} else if keepStale {
+			keepFor += maxStale
+		}
+
+		backend.set(entry.Key, entry, keepFor)
+		restored++
+	}
+
+	return restored, nil
+}
+
+// runCacheSnapshots saves the cache every interval until stop is closed.
+func runCacheSnapshots(backend *memoryCacheBackend, path string, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := saveCacheSnapshot(backend, path); err != nil {
+				log.Printf("ERR: could not save cache snapshot: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package dohboy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// storeAged caches an answer to the query as if it had been stored age ago,
+// with the given TTL.
+func storeAged(t *testing.T, cache *responseCache, query *dns.Msg, ttl uint32, age time.Duration) {
+	t.Helper()
+	wire, err := replyA(query, "192.0.2.1", ttl).Pack()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	storedAt := time.Now().Add(-age)
+	key := cache.key(query, "default")
+	entry := &cacheEntry{
+		Key:       key,
+		Wire:      wire,
+		StoredAt:  storedAt,
+		ExpiresAt: storedAt.Add(time.Duration(ttl) * time.Second),
+		Upstream:  "dns.example",
+	}
+	cache.backend.set(key, entry, time.Hour)
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	fresh := newTestQuery("fresh.example.", dns.TypeA)
+	expired := newTestQuery("expired.example.", dns.TypeA)
+	longGone := newTestQuery("long-gone.example.", dns.TypeA)
+
+	saved := newMemoryCacheBackend(10)
+	cache := newResponseCache(saved, "/dns-query", &CacheConfig{})
+	storeAged(t, cache, fresh, 300, 100*time.Second)
+	storeAged(t, cache, expired, 60, 2*time.Minute)
+	storeAged(t, cache, longGone, 60, 2*time.Hour)
+
+	path := filepath.Join(t.TempDir(), "cache.json")
+	if err := saveCacheSnapshot(saved, path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("snapshot directory has %v files, want the temporary file renamed", len(files))
+	}
+
+	t.Run("expired entries dropped", func(t *testing.T) {
+		loaded := newMemoryCacheBackend(10)
+		restored, err := loadCacheSnapshot(loaded, path, false, time.Hour)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if restored != 1 {
+			t.Errorf("restored = %v, want 1", restored)
+		}
+
+		cache := newResponseCache(loaded, "/dns-query", &CacheConfig{})
+		resp, upstream, stale := cache.lookup(fresh, "default")
+		if resp == nil || stale || upstream != "dns.example" {
+			t.Fatalf("lookup = %v, %v, %v, want the fresh answer", resp, upstream, stale)
+		}
+		if ttl := resp.Answer[0].Header().Ttl; ttl < 199 || ttl > 200 {
+			t.Errorf("TTL = %v, want it counted down to 200", ttl)
+		}
+		if resp, _, _ := cache.lookup(expired, "default"); resp != nil {
+			t.Errorf("answered with an expired entry")
+		}
+	})
+
+	t.Run("expired entries kept as stale", func(t *testing.T) {
+		loaded := newMemoryCacheBackend(10)
+		restored, err := loadCacheSnapshot(loaded, path, true, time.Hour)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if restored != 2 {
+			t.Errorf("restored = %v, want the fresh and the recently expired entries", restored)
+		}
+
+		cache := newResponseCache(loaded, "/dns-query", &CacheConfig{KeepStale: true, MaxStaleSeconds: 3600, StaleAnswerTTLSeconds: 30})
+		resp, _, stale := cache.lookup(expired, "default")
+		if resp == nil || !stale {
+			t.Fatalf("lookup = %v, %v, want the expired entry as stale", resp, stale)
+		}
+		if ttl := resp.Answer[0].Header().Ttl; ttl != 30 {
+			t.Errorf("TTL = %v, want the stale answer TTL", ttl)
+		}
+		if resp, _, _ := cache.lookup(longGone, "default"); resp != nil {
+			t.Errorf("answered with an entry expired for longer than max stale")
+		}
+	})
+}
+
+func TestLoadCacheSnapshotErrors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Could not write snapshot: %v", err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "missing", path: filepath.Join(dir, "missing.json")},
+		{name: "corrupt", path: write("corrupt.json", `{"version": 1, "entries": [{"key": `), wantErr: true},
+		{name: "not json", path: write("garbage.json", "\x00\x01\x02"), wantErr: true},
+		{name: "unknown version", path: write("future.json", `{"version": 99, "entries": [{"key": "k", "expires_at": "2999-01-01T00:00:00Z"}]}`)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newMemoryCacheBackend(10)
+			restored, err := loadCacheSnapshot(backend, test.path, true, time.Hour)
+			if (err != nil) != test.wantErr {
+				t.Errorf("err = %v, want an error: %v", err, test.wantErr)
+			}
+			if entries, _ := backend.dump(); restored != 0 || len(entries) != 0 {
+				t.Errorf("restored %v entries, want none", restored)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package dohboy
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type cacheEntry struct {
+	Key       string    `json:"key"`
+	Wire      []byte    `json:"wire"`
+	StoredAt  time.Time `json:"stored_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// The name of the upstream that answered, whose post-processing for
+	// clients applies to the response.
+	Upstream string `json:"upstream,omitempty"`
+	// Kept past its expiry, to be answered with only if upstream can't be
+	// reached.
+	Stale bool `json:"stale,omitempty"`
+}
+
+func encodeCacheEntry(entry *cacheEntry) ([]byte, error) {
+	return json.Marshal(entry)
+}
+
+func decodeCacheEntry(raw []byte) (*cacheEntry, error) {
+	entry := &cacheEntry{}
+	return entry, json.Unmarshal(raw, entry)
+}
+
+// cacheBackend holds cached responses.
+type cacheBackend interface {
+	get(key string) (*cacheEntry, bool)
+	// set stores an entry, to be dropped after keepFor.
+	set(key string, entry *cacheEntry, keepFor time.Duration)
+	deletePrefix(prefix string) int
+	entries(prefix string, limit int) []*cacheEntry
+}
+
+type memoryCacheItem struct {
+	entry     *cacheEntry
+	keepUntil time.Time
+}
+
+// memoryCacheBackend is an in-process LRU of cache entries.
+type memoryCacheBackend struct {
+	items      map[string]*list.Element
+	lru        *list.List
+	maxEntries int
+	mu         sync.Mutex
+}
+
+func newMemoryCacheBackend(maxEntries int) *memoryCacheBackend {
+	return &memoryCacheBackend{
+		items:      make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+	}
+}
+
+func (backend *memoryCacheBackend) get(key string) (*cacheEntry, bool) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	element, exists := backend.items[key]
+	if !exists {
+		return nil, false
+	}
+
+	item := element.Value.(*memoryCacheItem)
+	if time.Now().After(item.keepUntil) {
+		backend.lru.Remove(element)
+		delete(backend.items, key)
+		return nil, false
+	}
+
+	backend.lru.MoveToFront(element)
+	return item.entry, true
+}
+
+func (backend *memoryCacheBackend) set(key string, entry *cacheEntry, keepFor time.Duration) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	item := &memoryCacheItem{entry: entry, keepUntil: time.Now().Add(keepFor)}
+
+	if element, exists := backend.items[key]; exists {
+		element.Value = item
+		backend.lru.MoveToFront(element)
+		return
+	}
+
+	for backend.lru.Len() >= backend.maxEntries {
+		oldest := backend.lru.Back()
+		backend.lru.Remove(oldest)
+		delete(backend.items, oldest.Value.(*memoryCacheItem).entry.Key)
+	}
+
+	backend.items[key] = backend.lru.PushFront(item)
+}
+
+func (backend *memoryCacheBackend) deletePrefix(prefix string) int {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	deleted := 0
+	for key, element := range backend.items {
+		if strings.HasPrefix(key, prefix) {
+			backend.lru.Remove(element)
+			delete(backend.items, key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (backend *memoryCacheBackend) entries(prefix string, limit int) []*cacheEntry {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	retval := []*cacheEntry{}
+	for element := backend.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*memoryCacheItem).entry
+		if strings.HasPrefix(entry.Key, prefix) {
+			retval = append(retval, entry)
+			if limit > 0 && len(retval) >= limit {
+				break
+			}
+		}
+	}
+	return retval
+}
+
+// dump lists every entry still being kept, oldest first.
+func (backend *memoryCacheBackend) dump() ([]*cacheEntry, []time.Time) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	entries := make([]*cacheEntry, 0, backend.lru.Len())
+	keepUntil := make([]time.Time, 0, backend.lru.Len())
+	for element := backend.lru.Back(); element != nil; element = element.Prev() {
+		item := element.Value.(*memoryCacheItem)
+		entries = append(entries, item.entry)
+		keepUntil = append(keepUntil, item.keepUntil)
+	}
+	return entries, keepUntil
+}
+
+// responseCache caches upstream responses for one endpoint.
+type responseCache struct {
+	backend        cacheBackend
+	namespace      string
+	staleFor       time.Duration // how long entries are kept past expiry; 0 to drop them
+	staleAnswerTTL uint32
+}
+
+func newResponseCache(backend cacheBackend, namespace string, config *CacheConfig) *responseCache {
+	staleFor := time.Duration(0)
+	if config.KeepStale {
+		staleFor = time.Duration(config.MaxStaleSeconds) * time.Second
+	}
+
+	return &responseCache{
+		backend:        backend,
+		namespace:      namespace,
+		staleFor:       staleFor,
+		staleAnswerTTL: config.StaleAnswerTTLSeconds,
+	}
+}
+
+func (cache *responseCache) namePrefix(name string) string {
+	return fmt.Sprintf("%v|%v|", cache.namespace, strings.ToLower(dns.Fqdn(name)))
+}
+
+func (cache *responseCache) key(dnsQuery *dns.Msg, route string) string {
+	return cache.namespace + "|" + questionKey(dnsQuery) + "|" + route
+}
+
+// questionKey identifies the queries that can be answered with the same
+// response: same question, same DNSSEC related bits, and the same client
+// subnet (ECS), since upstreams tailor their answers to it.
+func questionKey(dnsQuery *dns.Msg) string {
+	question := dnsQuery.Question[0]
+	do := false
+	subnet := ""
+	if opt := dnsQuery.IsEdns0(); opt != nil {
+		do = opt.Do()
+		for _, option := range opt.Option {
+			if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+				bits := 8 * net.IPv6len
+				if ecs.Family == 1 {
+					bits = 8 * net.IPv4len
+				}
+				network := ecs.Address.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits))
+				subnet = fmt.Sprintf("%v/%v", network, ecs.SourceNetmask)
+			}
+		}
+	}
+	return fmt.Sprintf("%v|%v|%v|%v|%v|%v", strings.ToLower(dns.Fqdn(question.Name)),
+		question.Qtype, question.Qclass, do, dnsQuery.CheckingDisabled, subnet)
+}
+
+// lookup returns a cached response for the query, with its ID set to match
+// and its TTLs counted down by the time it spent in the cache, along with the
+// name of the upstream that answered. A stale response is only returned with
+// the stale flag set, and with its TTLs set to the stale answer TTL.
+func (cache *responseCache) lookup(dnsQuery *dns.Msg, route string) (*dns.Msg, string, bool) {
+	entry, found := cache.backend.get(cache.key(dnsQuery, route))
+	if !found {
+		return nil, "", false
+	}
+
+	now := time.Now()
+	stale := entry.Stale || !now.Before(entry.ExpiresAt)
+	if stale && cache.staleFor == 0 {
+		return nil, "", false
+	}
+
+	responseMsg := new(dns.Msg)
+	if err := responseMsg.Unpack(entry.Wire); err != nil {
+		return nil, "", false
+	}
+
+	responseMsg.Id = dnsQuery.Id
+	responseMsg.Question = append([]dns.Question(nil), dnsQuery.Question...)
+	if stale {
+		overrideAnyLargeTTL(responseMsg, cache.staleAnswerTTL)
+	} else {
+		countDownTTLs(responseMsg, uint32(now.Sub(entry.StoredAt)/time.Second))
+	}
+	return responseMsg, entry.Upstream, stale
+}
+
+func (cache *responseCache) store(dnsQuery *dns.Msg, route string, upstream string, responseMsg *dns.Msg) {
+	if responseMsg.Rcode != dns.RcodeSuccess && responseMsg.Rcode != dns.RcodeNameError {
+		return
+	}
+
+	ttl := getOverallTTL(responseMsg)
+	if ttl == 0 {
+		return
+	}
+
+	wire, err := responseMsg.Pack()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	key := cache.key(dnsQuery, route)
+	entry := &cacheEntry{
+		Key:       key,
+		Wire:      wire,
+		StoredAt:  now,
+		ExpiresAt: now.Add(time.Duration(ttl) * time.Second),
+		Upstream:  upstream,
+	}
+	cache.backend.set(key, entry, time.Duration(ttl)*time.Second+cache.staleFor)
+}
+
+// flush drops the cached responses for a name, or every cached response if
+// name is empty.
+func (cache *responseCache) flush(name string) int {
+	if name == "" {
+		return cache.backend.deletePrefix(cache.namespace + "|")
+	}
+	return cache.backend.deletePrefix(cache.namePrefix(name))
+}
+
+type cacheEntryInfo struct {
+	Key       string   `json:"key"`
+	Rcode     string   `json:"rcode"`
+	Answer    []string `json:"answer"`
+	ExpiresIn int64    `json:"expires_in_sec"`
+}
+
+// entries describes up to limit cached responses for a name, or for all names
+// if name is empty.
+func (cache *responseCache) entries(name string, limit int) []cacheEntryInfo {
+	prefix := cache.namespace + "|"
+	if name != "" {
+		prefix = cache.namePrefix(name)
+	}
+
+	now := time.Now()
+	retval := []cacheEntryInfo{}
+	for _, entry := range cache.backend.entries(prefix, limit) {
+		responseMsg := new(dns.Msg)
+		if err := responseMsg.Unpack(entry.Wire); err != nil {
+			continue
+		}
+
+		answer := make([]string, 0, len(responseMsg.Answer))
+		for _, rr := range responseMsg.Answer {
+			answer = append(answer, rr.String())
+		}
+
+		retval = append(retval, cacheEntryInfo{
+			Key:       entry.Key,
+			Rcode:     dns.RcodeToString[responseMsg.Rcode],
+			Answer:    answer,
+			ExpiresIn: int64(entry.ExpiresAt.Sub(now) / time.Second),
+		})
+	}
+	return retval
+}
+
+func countDownTTLs(dnsMsg *dns.Msg, elapsed uint32) {
+	for _, rrs := range [][]dns.RR{dnsMsg.Answer, dnsMsg.Ns, dnsMsg.Extra} {
+		for _, rr := range rrs {
+			header := rr.Header()
+			if header == nil || header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if header.Ttl > elapsed {
+				header.Ttl -= elapsed
+			} else {
+				header.Ttl = 0
+			}
+		}
+	}
+}
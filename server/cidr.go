@@ -0,0 +1,49 @@
+package dohboy
+
+import (
+	"net"
+	"strings"
+)
+
+type cidrList []*net.IPNet
+
+// parseCIDRs parses a list of networks. Plain addresses are accepted too, and
+// are treated as a network of just that address.
+func parseCIDRs(cidrs []string) (cidrList, error) {
+	retval := make(cidrList, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				retval = append(retval, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		retval = append(retval, network)
+	}
+
+	return retval, nil
+}
+
+func (list cidrList) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range list {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package dohboy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPResolver struct {
+	fetchFromHeaders bool
+	trustedProxies   cidrList
+}
+
+// getIP returns the address of the client that sent the request. Forwarding
+// headers are only looked at when the request came in from a trusted proxy.
+// They are walked from the nearest hop outwards, skipping any hop that is a
+// trusted proxy itself, so that a client can't pass off a spoofed entry as
+// its own address.
+func (resolver *clientIPResolver) getIP(request *http.Request) string {
+	remoteIP := ""
+	if ip, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		remoteIP = ip
+	}
+
+	if !resolver.fetchFromHeaders || !resolver.trustedProxies.contains(net.ParseIP(remoteIP)) {
+		return remoteIP
+	}
+
+	hops := parseForwardedHeader(request.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = parseXForwardedForHeader(request.Header.Values("X-Forwarded-For"))
+	}
+	if len(hops) == 0 {
+		hops = parseXForwardedForHeader(request.Header.Values("X-Real-Ip"))
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// Obfuscated or unknown identifiers; nothing further out can be trusted.
+			break
+		}
+		if i == 0 || !resolver.trustedProxies.contains(ip) {
+			return ip.String()
+		}
+	}
+
+	return remoteIP
+}
+
+func parseXForwardedForHeader(values []string) []string {
+	retval := []string{}
+	for _, value := range values {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				retval = append(retval, addr)
+			}
+		}
+	}
+	return retval
+}
+
+// parseForwardedHeader pulls the `for` parameters out of RFC 7239 Forwarded
+// headers, e.g. `for=192.0.2.60;proto=http, for="[2001:db8::1]:4711"`.
+func parseForwardedHeader(values []string) []string {
+	retval := []string{}
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				retval = append(retval, stripForwardedNode(kv[1]))
+			}
+		}
+	}
+	return retval
+}
+
+func stripForwardedNode(node string) string {
+	node = strings.Trim(node, "\"")
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end != -1 {
+			return node[1:end]
+		}
+	}
+	if strings.Count(node, ":") == 1 {
+		return node[:strings.Index(node, ":")]
+	}
+	return node
+}
+
+func newClientIPResolver(config *RateLimitConfig) *clientIPResolver {
+	trustedProxies, _ := parseCIDRs(config.TrustedProxies)
+
+	return &clientIPResolver{
+		fetchFromHeaders: config.FetchIPFromHeaders,
+		trustedProxies:   trustedProxies,
+	}
+}
@@ -0,0 +1,133 @@
+package dohboy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseForwardedHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{name: "single", values: []string{"for=192.0.2.60;proto=http;by=203.0.113.43"}, want: []string{"192.0.2.60"}},
+		{name: "list", values: []string{"for=192.0.2.43, for=198.51.100.17"}, want: []string{"192.0.2.43", "198.51.100.17"}},
+		{name: "several headers", values: []string{"for=192.0.2.43", "for=198.51.100.17"}, want: []string{"192.0.2.43", "198.51.100.17"}},
+		{name: "quoted IPv6 with port", values: []string{`for="[2001:db8:cafe::17]:4711"`}, want: []string{"2001:db8:cafe::17"}},
+		{name: "IPv4 with port", values: []string{`for="192.0.2.43:47011"`}, want: []string{"192.0.2.43"}},
+		{name: "case of the parameter", values: []string{"For=192.0.2.43;Proto=https"}, want: []string{"192.0.2.43"}},
+		{name: "obfuscated", values: []string{"for=_hidden, for=unknown"}, want: []string{"_hidden", "unknown"}},
+		{name: "no for", values: []string{"proto=https;by=203.0.113.43"}, want: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseForwardedHeader(test.values); !equalStrings(got, test.want) {
+				t.Errorf("hops = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseXForwardedForHeader(t *testing.T) {
+	got := parseXForwardedForHeader([]string{"192.0.2.43, 2001:db8::1,, ", "198.51.100.17"})
+	if want := []string{"192.0.2.43", "2001:db8::1", "198.51.100.17"}; !equalStrings(got, want) {
+		t.Errorf("hops = %v, want %v", got, want)
+	}
+}
+
+func TestClientIPResolver(t *testing.T) {
+	const proxy = "10.0.0.2"
+
+	tests := []struct {
+		name       string
+		noHeaders  bool
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "headers not fetched",
+			noHeaders:  true,
+			remoteAddr: proxy,
+			headers:    map[string]string{"X-Forwarded-For": "192.0.2.1"},
+			want:       proxy,
+		},
+		{
+			name:       "untrusted peer",
+			remoteAddr: "203.0.113.9",
+			headers:    map[string]string{"X-Forwarded-For": "192.0.2.1"},
+			want:       "203.0.113.9",
+		},
+		{
+			name:       "X-Forwarded-For from a trusted proxy",
+			remoteAddr: proxy,
+			headers:    map[string]string{"X-Forwarded-For": "192.0.2.1"},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "spoofed leftmost entry",
+			remoteAddr: proxy,
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.66, 192.0.2.1"},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "trusted hops are skipped",
+			remoteAddr: proxy,
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.66, 192.0.2.1, 10.0.0.3, 10.0.0.4"},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "every hop trusted",
+			remoteAddr: proxy,
+			headers:    map[string]string{"X-Forwarded-For": "10.0.0.5, 10.0.0.3"},
+			want:       "10.0.0.5",
+		},
+		{
+			name:       "spoofed entry behind an obfuscated hop",
+			remoteAddr: proxy,
+			headers:    map[string]string{"Forwarded": "for=198.51.100.66, for=_hidden, for=10.0.0.3"},
+			want:       proxy,
+		},
+		{
+			name:       "Forwarded over X-Forwarded-For",
+			remoteAddr: proxy,
+			headers: map[string]string{
+				"Forwarded":       `for=198.51.100.66, for="[2001:db8::1]:4711"`,
+				"X-Forwarded-For": "192.0.2.1",
+			},
+			want: "2001:db8::1",
+		},
+		{
+			name:       "X-Real-Ip",
+			remoteAddr: proxy,
+			headers:    map[string]string{"X-Real-Ip": "192.0.2.1"},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "no headers",
+			remoteAddr: proxy,
+			want:       proxy,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := newClientIPResolver(&RateLimitConfig{
+				FetchIPFromHeaders: !test.noHeaders,
+				TrustedProxies:     []string{"10.0.0.0/24"},
+			})
+
+			request := httptest.NewRequest("GET", "/dns-query", nil)
+			request.RemoteAddr = test.remoteAddr + ":1234"
+			for name, value := range test.headers {
+				request.Header.Set(name, value)
+			}
+
+			if got := resolver.getIP(request); got != test.want {
+				t.Errorf("client IP = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -3,8 +3,10 @@ package dohboy
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/creasty/defaults"
+	"github.com/miekg/dns"
 	"gopkg.in/yaml.v2"
 )
 
@@ -12,8 +14,8 @@ type Config struct {
 	Server struct {
 		Host          string `yaml:"host" default:"127.0.0.1"`
 		Port          string `yaml:"port" default:"8080"`
-		TLSCertPath   string `yaml:"tls_cert_filepath`
-		TLSKeyPath    string `yaml:"tls_key_filepath`
+		TLSCertPath   string `yaml:"tls_cert_filepath"`
+		TLSKeyPath    string `yaml:"tls_key_filepath"`
 		TimeoutMillis struct {
 			Shutdown int64 `yaml:"shutdown" default:"30000"`
 			Write    int64 `yaml:"write" default:"10000"`
@@ -21,31 +23,295 @@ type Config struct {
 			Idle     int64 `yaml:"idle" default:"5000"`
 		} `yaml:"timeout_sec"`
 	} `yaml:"server"`
-	IPRateLimit struct {
-		Enabled              bool   `yaml:"enabled" default:"true"`
-		KeyWhitelist         string `yaml:"key_whitelist"`
-		RecoverXTokensPerSec int    `yaml:"recover_x_tokens_per_sec" default:"5"`
-		MaxTokens            int    `yaml:"max_tokens" default:"25"`
-		FetchIPFromHeaders   bool   `yaml:"fetch_ip_from_headers" default: "false"`
-	} `yaml:"ip_rate_limit"`
+	IPRateLimit RateLimitConfig `yaml:"ip_rate_limit"`
+	Auth        AuthConfig      `yaml:"auth"`
 	Development struct {
 		TerseResponses bool `yaml:"terse_responses" default:"true"`
 	} `yaml:"development"`
-	Upstream struct {
-		Custom                    []UpstreamConfig `yaml:"custom_upstream" default:"[]"`
-		MaximumTTLOverrideSeconds uint32           `yaml:"maximum_ttl_override_seconds" default:"0"`
-	} `yaml:"upstream"`
-	Caching struct {
-		EnableHTTPCaching bool `yaml:"enable_http_caching" default:"true"`
-	} `yaml:"caching"`
+	Logging struct {
+		// Log a line for every answered query, including the client's label.
+		Queries bool `yaml:"queries" default:"false"`
+	} `yaml:"logging"`
+	Upstream  UpstreamSettings `yaml:"upstream"`
+	Cookies   CookieConfig     `yaml:"cookies"`
+	Filtering FilterConfig     `yaml:"filtering"`
+	// Endpoints served by this relay. Any section left out of an endpoint falls
+	// back to the top-level section of the same name. If no endpoints are
+	// configured, a single endpoint is served at /dns-query.
+	Endpoints []EndpointConfig `yaml:"endpoints" default:"[]"`
+	Caching   CacheConfig      `yaml:"caching"`
+	// A separate listener for the admin api. Requests to it must carry an
+	// `Authorization: Bearer <token>` header.
+	Admin struct {
+		Enabled bool   `yaml:"enabled" default:"false"`
+		Host    string `yaml:"host" default:"127.0.0.1"`
+		Port    string `yaml:"port" default:"8081"`
+		Token   string `yaml:"token"`
+	} `yaml:"admin"`
+	// Where rate-limit counters and cached responses are kept: [memory|redis].
+	// Pointing several replicas at the same redis lets them share limits and
+	// cache.
+	Backend struct {
+		RateLimit string      `yaml:"rate_limit" default:"memory"`
+		Cache     string      `yaml:"cache" default:"memory"`
+		Redis     RedisConfig `yaml:"redis"`
+	} `yaml:"backend"`
+}
+
+// CookieConfig sets up DNS cookies (RFC 7873): client cookies on queries to
+// plain DNS upstreams, and server cookies for clients that send a cookie.
+type CookieConfig struct {
+	Enabled bool `yaml:"enabled" default:"true"`
+	// Hex encoded secrets, of at least 16 bytes, that cookies are derived
+	// from. Replicas sharing the secrets accept each other's cookies. The first
+	// one makes new cookies and the rest are only accepted, so secrets can be
+	// swapped out without a hitch. Without any, a random one is used.
+	Secrets []string `yaml:"secrets" default:"[]"`
+	// How often the secret derived from the configured ones changes.
+	RotationSeconds int `yaml:"rotation_seconds" default:"86400"`
+}
+
+type CacheConfig struct {
+	EnableHTTPCaching bool `yaml:"enable_http_caching" default:"true"`
+	// Answer NXDOMAIN for names that the NSEC/NSEC3 records of earlier
+	// validated negative responses prove don't exist (RFC 8198). Upstream
+	// queries are then always sent with the DO bit set.
+	AggressiveNSEC bool `yaml:"aggressive_nsec" default:"false"`
+	// Cache upstream responses, per endpoint, for as long as their TTL.
+	EnableResponseCache bool `yaml:"enable_response_cache" default:"false"`
+	// Bound on cached responses, across all endpoints, for the in-memory
+	// backend.
+	MaxEntries int `yaml:"max_entries" default:"10000"`
+	// Keep expired responses around for up to max_stale_seconds, to answer
+	// with (using stale_answer_ttl_seconds as TTL) if upstream can't be
+	// reached.
+	KeepStale             bool   `yaml:"keep_stale" default:"false"`
+	MaxStaleSeconds       int64  `yaml:"max_stale_seconds" default:"86400"`
+	StaleAnswerTTLSeconds uint32 `yaml:"stale_answer_ttl_seconds" default:"30"`
+	// With the in-memory backend, the cache is saved here on shutdown and every
+	// snapshot_interval_seconds, and loaded back on startup.
+	SnapshotPath            string `yaml:"snapshot_filepath"`
+	SnapshotIntervalSeconds int64  `yaml:"snapshot_interval_seconds" default:"300"`
+}
+
+type RedisConfig struct {
+	Address       string `yaml:"address" default:"127.0.0.1:6379"`
+	Password      string `yaml:"password"`
+	DB            int    `yaml:"db" default:"0"`
+	KeyPrefix     string `yaml:"key_prefix" default:"dohboy:"`
+	TimeoutMillis int64  `yaml:"timeout_millis" default:"500"`
+	MaxIdleConns  int    `yaml:"max_idle_conns" default:"16"`
+}
+
+type RateLimitConfig struct {
+	Enabled              bool   `yaml:"enabled" default:"true"`
+	KeyWhitelist         string `yaml:"key_whitelist"`
+	RecoverXTokensPerSec int    `yaml:"recover_x_tokens_per_sec" default:"5"`
+	MaxTokens            int    `yaml:"max_tokens" default:"25"`
+	FetchIPFromHeaders   bool   `yaml:"fetch_ip_from_headers" default:"false"`
+	// With fetch_ip_from_headers set, the proxies allowed to set the client IP
+	// through the Forwarded, X-Forwarded-For and X-Real-Ip headers. Required
+	// along with fetch_ip_from_headers.
+	TrustedProxies []string `yaml:"trusted_proxies" default:"[]"`
+	// Clients are bucketed by network rather than by address, so that a client
+	// can't get fresh buckets by hopping around its own prefix.
+	IPv4PrefixLength int `yaml:"ipv4_prefix_length" default:"32"`
+	IPv6PrefixLength int `yaml:"ipv6_prefix_length" default:"56"`
+	// Client networks that are never rate limited.
+	Allowlist []string `yaml:"allowlist" default:"[]"`
+	// Buckets not used for this long are dropped. Never shorter than the time
+	// a bucket takes to refill.
+	IdleEvictionSeconds int `yaml:"idle_eviction_seconds" default:"600"`
+	// Upper bound on the number of buckets kept in memory. The least recently
+	// used ones are dropped first.
+	MaxTrackedKeys int `yaml:"max_tracked_keys" default:"100000"`
+	// Tokens charged per query by qtype, e.g. {ANY: 10, TXT: 3}. Anything not
+	// listed costs 1.
+	QtypeCosts map[string]int `yaml:"qtype_costs" default:"{}"`
+	// Extra tokens charged after the fact for queries answered with NXDOMAIN,
+	// to slow down random-subdomain floods.
+	NXDOMAINCost int `yaml:"nxdomain_cost" default:"0"`
+	// Buckets per client token (or authenticated label), on top of the ones
+	// per client network.
+	PerToken struct {
+		Enabled      bool `yaml:"enabled" default:"false"`
+		BucketConfig `yaml:",inline"`
+	} `yaml:"per_token"`
+	// A single bucket shared by every client of the endpoint.
+	PerEndpoint struct {
+		Enabled      bool `yaml:"enabled" default:"false"`
+		BucketConfig `yaml:",inline"`
+	} `yaml:"per_endpoint"`
+	// Tell rate-limited clients when to come back through a Retry-After header.
+	RetryAfterHeader bool `yaml:"retry_after_header" default:"false"`
+}
+
+type BucketConfig struct {
+	RecoverXTokensPerSec int `yaml:"recover_x_tokens_per_sec" default:"5"`
+	MaxTokens            int `yaml:"max_tokens" default:"25"`
+}
+
+type UpstreamSettings struct {
+	Custom                    []UpstreamConfig `yaml:"custom_upstream" default:"[]"`
+	MaximumTTLOverrideSeconds uint32           `yaml:"maximum_ttl_override_seconds" default:"0"`
+	// Where queries go that none of the custom upstreams match.
+	Default DefaultUpstreamSettings `yaml:"default_upstream"`
+	// Keeps reverse lookups for private address space away from the default
+	// upstreams. Custom upstreams still get them if they match.
+	PrivatePTR PrivatePTRConfig `yaml:"private_ptr"`
+	DNS64      DNS64Config      `yaml:"dns64"`
+	// Answer messages with several questions by resolving each question on
+	// its own and merging the answers, rather than with FORMERR.
+	SplitMultipleQuestions bool `yaml:"split_multiple_questions" default:"false"`
+	// With split_multiple_questions, messages with more questions than this
+	// get FORMERR rather than fanning out to the upstreams.
+	MaxQuestions int `yaml:"max_questions" default:"8"`
+}
+
+// DNS64Config sets up synthesizing AAAA records from A records (RFC 6147) for
+// clients on an IPv6-only network behind a NAT64 gateway.
+type DNS64Config struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// The NAT64 gateway's prefix. Must be a /32, /40, /48, /56, /64 or /96.
+	Prefix string `yaml:"prefix" default:"64:ff9b::/96"`
+	// A records in these networks aren't synthesized from.
+	ExcludedIPv4 []string `yaml:"excluded_ipv4" default:"[]"`
+	// AAAA records in these networks are ignored, so names with only such
+	// records get synthesized ones instead.
+	ExcludedIPv6 []string `yaml:"excluded_ipv6" default:"[\"::ffff:0:0/96\"]"`
+	// Only clients in these networks get synthesized records. Empty means
+	// every client.
+	ClientCIDRs []string `yaml:"client_cidrs" default:"[]"`
+}
+
+type PrivatePTRConfig struct {
+	Enabled bool `yaml:"enabled" default:"true"`
+	// A local resolver to send the lookups to. Without one, they're answered
+	// with NXDOMAIN. Its name_regex is ignored.
+	Upstream *UpstreamConfig `yaml:"upstream"`
+}
+
+type DefaultUpstreamSettings struct {
+	// If disabled, queries that no custom upstream matches are answered with
+	// REFUSED.
+	Enabled bool `yaml:"enabled" default:"true"`
+	// Tried in order until one of them answers. Their name_regex and match are
+	// ignored, and the post_processing of whichever one answered applies. With
+	// none given, dns.google is used over DoH.
+	Upstreams []UpstreamConfig `yaml:"upstreams" default:"[]"`
+}
+
+type FilterConfig struct {
+	// Names to block. A blocked name also blocks all of its subdomains.
+	Blocklist []string `yaml:"blocklist" default:"[]"`
+	// Files holding additional blocked names, one per line. Lines starting with
+	// '#' are ignored.
+	BlocklistFiles []string `yaml:"blocklist_files" default:"[]"`
+	// What to answer for blocked names: [nxdomain|refused]
+	BlockResponse string `yaml:"block_response" default:"nxdomain"`
+}
+
+type AuthConfig struct {
+	// Reject requests that don't present valid credentials. Can be overridden
+	// per endpoint with `require_auth`.
+	Required bool `yaml:"required" default:"false"`
+	// Accept tokens in an `Authorization: Bearer <token>` header.
+	AllowBearer bool `yaml:"allow_bearer" default:"true"`
+	// Accept tokens given as an endpoint path segment or `token` query param.
+	AllowURLToken bool `yaml:"allow_url_token" default:"true"`
+	// yaml file listing the accepted tokens, as a list of {label, token}.
+	TokensFile string `yaml:"tokens_filepath"`
+	// PEM bundle of CAs that client certificates are verified against. Only
+	// has an effect when the server is configured for TLS.
+	ClientCAPath string `yaml:"client_ca_filepath"`
+}
+
+type EndpointConfig struct {
+	// URL path the endpoint is served at, e.g. /dns-query/kids. Requests to a
+	// single extra path segment below it (e.g. /dns-query/kids/<token>) are also
+	// routed here, with that segment used as the client token.
+	Path        string            `yaml:"path"`
+	Upstream    *UpstreamSettings `yaml:"upstream"`
+	Filtering   *FilterConfig     `yaml:"filtering"`
+	IPRateLimit *RateLimitConfig  `yaml:"ip_rate_limit"`
+	RequireAuth *bool             `yaml:"require_auth"`
 }
 
 type UpstreamConfig struct {
-	NameRegex           string              `yaml:"name_regex"`
-	UseDOH              bool                `yaml:"use_doh" default:"true"`
-	Address             string              `yaml:"address"`
-	TimeoutMillis       int64               `yaml:"timeout" default:"5000"`
+	NameRegex string `yaml:"name_regex"`
+	// [doh|dns|recursive]. Left empty, use_doh picks between doh and dns, and
+	// without use_doh, the address does: a URL is doh and a host:port dns.
+	Type string `yaml:"type"`
+	// Further criteria a query has to meet to be sent to this upstream.
+	Match         MatchConfig `yaml:"match"`
+	UseDOH        *bool       `yaml:"use_doh"`
+	Address       string      `yaml:"address"`
+	TimeoutMillis int64       `yaml:"timeout" default:"5000"`
+	// Plain DNS only: randomize the case of the question name (DNS 0x20) and
+	// drop udp responses that don't echo it exactly.
+	RandomizeCase       bool                `yaml:"randomize_case" default:"false"`
 	HttpTransportConfig HttpTransportConfig `yaml:"http_transport_config" default:"{}"`
+	// How a DoH upstream's hostname gets resolved. If neither servers nor
+	// static ips are given, the system resolver is used.
+	Bootstrap BootstrapConfig `yaml:"bootstrap"`
+	// Settings for the recursive type, which needs no address.
+	Recursive RecursiveConfig `yaml:"recursive"`
+	// How this upstream's responses are reworked before they're handed out.
+	PostProcessing PostProcessConfig `yaml:"post_processing"`
+}
+
+type PostProcessConfig struct {
+	// Networks to order A/AAAA answers by. Addresses in earlier networks come
+	// first, and addresses in none of them come last.
+	SortPreference []string `yaml:"sort_preference" default:"[]"`
+	// Client networks that get no AAAA records, e.g. IPv4-only networks.
+	FilterAAAAClients []string `yaml:"filter_aaaa_clients" default:"[]"`
+	// Drop the authority and additional sections when there's an answer, and
+	// the additional section otherwise.
+	MinimalResponses bool `yaml:"minimal_responses" default:"false"`
+	// TTL clamps, in seconds. A maximum of 0 means no maximum. The negative
+	// ones apply to the SOA of NXDOMAIN/NODATA responses instead.
+	MinTTL         uint32 `yaml:"min_ttl" default:"0"`
+	MaxTTL         uint32 `yaml:"max_ttl" default:"0"`
+	MinNegativeTTL uint32 `yaml:"min_negative_ttl" default:"0"`
+	MaxNegativeTTL uint32 `yaml:"max_negative_ttl" default:"0"`
+}
+
+type RecursiveConfig struct {
+	// Addresses of the root servers to start from. Defaults to the IANA root
+	// servers.
+	RootHints []string `yaml:"root_hints" default:"[]"`
+	// Only show each server as much of the name as it needs to see (RFC 9156).
+	QnameMinimisation bool `yaml:"qname_minimisation" default:"true"`
+}
+
+// MatchConfig narrows down which queries a custom upstream gets. Every
+// criterion given has to be met; any left empty matches everything.
+type MatchConfig struct {
+	// Question types, e.g. [PTR, SRV].
+	Qtypes []string `yaml:"qtypes" default:"[]"`
+	// Domain suffixes. A suffix also matches all of its subdomains.
+	Suffixes []string `yaml:"suffixes" default:"[]"`
+	// Files holding additional suffixes, one per line. Lines starting with '#'
+	// are ignored.
+	SuffixFiles []string `yaml:"suffix_files" default:"[]"`
+	// Client networks, in CIDR notation.
+	ClientCIDRs []string `yaml:"client_cidrs" default:"[]"`
+	// Labels of client tokens, as given in auth.tokens_filepath.
+	ClientLabels []string `yaml:"client_labels" default:"[]"`
+	// Send the queries that don't meet the criteria (name_regex included) to
+	// this upstream instead.
+	Negate bool `yaml:"negate" default:"false"`
+}
+
+type BootstrapConfig struct {
+	// Plain DNS servers (host[:port]) to resolve the hostname through.
+	Servers []string `yaml:"servers" default:"[]"`
+	// Addresses to pin the hostname to. Along with servers, these are only
+	// used if the servers can't be reached.
+	StaticIPs []string `yaml:"static_ips" default:"[]"`
+	// How often to re-resolve the hostname through the servers.
+	RefreshSeconds int `yaml:"refresh_seconds" default:"300"`
 }
 
 type HttpTransportConfig struct {
@@ -53,6 +319,60 @@ type HttpTransportConfig struct {
 	IdleConnTimeoutMillis int64 `yaml:"idle_conn_timeout_millis" default:"30000"`
 }
 
+// yaml doesn't know about the `default` tags, so anything decoded into a list
+// element or a nil pointer needs its defaults applied before it's filled in.
+
+func (c *RateLimitConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	defaults.Set(c)
+	type plain RateLimitConfig
+	return unmarshal((*plain)(c))
+}
+
+func (c *UpstreamSettings) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	defaults.Set(c)
+	type plain UpstreamSettings
+	return unmarshal((*plain)(c))
+}
+
+func (c *FilterConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	defaults.Set(c)
+	type plain FilterConfig
+	return unmarshal((*plain)(c))
+}
+
+func (c *UpstreamConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	defaults.Set(c)
+	type plain UpstreamConfig
+	return unmarshal((*plain)(c))
+}
+
+// effectiveEndpoints resolves the configured endpoints against the top-level
+// sections, so that every returned endpoint has all of its sections set.
+func (config *Config) effectiveEndpoints() []EndpointConfig {
+	endpoints := config.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = []EndpointConfig{{Path: "/dns-query"}}
+	}
+
+	retval := make([]EndpointConfig, 0, len(endpoints))
+	for _, ep := range endpoints {
+		if ep.Upstream == nil {
+			ep.Upstream = &config.Upstream
+		}
+		if ep.Filtering == nil {
+			ep.Filtering = &config.Filtering
+		}
+		if ep.IPRateLimit == nil {
+			ep.IPRateLimit = &config.IPRateLimit
+		}
+		if ep.RequireAuth == nil {
+			ep.RequireAuth = &config.Auth.Required
+		}
+		retval = append(retval, ep)
+	}
+	return retval
+}
+
 func parseConfigFile(filepath string) (*Config, error) {
 
 	config := &Config{}
@@ -85,6 +405,41 @@ func ensureFileExists(filepath string) error {
 	return nil
 }
 
+func validateRateLimitConfig(config *RateLimitConfig) error {
+	if config.IPv4PrefixLength < 0 || config.IPv4PrefixLength > 32 {
+		return fmt.Errorf("ipv4_prefix_length must be within [0, 32].")
+	}
+
+	if config.IPv6PrefixLength < 0 || config.IPv6PrefixLength > 128 {
+		return fmt.Errorf("ipv6_prefix_length must be within [0, 128].")
+	}
+
+	if config.MaxTrackedKeys <= 0 {
+		return fmt.Errorf("max_tracked_keys must be positive.")
+	}
+
+	for qtype, cost := range config.QtypeCosts {
+		if _, exists := dns.StringToType[strings.ToUpper(qtype)]; !exists {
+			return fmt.Errorf("Unknown qtype [%v] in qtype_costs.", qtype)
+		}
+		if cost < 0 {
+			return fmt.Errorf("Cost for qtype [%v] must not be negative.", qtype)
+		}
+	}
+
+	if config.FetchIPFromHeaders && len(config.TrustedProxies) == 0 {
+		return fmt.Errorf("fetch_ip_from_headers needs the proxies setting the headers listed in trusted_proxies.")
+	}
+
+	for _, cidrs := range [][]string{config.TrustedProxies, config.Allowlist} {
+		if _, err := parseCIDRs(cidrs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func validateConfig(config *Config) error {
 	if (config.Server.TLSCertPath == "") != (config.Server.TLSKeyPath == "") {
 		return fmt.Errorf("Both a cert path and a key path must be provided to configure TLS.")
@@ -102,6 +457,80 @@ func validateConfig(config *Config) error {
 		}
 	}
 
+	if config.Auth.TokensFile != "" {
+		if err := ensureFileExists(config.Auth.TokensFile); err != nil {
+			return err
+		}
+	}
+
+	if config.Auth.ClientCAPath != "" {
+		if !useTLS(config) {
+			return fmt.Errorf("A client CA can only be used when the server is configured for TLS.")
+		}
+		if err := ensureFileExists(config.Auth.ClientCAPath); err != nil {
+			return err
+		}
+	}
+
+	for _, backend := range []string{config.Backend.RateLimit, config.Backend.Cache} {
+		if backend != "memory" && backend != "redis" {
+			return fmt.Errorf("Unknown backend [%v]; must be one of [memory|redis].", backend)
+		}
+	}
+
+	if config.Admin.Enabled && config.Admin.Token == "" {
+		return fmt.Errorf("The admin api needs a token to be enabled.")
+	}
+
+	if config.Caching.MaxEntries <= 0 {
+		return fmt.Errorf("Caching max_entries must be positive.")
+	}
+
+	if config.Caching.SnapshotPath != "" && config.Caching.SnapshotIntervalSeconds <= 0 {
+		return fmt.Errorf("Caching snapshot_interval_seconds must be positive.")
+	}
+
+	paths := newSet()
+	for _, ep := range config.effectiveEndpoints() {
+		if !strings.HasPrefix(ep.Path, "/") || (len(ep.Path) > 1 && strings.HasSuffix(ep.Path, "/")) {
+			return fmt.Errorf("Endpoint path [%v] must start with '/' and must not end with one.", ep.Path)
+		}
+		if paths.Contains(ep.Path) {
+			return fmt.Errorf("Endpoint path [%v] is configured more than once.", ep.Path)
+		}
+		paths.Add(ep.Path)
+
+		if ep.Upstream.MaxQuestions < 1 {
+			return fmt.Errorf("Upstream max_questions must be positive for endpoint [%v].", ep.Path)
+		}
+
+		upstreams := append(append([]UpstreamConfig{}, ep.Upstream.Custom...), ep.Upstream.Default.Upstreams...)
+		if ep.Upstream.PrivatePTR.Upstream != nil {
+			upstreams = append(upstreams, *ep.Upstream.PrivatePTR.Upstream)
+		}
+		for _, upstream := range upstreams {
+			if _, err := upstreamType(upstream); err != nil {
+				return fmt.Errorf("Bad upstream for endpoint [%v]: %v", ep.Path, err)
+			}
+		}
+
+		if err := validateRateLimitConfig(ep.IPRateLimit); err != nil {
+			return fmt.Errorf("Bad ip_rate_limit for endpoint [%v]: %v", ep.Path, err)
+		}
+
+		switch ep.Filtering.BlockResponse {
+		case "nxdomain", "refused":
+		default:
+			return fmt.Errorf("Unknown block_response [%v] for endpoint [%v].", ep.Filtering.BlockResponse, ep.Path)
+		}
+
+		for _, path := range ep.Filtering.BlocklistFiles {
+			if err := ensureFileExists(path); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -112,7 +541,7 @@ func FetchConfig(filepath string) (*Config, error) {
 	}
 
 	if invalid := validateConfig(cfg); invalid != nil {
-		return nil, err
+		return nil, invalid
 	}
 
 	return cfg, nil
@@ -0,0 +1,171 @@
+package dohboy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatalf("Could not write config: %v", err)
+	}
+	return path
+}
+
+func TestConfigDefaults(t *testing.T) {
+	config, err := FetchConfig("")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if config.Server.Host != "127.0.0.1" || config.Server.Port != "8080" {
+		t.Errorf("listening on %v:%v, want 127.0.0.1:8080", config.Server.Host, config.Server.Port)
+	}
+	if !config.IPRateLimit.Enabled || config.IPRateLimit.MaxTokens != 25 || config.IPRateLimit.RecoverXTokensPerSec != 5 {
+		t.Errorf("ip_rate_limit = %+v", config.IPRateLimit)
+	}
+	if !config.Upstream.Default.Enabled || len(config.Upstream.Default.Upstreams) != 0 {
+		t.Errorf("default_upstream = %+v", config.Upstream.Default)
+	}
+	if !config.Upstream.PrivatePTR.Enabled || config.Upstream.DNS64.Prefix != "64:ff9b::/96" {
+		t.Errorf("private_ptr = %+v, dns64 = %+v", config.Upstream.PrivatePTR, config.Upstream.DNS64)
+	}
+	if config.Caching.EnableResponseCache || !config.Caching.EnableHTTPCaching || config.Caching.MaxEntries != 10000 {
+		t.Errorf("caching = %+v", config.Caching)
+	}
+	if config.Filtering.BlockResponse != "nxdomain" || !config.Cookies.Enabled {
+		t.Errorf("filtering = %+v, cookies = %+v", config.Filtering, config.Cookies)
+	}
+
+	endpoints := config.effectiveEndpoints()
+	if len(endpoints) != 1 || endpoints[0].Path != "/dns-query" {
+		t.Errorf("endpoints = %+v, want just /dns-query", endpoints)
+	}
+}
+
+func TestConfigParsing(t *testing.T) {
+	config, err := FetchConfig(writeTestConfig(t, `
+server:
+  port: "9090"
+ip_rate_limit:
+  max_tokens: 100
+upstream:
+  custom_upstream:
+    - name_regex: "corp\\.example\\.$"
+      use_doh: false
+      address: 10.0.0.53:53
+    - name_regex: "example\\.org\\.$"
+      address: https://dns.example/dns-query
+      post_processing:
+        max_ttl: 600
+  default_upstream:
+    upstreams:
+      - type: dns
+        address: 192.0.2.53:53
+endpoints:
+  - path: /dns-query
+  - path: /kids
+    filtering:
+      blocklist: [games.example]
+    ip_rate_limit:
+      max_tokens: 5
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if config.Server.Port != "9090" || config.Server.Host != "127.0.0.1" {
+		t.Errorf("listening on %v:%v, want 127.0.0.1:9090", config.Server.Host, config.Server.Port)
+	}
+	if config.IPRateLimit.MaxTokens != 100 || config.IPRateLimit.RecoverXTokensPerSec != 5 {
+		t.Errorf("ip_rate_limit = %+v, want max_tokens set and the rest defaulted", config.IPRateLimit)
+	}
+
+	custom := config.Upstream.Custom
+	if len(custom) != 2 {
+		t.Fatalf("custom_upstream = %+v", custom)
+	}
+	if kind, _ := upstreamType(custom[0]); kind != "dns" || custom[0].Address != "10.0.0.53:53" || custom[0].TimeoutMillis != 5000 {
+		t.Errorf("first custom upstream = %+v", custom[0])
+	}
+	if kind, _ := upstreamType(custom[1]); kind != "doh" || custom[1].TimeoutMillis != 5000 || custom[1].PostProcessing.MaxTTL != 600 {
+		t.Errorf("second custom upstream = %+v", custom[1])
+	}
+	if !custom[1].Recursive.QnameMinimisation || custom[1].Bootstrap.RefreshSeconds != 300 {
+		t.Errorf("second custom upstream's nested defaults = %+v, %+v", custom[1].Recursive, custom[1].Bootstrap)
+	}
+
+	defaults := config.Upstream.Default
+	if !defaults.Enabled || len(defaults.Upstreams) != 1 || defaults.Upstreams[0].TimeoutMillis != 5000 {
+		t.Errorf("default_upstream = %+v", defaults)
+	}
+
+	endpoints := config.effectiveEndpoints()
+	if len(endpoints) != 2 {
+		t.Fatalf("endpoints = %+v", endpoints)
+	}
+	if endpoints[0].Upstream != &config.Upstream || endpoints[0].Filtering != &config.Filtering || endpoints[0].IPRateLimit != &config.IPRateLimit {
+		t.Errorf("first endpoint doesn't fall back to the top-level sections")
+	}
+	if endpoints[1].Upstream != &config.Upstream {
+		t.Errorf("second endpoint doesn't fall back to the top-level upstream")
+	}
+	if len(endpoints[1].Filtering.Blocklist) != 1 || endpoints[1].Filtering.BlockResponse != "nxdomain" {
+		t.Errorf("second endpoint filtering = %+v", endpoints[1].Filtering)
+	}
+	if endpoints[1].IPRateLimit.MaxTokens != 5 || endpoints[1].IPRateLimit.RecoverXTokensPerSec != 5 {
+		t.Errorf("second endpoint ip_rate_limit = %+v", endpoints[1].IPRateLimit)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string // empty when the config is valid
+	}{
+		{name: "cert without key", yaml: "server:\n  tls_cert_filepath: /nonexistent/cert.pem\n", wantErr: "Both a cert path and a key path"},
+		{name: "missing cert", yaml: "server:\n  tls_cert_filepath: /nonexistent/cert.pem\n  tls_key_filepath: /nonexistent/key.pem\n", wantErr: "no such file"},
+		{name: "unknown backend", yaml: "backend:\n  cache: memcached\n", wantErr: "Unknown backend"},
+		{name: "admin without token", yaml: "admin:\n  enabled: true\n", wantErr: "needs a token"},
+		{name: "no cache entries", yaml: "caching:\n  max_entries: 0\n", wantErr: "max_entries"},
+		{name: "endpoint path without slash", yaml: "endpoints:\n  - path: dns-query\n", wantErr: "must start with '/'"},
+		{name: "endpoint path with trailing slash", yaml: "endpoints:\n  - path: /dns-query/\n", wantErr: "must start with '/'"},
+		{name: "duplicate endpoint", yaml: "endpoints:\n  - path: /a\n  - path: /a\n", wantErr: "more than once"},
+		{name: "bad block response", yaml: "filtering:\n  block_response: servfail\n", wantErr: "Unknown block_response"},
+		{name: "bad ipv4 prefix", yaml: "ip_rate_limit:\n  ipv4_prefix_length: 33\n", wantErr: "ipv4_prefix_length"},
+		{name: "unknown qtype cost", yaml: "ip_rate_limit:\n  qtype_costs: {BOGUS: 3}\n", wantErr: "Unknown qtype"},
+		{name: "headers without trusted proxies", yaml: "ip_rate_limit:\n  fetch_ip_from_headers: true\n", wantErr: "trusted_proxies"},
+		{name: "bad allowlist", yaml: "ip_rate_limit:\n  allowlist: [not-a-network]\n", wantErr: "invalid CIDR address"},
+		{name: "bad endpoint rate limit", yaml: "endpoints:\n  - path: /a\n    ip_rate_limit:\n      max_tracked_keys: 0\n", wantErr: "Bad ip_rate_limit for endpoint [/a]"},
+		{name: "upstream of no telling type", yaml: "upstream:\n  custom_upstream:\n    - name_regex: corp\n      address: dns.corp.example\n", wantErr: "give it a type"},
+		{name: "default upstream of no telling type", yaml: "upstream:\n  default_upstream:\n    upstreams:\n      - address: dns.example\n", wantErr: "Bad upstream for endpoint [/dns-query]"},
+		{name: "upstream of unknown type", yaml: "upstream:\n  custom_upstream:\n    - name_regex: corp\n      type: dot\n      address: dns.corp.example:853\n", wantErr: "Unknown upstream type [dot]"},
+		{name: "default upstream of unknown type", yaml: "upstream:\n  default_upstream:\n    upstreams:\n      - type: DoH\n        address: https://dns.example/dns-query\n", wantErr: "Unknown upstream type [DoH]"},
+		{name: "not yaml", yaml: "server: [", wantErr: "yaml"},
+		{name: "valid", yaml: "server:\n  port: \"8053\"\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := FetchConfig(writeTestConfig(t, test.yaml))
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("err = %v, want one containing [%v]", err, test.wantErr)
+			}
+		})
+	}
+
+	if _, err := FetchConfig("/nonexistent/config.yml"); err == nil {
+		t.Errorf("expected an error for a missing config file")
+	}
+}
@@ -0,0 +1,231 @@
+package dohboy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cookieSecrets derives the secrets DNS cookies are made with. The secret in
+// use changes every rotation period, and is derived from a configured seed so
+// that replicas sharing the seed agree on it without talking to each other.
+type cookieSecrets struct {
+	seeds    [][]byte // the first one mints cookies; the others are only accepted
+	rotation time.Duration
+}
+
+func newCookieSecrets(config *CookieConfig) (*cookieSecrets, error) {
+	seeds := make([][]byte, 0, len(config.Secrets))
+	for _, secret := range config.Secrets {
+		seed, err := hex.DecodeString(secret)
+		if err != nil || len(seed) < 16 {
+			return nil, fmt.Errorf("Cookie secrets must be at least 16 bytes, hex encoded.")
+		}
+		seeds = append(seeds, seed)
+	}
+
+	if len(seeds) == 0 {
+		seed := make([]byte, 16)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, seed)
+	}
+
+	rotation := time.Duration(config.RotationSeconds) * time.Second
+	if rotation <= 0 {
+		rotation = 24 * time.Hour
+	}
+
+	return &cookieSecrets{seeds: seeds, rotation: rotation}, nil
+}
+
+func (cs *cookieSecrets) derive(seed []byte, period int64) []byte {
+	mac := hmac.New(sha256.New, seed)
+	binary.Write(mac, binary.BigEndian, period)
+	return mac.Sum(nil)
+}
+
+func (cs *cookieSecrets) period(at time.Time) int64 {
+	return at.UnixNano() / int64(cs.rotation)
+}
+
+// current is the secret to make new cookies with.
+func (cs *cookieSecrets) current() []byte {
+	return cs.derive(cs.seeds[0], cs.period(time.Now()))
+}
+
+// accepted are the secrets cookies are checked against: those of the current
+// and the previous period, for every seed.
+func (cs *cookieSecrets) accepted() [][]byte {
+	now := cs.period(time.Now())
+	retval := make([][]byte, 0, 2*len(cs.seeds))
+	for _, seed := range cs.seeds {
+		retval = append(retval, cs.derive(seed, now), cs.derive(seed, now-1))
+	}
+	return retval
+}
+
+func cookieHash(secret []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)[:8]
+}
+
+// clientCookie is the client cookie dohboy uses towards an upstream server,
+// which is unique per server (RFC7873 B.1).
+func (cs *cookieSecrets) clientCookie(serverAddress string) string {
+	return hex.EncodeToString(cookieHash(cs.current(), []byte("client"), []byte(serverAddress)))
+}
+
+// Server cookies are laid out as RFC9018 describes: version, three reserved
+// bytes, a timestamp and a hash over the client cookie, the timestamp and the
+// client's address.
+const (
+	serverCookieVersion = 1
+	serverCookieMaxAge  = time.Hour
+	serverCookieRenewAt = 30 * time.Minute
+)
+
+func serverCookieHash(secret []byte, clientCookie []byte, header []byte, clientIP net.IP) []byte {
+	return cookieHash(secret, clientCookie, header, clientIP.To16())
+}
+
+// cookieCheck is what a client's cookie turned out to be.
+type cookieCheck int
+
+const (
+	cookieAbsent     cookieCheck = iota
+	cookieClientOnly             // no server cookie yet
+	cookieValid                  // a server cookie dohboy made, and still good
+	cookieInvalid                // a server cookie dohboy didn't make, or that expired
+	cookieMalformed              // neither a client cookie nor a client and server cookie
+)
+
+// serverCookie checks the cookie a client sent and returns the server cookie
+// to send back, along with its client cookie. A valid server cookie is reused
+// until it is due to be renewed. Malformed cookies get nothing back.
+func (cs *cookieSecrets) serverCookie(cookie string, clientIP net.IP) (string, cookieCheck) {
+	raw, err := hex.DecodeString(cookie)
+	// RFC7873 4: an 8 byte client cookie, optionally followed by an 8 to 32
+	// byte server cookie.
+	if err != nil || (len(raw) != 8 && (len(raw) < 16 || len(raw) > 40)) {
+		return "", cookieMalformed
+	}
+	clientCookie := raw[:8]
+
+	check := cookieClientOnly
+	if len(raw) > 8 {
+		check = cookieInvalid
+		if timestamp, valid := cs.checkServerCookie(clientCookie, raw[8:], clientIP); valid {
+			if time.Since(timestamp) < serverCookieRenewAt {
+				return cookie, cookieValid
+			}
+			check = cookieValid
+		}
+	}
+
+	header := make([]byte, 8)
+	header[0] = serverCookieVersion
+	binary.BigEndian.PutUint32(header[4:], uint32(time.Now().Unix()))
+
+	serverCookie := append(header, serverCookieHash(cs.current(), clientCookie, header, clientIP)...)
+	return hex.EncodeToString(append(append([]byte{}, clientCookie...), serverCookie...)), check
+}
+
+// checkServerCookie verifies a server cookie dohboy made earlier, returning
+// when it was made.
+func (cs *cookieSecrets) checkServerCookie(clientCookie []byte, serverCookie []byte, clientIP net.IP) (time.Time, bool) {
+	if len(serverCookie) != 16 || serverCookie[0] != serverCookieVersion {
+		return time.Time{}, false
+	}
+
+	timestamp := time.Unix(int64(binary.BigEndian.Uint32(serverCookie[4:8])), 0)
+	if time.Since(timestamp) > serverCookieMaxAge || time.Until(timestamp) > 5*time.Minute {
+		return time.Time{}, false
+	}
+
+	for _, secret := range cs.accepted() {
+		if hmac.Equal(serverCookie[8:], serverCookieHash(secret, clientCookie, serverCookie[:8], clientIP)) {
+			return timestamp, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// upstreamCookies keeps track of the cookie exchange with a plain DNS
+// upstream.
+type upstreamCookies struct {
+	secrets       *cookieSecrets
+	serverAddress string
+	clientCookie  string // the client cookie the server cookie belongs to
+	serverCookie  string
+	// Set once the upstream has answered with our cookie, after which answers
+	// without it are taken to be spoofed.
+	supported bool
+	mu        sync.Mutex
+}
+
+func newUpstreamCookies(secrets *cookieSecrets, serverAddress string) *upstreamCookies {
+	return &upstreamCookies{secrets: secrets, serverAddress: serverAddress}
+}
+
+// attach returns a copy of the query carrying our cookie instead of the
+// client's.
+func (uc *upstreamCookies) attach(dnsQuery *dns.Msg) *dns.Msg {
+	query := rfc7873_withoutCookie(dnsQuery)
+	if query == dnsQuery {
+		query = dnsQuery.Copy()
+	}
+	if query.IsEdns0() == nil {
+		query.SetEdns0(1232, false)
+	}
+
+	clientCookie := uc.secrets.clientCookie(uc.serverAddress)
+
+	uc.mu.Lock()
+	cookie := clientCookie
+	if uc.clientCookie == clientCookie {
+		cookie += uc.serverCookie
+	}
+	uc.mu.Unlock()
+
+	opt := query.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return query
+}
+
+// check looks at the cookie in an upstream response, remembering the server
+// cookie if there is one. It returns false if the response doesn't carry our
+// client cookie when it should have.
+func (uc *upstreamCookies) check(resp *dns.Msg) bool {
+	clientCookie := uc.secrets.clientCookie(uc.serverAddress)
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	cookie := rfc7873_getCookie(resp)
+	if cookie == nil || len(cookie.Cookie) < rfc7873_clientCookieLen {
+		return !uc.supported
+	}
+
+	if !strings.EqualFold(cookie.Cookie[:rfc7873_clientCookieLen], clientCookie) {
+		return false
+	}
+
+	uc.supported = true
+	uc.clientCookie = clientCookie
+	uc.serverCookie = cookie.Cookie[rfc7873_clientCookieLen:]
+	return true
+}
@@ -0,0 +1,214 @@
+package dohboy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testCookieSeed    = "000102030405060708090a0b0c0d0e0f"
+	testCookieOldSeed = "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"
+	testClientCookie  = "0123456789abcdef"
+)
+
+func newTestCookieSecrets(t *testing.T, secrets ...string) *cookieSecrets {
+	t.Helper()
+	cs, err := newCookieSecrets(&CookieConfig{Secrets: secrets, RotationSeconds: 3600})
+	if err != nil {
+		t.Fatalf("Could not create cookie secrets: %v", err)
+	}
+	return cs
+}
+
+// makeServerCookie makes a client and server cookie as if it was handed out
+// at the given time, with the secret of the given seed and rotation period.
+func makeServerCookie(cs *cookieSecrets, seed []byte, period int64, clientIP string, at time.Time) string {
+	clientCookie, _ := hex.DecodeString(testClientCookie)
+	header := make([]byte, 8)
+	header[0] = serverCookieVersion
+	binary.BigEndian.PutUint32(header[4:], uint32(at.Unix()))
+	hash := serverCookieHash(cs.derive(seed, period), clientCookie, header, net.ParseIP(clientIP))
+	return testClientCookie + hex.EncodeToString(append(header, hash...))
+}
+
+func TestNewCookieSecrets(t *testing.T) {
+	for _, secrets := range [][]string{{"not hex"}, {"0011223344"}} {
+		if _, err := newCookieSecrets(&CookieConfig{Secrets: secrets}); err == nil {
+			t.Errorf("%v: expected an error", secrets)
+		}
+	}
+
+	random := newTestCookieSecrets(t)
+	if len(random.seeds) != 1 || len(random.seeds[0]) != 16 {
+		t.Errorf("seeds = %v, want a single random one", random.seeds)
+	}
+	if other := newTestCookieSecrets(t); other.clientCookie("192.0.2.53:53") == random.clientCookie("192.0.2.53:53") {
+		t.Errorf("two random secrets made the same client cookie")
+	}
+}
+
+func TestCookieSecretDerivation(t *testing.T) {
+	cs := newTestCookieSecrets(t, testCookieSeed, testCookieOldSeed)
+	replica := newTestCookieSecrets(t, testCookieSeed)
+
+	if string(cs.current()) != string(replica.current()) {
+		t.Errorf("replicas sharing a seed disagree on the current secret")
+	}
+	if cs.clientCookie("192.0.2.53:53") != replica.clientCookie("192.0.2.53:53") {
+		t.Errorf("replicas sharing a seed disagree on the client cookie")
+	}
+	if cs.clientCookie("192.0.2.53:53") == cs.clientCookie("192.0.2.54:53") {
+		t.Errorf("two upstreams got the same client cookie")
+	}
+	if got := cs.clientCookie("192.0.2.53:53"); len(got) != rfc7873_clientCookieLen {
+		t.Errorf("client cookie %v isn't %v hex digits", got, rfc7873_clientCookieLen)
+	}
+
+	now := cs.period(time.Now())
+	seed, _ := hex.DecodeString(testCookieSeed)
+	oldSeed, _ := hex.DecodeString(testCookieOldSeed)
+	if string(cs.derive(seed, now)) == string(cs.derive(seed, now-1)) {
+		t.Errorf("the secret doesn't change between periods")
+	}
+
+	accepted := cs.accepted()
+	want := [][]byte{cs.derive(seed, now), cs.derive(seed, now-1), cs.derive(oldSeed, now), cs.derive(oldSeed, now-1)}
+	if len(accepted) != len(want) {
+		t.Fatalf("accepted %v secrets, want %v", len(accepted), len(want))
+	}
+	for i := range want {
+		if string(accepted[i]) != string(want[i]) {
+			t.Errorf("accepted[%v] is off", i)
+		}
+	}
+	if string(accepted[0]) != string(cs.current()) {
+		t.Errorf("the current secret isn't the first one accepted")
+	}
+}
+
+func TestServerCookie(t *testing.T) {
+	cs := newTestCookieSecrets(t, testCookieSeed, testCookieOldSeed)
+	seed, _ := hex.DecodeString(testCookieSeed)
+	oldSeed, _ := hex.DecodeString(testCookieOldSeed)
+	otherSeed, _ := hex.DecodeString("101112131415161718191a1b1c1d1e1f")
+	now := time.Now()
+	period := cs.period(now)
+	const clientIP = "198.51.100.7"
+
+	fresh := makeServerCookie(cs, seed, period, clientIP, now.Add(-time.Minute))
+
+	tests := []struct {
+		name        string
+		cookie      string
+		clientIP    string
+		want        cookieCheck
+		wantSame    bool // the same cookie comes back
+		wantNothing bool
+	}{
+		{name: "not hex", cookie: "zz", want: cookieMalformed, wantNothing: true},
+		{name: "too short", cookie: "01234567", want: cookieMalformed, wantNothing: true},
+		{name: "server cookie too short", cookie: testClientCookie + "0102030405", want: cookieMalformed, wantNothing: true},
+		{name: "server cookie too long", cookie: testClientCookie + strings.Repeat("00", 33), want: cookieMalformed, wantNothing: true},
+		{name: "client cookie only", cookie: testClientCookie, want: cookieClientOnly},
+		{name: "fresh", cookie: fresh, want: cookieValid, wantSame: true},
+		{name: "due for renewal", cookie: makeServerCookie(cs, seed, period, clientIP, now.Add(-45*time.Minute)), want: cookieValid},
+		{name: "previous period", cookie: makeServerCookie(cs, seed, period-1, clientIP, now.Add(-time.Minute)), want: cookieValid, wantSame: true},
+		{name: "retired seed", cookie: makeServerCookie(cs, oldSeed, period, clientIP, now.Add(-time.Minute)), want: cookieValid, wantSame: true},
+		{name: "two periods ago", cookie: makeServerCookie(cs, seed, period-2, clientIP, now.Add(-time.Minute)), want: cookieInvalid},
+		{name: "expired", cookie: makeServerCookie(cs, seed, period, clientIP, now.Add(-2*time.Hour)), want: cookieInvalid},
+		{name: "from the future", cookie: makeServerCookie(cs, seed, period, clientIP, now.Add(time.Hour)), want: cookieInvalid},
+		{name: "unknown seed", cookie: makeServerCookie(cs, otherSeed, period, clientIP, now.Add(-time.Minute)), want: cookieInvalid},
+		{name: "another client's", cookie: fresh, clientIP: "198.51.100.8", want: cookieInvalid},
+		{name: "unknown layout", cookie: testClientCookie + strings.Repeat("ab", 16), want: cookieInvalid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ip := test.clientIP
+			if ip == "" {
+				ip = clientIP
+			}
+
+			got, check := cs.serverCookie(test.cookie, net.ParseIP(ip))
+			if check != test.want {
+				t.Errorf("check = %v, want %v", check, test.want)
+			}
+			if test.wantNothing {
+				if got != "" {
+					t.Errorf("cookie = %v, want none", got)
+				}
+				return
+			}
+
+			if (got == test.cookie) != test.wantSame {
+				t.Errorf("cookie = %v, want the same one back: %v", got, test.wantSame)
+			}
+			if len(got) != 48 || !strings.HasPrefix(got, testClientCookie) {
+				t.Fatalf("cookie = %v, want the client cookie and a 16 byte server cookie", got)
+			}
+			if _, check := cs.serverCookie(got, net.ParseIP(ip)); check != cookieValid {
+				t.Errorf("the cookie handed out doesn't check out: %v", check)
+			}
+		})
+	}
+}
+
+func TestUpstreamCookies(t *testing.T) {
+	cs := newTestCookieSecrets(t, testCookieSeed)
+	uc := newUpstreamCookies(cs, "192.0.2.53:53")
+	ours := cs.clientCookie("192.0.2.53:53")
+
+	withCookie := func(msg *dns.Msg, cookie string) *dns.Msg {
+		msg.SetEdns0(1232, false)
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		return msg
+	}
+	response := func(cookie string) *dns.Msg {
+		resp := replyA(newTestQuery("www.example.com.", dns.TypeA), "192.0.2.1", 300)
+		if cookie == "" {
+			return resp
+		}
+		return withCookie(resp, cookie)
+	}
+
+	clientQuery := withCookie(newTestQuery("www.example.com.", dns.TypeA), testClientCookie)
+	query := uc.attach(clientQuery)
+	if got := rfc7873_getCookie(query); got == nil || got.Cookie != ours {
+		t.Fatalf("attached cookie = %v, want our client cookie %v", got, ours)
+	}
+	if got := rfc7873_getCookie(clientQuery); got.Cookie != testClientCookie {
+		t.Errorf("the client's query was changed: %v", got.Cookie)
+	}
+	if got := rfc7873_getCookie(uc.attach(newTestQuery("www.example.com.", dns.TypeA))); got == nil || got.Cookie != ours {
+		t.Errorf("a query without EDNS didn't get our cookie: %v", got)
+	}
+
+	if !uc.check(response("")) {
+		t.Errorf("a response without a cookie was rejected before the upstream showed cookie support")
+	}
+	if uc.check(response(testClientCookie + "0102030405060708")) {
+		t.Errorf("a response with someone else's client cookie was accepted")
+	}
+
+	const serverCookie = "a1a2a3a4a5a6a7a8b1b2b3b4b5b6b7b8"
+	if !uc.check(response(ours + serverCookie)) {
+		t.Fatalf("a response with our cookie was rejected")
+	}
+	if got := rfc7873_getCookie(uc.attach(clientQuery)); got.Cookie != ours+serverCookie {
+		t.Errorf("attached cookie = %v, want ours along with the server cookie", got.Cookie)
+	}
+
+	if uc.check(response("")) {
+		t.Errorf("a response without a cookie was accepted after the upstream showed cookie support")
+	}
+	if uc.check(response(ours[:8])) {
+		t.Errorf("a response with a truncated cookie was accepted after the upstream showed cookie support")
+	}
+}
@@ -0,0 +1,158 @@
+package dohboy
+
+import (
+	"net/http"
+)
+
+// dashboardHTML is a self-contained page that polls /api/stats. It holds no
+// data itself, so it's served without auth and asks for the admin token.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>dohboy</title>
+<style>
+  body { font-family: sans-serif; margin: 1.5em; background: #fafafa; color: #222; }
+  h1 { font-size: 1.4em; margin: 0 0 .5em 0; }
+  h2 { font-size: 1em; margin: 0 0 .5em 0; }
+  .row { display: flex; flex-wrap: wrap; gap: 1em; margin-bottom: 1em; }
+  .card { background: #fff; border: 1px solid #ddd; border-radius: 4px; padding: 1em; flex: 1 1 300px; }
+  .big { font-size: 1.8em; }
+  table { width: 100%; border-collapse: collapse; font-size: .9em; }
+  td { padding: 2px 4px; border-bottom: 1px solid #eee; }
+  td.n { text-align: right; }
+  canvas { width: 100%; height: 180px; }
+  #error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>dohboy</h1>
+<div class="row">
+  <label>window
+    <select id="window">
+      <option value="1h">last hour</option>
+      <option value="24h">last day</option>
+    </select>
+  </label>
+  <button id="logout">forget token</button>
+  <span id="error"></span>
+</div>
+<div class="row">
+  <div class="card"><h2>queries</h2><div class="big" id="queries">-</div></div>
+  <div class="card"><h2>blocked</h2><div class="big" id="blocked">-</div></div>
+  <div class="card"><h2>rcodes</h2><table id="rcodes"></table></div>
+</div>
+<div class="row">
+  <div class="card"><h2>queries per second</h2><canvas id="qps"></canvas></div>
+  <div class="card"><h2>upstream latency (ms)</h2><canvas id="latency"></canvas><table id="latency-legend"></table></div>
+</div>
+<div class="row">
+  <div class="card"><h2>top domains</h2><table id="top-domains"></table></div>
+  <div class="card"><h2>top blocked</h2><table id="top-blocked"></table></div>
+  <div class="card"><h2>top clients</h2><table id="top-clients"></table></div>
+</div>
+<script>
+const colors = ["#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b"];
+
+function token() {
+  let t = sessionStorage.getItem("dohboy-admin-token");
+  if (!t) {
+    t = prompt("admin token");
+    if (t) sessionStorage.setItem("dohboy-admin-token", t);
+  }
+  return t;
+}
+
+function fillTable(id, rows) {
+  const table = document.getElementById(id);
+  table.innerHTML = "";
+  for (const [key, val] of rows) {
+    const tr = table.insertRow();
+    tr.insertCell().textContent = key;
+    const td = tr.insertCell();
+    td.className = "n";
+    td.textContent = val;
+  }
+}
+
+function drawLines(id, lines) {
+  const canvas = document.getElementById(id);
+  const ctx = canvas.getContext("2d");
+  canvas.width = canvas.clientWidth;
+  canvas.height = canvas.clientHeight;
+  ctx.clearRect(0, 0, canvas.width, canvas.height);
+
+  let minT = Infinity, maxT = -Infinity, maxV = 0;
+  for (const line of lines) {
+    for (const p of line.points) {
+      minT = Math.min(minT, p.t); maxT = Math.max(maxT, p.t); maxV = Math.max(maxV, p.v);
+    }
+  }
+  if (!isFinite(minT) || maxV === 0) return;
+  const spanT = Math.max(maxT - minT, 1);
+
+  ctx.fillStyle = "#888";
+  ctx.fillText(maxV.toFixed(2), 2, 10);
+  lines.forEach((line, i) => {
+    ctx.strokeStyle = colors[i % colors.length];
+    ctx.beginPath();
+    line.points.forEach((p, j) => {
+      const x = (p.t - minT) / spanT * (canvas.width - 1);
+      const y = canvas.height - 1 - p.v / maxV * (canvas.height - 14);
+      if (j === 0) ctx.moveTo(x, y); else ctx.lineTo(x, y);
+    });
+    ctx.stroke();
+  });
+}
+
+async function refresh() {
+  const windowParam = document.getElementById("window").value;
+  const resp = await fetch("/api/stats?window=" + windowParam, {
+    headers: {"Authorization": "Bearer " + token()},
+  });
+  if (resp.status === 401) {
+    sessionStorage.removeItem("dohboy-admin-token");
+    document.getElementById("error").textContent = "bad admin token";
+    return;
+  }
+  const stats = await resp.json();
+  document.getElementById("error").textContent = "";
+
+  document.getElementById("queries").textContent = stats.queries;
+  document.getElementById("blocked").textContent = stats.blocked;
+  fillTable("rcodes", Object.entries(stats.rcodes).sort((a, b) => b[1] - a[1]));
+  fillTable("top-domains", stats.top_domains.map(r => [r.key, r.count]));
+  fillTable("top-blocked", stats.top_blocked.map(r => [r.key, r.count]));
+  fillTable("top-clients", stats.top_clients.map(r => [r.key, r.count]));
+
+  drawLines("qps", [{points: stats.series.map(p => ({t: Date.parse(p.time), v: p.qps}))}]);
+
+  const names = Object.keys(stats.upstream_latency).sort();
+  drawLines("latency", names.map(name => ({
+    points: stats.upstream_latency[name].map(p => ({t: Date.parse(p.time), v: p.avg_ms})),
+  })));
+  fillTable("latency-legend", names.map((name, i) => {
+    const points = stats.upstream_latency[name];
+    return ["■ " + name, points.length ? points[points.length - 1].avg_ms.toFixed(1) : "-"];
+  }));
+  names.forEach((name, i) => {
+    document.getElementById("latency-legend").rows[i].cells[0].style.color = colors[i % colors.length];
+  });
+}
+
+document.getElementById("window").addEventListener("change", refresh);
+document.getElementById("logout").addEventListener("click", () => {
+  sessionStorage.removeItem("dohboy-admin-token");
+  location.reload();
+});
+refresh();
+setInterval(refresh, 10000);
+</script>
+</body>
+</html>
+`
+
+func serveDashboard(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	response.Write([]byte(dashboardHTML))
+}
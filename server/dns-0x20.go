@@ -0,0 +1,35 @@
+package dohboy
+
+import (
+	"crypto/rand"
+
+	"github.com/miekg/dns"
+)
+
+// randomizeQuestionCase returns a copy of the query with the letters of its
+// question name randomly upper or lower cased. Servers echo the name as they
+// got it, so a spoofed response has to guess the case on top of the ID and
+// source port.
+func randomizeQuestionCase(dnsQuery *dns.Msg) *dns.Msg {
+	query := dnsQuery.Copy()
+
+	for i := range query.Question {
+		name := []byte(query.Question[i].Name)
+		coins := make([]byte, len(name))
+		rand.Read(coins)
+
+		for j, c := range name {
+			if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+				if coins[j]&1 == 0 {
+					c |= 0x20
+				} else {
+					c &^= 0x20
+				}
+				name[j] = c
+			}
+		}
+		query.Question[i].Name = string(name)
+	}
+
+	return query
+}
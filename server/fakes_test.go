@@ -0,0 +1,482 @@
+package dohboy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeDNSServer is an in-process DNS server answering on the same port over
+// both udp and tcp.
+type fakeDNSServer struct {
+	address string
+	handler func(network string, query *dns.Msg) *dns.Msg
+
+	mu      sync.Mutex
+	queries map[string]int // by network
+}
+
+// startFakeDNSServer starts a fake DNS server that answers every query with
+// whatever handler returns. A nil return drops the query.
+func startFakeDNSServer(t *testing.T, handler func(network string, query *dns.Msg) *dns.Msg) *fakeDNSServer {
+	t.Helper()
+	fake := &fakeDNSServer{handler: handler, queries: map[string]int{}}
+
+	var packetConn net.PacketConn
+	var listener net.Listener
+	for attempt := 0; attempt < 10 && listener == nil; attempt++ {
+		var err error
+		if packetConn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatalf("Could not listen on udp: %v", err)
+		}
+		if listener, err = net.Listen("tcp", packetConn.LocalAddr().String()); err != nil {
+			// Someone else has the tcp port; try another one.
+			packetConn.Close()
+		}
+	}
+	if listener == nil {
+		t.Fatalf("Could not find a free port for both udp and tcp.")
+	}
+	fake.address = packetConn.LocalAddr().String()
+
+	servers := []*dns.Server{
+		{PacketConn: packetConn, Handler: dns.HandlerFunc(fake.serve("udp"))},
+		{Listener: listener, Handler: dns.HandlerFunc(fake.serve("tcp"))},
+	}
+	for _, server := range servers {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go server.ActivateAndServe()
+		<-started
+	}
+
+	t.Cleanup(func() {
+		for _, server := range servers {
+			server.Shutdown()
+		}
+	})
+	return fake
+}
+
+func (fake *fakeDNSServer) serve(network string) func(dns.ResponseWriter, *dns.Msg) {
+	return func(writer dns.ResponseWriter, query *dns.Msg) {
+		fake.mu.Lock()
+		fake.queries[network]++
+		fake.mu.Unlock()
+
+		if resp := fake.handler(network, query); resp != nil {
+			writer.WriteMsg(resp)
+		}
+	}
+}
+
+func (fake *fakeDNSServer) queryCount(network string) int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.queries[network]
+}
+
+// fakeDoHServer is an in-process DoH server taking queries by GET and POST.
+type fakeDoHServer struct {
+	*httptest.Server
+	handler func(query *dns.Msg) *dns.Msg
+
+	mu      sync.Mutex
+	methods []string
+}
+
+// startFakeDoHServer starts a fake DoH server over https that answers every
+// query with whatever handler returns. A nil return fails the request with a
+// 502.
+func startFakeDoHServer(t *testing.T, handler func(query *dns.Msg) *dns.Msg) *fakeDoHServer {
+	t.Helper()
+	fake := &fakeDoHServer{handler: handler}
+	fake.Server = httptest.NewTLSServer(http.HandlerFunc(fake.serveHTTP))
+	t.Cleanup(fake.Server.Close)
+	return fake
+}
+
+func (fake *fakeDoHServer) serveHTTP(response http.ResponseWriter, request *http.Request) {
+	fake.mu.Lock()
+	fake.methods = append(fake.methods, request.Method)
+	fake.mu.Unlock()
+
+	var wireFormat []byte
+	var err error
+	if request.Method == http.MethodGet {
+		wireFormat, err = base64.RawURLEncoding.DecodeString(request.URL.Query().Get("dns"))
+	} else {
+		wireFormat, err = ioutil.ReadAll(request.Body)
+	}
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := new(dns.Msg)
+	if err := query.Unpack(wireFormat); err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := fake.handler(query)
+	if resp == nil {
+		http.Error(response, "no answer", http.StatusBadGateway)
+		return
+	}
+
+	packed, err := resp.Pack()
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "application/dns-message")
+	response.Write(packed)
+}
+
+// upstream creates a DoH upstream for the fake server, trusting its
+// certificate.
+func (fake *fakeDoHServer) upstream(t *testing.T) upstream {
+	t.Helper()
+	us, err := createDnsOverHttpsUpstream(fake.URL+"/dns-query", time.Second, HttpTransportConfig{}, BootstrapConfig{})
+	if err != nil {
+		t.Fatalf("Could not create DoH upstream: %v", err)
+	}
+	client := fake.Client()
+	client.Timeout = time.Second
+	us.(*dnsOverHttpsUpstream).httpClient = client
+	return us
+}
+
+// fakeRedisServer is an in-process server speaking enough of RESP for the
+// redis backends: AUTH, SELECT, GET, SET (with PX), INCRBY, DECRBY, PEXPIRE,
+// PTTL, DEL, SCAN (with MATCH, two keys per page) and MULTI/EXEC.
+type fakeRedisServer struct {
+	address  string
+	password string
+	listener net.Listener
+
+	mu    sync.Mutex
+	data  map[string]fakeRedisValue
+	conns []net.Conn
+	dials int
+	// Error reply for every command but AUTH, if set.
+	failWith string
+	// Commands to run before dropping the connection instead of replying.
+	dropReplies int
+}
+
+type fakeRedisValue struct {
+	value   string
+	expires time.Time // zero for never
+}
+
+func startFakeRedisServer(t *testing.T, password string) *fakeRedisServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+
+	fake := &fakeRedisServer{
+		address:  listener.Addr().String(),
+		password: password,
+		listener: listener,
+		data:     map[string]fakeRedisValue{},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fake.mu.Lock()
+			fake.conns = append(fake.conns, conn)
+			fake.dials++
+			fake.mu.Unlock()
+			go fake.serveConn(conn)
+		}
+	}()
+
+	t.Cleanup(func() {
+		listener.Close()
+		fake.dropConnections()
+	})
+	return fake
+}
+
+// client creates a redis client for the fake server.
+func (fake *fakeRedisServer) client(db int) *redisClient {
+	return newRedisClient(&RedisConfig{Address: fake.address, Password: fake.password, DB: db, TimeoutMillis: 1000, MaxIdleConns: 2})
+}
+
+// dropConnections closes every open connection, as a restarting server would.
+func (fake *fakeRedisServer) dropConnections() {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, conn := range fake.conns {
+		conn.Close()
+	}
+	fake.conns = nil
+}
+
+// dropNextReplies has the server run the next n commands but drop the
+// connection instead of replying to them.
+func (fake *fakeRedisServer) dropNextReplies(n int) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.dropReplies = n
+}
+
+func (fake *fakeRedisServer) dialCount() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.dials
+}
+
+func (fake *fakeRedisServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := fake.password == ""
+	var queued [][]string // nil outside MULTI
+
+	for {
+		request, err := readRedisReply(reader)
+		parts, ok := request.([]interface{})
+		if err != nil || !ok || len(parts) == 0 {
+			return
+		}
+		args := make([]string, len(parts))
+		for i, part := range parts {
+			bytes, _ := part.([]byte)
+			args[i] = string(bytes)
+		}
+
+		var reply string
+		switch {
+		case strings.ToUpper(args[0]) == "AUTH":
+			authenticated = len(args) == 2 && args[1] == fake.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case strings.ToUpper(args[0]) == "MULTI":
+			queued = [][]string{}
+			reply = "+OK\r\n"
+		case strings.ToUpper(args[0]) == "EXEC" && queued != nil:
+			reply = fmt.Sprintf("*%v\r\n", len(queued))
+			for _, command := range queued {
+				reply += fake.execute(command)
+			}
+			queued = nil
+		case queued != nil:
+			queued = append(queued, args)
+			reply = "+QUEUED\r\n"
+		default:
+			reply = fake.execute(args)
+		}
+
+		fake.mu.Lock()
+		drop := fake.dropReplies > 0 && queued == nil
+		if drop {
+			fake.dropReplies--
+		}
+		fake.mu.Unlock()
+		if drop {
+			return
+		}
+
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (fake *fakeRedisServer) execute(args []string) string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if fake.failWith != "" {
+		return "-" + fake.failWith + "\r\n"
+	}
+
+	now := time.Now()
+	for key, value := range fake.data {
+		if !value.expires.IsZero() && !now.Before(value.expires) {
+			delete(fake.data, key)
+		}
+	}
+
+	bulk := func(s string) string { return fmt.Sprintf("$%v\r\n%v\r\n", len(s), s) }
+	integer := func(n int64) string { return fmt.Sprintf(":%v\r\n", n) }
+
+	switch command := strings.ToUpper(args[0]); {
+	case command == "SELECT":
+		return "+OK\r\n"
+
+	case command == "GET" && len(args) == 2:
+		if value, exists := fake.data[args[1]]; exists {
+			return bulk(value.value)
+		}
+		return "$-1\r\n"
+
+	case command == "SET" && len(args) >= 3:
+		value := fakeRedisValue{value: args[2]}
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			millis, _ := strconv.ParseInt(args[4], 10, 64)
+			value.expires = now.Add(time.Duration(millis) * time.Millisecond)
+		}
+		fake.data[args[1]] = value
+		return "+OK\r\n"
+
+	case (command == "INCRBY" || command == "DECRBY") && len(args) == 3:
+		current, _ := strconv.ParseInt(fake.data[args[1]].value, 10, 64)
+		by, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		if command == "DECRBY" {
+			by = -by
+		}
+		value := fake.data[args[1]]
+		value.value = strconv.FormatInt(current+by, 10)
+		fake.data[args[1]] = value
+		return integer(current + by)
+
+	case command == "PEXPIRE" && len(args) == 3:
+		value, exists := fake.data[args[1]]
+		if !exists {
+			return integer(0)
+		}
+		millis, _ := strconv.ParseInt(args[2], 10, 64)
+		value.expires = now.Add(time.Duration(millis) * time.Millisecond)
+		fake.data[args[1]] = value
+		return integer(1)
+
+	case command == "PTTL" && len(args) == 2:
+		value, exists := fake.data[args[1]]
+		switch {
+		case !exists:
+			return integer(-2)
+		case value.expires.IsZero():
+			return integer(-1)
+		}
+		return integer(int64(value.expires.Sub(now) / time.Millisecond))
+
+	case command == "DEL":
+		deleted := int64(0)
+		for _, key := range args[1:] {
+			if _, exists := fake.data[key]; exists {
+				delete(fake.data, key)
+				deleted++
+			}
+		}
+		return integer(deleted)
+
+	case command == "SCAN" && len(args) >= 2:
+		pattern := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		keys := []string{}
+		for key := range fake.data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		cursor, _ := strconv.Atoi(args[1])
+		next := cursor + 2
+		if next >= len(keys) {
+			next = 0
+		}
+		page := ""
+		count := 0
+		for i := cursor; i < len(keys) && i < cursor+2; i++ {
+			if redisGlobMatch(pattern, keys[i]) {
+				page += bulk(keys[i])
+				count++
+			}
+		}
+		return fmt.Sprintf("*2\r\n%v*%v\r\n%v", bulk(strconv.Itoa(next)), count, page)
+	}
+
+	return fmt.Sprintf("-ERR unknown command '%v'\r\n", args[0])
+}
+
+// redisGlobMatch matches a key against a SCAN pattern, with '*', '?' and
+// backslash escapes.
+func redisGlobMatch(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if redisGlobMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+func newTestQuery(name string, qtype uint16) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+	return query
+}
+
+// replyA answers a query with a single A record.
+func replyA(query *dns.Msg, ip string, ttl uint32) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.RecursionAvailable = true
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP(ip),
+	})
+	return resp
+}
+
+// answeredIP returns the address of the first A record of a response.
+func answeredIP(resp *dns.Msg) string {
+	if resp == nil {
+		return ""
+	}
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+package dohboy
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type filter struct {
+	blocked    *set
+	blockRcode int
+}
+
+func (filter *filter) isBlocked(dnsQuery *dns.Msg) bool {
+	if filter == nil || len(dnsQuery.Question) == 0 {
+		return false
+	}
+
+	return matchesNameOrParent(filter.blocked, dnsQuery.Question[0].Name)
+}
+
+// matchesNameOrParent checks whether the name, or any name it is a subdomain
+// of, is in the set.
+func matchesNameOrParent(names *set, name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	for offset, end := 0, false; !end; offset, end = dns.NextLabel(name, offset) {
+		if names.Contains(name[offset:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (filter *filter) createBlockedResponse(dnsQuery *dns.Msg) *dns.Msg {
+	responseMsg := dns.Msg{}
+	return responseMsg.SetRcode(dnsQuery, filter.blockRcode)
+}
+
+func addName(names *set, name string) {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.HasPrefix(name, "#") {
+		return
+	}
+	names.Add(strings.ToLower(dns.Fqdn(name)))
+}
+
+// readNamesFile adds the names in a file, one per line, to the set. Lines
+// starting with '#' are ignored.
+func readNamesFile(names *set, filepath string) error {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		addName(names, scanner.Text())
+	}
+	return scanner.Err()
+}
+
+func newFilter(config *FilterConfig) (*filter, error) {
+	blocked := newSet()
+
+	for _, name := range config.Blocklist {
+		addName(blocked, name)
+	}
+
+	for _, filepath := range config.BlocklistFiles {
+		if err := readNamesFile(blocked, filepath); err != nil {
+			return nil, err
+		}
+	}
+
+	blockRcode := dns.RcodeNameError
+	if config.BlockResponse == "refused" {
+		blockRcode = dns.RcodeRefused
+	}
+
+	return &filter{
+		blocked:    blocked,
+		blockRcode: blockRcode,
+	}, nil
+}
@@ -0,0 +1,80 @@
+package dohboy
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// errFlightAborted is what callers waiting on a query get if resolving it
+// panicked.
+var errFlightAborted = errors.New("Resolving the query was aborted.")
+
+type flightCall struct {
+	done     chan struct{}
+	resp     *dns.Msg
+	upstream string
+	err      error
+	waiters  int
+}
+
+// flightGroup coalesces identical queries that are in flight at the same
+// time, so that only the first of them goes out to an upstream.
+type flightGroup struct {
+	calls   map[string]*flightCall
+	callsMu sync.Mutex
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		calls: make(map[string]*flightCall),
+	}
+}
+
+// do runs resolve for the first caller with a given key, and has any caller
+// arriving with the same key meanwhile wait for that result instead. Every
+// caller gets its own copy of the response, with the ID and question of its
+// own query, along with the name of the upstream that answered. The returned
+// count is how many callers were coalesced into this one, which only the first
+// caller gets to see. Should resolve panic, the callers waiting on it get
+// errFlightAborted.
+func (group *flightGroup) do(key string, dnsQuery *dns.Msg, resolve func() (*dns.Msg, string, error)) (resp *dns.Msg, upstream string, coalesced int, shared bool, err error) {
+	group.callsMu.Lock()
+	if call, inFlight := group.calls[key]; inFlight {
+		call.waiters++
+		group.callsMu.Unlock()
+
+		<-call.done
+		return copyForQuery(call.resp, dnsQuery), call.upstream, 0, true, call.err
+	}
+
+	call := &flightCall{done: make(chan struct{}), err: errFlightAborted}
+	group.calls[key] = call
+	group.callsMu.Unlock()
+
+	// Deferred so that the call is removed and its waiters released even if
+	// resolve panics.
+	defer func() {
+		group.callsMu.Lock()
+		delete(group.calls, key)
+		coalesced = call.waiters
+		group.callsMu.Unlock()
+
+		close(call.done)
+	}()
+
+	call.resp, call.upstream, call.err = resolve()
+	return copyForQuery(call.resp, dnsQuery), call.upstream, 0, false, call.err
+}
+
+func copyForQuery(resp *dns.Msg, dnsQuery *dns.Msg) *dns.Msg {
+	if resp == nil {
+		return nil
+	}
+
+	retval := resp.Copy()
+	retval.Id = dnsQuery.Id
+	retval.Question = append([]dns.Question(nil), dnsQuery.Question...)
+	return retval
+}
@@ -0,0 +1,180 @@
+package dohboy
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// waitForWaiters waits until the calls in flight have the given number of
+// callers waiting on them in total.
+func waitForWaiters(t *testing.T, group *flightGroup, want int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		group.callsMu.Lock()
+		waiters := 0
+		for _, call := range group.calls {
+			waiters += call.waiters
+		}
+		group.callsMu.Unlock()
+
+		if waiters == want {
+			return
+		}
+	}
+	t.Fatalf("Gave up waiting for %v callers to join the flight.", want)
+}
+
+func TestFlightGroup(t *testing.T) {
+	const callers = 5
+	group := newFlightGroup()
+	release := make(chan struct{})
+	var resolved int32
+
+	type result struct {
+		query     *dns.Msg
+		resp      *dns.Msg
+		coalesced int
+		shared    bool
+		err       error
+	}
+	results := make(chan result, callers)
+
+	resolve := func() (*dns.Msg, string, error) {
+		atomic.AddInt32(&resolved, 1)
+		<-release
+		return replyA(newTestQuery("www.example.com.", dns.TypeA), "192.0.2.1", 300), "dns.example", nil
+	}
+	run := func(query *dns.Msg) {
+		resp, _, coalesced, shared, err := group.do("www.example.com.", query, resolve)
+		results <- result{query, resp, coalesced, shared, err}
+	}
+
+	go run(newTestQuery("www.example.com.", dns.TypeA))
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&resolved) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("resolve never ran")
+		}
+	}
+	for i := 1; i < callers; i++ {
+		go run(newTestQuery("www.example.com.", dns.TypeA))
+	}
+	waitForWaiters(t, group, callers-1)
+	close(release)
+
+	ids := map[uint16]bool{}
+	for i := 0; i < callers; i++ {
+		got := <-results
+		if got.err != nil {
+			t.Fatalf("Unexpected error: %v", got.err)
+		}
+		if got.resp.Id != got.query.Id || answeredIP(got.resp) != "192.0.2.1" {
+			t.Errorf("response = %v, want the answer with ID %v", got.resp, got.query.Id)
+		}
+		ids[got.resp.Id] = true
+
+		if !got.shared && got.coalesced != callers-1 {
+			t.Errorf("first caller: coalesced = %v, want %v", got.coalesced, callers-1)
+		} else if got.shared && got.coalesced != 0 {
+			t.Errorf("waiting caller: coalesced = %v, want 0", got.coalesced)
+		}
+	}
+
+	if got := atomic.LoadInt32(&resolved); got != 1 {
+		t.Errorf("resolved %v times, want once", got)
+	}
+	if len(ids) != callers {
+		t.Errorf("callers got %v distinct IDs, want %v", len(ids), callers)
+	}
+	if len(group.calls) != 0 {
+		t.Errorf("%v calls left in flight", len(group.calls))
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	group := newFlightGroup()
+	query := newTestQuery("www.example.com.", dns.TypeA)
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		group.do("www.example.com.", query, func() (*dns.Msg, string, error) {
+			close(started)
+			<-release
+			panic("upstream went wrong")
+		})
+	}()
+
+	<-started
+	waited := make(chan error)
+	go func() {
+		_, _, _, _, err := group.do("www.example.com.", query, func() (*dns.Msg, string, error) {
+			t.Errorf("a waiting caller resolved the query")
+			return nil, "", nil
+		})
+		waited <- err
+	}()
+	waitForWaiters(t, group, 1)
+	close(release)
+
+	if recovered := <-panicked; recovered == nil {
+		t.Errorf("the panic didn't reach the first caller")
+	}
+	select {
+	case err := <-waited:
+		if err != errFlightAborted {
+			t.Errorf("err = %v, want %v", err, errFlightAborted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the waiting caller was never released")
+	}
+
+	resp, _, _, shared, err := group.do("www.example.com.", query, func() (*dns.Msg, string, error) {
+		return replyA(query, "192.0.2.1", 300), "dns.example", nil
+	})
+	if err != nil || shared || answeredIP(resp) != "192.0.2.1" {
+		t.Errorf("do = %v, %v, %v, want the query resolved anew", resp, shared, err)
+	}
+}
+
+func TestRelayCoalescesIdenticalQueries(t *testing.T) {
+	const callers = 5
+	release := make(chan struct{})
+	fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		<-release
+		return replyA(query, "192.0.2.1", 300)
+	})
+	upstream := dnsUpstreamConfig("", fake.address)
+	upstream.TimeoutMillis = 5000
+	relay := newTestRelay(UpstreamSettings{Default: DefaultUpstreamSettings{Enabled: true, Upstreams: []UpstreamConfig{upstream}}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			query := newTestQuery("www.example.com.", dns.TypeA)
+			resp, err := relay.resolveDNSQuery(query, queryClient{})
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			if resp.Id != query.Id || answeredIP(resp) != "192.0.2.1" {
+				t.Errorf("response = %v, want the answer with ID %v", resp, query.Id)
+			}
+		}()
+	}
+
+	waitForWaiters(t, relay.flights, callers-1)
+	close(release)
+	wg.Wait()
+
+	if got := fake.queryCount("udp") + fake.queryCount("tcp"); got != 1 {
+		t.Errorf("upstream got %v queries, want a single exchange", got)
+	}
+}
@@ -0,0 +1,162 @@
+package dohboy
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const limiterStoreShards = 32
+
+type limiterEntry struct {
+	key      string
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// limiterShard keeps its entries in LRU order, most recently used at the
+// front, so that both capacity and idle eviction only ever touch the back.
+type limiterShard struct {
+	entries  map[string]*list.Element
+	lru      *list.List
+	capacity int
+	mu       sync.Mutex
+}
+
+// limiterStore tracks the rate.Limiter for each key, spread across shards so
+// that concurrent requests rarely contend on the same lock. Keys that go idle
+// are evicted in the background, and each shard holds a bounded number of
+// keys, dropping the least recently used when full.
+type limiterStore struct {
+	shards      []*limiterShard
+	newLimiter  func() *rate.Limiter
+	idleTimeout time.Duration
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+func (store *limiterStore) shardFor(key string) *limiterShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return store.shards[hash.Sum32()%uint32(len(store.shards))]
+}
+
+func (store *limiterStore) get(key string) *rate.Limiter {
+	shard := store.shardFor(key)
+	now := time.Now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if element, exists := shard.entries[key]; exists {
+		entry := element.Value.(*limiterEntry)
+		entry.lastSeen = now
+		shard.lru.MoveToFront(element)
+		return entry.limiter
+	}
+
+	for shard.lru.Len() >= shard.capacity {
+		oldest := shard.lru.Back()
+		shard.lru.Remove(oldest)
+		delete(shard.entries, oldest.Value.(*limiterEntry).key)
+	}
+
+	entry := &limiterEntry{key: key, limiter: store.newLimiter(), lastSeen: now}
+	shard.entries[key] = shard.lru.PushFront(entry)
+	return entry.limiter
+}
+
+func (store *limiterStore) evictIdle(now time.Time) {
+	for _, shard := range store.shards {
+		shard.mu.Lock()
+		for element := shard.lru.Back(); element != nil; element = shard.lru.Back() {
+			entry := element.Value.(*limiterEntry)
+			if now.Sub(entry.lastSeen) < store.idleTimeout {
+				break
+			}
+			shard.lru.Remove(element)
+			delete(shard.entries, entry.key)
+		}
+		shard.mu.Unlock()
+	}
+}
+
+func (store *limiterStore) len() int {
+	total := 0
+	for _, shard := range store.shards {
+		shard.mu.Lock()
+		total += shard.lru.Len()
+		shard.mu.Unlock()
+	}
+	return total
+}
+
+func (store *limiterStore) runEvictions() {
+	ticker := time.NewTicker(store.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			store.evictIdle(now)
+		case <-store.stop:
+			return
+		}
+	}
+}
+
+func (store *limiterStore) close() {
+	store.stopOnce.Do(func() { close(store.stop) })
+}
+
+// newLimiterStore creates a store and starts its background eviction. The
+// idle timeout is never shorter than the time a bucket takes to refill, since
+// evicting a bucket hands the client a full one on its next request.
+func newLimiterStore(newLimiter func() *rate.Limiter, maxKeys int, idleTimeout time.Duration, refillTime time.Duration) *limiterStore {
+	if idleTimeout < refillTime {
+		idleTimeout = refillTime
+	}
+	if idleTimeout < time.Second {
+		idleTimeout = time.Second
+	}
+
+	perShard := maxKeys / limiterStoreShards
+	if perShard < 1 {
+		perShard = 1
+	}
+
+	shards := make([]*limiterShard, limiterStoreShards)
+	for i := range shards {
+		shards[i] = &limiterShard{
+			entries:  make(map[string]*list.Element),
+			lru:      list.New(),
+			capacity: perShard,
+		}
+	}
+
+	store := &limiterStore{
+		shards:      shards,
+		newLimiter:  newLimiter,
+		idleTimeout: idleTimeout,
+		stop:        make(chan struct{}),
+	}
+	go store.runEvictions()
+	return store
+}
+
+// peek returns the limiter for a key without creating one or counting it as
+// a use.
+func (store *limiterStore) peek(key string) (*rate.Limiter, bool) {
+	shard := store.shardFor(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if element, exists := shard.entries[key]; exists {
+		return element.Value.(*limiterEntry).limiter, true
+	}
+	return nil, false
+}
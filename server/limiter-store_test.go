@@ -0,0 +1,152 @@
+package dohboy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func newTestLimiterStore(t *testing.T, maxKeys int) *limiterStore {
+	t.Helper()
+	store := newLimiterStore(func() *rate.Limiter { return rate.NewLimiter(1, 1) }, maxKeys, time.Minute, time.Second)
+	t.Cleanup(store.close)
+	return store
+}
+
+// keysInShard returns count keys that all land in the same shard.
+func keysInShard(store *limiterStore, count int) []string {
+	keys := []string{}
+	shard := store.shardFor("key-0")
+	for i := 0; len(keys) < count; i++ {
+		if key := fmt.Sprintf("key-%v", i); store.shardFor(key) == shard {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestLimiterStoreGet(t *testing.T) {
+	store := newTestLimiterStore(t, 100)
+
+	if _, found := store.peek("198.51.100.1"); found {
+		t.Errorf("found a limiter before any request")
+	}
+	limiter := store.get("198.51.100.1")
+	if store.get("198.51.100.1") != limiter {
+		t.Errorf("got a new limiter for a known key")
+	}
+	if peeked, found := store.peek("198.51.100.1"); !found || peeked != limiter {
+		t.Errorf("peek = %v, %v, want the key's limiter", peeked, found)
+	}
+	if store.len() != 1 {
+		t.Errorf("len = %v, want 1", store.len())
+	}
+}
+
+func TestLimiterStoreCapacity(t *testing.T) {
+	store := newTestLimiterStore(t, 2*limiterStoreShards)
+
+	keys := keysInShard(store, 3)
+	store.get(keys[0])
+	store.get(keys[1])
+	store.get(keys[0])
+	store.get(keys[2])
+
+	if _, found := store.peek(keys[1]); found {
+		t.Errorf("kept the least recently used key of a full shard")
+	}
+	for _, key := range []string{keys[0], keys[2]} {
+		if _, found := store.peek(key); !found {
+			t.Errorf("evicted %v", key)
+		}
+	}
+
+	for i := 0; i < 10*limiterStoreShards; i++ {
+		store.get(fmt.Sprintf("198.51.100.%v", i))
+	}
+	if got := store.len(); got > 2*limiterStoreShards {
+		t.Errorf("len = %v, want at most %v", got, 2*limiterStoreShards)
+	}
+	for _, shard := range store.shards {
+		if len(shard.entries) != shard.lru.Len() || shard.lru.Len() > shard.capacity {
+			t.Errorf("shard holds %v entries in a list of %v, want at most %v", len(shard.entries), shard.lru.Len(), shard.capacity)
+		}
+	}
+}
+
+func TestLimiterStoreEvictIdle(t *testing.T) {
+	store := newTestLimiterStore(t, 10000)
+
+	idle := []string{}
+	for i := 0; i < 4*limiterStoreShards; i++ {
+		key := fmt.Sprintf("idle-%v", i)
+		idle = append(idle, key)
+		store.get(key)
+	}
+	for _, shard := range store.shards {
+		shard.mu.Lock()
+		for element := shard.lru.Front(); element != nil; element = element.Next() {
+			element.Value.(*limiterEntry).lastSeen = time.Now().Add(-2 * store.idleTimeout)
+		}
+		shard.mu.Unlock()
+	}
+
+	active := []string{}
+	for i := 0; i < 4*limiterStoreShards; i++ {
+		key := fmt.Sprintf("active-%v", i)
+		active = append(active, key)
+		store.get(key)
+	}
+	// Using an idle key again makes it active.
+	store.get(idle[0])
+
+	store.evictIdle(time.Now())
+
+	for _, key := range idle[1:] {
+		if _, found := store.peek(key); found {
+			t.Errorf("kept idle key %v", key)
+		}
+	}
+	for _, key := range append(active, idle[0]) {
+		if _, found := store.peek(key); !found {
+			t.Errorf("evicted active key %v", key)
+		}
+	}
+	if got, want := store.len(), len(active)+1; got != want {
+		t.Errorf("len = %v, want %v", got, want)
+	}
+}
+
+func TestNewLimiterStore(t *testing.T) {
+	newLimiter := func() *rate.Limiter { return rate.NewLimiter(1, 1) }
+
+	tests := []struct {
+		name         string
+		maxKeys      int
+		idleTimeout  time.Duration
+		refillTime   time.Duration
+		wantIdle     time.Duration
+		wantPerShard int
+	}{
+		{name: "as configured", maxKeys: 64 * limiterStoreShards, idleTimeout: time.Minute, refillTime: time.Second, wantIdle: time.Minute, wantPerShard: 64},
+		{name: "idle timeout under the refill time", maxKeys: 100, idleTimeout: time.Second, refillTime: time.Hour, wantIdle: time.Hour, wantPerShard: 100 / limiterStoreShards},
+		{name: "idle timeout under a second", maxKeys: 100, wantIdle: time.Second, wantPerShard: 100 / limiterStoreShards},
+		{name: "fewer keys than shards", maxKeys: 1, idleTimeout: time.Minute, wantIdle: time.Minute, wantPerShard: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newLimiterStore(newLimiter, test.maxKeys, test.idleTimeout, test.refillTime)
+			defer store.close()
+
+			if store.idleTimeout != test.wantIdle {
+				t.Errorf("idle timeout = %v, want %v", store.idleTimeout, test.wantIdle)
+			}
+			if capacity := store.shards[0].capacity; capacity != test.wantPerShard {
+				t.Errorf("capacity per shard = %v, want %v", capacity, test.wantPerShard)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package dohboy
+
+import (
+	"sync"
+)
+
+// metrics holds simple counters, keyed by metric name and then by label
+// (e.g. a client label or an endpoint path).
+type metrics struct {
+	counters   map[string]map[string]uint64
+	countersMu sync.Mutex
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		counters: make(map[string]map[string]uint64),
+	}
+}
+
+func (m *metrics) incr(name string, label string) {
+	m.add(name, label, 1)
+}
+
+func (m *metrics) add(name string, label string, delta uint64) {
+	m.countersMu.Lock()
+	defer m.countersMu.Unlock()
+
+	byLabel, exists := m.counters[name]
+	if !exists {
+		byLabel = make(map[string]uint64)
+		m.counters[name] = byLabel
+	}
+	byLabel[label] += delta
+}
+
+func (m *metrics) snapshot() map[string]map[string]uint64 {
+	m.countersMu.Lock()
+	defer m.countersMu.Unlock()
+
+	retval := make(map[string]map[string]uint64, len(m.counters))
+	for name, byLabel := range m.counters {
+		copied := make(map[string]uint64, len(byLabel))
+		for label, count := range byLabel {
+			copied[label] = count
+		}
+		retval[name] = copied
+	}
+	return retval
+}
@@ -0,0 +1,148 @@
+package dohboy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// postProcessor reworks the responses of an upstream before they're cached
+// and handed out.
+type postProcessor struct {
+	sortNetworks      cidrList // A/AAAA answers in earlier networks go first
+	filterAAAAClients cidrList
+	minimal           bool
+	ttl               ttlBounds
+	negativeTTL       ttlBounds // for the SOA of negative responses
+}
+
+// newPostProcessor returns nil if the config doesn't ask for any processing.
+func newPostProcessor(config *PostProcessConfig) (*postProcessor, error) {
+	sortNetworks, err := parseCIDRs(config.SortPreference)
+	if err != nil {
+		return nil, err
+	}
+
+	filterAAAAClients, err := parseCIDRs(config.FilterAAAAClients)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := ttlBounds{min: config.MinTTL, max: config.MaxTTL}
+	negativeTTL := ttlBounds{min: config.MinNegativeTTL, max: config.MaxNegativeTTL}
+	for _, bounds := range []ttlBounds{ttl, negativeTTL} {
+		if bounds.max != 0 && bounds.min > bounds.max {
+			return nil, fmt.Errorf("Minimum TTL [%v] is above the maximum TTL [%v].", bounds.min, bounds.max)
+		}
+	}
+
+	if len(sortNetworks) == 0 && len(filterAAAAClients) == 0 && !config.MinimalResponses &&
+		!ttl.isSet() && !negativeTTL.isSet() {
+		return nil, nil
+	}
+
+	return &postProcessor{
+		sortNetworks:      sortNetworks,
+		filterAAAAClients: filterAAAAClients,
+		minimal:           config.MinimalResponses,
+		ttl:               ttl,
+		negativeTTL:       negativeTTL,
+	}, nil
+}
+
+// process applies the processing that's the same for every client, so its
+// result can be cached.
+func (pp *postProcessor) process(resp *dns.Msg) {
+	if pp == nil || resp == nil {
+		return
+	}
+
+	if len(pp.sortNetworks) > 0 {
+		pp.sortAddresses(resp.Answer)
+	}
+
+	if pp.minimal {
+		// Negative answers keep their authority section, which holds the SOA
+		// they're cached by.
+		if len(resp.Answer) > 0 {
+			resp.Ns = nil
+		}
+		resp.Extra = onlyOPT(resp.Extra)
+	}
+
+	if pp.ttl.isSet() || pp.negativeTTL.isSet() {
+		clampTTLs(resp, pp.ttl, pp.negativeTTL)
+	}
+}
+
+// processForClient applies the processing that depends on who's asking.
+// Clients on IPv4-only networks get no AAAA records, so they don't go trying
+// addresses they can't reach.
+func (pp *postProcessor) processForClient(resp *dns.Msg, client queryClient) {
+	if pp == nil || resp == nil || !pp.filterAAAAClients.contains(client.ip) {
+		return
+	}
+
+	withoutAAAA := func(rrs []dns.RR) []dns.RR {
+		retval := rrs[:0]
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeAAAA {
+				retval = append(retval, rr)
+			}
+		}
+		return retval
+	}
+
+	resp.Answer = withoutAAAA(resp.Answer)
+	resp.Extra = withoutAAAA(resp.Extra)
+}
+
+// sortAddresses reorders the A and AAAA records by the network they're in,
+// leaving every other record where it is.
+func (pp *postProcessor) sortAddresses(rrs []dns.RR) {
+	positions := []int{}
+	addresses := []dns.RR{}
+	for i, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeA || rr.Header().Rrtype == dns.TypeAAAA {
+			positions = append(positions, i)
+			addresses = append(addresses, rr)
+		}
+	}
+
+	sort.SliceStable(addresses, func(i, j int) bool {
+		return pp.preference(addresses[i]) < pp.preference(addresses[j])
+	})
+
+	for i, position := range positions {
+		rrs[position] = addresses[i]
+	}
+}
+
+func (pp *postProcessor) preference(rr dns.RR) int {
+	var ip net.IP
+	switch record := rr.(type) {
+	case *dns.A:
+		ip = record.A
+	case *dns.AAAA:
+		ip = record.AAAA
+	}
+
+	for i, network := range pp.sortNetworks {
+		if network.Contains(ip) {
+			return i
+		}
+	}
+	return len(pp.sortNetworks)
+}
+
+func onlyOPT(rrs []dns.RR) []dns.RR {
+	retval := rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			retval = append(retval, rr)
+		}
+	}
+	return retval
+}
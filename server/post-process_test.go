@@ -0,0 +1,163 @@
+package dohboy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// rrSummaries lists the records as "TYPE data", leaving out OPT records.
+func rrSummaries(rrs []dns.RR) []string {
+	retval := []string{}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		fields := strings.Fields(rr.String())
+		retval = append(retval, strings.Join(fields[3:], " "))
+	}
+	return retval
+}
+
+func newTestPostProcessor(t *testing.T, config PostProcessConfig) *postProcessor {
+	t.Helper()
+	pp, err := newPostProcessor(&config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return pp
+}
+
+func TestSortAddresses(t *testing.T) {
+	tests := []struct {
+		name       string
+		preference []string
+		answer     []string
+		want       []string
+	}{
+		{
+			name:       "earlier networks first",
+			preference: []string{"192.0.2.0/24", "198.51.100.0/24"},
+			answer: []string{
+				"example.com. 60 IN A 203.0.113.1",
+				"example.com. 60 IN A 198.51.100.1",
+				"example.com. 60 IN A 192.0.2.1",
+			},
+			want: []string{"A 192.0.2.1", "A 198.51.100.1", "A 203.0.113.1"},
+		},
+		{
+			name:       "order kept within a network",
+			preference: []string{"192.0.2.0/24"},
+			answer: []string{
+				"example.com. 60 IN A 203.0.113.2",
+				"example.com. 60 IN A 192.0.2.2",
+				"example.com. 60 IN A 203.0.113.1",
+				"example.com. 60 IN A 192.0.2.1",
+			},
+			want: []string{"A 192.0.2.2", "A 192.0.2.1", "A 203.0.113.2", "A 203.0.113.1"},
+		},
+		{
+			name:       "IPv6 before IPv4",
+			preference: []string{"2001:db8::/32", "192.0.2.0/24"},
+			answer: []string{
+				"example.com. 60 IN A 192.0.2.1",
+				"example.com. 60 IN AAAA 2001:db8::1",
+				"example.com. 60 IN AAAA 2001:db9::1",
+			},
+			want: []string{"AAAA 2001:db8::1", "A 192.0.2.1", "AAAA 2001:db9::1"},
+		},
+		{
+			name:       "other records stay put",
+			preference: []string{"192.0.2.0/24"},
+			answer: []string{
+				"example.com. 60 IN CNAME cdn.example.net.",
+				"cdn.example.net. 60 IN A 203.0.113.1",
+				"cdn.example.net. 60 IN RRSIG A 8 3 60 20300101000000 20200101000000 12345 example.net. AAAA",
+				"cdn.example.net. 60 IN A 192.0.2.1",
+			},
+			want: []string{
+				"CNAME cdn.example.net.",
+				"A 192.0.2.1",
+				"RRSIG A 8 3 60 20300101000000 20200101000000 12345 example.net. AAAA",
+				"A 203.0.113.1",
+			},
+		},
+		{
+			name:       "no address in any network",
+			preference: []string{"192.0.2.0/24"},
+			answer:     []string{"example.com. 60 IN A 203.0.113.2", "example.com. 60 IN A 203.0.113.1"},
+			want:       []string{"A 203.0.113.2", "A 203.0.113.1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pp := newTestPostProcessor(t, PostProcessConfig{SortPreference: test.preference})
+			resp := newTestResponse(t, dns.RcodeSuccess, test.answer, nil, nil)
+			pp.process(resp)
+
+			if got := rrSummaries(resp.Answer); !equalStrings(got, test.want) {
+				t.Errorf("answer = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMinimalResponses(t *testing.T) {
+	const soa = "example.com. 300 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300"
+
+	tests := []struct {
+		name      string
+		rcode     int
+		answer    []string
+		ns        []string
+		extra     []string
+		wantNs    []string
+		wantExtra []string
+	}{
+		{
+			name:      "positive answer",
+			answer:    []string{"example.com. 60 IN A 192.0.2.1"},
+			ns:        []string{"example.com. 3600 IN NS ns.example.com."},
+			extra:     []string{"ns.example.com. 3600 IN A 192.0.2.53"},
+			wantNs:    []string{},
+			wantExtra: []string{},
+		},
+		{
+			name:      "NXDOMAIN keeps its SOA",
+			rcode:     dns.RcodeNameError,
+			ns:        []string{soa},
+			extra:     []string{"ns.example.com. 3600 IN A 192.0.2.53"},
+			wantNs:    []string{"SOA ns.example.com. admin.example.com. 1 3600 600 86400 300"},
+			wantExtra: []string{},
+		},
+		{
+			name:      "NODATA keeps its SOA",
+			ns:        []string{soa},
+			wantNs:    []string{"SOA ns.example.com. admin.example.com. 1 3600 600 86400 300"},
+			wantExtra: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pp := newTestPostProcessor(t, PostProcessConfig{MinimalResponses: true})
+			resp := newTestResponse(t, test.rcode, test.answer, test.ns, test.extra)
+			pp.process(resp)
+
+			if got := rrSummaries(resp.Ns); !equalStrings(got, test.wantNs) {
+				t.Errorf("authority = %v, want %v", got, test.wantNs)
+			}
+			if got := rrSummaries(resp.Extra); !equalStrings(got, test.wantExtra) {
+				t.Errorf("additional = %v, want %v", got, test.wantExtra)
+			}
+			if resp.IsEdns0() == nil {
+				t.Errorf("the OPT record was stripped")
+			}
+			if len(resp.Answer) != len(test.answer) {
+				t.Errorf("answer = %v, want it untouched", resp.Answer)
+			}
+		})
+	}
+}
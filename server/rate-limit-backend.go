@@ -0,0 +1,137 @@
+package dohboy
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// bucketRef names a single rate-limit bucket: a family of buckets (e.g. one
+// per client network) and the key within it.
+type bucketRef struct {
+	family string
+	key    string
+	limits BucketConfig
+}
+
+// rateLimitBackend holds the state of rate-limit buckets.
+type rateLimitBackend interface {
+	// take charges cost to every given bucket. Unless forced, it's all or
+	// nothing: if any bucket can't cover the cost, none are charged and the
+	// returned duration is how long until they could be.
+	take(buckets []bucketRef, cost int, force bool) (bool, time.Duration)
+	// peek reports the tokens left in a bucket, if the bucket is being tracked.
+	peek(bucket bucketRef) (float64, bool)
+	close()
+}
+
+// memoryRateLimitBackend keeps token buckets in process, one limiterStore per
+// bucket family.
+type memoryRateLimitBackend struct {
+	stores              map[string]*limiterStore
+	storesMu            sync.Mutex
+	maxKeys             int
+	idleEvictionSeconds int
+}
+
+func newMemoryRateLimitBackend(maxKeys int, idleEvictionSeconds int) *memoryRateLimitBackend {
+	return &memoryRateLimitBackend{
+		stores:              make(map[string]*limiterStore),
+		maxKeys:             maxKeys,
+		idleEvictionSeconds: idleEvictionSeconds,
+	}
+}
+
+func (backend *memoryRateLimitBackend) storeFor(family string, limits BucketConfig) *limiterStore {
+	backend.storesMu.Lock()
+	defer backend.storesMu.Unlock()
+
+	store, exists := backend.stores[family]
+	if !exists {
+		store = newBucketStore(&limits, backend.maxKeys, backend.idleEvictionSeconds)
+		backend.stores[family] = store
+	}
+	return store
+}
+
+func (backend *memoryRateLimitBackend) take(buckets []bucketRef, cost int, force bool) (bool, time.Duration) {
+	now := time.Now()
+	reservations := make([]*rate.Reservation, 0, len(buckets))
+	wait := time.Duration(0)
+
+	for _, bucket := range buckets {
+		limiter := backend.storeFor(bucket.family, bucket.limits).get(bucket.key)
+		reservation := limiter.ReserveN(now, clampCost(bucket.limits, cost))
+		reservations = append(reservations, reservation)
+		if !reservation.OK() {
+			wait = rate.InfDuration
+		} else if delay := reservation.DelayFrom(now); delay > wait {
+			wait = delay
+		}
+	}
+
+	if wait == 0 || force {
+		return true, 0
+	}
+
+	for _, reservation := range reservations {
+		reservation.CancelAt(now)
+	}
+	return false, wait
+}
+
+func (backend *memoryRateLimitBackend) peek(bucket bucketRef) (float64, bool) {
+	limiter, exists := backend.storeFor(bucket.family, bucket.limits).peek(bucket.key)
+	if !exists {
+		return 0, false
+	}
+
+	// There's no way to read the tokens directly, so work them out from how
+	// long a full bucket's worth would take.
+	now := time.Now()
+	reservation := limiter.ReserveN(now, limiter.Burst())
+	defer reservation.CancelAt(now)
+
+	if !reservation.OK() {
+		return 0, true
+	}
+	return float64(limiter.Burst()) - reservation.DelayFrom(now).Seconds()*float64(limiter.Limit()), true
+}
+
+func (backend *memoryRateLimitBackend) close() {
+	backend.storesMu.Lock()
+	defer backend.storesMu.Unlock()
+
+	for _, store := range backend.stores {
+		store.close()
+	}
+}
+
+func newBucketStore(config *BucketConfig, maxKeys int, idleEvictionSeconds int) *limiterStore {
+	recoverXTokensPerSec := rate.Limit(config.RecoverXTokensPerSec)
+	maxTokens := config.MaxTokens
+	newLimiter := func() *rate.Limiter {
+		return rate.NewLimiter(recoverXTokensPerSec, maxTokens)
+	}
+
+	idleTimeout := time.Duration(idleEvictionSeconds) * time.Second
+	return newLimiterStore(newLimiter, maxKeys, idleTimeout, config.refillTime())
+}
+
+// refillTime is how long an empty bucket takes to fill back up.
+func (config BucketConfig) refillTime() time.Duration {
+	if config.RecoverXTokensPerSec <= 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(config.MaxTokens) * time.Second / time.Duration(config.RecoverXTokensPerSec)
+}
+
+// clampCost keeps a cost within what a bucket can ever hold, so that an
+// expensive query is slowed down rather than rejected forever.
+func clampCost(limits BucketConfig, cost int) int {
+	if cost > limits.MaxTokens {
+		return limits.MaxTokens
+	}
+	return cost
+}
@@ -2,76 +2,213 @@ package dohboy
 
 import (
 	"net"
-	"net/http"
 	"strings"
-	"sync"
+	"time"
 
-	"golang.org/x/time/rate"
+	"github.com/miekg/dns"
 )
 
+// rateLimitClient identifies who a request is charged to.
+type rateLimitClient struct {
+	ip      string
+	userKey string // token supplied with the request, if any
+	label   string // label of the authenticated client, if any
+}
+
 type rateLimiter interface {
-	please(ip string, userKey string) bool
-	getIP(request *http.Request) string
+	// please takes cost tokens from every bucket the client is charged to. If
+	// any of them can't cover it, nothing is taken and the returned duration
+	// is how long until the request would be allowed.
+	please(client rateLimitClient, cost int) (bool, time.Duration)
+	// pleaseIP is please for the bucket of the client's address alone, for
+	// requests that mustn't drain buckets shared with other clients.
+	pleaseIP(ip string, cost int) (bool, time.Duration)
+	// charge takes cost tokens unconditionally, letting buckets go into debt.
+	charge(client rateLimitClient, cost int)
+	queryCost(dnsQuery *dns.Msg) int
+	responseCost(dnsResponse *dns.Msg) int
+	// inspect reports the state of every bucket the client is charged to.
+	inspect(client rateLimitClient) []bucketStatus
+	close()
+}
+
+type bucketStatus struct {
+	Family    string  `json:"family"`
+	Key       string  `json:"key"`
+	Tracked   bool    `json:"tracked"`
+	Tokens    float64 `json:"tokens"`
+	MaxTokens int     `json:"max_tokens"`
+	Exempt    bool    `json:"exempt"`
 }
 
 type noopRateLimiter struct{}
 
-func (n *noopRateLimiter) please(a string, b string) bool {
-	return true
+func (n *noopRateLimiter) please(a rateLimitClient, b int) (bool, time.Duration) {
+	return true, 0
 }
 
-func (n *noopRateLimiter) getIP(request *http.Request) string {
-	return ""
+func (n *noopRateLimiter) pleaseIP(a string, b int) (bool, time.Duration) {
+	return true, 0
+}
+
+func (n *noopRateLimiter) charge(a rateLimitClient, b int) {}
+
+func (n *noopRateLimiter) queryCost(a *dns.Msg) int {
+	return 0
 }
 
+func (n *noopRateLimiter) responseCost(a *dns.Msg) int {
+	return 0
+}
+
+func (n *noopRateLimiter) inspect(a rateLimitClient) []bucketStatus {
+	return []bucketStatus{}
+}
+
+func (n *noopRateLimiter) close() {}
+
 type iPRateLimiter struct {
-	userKeyWhitelist     set
-	ipLimits             map[string]*rate.Limiter
-	ipLimitsMu           sync.RWMutex
-	recoverXTokensPerSec rate.Limit
-	maxTokens            int
-	allowIPFromHeader    bool
+	backend          rateLimitBackend
+	namespace        string // keeps the buckets of different endpoints apart
+	userKeyWhitelist *set
+	ipAllowlist      cidrList
+	ipv4Mask         net.IPMask
+	ipv6Mask         net.IPMask
+	ipLimits         BucketConfig
+	tokenLimits      *BucketConfig // nil unless per-token limits are enabled
+	endpointLimits   *BucketConfig // nil unless per-endpoint limits are enabled
+	qtypeCosts       map[uint16]int
+	nxdomainCost     int
+}
+
+func (rl *iPRateLimiter) isExempt(client rateLimitClient) bool {
+	return rl.userKeyWhitelist.Contains(client.userKey) ||
+		rl.ipAllowlist.contains(net.ParseIP(client.ip))
 }
 
-func (rl *iPRateLimiter) please(ip string, userKey string) bool {
-	if rl.userKeyWhitelist.Contains(userKey) {
-		return true
+// bucketsFor lists every bucket a client is charged to.
+func (rl *iPRateLimiter) bucketsFor(client rateLimitClient) []bucketRef {
+	buckets := []bucketRef{rl.ipBucket(client.ip)}
+
+	if rl.tokenLimits != nil {
+		if key := tokenBucketKey(client); key != "" {
+			buckets = append(buckets, bucketRef{family: rl.namespace + "|token", key: key, limits: *rl.tokenLimits})
+		}
+	}
+
+	if rl.endpointLimits != nil {
+		buckets = append(buckets, bucketRef{family: rl.namespace + "|endpoint", key: "", limits: *rl.endpointLimits})
+	}
+
+	return buckets
+}
+
+func (rl *iPRateLimiter) ipBucket(ip string) bucketRef {
+	return bucketRef{
+		family: rl.namespace + "|ip",
+		key:    rl.bucketKey(net.ParseIP(ip), ip),
+		limits: rl.ipLimits,
 	}
+}
 
-	rl.ipLimitsMu.RLock()
-	limiter, exists := rl.ipLimits[ip]
-	rl.ipLimitsMu.RUnlock()
+func (rl *iPRateLimiter) please(client rateLimitClient, cost int) (bool, time.Duration) {
+	if cost <= 0 || rl.isExempt(client) {
+		return true, 0
+	}
+	return rl.backend.take(rl.bucketsFor(client), cost, false)
+}
 
-	if !exists {
-		limiter = rate.NewLimiter(rl.recoverXTokensPerSec, rl.maxTokens)
-		rl.ipLimitsMu.Lock()
-		rl.ipLimits[ip] = limiter
-		rl.ipLimitsMu.Unlock()
+func (rl *iPRateLimiter) pleaseIP(ip string, cost int) (bool, time.Duration) {
+	if cost <= 0 || rl.isExempt(rateLimitClient{ip: ip}) {
+		return true, 0
 	}
+	return rl.backend.take([]bucketRef{rl.ipBucket(ip)}, cost, false)
+}
 
-	return limiter.Allow()
+func (rl *iPRateLimiter) charge(client rateLimitClient, cost int) {
+	if cost <= 0 || rl.isExempt(client) {
+		return
+	}
+	rl.backend.take(rl.bucketsFor(client), cost, true)
 }
 
-func (rl *iPRateLimiter) getIP(request *http.Request) string {
-	if rl.allowIPFromHeader {
-		for _, key := range []string{"X-Forwarded-For", "X-Real-Ip"} {
-			if val := request.Header.Get(key); val != "" {
-				addrs := strings.Split(strings.Trim(val, ","), ",")
-				last := addrs[len(addrs)-1]
-				if ip := net.ParseIP(last); ip != nil {
-					return ip.String()
-				}
-			}
+func (rl *iPRateLimiter) inspect(client rateLimitClient) []bucketStatus {
+	exempt := rl.isExempt(client)
+
+	retval := []bucketStatus{}
+	for _, bucket := range rl.bucketsFor(client) {
+		tokens, tracked := rl.backend.peek(bucket)
+		if !tracked {
+			tokens = float64(bucket.limits.MaxTokens)
 		}
+		retval = append(retval, bucketStatus{
+			Family:    bucket.family,
+			Key:       bucket.key,
+			Tracked:   tracked,
+			Tokens:    tokens,
+			MaxTokens: bucket.limits.MaxTokens,
+			Exempt:    exempt,
+		})
 	}
+	return retval
+}
+
+func (rl *iPRateLimiter) queryCost(dnsQuery *dns.Msg) int {
+	if dnsQuery == nil || len(dnsQuery.Question) == 0 {
+		return 1
+	}
+
+	// Every question is charged for, since each one can cost an upstream
+	// query of its own.
+	total := 0
+	for _, question := range dnsQuery.Question {
+		if cost, exists := rl.qtypeCosts[question.Qtype]; exists {
+			total += cost
+		} else {
+			total++
+		}
+	}
+	return total
+}
 
-	if ip, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
-		return ip
+func (rl *iPRateLimiter) responseCost(dnsResponse *dns.Msg) int {
+	if dnsResponse != nil && dnsResponse.Rcode == dns.RcodeNameError {
+		return rl.nxdomainCost
+	}
+	return 0
+}
+
+func (rl *iPRateLimiter) close() {
+	rl.backend.close()
+}
+
+func tokenBucketKey(client rateLimitClient) string {
+	if client.label != "" {
+		return "label:" + client.label
+	}
+	if client.userKey != "" {
+		return "token:" + client.userKey
 	}
 	return ""
 }
 
-func toSet(commaSeparated string) set {
+// bucketKey maps a client address onto the network its bucket is tracked
+// under, e.g. 2001:db8:0:ab12::1 -> 2001:db8:0:ab00::/56.
+func (rl *iPRateLimiter) bucketKey(ip net.IP, fallback string) string {
+	if ip == nil {
+		return fallback
+	}
+
+	if ipv4 := ip.To4(); ipv4 != nil {
+		network := net.IPNet{IP: ipv4.Mask(rl.ipv4Mask), Mask: rl.ipv4Mask}
+		return network.String()
+	}
+
+	network := net.IPNet{IP: ip.Mask(rl.ipv6Mask), Mask: rl.ipv6Mask}
+	return network.String()
+}
+
+func toSet(commaSeparated string) *set {
 	retval := newSet()
 
 	if commaSeparated != "" {
@@ -80,20 +217,51 @@ func toSet(commaSeparated string) set {
 		}
 	}
 
-	return *retval
+	return retval
+}
+
+func parseQtypeCosts(costs map[string]int) map[uint16]int {
+	retval := make(map[uint16]int, len(costs))
+	for qtype, cost := range costs {
+		if parsed, exists := dns.StringToType[strings.ToUpper(qtype)]; exists {
+			retval[parsed] = cost
+		}
+	}
+	return retval
 }
 
-func newRateLimiter(config *Config) rateLimiter {
+func newRateLimiter(config *RateLimitConfig, namespace string, backends *backends) rateLimiter {
 
-	if config.IPRateLimit.Enabled == false {
+	if config.Enabled == false {
 		return &noopRateLimiter{}
 	}
 
+	ipAllowlist, _ := parseCIDRs(config.Allowlist)
+
+	var tokenLimits *BucketConfig
+	if config.PerToken.Enabled {
+		tokenLimits = &config.PerToken.BucketConfig
+	}
+
+	var endpointLimits *BucketConfig
+	if config.PerEndpoint.Enabled {
+		endpointLimits = &config.PerEndpoint.BucketConfig
+	}
+
 	return &iPRateLimiter{
-		userKeyWhitelist:     toSet(config.IPRateLimit.KeyWhitelist),
-		ipLimits:             make(map[string]*rate.Limiter),
-		recoverXTokensPerSec: rate.Limit(config.IPRateLimit.RecoverXTokensPerSec),
-		maxTokens:            config.IPRateLimit.MaxTokens,
-		allowIPFromHeader:    config.IPRateLimit.FetchIPFromHeaders,
+		backend:          backends.newRateLimitBackend(config),
+		namespace:        namespace,
+		userKeyWhitelist: toSet(config.KeyWhitelist),
+		ipAllowlist:      ipAllowlist,
+		ipv4Mask:         net.CIDRMask(config.IPv4PrefixLength, 8*net.IPv4len),
+		ipv6Mask:         net.CIDRMask(config.IPv6PrefixLength, 8*net.IPv6len),
+		ipLimits: BucketConfig{
+			RecoverXTokensPerSec: config.RecoverXTokensPerSec,
+			MaxTokens:            config.MaxTokens,
+		},
+		tokenLimits:    tokenLimits,
+		endpointLimits: endpointLimits,
+		qtypeCosts:     parseQtypeCosts(config.QtypeCosts),
+		nxdomainCost:   config.NXDOMAINCost,
 	}
 }
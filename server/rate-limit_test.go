@@ -0,0 +1,177 @@
+package dohboy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newTestRateLimiter(t *testing.T, configure func(config *RateLimitConfig)) *iPRateLimiter {
+	t.Helper()
+	config, err := parseConfigFile("")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	configure(&config.IPRateLimit)
+
+	backends := newBackends(config)
+	limiter := newRateLimiter(&config.IPRateLimit, "/dns-query", backends)
+	t.Cleanup(limiter.close)
+	return limiter.(*iPRateLimiter)
+}
+
+func TestRateLimiterBucketKeys(t *testing.T) {
+	limiter := newTestRateLimiter(t, func(config *RateLimitConfig) {
+		config.IPv4PrefixLength = 24
+		config.IPv6PrefixLength = 56
+	})
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "192.0.2.77", want: "192.0.2.0/24"},
+		{ip: "::ffff:192.0.2.77", want: "192.0.2.0/24"},
+		{ip: "2001:db8:0:ab12::1", want: "2001:db8:0:ab00::/56"},
+		{ip: "not-an-ip", want: "not-an-ip"},
+	}
+
+	for _, test := range tests {
+		buckets := limiter.bucketsFor(rateLimitClient{ip: test.ip})
+		if len(buckets) != 1 || buckets[0].key != test.want {
+			t.Errorf("buckets for %v = %+v, want one keyed %v", test.ip, buckets, test.want)
+		}
+	}
+}
+
+func TestRateLimiterBuckets(t *testing.T) {
+	tests := []struct {
+		name         string
+		configure    func(config *RateLimitConfig)
+		client       rateLimitClient
+		wantFamilies []string
+	}{
+		{
+			name:         "ip only",
+			configure:    func(config *RateLimitConfig) {},
+			client:       rateLimitClient{ip: "192.0.2.1", userKey: "abc"},
+			wantFamilies: []string{"/dns-query|ip"},
+		},
+		{
+			name:         "per token, with a token",
+			configure:    func(config *RateLimitConfig) { config.PerToken.Enabled = true },
+			client:       rateLimitClient{ip: "192.0.2.1", userKey: "abc"},
+			wantFamilies: []string{"/dns-query|ip", "/dns-query|token"},
+		},
+		{
+			name:         "per token, without a token",
+			configure:    func(config *RateLimitConfig) { config.PerToken.Enabled = true },
+			client:       rateLimitClient{ip: "192.0.2.1"},
+			wantFamilies: []string{"/dns-query|ip"},
+		},
+		{
+			name:         "per endpoint",
+			configure:    func(config *RateLimitConfig) { config.PerEndpoint.Enabled = true },
+			client:       rateLimitClient{ip: "192.0.2.1"},
+			wantFamilies: []string{"/dns-query|ip", "/dns-query|endpoint"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buckets := newTestRateLimiter(t, test.configure).bucketsFor(test.client)
+			if len(buckets) != len(test.wantFamilies) {
+				t.Fatalf("buckets = %+v, want families %v", buckets, test.wantFamilies)
+			}
+			for i, bucket := range buckets {
+				if bucket.family != test.wantFamilies[i] {
+					t.Errorf("bucket %v family = %v, want %v", i, bucket.family, test.wantFamilies[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterCosts(t *testing.T) {
+	limiter := newTestRateLimiter(t, func(config *RateLimitConfig) {
+		config.QtypeCosts = map[string]int{"any": 10, "TXT": 3}
+		config.NXDOMAINCost = 2
+	})
+
+	queryCosts := []struct {
+		query *dns.Msg
+		want  int
+	}{
+		{query: newTestQuery("example.com.", dns.TypeA), want: 1},
+		{query: newTestQuery("example.com.", dns.TypeANY), want: 10},
+		{query: newTestQuery("example.com.", dns.TypeTXT), want: 3},
+		{query: &dns.Msg{Question: []dns.Question{
+			{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			{Name: "example.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+			{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+		}}, want: 5},
+		{query: new(dns.Msg), want: 1},
+		{query: nil, want: 1},
+	}
+	for _, test := range queryCosts {
+		if got := limiter.queryCost(test.query); got != test.want {
+			t.Errorf("queryCost(%v) = %v, want %v", test.query, got, test.want)
+		}
+	}
+
+	nxdomain := newTestResponse(t, dns.RcodeNameError, nil, nil, nil)
+	if got := limiter.responseCost(nxdomain); got != 2 {
+		t.Errorf("responseCost(NXDOMAIN) = %v, want 2", got)
+	}
+	noerror := newTestResponse(t, dns.RcodeSuccess, nil, nil, nil)
+	if got := limiter.responseCost(noerror); got != 0 {
+		t.Errorf("responseCost(NOERROR) = %v, want 0", got)
+	}
+}
+
+func TestRateLimiterPleaseAndCharge(t *testing.T) {
+	limiter := newTestRateLimiter(t, func(config *RateLimitConfig) {
+		config.MaxTokens = 5
+		config.RecoverXTokensPerSec = 1
+		config.KeyWhitelist = "friend, other-friend"
+		config.Allowlist = []string{"203.0.113.0/24"}
+	})
+
+	client := rateLimitClient{ip: "192.0.2.1"}
+	if allowed, _ := limiter.please(client, 3); !allowed {
+		t.Fatalf("first request refused")
+	}
+	if allowed, retryAfter := limiter.please(client, 3); allowed || retryAfter <= 0 {
+		t.Fatalf("request over the limit allowed = %v, retryAfter = %v", allowed, retryAfter)
+	}
+	// A refused request takes nothing, so a smaller one still fits.
+	if allowed, _ := limiter.please(client, 2); !allowed {
+		t.Fatalf("request within the limit refused")
+	}
+
+	// Charges go into debt, which has to be paid off before the next request.
+	limiter.charge(client, 4)
+	if status := limiter.inspect(client); len(status) != 1 || status[0].Tokens > -3.5 {
+		t.Errorf("bucket = %+v, want it in debt", status)
+	}
+
+	for _, exempt := range []rateLimitClient{
+		{ip: "192.0.2.1", userKey: "other-friend"},
+		{ip: "203.0.113.9"},
+	} {
+		if allowed, _ := limiter.please(exempt, 100); !allowed {
+			t.Errorf("exempt client %+v refused", exempt)
+		}
+	}
+
+	if allowed, _ := limiter.please(client, 0); !allowed {
+		t.Errorf("free request refused")
+	}
+}
+
+func TestDisabledRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(&RateLimitConfig{Enabled: false}, "/dns-query", nil)
+	if allowed, _ := limiter.please(rateLimitClient{ip: "192.0.2.1"}, 1000); !allowed {
+		t.Errorf("disabled rate limiter refused a request")
+	}
+}
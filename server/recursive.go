@@ -0,0 +1,456 @@
+package dohboy
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The IANA root hints, IPv4 only.
+var defaultRootHints = []string{
+	"198.41.0.4",     // a.root-servers.net
+	"170.247.170.2",  // b.root-servers.net
+	"192.33.4.12",    // c.root-servers.net
+	"199.7.91.13",    // d.root-servers.net
+	"192.203.230.10", // e.root-servers.net
+	"192.5.5.241",    // f.root-servers.net
+	"192.112.36.4",   // g.root-servers.net
+	"198.97.190.53",  // h.root-servers.net
+	"192.36.148.17",  // i.root-servers.net
+	"192.58.128.30",  // j.root-servers.net
+	"193.0.14.129",   // k.root-servers.net
+	"199.7.83.42",    // l.root-servers.net
+	"202.12.27.33",   // m.root-servers.net
+}
+
+const (
+	recursiveMaxReferrals  = 30 // per name looked up
+	recursiveMaxDepth      = 6  // nested lookups of nameserver addresses
+	recursiveMaxCNAMEs     = 8
+	recursiveMaxCached     = 10000
+	recursiveMaxCachedTTL  = 24 * time.Hour
+	recursiveEDNSBufferLen = 1232
+)
+
+type delegation struct {
+	servers []string // host:port of the nameservers
+	expires time.Time
+}
+
+// recursiveUpstream resolves queries itself, starting from the root servers
+// and following referrals down to the authoritative servers, rather than
+// handing them to someone else's resolver. Zone cuts and nameserver addresses
+// are cached. With QNAME minimisation (RFC9156), each server only gets to see
+// as much of the name as it needs to refer us onwards.
+type recursiveUpstream struct {
+	rootServers []string
+	minimise    bool
+	udpClient   *dns.Client
+	tcpClient   *dns.Client
+	// Sends a query to a server. Swapped out for a fake hierarchy in tests.
+	exchange func(query *dns.Msg, server string) (*dns.Msg, error)
+
+	zones       map[string]*delegation // zone cuts, by zone name
+	nameservers map[string]*delegation // nameserver addresses, by host name
+	cacheMu     sync.Mutex
+}
+
+func createRecursiveUpstream(config RecursiveConfig, timeout time.Duration) (upstream, error) {
+	hints := config.RootHints
+	if len(hints) == 0 {
+		hints = defaultRootHints
+	}
+
+	rootServers := make([]string, 0, len(hints))
+	for _, hint := range hints {
+		if _, _, err := net.SplitHostPort(hint); err != nil {
+			hint = net.JoinHostPort(hint, "53")
+		}
+		host, _, _ := net.SplitHostPort(hint)
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("Root hints must be ip addresses. Provided: [%v].", hint)
+		}
+		rootServers = append(rootServers, hint)
+	}
+
+	recursive := &recursiveUpstream{
+		rootServers: rootServers,
+		minimise:    config.QnameMinimisation,
+		udpClient:   &dns.Client{Net: "udp", Timeout: timeout},
+		tcpClient:   &dns.Client{Net: "tcp", Timeout: timeout},
+		zones:       make(map[string]*delegation),
+		nameservers: make(map[string]*delegation),
+	}
+	recursive.exchange = recursive.exchangeWithServer
+	return recursive, nil
+}
+
+func (recursive *recursiveUpstream) exchangeWithServer(query *dns.Msg, server string) (*dns.Msg, error) {
+	resp, _, err := recursive.udpClient.Exchange(query, server)
+	if err == nil && resp.Truncated {
+		resp, _, err = recursive.tcpClient.Exchange(query, server)
+	}
+	return resp, err
+}
+
+func (recursive *recursiveUpstream) resolve(dnsQuery *dns.Msg) (*dns.Msg, error) {
+	question := dnsQuery.Question[0]
+	if question.Qclass != dns.ClassINET {
+		responseMsg := dns.Msg{}
+		return responseMsg.SetRcode(dnsQuery, dns.RcodeNotImplemented), nil
+	}
+
+	name := strings.ToLower(dns.Fqdn(question.Name))
+	chain := []dns.RR{}
+
+	for i := 0; i <= recursiveMaxCNAMEs; i++ {
+		resp, err := recursive.lookup(name, question.Qtype, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		// Each link of a CNAME chain is looked up on its own, from the closest
+		// zone cut, rather than taken from whichever server handed out the
+		// CNAME pointing at it.
+		answers, target := answersFor(resp, name, question.Qtype)
+		chain = append(chain, answers...)
+		if target == "" {
+			return recursive.reply(dnsQuery, resp, chain), nil
+		}
+		name = target
+	}
+
+	return nil, fmt.Errorf("Too many CNAMEs resolving [%v].", question.Name)
+}
+
+// reply builds the response to the client's query out of the last response
+// along the CNAME chain and the answers collected along it.
+func (recursive *recursiveUpstream) reply(dnsQuery *dns.Msg, last *dns.Msg, chain []dns.RR) *dns.Msg {
+	responseMsg := new(dns.Msg)
+	responseMsg.SetReply(dnsQuery)
+	responseMsg.RecursionAvailable = true
+	responseMsg.Rcode = last.Rcode
+	responseMsg.Answer = chain
+
+	// The SOA record is what negative answers are cached by.
+	if len(last.Answer) == 0 {
+		for _, rr := range last.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				responseMsg.Ns = append(responseMsg.Ns, rr)
+			}
+		}
+	}
+
+	if opt := dnsQuery.IsEdns0(); opt != nil {
+		responseMsg.SetEdns0(recursiveEDNSBufferLen, opt.Do())
+	}
+	return responseMsg
+}
+
+// answersFor picks the records of a response that answer for the name itself,
+// along with a DNAME above it that a CNAME was synthesized from, and returns
+// the name the CNAME points to if the question isn't answered yet.
+func answersFor(resp *dns.Msg, name string, qtype uint16) ([]dns.RR, string) {
+	answers := []dns.RR{}
+	target := ""
+	answered := false
+
+	for _, rr := range resp.Answer {
+		header := rr.Header()
+		owner := strings.ToLower(header.Name)
+		switch {
+		case header.Rrtype == dns.TypeDNAME && owner != name && dns.IsSubDomain(owner, name):
+			answers = append(answers, rr)
+		case owner != name:
+			continue
+		case header.Rrtype == qtype:
+			answers = append(answers, rr)
+			answered = true
+		case header.Rrtype == dns.TypeCNAME:
+			answers = append(answers, rr)
+			target = strings.ToLower(rr.(*dns.CNAME).Target)
+		case header.Rrtype == dns.TypeRRSIG && rr.(*dns.RRSIG).TypeCovered == qtype:
+			answers = append(answers, rr)
+		}
+	}
+
+	if answered || resp.Rcode != dns.RcodeSuccess || target == name {
+		return answers, ""
+	}
+	return answers, target
+}
+
+// scrubOutOfBailiwick drops the records of a response that the servers of the
+// zone have no say over, so they can't slip records for other zones into the
+// answer or into the cache.
+func scrubOutOfBailiwick(resp *dns.Msg, zone string) {
+	inZone := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT || dns.IsSubDomain(zone, strings.ToLower(rr.Header().Name)) {
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+
+	resp.Answer = inZone(resp.Answer)
+	resp.Ns = inZone(resp.Ns)
+	resp.Extra = inZone(resp.Extra)
+}
+
+// lookup follows referrals from the closest known zone cut down to the
+// servers authoritative for the name, and returns their response.
+func (recursive *recursiveUpstream) lookup(name string, qtype uint16, depth int) (*dns.Msg, error) {
+	zone, servers := recursive.closestZone(name)
+	labels := dns.CountLabel(zone) + 1
+
+	for i := 0; i < recursiveMaxReferrals; i++ {
+		qname, qt := name, qtype
+		if recursive.minimise && labels < dns.CountLabel(name) {
+			// RFC9156 2.1: A is the qtype least likely to trip up servers.
+			qname, qt = lastLabels(name, labels), dns.TypeA
+		}
+
+		resp, err := recursive.ask(qname, qt, zone, servers)
+		if err != nil {
+			return nil, err
+		}
+		scrubOutOfBailiwick(resp, zone)
+
+		if cut, nsNames := findReferral(resp, zone, qname); cut != "" {
+			next, err := recursive.delegate(zone, cut, nsNames, resp, depth)
+			if err != nil {
+				return nil, err
+			}
+			zone, servers = cut, next
+			labels = dns.CountLabel(zone) + 1
+			continue
+		}
+
+		if qname != name {
+			if resp.Rcode != dns.RcodeSuccess {
+				// RFC9156 3: some servers get names without records of their
+				// own wrong, so don't take their word for it and ask for the
+				// whole name instead.
+				labels = dns.CountLabel(name)
+			} else {
+				labels++
+			}
+			continue
+		}
+
+		if !resp.Authoritative && len(resp.Answer) == 0 && resp.Rcode == dns.RcodeSuccess {
+			return nil, fmt.Errorf("Lame response for [%v] from the servers of [%v].", name, zone)
+		}
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("Too many referrals resolving [%v].", name)
+}
+
+func lastLabels(name string, count int) string {
+	indexes := dns.Split(name)
+	if count >= len(indexes) {
+		return name
+	}
+	return name[indexes[len(indexes)-count]:]
+}
+
+// ask sends a query to the servers of a zone, starting from a random one and
+// moving on to the next one if a server doesn't answer usefully.
+func (recursive *recursiveUpstream) ask(qname string, qtype uint16, zone string, servers []string) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(qname, qtype)
+	query.RecursionDesired = false
+	query.SetEdns0(recursiveEDNSBufferLen, false)
+
+	var lastErr error = fmt.Errorf("No servers known for [%v].", zone)
+	start := 0
+	if len(servers) > 0 {
+		start = rand.Intn(len(servers))
+	}
+	for i := range servers {
+		server := servers[(start+i)%len(servers)]
+
+		resp, err := recursive.exchange(query, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch {
+		case !questionMatches(query, resp, false):
+			lastErr = fmt.Errorf("Mismatched question from [%v].", server)
+		case resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused || resp.Rcode == dns.RcodeNotImplemented:
+			lastErr = fmt.Errorf("Got %v from [%v] for [%v].", dns.RcodeToString[resp.Rcode], server, qname)
+		default:
+			return resp, nil
+		}
+	}
+
+	return nil, lastErr
+}
+
+// findReferral returns the zone cut a response refers us to, along with the
+// names of its nameservers. Only referrals further down towards the name are
+// followed.
+func findReferral(resp *dns.Msg, zone string, qname string) (string, []string) {
+	if len(resp.Answer) > 0 || resp.Rcode != dns.RcodeSuccess {
+		return "", nil
+	}
+
+	cut := ""
+	nsNames := []string{}
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		owner := strings.ToLower(ns.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, qname) {
+			continue
+		}
+		if cut == "" {
+			cut = owner
+		}
+		if owner == cut {
+			nsNames = append(nsNames, strings.ToLower(ns.Ns))
+		}
+	}
+
+	return cut, nsNames
+}
+
+// delegate works out the addresses of a zone cut's nameservers, from the glue
+// in the referral or by looking them up, and caches them.
+func (recursive *recursiveUpstream) delegate(parent string, cut string, nsNames []string, referral *dns.Msg, depth int) ([]string, error) {
+	ttl := recursiveMaxCachedTTL
+	for _, rr := range referral.Ns {
+		if header := rr.Header(); header.Rrtype == dns.TypeNS {
+			ttl = minDuration(ttl, time.Duration(header.Ttl)*time.Second)
+		}
+	}
+
+	isNameserver := make(map[string]bool, len(nsNames))
+	for _, nsName := range nsNames {
+		isNameserver[nsName] = true
+	}
+
+	// Glue is only taken from the parent zone for names within it, so a
+	// server can't hand out addresses for names it has no say over.
+	servers := []string{}
+	for _, rr := range referral.Extra {
+		a, ok := rr.(*dns.A)
+		owner := strings.ToLower(rr.Header().Name)
+		if ok && isNameserver[owner] && dns.IsSubDomain(parent, owner) {
+			servers = append(servers, net.JoinHostPort(a.A.String(), "53"))
+		}
+	}
+
+	if len(servers) == 0 {
+		if depth >= recursiveMaxDepth {
+			return nil, fmt.Errorf("Too deep looking up the nameservers of [%v].", cut)
+		}
+
+		var lastErr error
+		for _, nsName := range nsNames {
+			addresses, err := recursive.nameserverAddresses(nsName, depth+1)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			servers = append(servers, addresses...)
+			break
+		}
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("Could not find the nameservers of [%v]: %v", cut, lastErr)
+		}
+	}
+
+	recursive.cacheMu.Lock()
+	storeDelegation(recursive.zones, cut, servers, ttl)
+	recursive.cacheMu.Unlock()
+
+	return servers, nil
+}
+
+func (recursive *recursiveUpstream) nameserverAddresses(host string, depth int) ([]string, error) {
+	recursive.cacheMu.Lock()
+	cached, found := recursive.nameservers[host]
+	recursive.cacheMu.Unlock()
+	if found && time.Now().Before(cached.expires) {
+		return cached.servers, nil
+	}
+
+	resp, err := recursive.lookup(host, dns.TypeA, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := recursiveMaxCachedTTL
+	servers := []string{}
+	answers, _ := answersFor(resp, host, dns.TypeA)
+	for _, rr := range answers {
+		if a, ok := rr.(*dns.A); ok {
+			servers = append(servers, net.JoinHostPort(a.A.String(), "53"))
+			ttl = minDuration(ttl, time.Duration(a.Hdr.Ttl)*time.Second)
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("No addresses found for nameserver [%v].", host)
+	}
+
+	recursive.cacheMu.Lock()
+	storeDelegation(recursive.nameservers, host, servers, ttl)
+	recursive.cacheMu.Unlock()
+
+	return servers, nil
+}
+
+// closestZone finds the closest cached zone cut above the name, falling back
+// to the root.
+func (recursive *recursiveUpstream) closestZone(name string) (string, []string) {
+	recursive.cacheMu.Lock()
+	defer recursive.cacheMu.Unlock()
+
+	now := time.Now()
+	for offset, end := 0, false; !end; offset, end = dns.NextLabel(name, offset) {
+		if cached, found := recursive.zones[name[offset:]]; found && now.Before(cached.expires) {
+			return name[offset:], cached.servers
+		}
+	}
+	return ".", recursive.rootServers
+}
+
+// storeDelegation caches an entry, making room by dropping expired entries,
+// or everything if that isn't enough.
+func storeDelegation(cache map[string]*delegation, name string, servers []string, ttl time.Duration) {
+	if len(cache) >= recursiveMaxCached {
+		now := time.Now()
+		for key, entry := range cache {
+			if !now.Before(entry.expires) {
+				delete(cache, key)
+			}
+		}
+		if len(cache) >= recursiveMaxCached {
+			for key := range cache {
+				delete(cache, key)
+			}
+		}
+	}
+	cache[name] = &delegation{servers: servers, expires: time.Now().Add(ttl)}
+}
+
+func minDuration(a time.Duration, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
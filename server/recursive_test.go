@@ -0,0 +1,381 @@
+package dohboy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeZone is a server in a fake DNS hierarchy, authoritative for a single
+// zone and referring queries below its zone cuts onwards.
+type fakeZone struct {
+	apex    string
+	records []dns.RR
+	// Records slipped into every answer, as a server trying to poison caches
+	// would.
+	inject []dns.RR
+	// Answers everything with this rcode instead, if set.
+	rcode int
+	// Answers everything without authority and without a referral.
+	lame bool
+}
+
+func (zone *fakeZone) answer(query *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	if zone.rcode != dns.RcodeSuccess {
+		resp.Rcode = zone.rcode
+		return resp
+	}
+	if zone.lame {
+		return resp
+	}
+
+	question := query.Question[0]
+	qname := strings.ToLower(question.Name)
+
+	cut := ""
+	for _, rr := range zone.records {
+		owner := strings.ToLower(rr.Header().Name)
+		if rr.Header().Rrtype == dns.TypeNS && owner != zone.apex && dns.IsSubDomain(owner, qname) && len(owner) > len(cut) {
+			cut = owner
+		}
+	}
+	if cut != "" {
+		nsNames := map[string]bool{}
+		for _, rr := range zone.records {
+			if ns, ok := rr.(*dns.NS); ok && strings.ToLower(ns.Hdr.Name) == cut {
+				resp.Ns = append(resp.Ns, rr)
+				nsNames[strings.ToLower(ns.Ns)] = true
+			}
+		}
+		for _, rr := range zone.records {
+			if rr.Header().Rrtype == dns.TypeA && nsNames[strings.ToLower(rr.Header().Name)] {
+				resp.Extra = append(resp.Extra, rr)
+			}
+		}
+		resp.Extra = append(resp.Extra, zone.inject...)
+		return resp
+	}
+
+	resp.Authoritative = true
+	exists := false
+	for _, rr := range zone.records {
+		owner := strings.ToLower(rr.Header().Name)
+		if owner == qname {
+			exists = true
+			if rr.Header().Rrtype == question.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		} else if dns.IsSubDomain(qname, owner) {
+			exists = true
+		}
+	}
+	resp.Answer = append(resp.Answer, zone.inject...)
+
+	if len(resp.Answer) == 0 {
+		if !exists {
+			resp.Rcode = dns.RcodeNameError
+		}
+		soa, _ := dns.NewRR(zone.apex + " 300 IN SOA ns.invalid. hostmaster.invalid. 1 3600 600 86400 60")
+		resp.Ns = append(resp.Ns, soa)
+	}
+	return resp
+}
+
+// fakeHierarchy stands in for the internet in recursive resolver tests,
+// routing queries to fake servers by address.
+type fakeHierarchy struct {
+	servers map[string]*fakeZone // by host:port
+
+	mu    sync.Mutex
+	asked map[string][]string // "name type" asked of each server
+}
+
+func (hierarchy *fakeHierarchy) exchange(query *dns.Msg, server string) (*dns.Msg, error) {
+	zone, found := hierarchy.servers[server]
+	if !found {
+		return nil, fmt.Errorf("No route to [%v].", server)
+	}
+
+	question := query.Question[0]
+	hierarchy.mu.Lock()
+	hierarchy.asked[server] = append(hierarchy.asked[server], question.Name+" "+dns.TypeToString[question.Qtype])
+	hierarchy.mu.Unlock()
+
+	return zone.answer(query), nil
+}
+
+func (hierarchy *fakeHierarchy) questions(server string) []string {
+	hierarchy.mu.Lock()
+	defer hierarchy.mu.Unlock()
+	return hierarchy.asked[server]
+}
+
+// newFakeHierarchy sets up a root, the test. TLD and a handful of zones
+// below it:
+//   - example.test, with glue, holding a CNAME chain into bank.test
+//   - glueless.test, whose nameserver only example.test knows the address of
+//   - bank.test, the target of the poisoning attempts
+//   - evil.test, whose server slips bank.test records into its responses
+//   - lame.test, with one server refusing and one answering
+//   - dead.test, with only the refusing server, and stale.test, with a server
+//     that doesn't consider itself authoritative
+//   - deep0.test, deep1.test, ..., each glueless and served from the next one
+func newFakeHierarchy(t *testing.T) *fakeHierarchy {
+	t.Helper()
+
+	tld := []string{
+		"test. 3600 IN SOA ns.nic.test. hostmaster.nic.test. 1 3600 600 86400 60",
+		"example.test. 3600 IN NS ns1.example.test.",
+		"ns1.example.test. 3600 IN A 198.51.100.3",
+		"glueless.test. 3600 IN NS ns2.example.test.",
+		"bank.test. 3600 IN NS ns.bank.test.",
+		"ns.bank.test. 3600 IN A 198.51.100.4",
+		"evil.test. 3600 IN NS ns.evil.test.",
+		"ns.evil.test. 3600 IN A 198.51.100.6",
+		"lame.test. 3600 IN NS ns1.lame.test.",
+		"lame.test. 3600 IN NS ns2.lame.test.",
+		"ns1.lame.test. 3600 IN A 198.51.100.9",
+		"ns2.lame.test. 3600 IN A 198.51.100.10",
+		"dead.test. 3600 IN NS ns1.lame.test.",
+		"stale.test. 3600 IN NS ns.stale.test.",
+		"ns.stale.test. 3600 IN A 198.51.100.11",
+	}
+	for i := 0; i < 2*recursiveMaxDepth; i++ {
+		tld = append(tld, fmt.Sprintf("deep%v.test. 3600 IN NS ns.deep%v.test.", i, i+1))
+	}
+
+	return &fakeHierarchy{
+		servers: map[string]*fakeZone{
+			"198.51.100.1:53": {apex: ".", records: mustRRs(t,
+				"test. 86400 IN NS ns.nic.test.",
+				"ns.nic.test. 86400 IN A 198.51.100.2",
+			)},
+			"198.51.100.2:53": {apex: "test.", records: mustRRs(t, tld...)},
+			"198.51.100.3:53": {apex: "example.test.", records: mustRRs(t,
+				"www.example.test. 300 IN A 192.0.2.1",
+				"www.example.test. 300 IN MX 10 mail.example.test.",
+				"chain.example.test. 300 IN CNAME alias.example.test.",
+				"alias.example.test. 300 IN CNAME www.bank.test.",
+				"ns2.example.test. 300 IN A 198.51.100.5",
+			)},
+			"198.51.100.4:53": {apex: "bank.test.", records: mustRRs(t,
+				"www.bank.test. 300 IN A 192.0.2.99",
+			)},
+			"198.51.100.5:53": {apex: "glueless.test.", records: mustRRs(t,
+				"www.glueless.test. 300 IN A 192.0.2.5",
+			)},
+			"198.51.100.6:53": {
+				apex: "evil.test.",
+				records: mustRRs(t,
+					"www.evil.test. 300 IN A 192.0.2.6",
+					"phish.evil.test. 300 IN CNAME www.bank.test.",
+				),
+				inject: mustRRs(t,
+					"www.bank.test. 86400 IN A 203.0.113.66",
+					"ns.bank.test. 86400 IN A 203.0.113.66",
+				),
+			},
+			"198.51.100.9:53": {rcode: dns.RcodeRefused},
+			"198.51.100.10:53": {apex: "lame.test.", records: mustRRs(t,
+				"www.lame.test. 300 IN A 192.0.2.10",
+			)},
+			"198.51.100.11:53": {lame: true},
+		},
+		asked: map[string][]string{},
+	}
+}
+
+func newTestRecursiveUpstream(t *testing.T, hierarchy *fakeHierarchy, minimise bool) *recursiveUpstream {
+	t.Helper()
+	us, err := createRecursiveUpstream(RecursiveConfig{RootHints: []string{"198.51.100.1"}, QnameMinimisation: minimise}, time.Second)
+	if err != nil {
+		t.Fatalf("Could not create recursive upstream: %v", err)
+	}
+	recursive := us.(*recursiveUpstream)
+	recursive.exchange = hierarchy.exchange
+	return recursive
+}
+
+func TestRecursiveResolve(t *testing.T) {
+	tests := []struct {
+		name        string
+		qname       string
+		wantErr     string
+		wantRcode   int
+		wantAnswers []string // types, in order
+		wantIP      string
+	}{
+		{name: "glue", qname: "www.example.test.", wantAnswers: []string{"A"}, wantIP: "192.0.2.1"},
+		{name: "glueless", qname: "www.glueless.test.", wantAnswers: []string{"A"}, wantIP: "192.0.2.5"},
+		{name: "CNAME chain across zones", qname: "chain.example.test.", wantAnswers: []string{"CNAME", "CNAME", "A"}, wantIP: "192.0.2.99"},
+		{name: "NXDOMAIN", qname: "nope.example.test.", wantRcode: dns.RcodeNameError},
+		{name: "NXDOMAIN in the TLD", qname: "www.nope.test.", wantRcode: dns.RcodeNameError},
+		{name: "refusing server skipped", qname: "www.lame.test.", wantAnswers: []string{"A"}, wantIP: "192.0.2.10"},
+		{name: "only refusing servers", qname: "www.dead.test.", wantErr: "REFUSED"},
+		{name: "non-authoritative server", qname: "www.stale.test.", wantErr: "Lame"},
+		{name: "depth limit", qname: "www.deep0.test.", wantErr: "Too deep"},
+		{name: "out of bailiwick answers dropped", qname: "www.evil.test.", wantAnswers: []string{"A"}, wantIP: "192.0.2.6"},
+		{name: "out of bailiwick CNAME target looked up afresh", qname: "phish.evil.test.", wantAnswers: []string{"CNAME", "A"}, wantIP: "192.0.2.99"},
+	}
+
+	for _, minimise := range []bool{true, false} {
+		for _, test := range tests {
+			t.Run(fmt.Sprintf("%v (minimise %v)", test.name, minimise), func(t *testing.T) {
+				recursive := newTestRecursiveUpstream(t, newFakeHierarchy(t), minimise)
+
+				resp, err := recursive.resolve(newTestQuery(test.qname, dns.TypeA))
+				if test.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+						t.Fatalf("err = %v, want one containing [%v]", err, test.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+
+				if resp.Rcode != test.wantRcode {
+					t.Errorf("rcode = %v, want %v", dns.RcodeToString[resp.Rcode], dns.RcodeToString[test.wantRcode])
+				}
+				types := []string{}
+				for _, rr := range resp.Answer {
+					types = append(types, dns.TypeToString[rr.Header().Rrtype])
+				}
+				if strings.Join(types, " ") != strings.Join(test.wantAnswers, " ") {
+					t.Errorf("answer = %v, want %v", resp.Answer, test.wantAnswers)
+				}
+				if got := answeredIP(resp); got != test.wantIP {
+					t.Errorf("answered %v, want %v", got, test.wantIP)
+				}
+				if resp.Rcode == dns.RcodeNameError && (len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA) {
+					t.Errorf("authority = %v, want the SOA", resp.Ns)
+				}
+			})
+		}
+	}
+}
+
+func TestRecursiveQnameMinimisation(t *testing.T) {
+	tests := []struct {
+		minimise bool
+		want     map[string][]string
+	}{
+		{
+			minimise: true,
+			want: map[string][]string{
+				"198.51.100.1:53": {"test. A"},
+				"198.51.100.2:53": {"example.test. A"},
+				"198.51.100.3:53": {"www.example.test. MX"},
+			},
+		},
+		{
+			minimise: false,
+			want: map[string][]string{
+				"198.51.100.1:53": {"www.example.test. MX"},
+				"198.51.100.2:53": {"www.example.test. MX"},
+				"198.51.100.3:53": {"www.example.test. MX"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		hierarchy := newFakeHierarchy(t)
+		recursive := newTestRecursiveUpstream(t, hierarchy, test.minimise)
+
+		resp, err := recursive.resolve(newTestQuery("www.example.test.", dns.TypeMX))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeMX {
+			t.Errorf("minimise %v: answer = %v, want the MX", test.minimise, resp.Answer)
+		}
+
+		for server, want := range test.want {
+			if got := hierarchy.questions(server); strings.Join(got, ", ") != strings.Join(want, ", ") {
+				t.Errorf("minimise %v: %v was asked %v, want %v", test.minimise, server, got, want)
+			}
+		}
+	}
+}
+
+func TestRecursiveCachesDelegations(t *testing.T) {
+	hierarchy := newFakeHierarchy(t)
+	recursive := newTestRecursiveUpstream(t, hierarchy, true)
+
+	for _, qname := range []string{"www.example.test.", "www.example.test.", "chain.example.test."} {
+		if _, err := recursive.resolve(newTestQuery(qname, dns.TypeA)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Everything after the first lookup starts from a cached zone cut, even
+	// the lookup of www.bank.test.
+	if got := hierarchy.questions("198.51.100.1:53"); len(got) != 1 {
+		t.Errorf("root was asked %v, want a single question", got)
+	}
+	// Answers themselves aren't cached, and every link of the CNAME chain gets
+	// its own question.
+	want := "www.example.test. A, www.example.test. A, chain.example.test. A, alias.example.test. A"
+	if got := hierarchy.questions("198.51.100.3:53"); strings.Join(got, ", ") != want {
+		t.Errorf("example.test. was asked %v, want %v", got, want)
+	}
+}
+
+func TestRecursivePoisoningAttempts(t *testing.T) {
+	hierarchy := newFakeHierarchy(t)
+	recursive := newTestRecursiveUpstream(t, hierarchy, true)
+
+	for _, qname := range []string{"www.evil.test.", "phish.evil.test.", "nope.evil.test."} {
+		if _, err := recursive.resolve(newTestQuery(qname, dns.TypeA)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	recursive.cacheMu.Lock()
+	for name, cached := range recursive.nameservers {
+		for _, server := range cached.servers {
+			if strings.HasPrefix(server, "203.0.113.66") {
+				t.Errorf("cached the injected address for %v", name)
+			}
+		}
+	}
+	if cached, found := recursive.zones["bank.test."]; found && strings.Join(cached.servers, " ") != "198.51.100.4:53" {
+		t.Errorf("bank.test. servers = %v, want 198.51.100.4:53", cached.servers)
+	}
+	recursive.cacheMu.Unlock()
+
+	resp, err := recursive.resolve(newTestQuery("www.bank.test.", dns.TypeA))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := answeredIP(resp); got != "192.0.2.99" || len(resp.Answer) != 1 {
+		t.Errorf("answer = %v, want only 192.0.2.99", resp.Answer)
+	}
+}
+
+func TestScrubOutOfBailiwick(t *testing.T) {
+	resp := newTestResponse(t, dns.RcodeSuccess,
+		[]string{"www.example.test. 300 IN A 192.0.2.1", "www.bank.test. 300 IN A 203.0.113.66"},
+		[]string{"example.test. 300 IN NS ns1.example.test.", "bank.test. 300 IN NS ns.evil.test."},
+		[]string{"ns1.example.test. 300 IN A 192.0.2.53", "ns.bank.test. 300 IN A 203.0.113.66"},
+	)
+
+	scrubOutOfBailiwick(resp, "example.test.")
+
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if strings.Contains(rr.Header().Name, "bank") {
+				t.Errorf("kept %v", rr)
+			}
+		}
+	}
+	if len(resp.Answer) != 1 || len(resp.Ns) != 1 || len(resp.Extra) != 2 || resp.IsEdns0() == nil {
+		t.Errorf("scrubbed too much: %v", resp)
+	}
+}
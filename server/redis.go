@@ -0,0 +1,498 @@
+package dohboy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisClient speaks just enough of the redis protocol (RESP) for the shared
+// rate-limit and cache backends.
+type redisClient struct {
+	address  string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type redisError string
+
+func (err redisError) Error() string {
+	return string(err)
+}
+
+var errRedisNil = errors.New("redis: nil reply")
+
+func newRedisClient(config *RedisConfig) *redisClient {
+	return &redisClient{
+		address:  config.Address,
+		password: config.Password,
+		db:       config.DB,
+		timeout:  time.Duration(config.TimeoutMillis) * time.Millisecond,
+		idle:     make(chan *redisConn, config.MaxIdleConns),
+	}
+}
+
+func (client *redisClient) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", client.address, client.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if client.password != "" {
+		if _, err := client.roundTrip(rc, "AUTH", client.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if client.db != 0 {
+		if _, err := client.roundTrip(rc, "SELECT", strconv.Itoa(client.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return rc, nil
+}
+
+// redisWriteError is an I/O error sending a command. The server can't have
+// run a command it didn't get in full, so it's safe to send it again.
+type redisWriteError struct {
+	error
+}
+
+// redisRetryable lists the commands that can be sent again when it's unclear
+// whether the server ran them: running them twice does no harm. INCRBY and
+// DECRBY aren't among them, as they would count twice.
+var redisRetryable = map[string]bool{
+	"GET":     true,
+	"SET":     true,
+	"DEL":     true,
+	"PEXPIRE": true,
+	"PTTL":    true,
+	"SCAN":    true,
+}
+
+func (client *redisClient) roundTrip(rc *redisConn, args ...string) (interface{}, error) {
+	replies, err := client.pipeline(rc, args)
+	if err != nil {
+		return nil, err
+	}
+	if replyErr, isReplyErr := replies[0].(redisError); isReplyErr {
+		return nil, replyErr
+	}
+	return replies[0], nil
+}
+
+// pipeline sends the commands in one go and reads a reply to each of them.
+// Error replies are returned as a redisError in place of the reply, the error
+// is only for I/O errors, which leave the connection unusable.
+func (client *redisClient) pipeline(rc *redisConn, commands ...[]string) ([]interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(client.timeout))
+
+	request := ""
+	for _, args := range commands {
+		request += fmt.Sprintf("*%v\r\n", len(args))
+		for _, arg := range args {
+			request += fmt.Sprintf("$%v\r\n%v\r\n", len(arg), arg)
+		}
+	}
+
+	if _, err := io.WriteString(rc.conn, request); err != nil {
+		return nil, redisWriteError{err}
+	}
+
+	replies := make([]interface{}, len(commands))
+	for i := range replies {
+		reply, err := readRedisReply(rc.reader)
+		if replyErr, isReplyErr := err.(redisError); isReplyErr {
+			reply = replyErr
+		} else if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// do runs a single command. Error replies from the server come back as a
+// redisError, and leave the connection usable.
+func (client *redisClient) do(args ...string) (interface{}, error) {
+	replies, err := client.exec(redisRetryable[strings.ToUpper(args[0])], args)
+	if err != nil {
+		return nil, err
+	}
+	if replyErr, isReplyErr := replies[0].(redisError); isReplyErr {
+		return nil, replyErr
+	}
+	return replies[0], nil
+}
+
+// transaction runs the commands in a MULTI/EXEC block, so the server runs all
+// of them or none, and returns their replies.
+func (client *redisClient) transaction(commands ...[]string) ([]interface{}, error) {
+	block := append(append([][]string{{"MULTI"}}, commands...), []string{"EXEC"})
+	replies, err := client.exec(false, block...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Commands the server turned down while queueing them abort the block.
+	last := replies[len(replies)-1]
+	if replyErr, isReplyErr := last.(redisError); isReplyErr {
+		return nil, replyErr
+	}
+	results, ok := last.([]interface{})
+	if !ok || len(results) != len(commands) {
+		return nil, fmt.Errorf("redis: unexpected reply to EXEC: %v", last)
+	}
+	return results, nil
+}
+
+// exec sends commands down a pooled connection, or a fresh one if there's none
+// idle. A pooled connection may have been dropped by the server while idle (a
+// restart, or its idle timeout), so after an I/O error the commands get one
+// more go on a fresh connection: always if they weren't sent in full, and if
+// they were, only when they're safe to run twice.
+func (client *redisClient) exec(retryable bool, commands ...[]string) ([]interface{}, error) {
+	select {
+	case rc := <-client.idle:
+		replies, err := client.execOn(rc, commands...)
+		if _, isWriteErr := err.(redisWriteError); err == nil || !(retryable || isWriteErr) {
+			return replies, err
+		}
+	default:
+	}
+
+	rc, err := client.dial()
+	if err != nil {
+		return nil, err
+	}
+	return client.execOn(rc, commands...)
+}
+
+// execOn runs commands on a connection and hands the connection back to the
+// pool, unless it failed with an I/O error.
+func (client *redisClient) execOn(rc *redisConn, commands ...[]string) ([]interface{}, error) {
+	replies, err := client.pipeline(rc, commands...)
+	if err != nil {
+		rc.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case client.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+
+	return replies, nil
+}
+
+func (client *redisClient) doInt(args ...string) (int64, error) {
+	reply, err := client.do(args...)
+	if err != nil {
+		return 0, err
+	}
+	if val, ok := reply.(int64); ok {
+		return val, nil
+	}
+	return 0, fmt.Errorf("redis: unexpected reply to %v: %v", args[0], reply)
+}
+
+func (client *redisClient) doBytes(args ...string) ([]byte, error) {
+	reply, err := client.do(args...)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, errRedisNil
+	}
+	if val, ok := reply.([]byte); ok {
+		return val, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply to %v: %v", args[0], reply)
+}
+
+// scan walks all keys matching a pattern, stopping after limit keys if limit
+// is positive.
+func (client *redisClient) scan(pattern string, limit int) ([]string, error) {
+	keys := []string{}
+	cursor := "0"
+
+	for {
+		reply, err := client.do("SCAN", cursor, "MATCH", pattern, "COUNT", "500")
+		if err != nil {
+			return keys, err
+		}
+
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return keys, fmt.Errorf("redis: unexpected reply to SCAN: %v", reply)
+		}
+
+		next, _ := parts[0].([]byte)
+		batch, _ := parts[1].([]interface{})
+		for _, key := range batch {
+			if keyBytes, ok := key.([]byte); ok {
+				keys = append(keys, string(keyBytes))
+				if limit > 0 && len(keys) >= limit {
+					return keys, nil
+				}
+			}
+		}
+
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+func (client *redisClient) close() {
+	for {
+		select {
+		case rc := <-client.idle:
+			rc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// readRedisReply reads one RESP reply: simple strings come back as string,
+// integers as int64, bulk strings as []byte (nil for a nil reply) and arrays
+// as []interface{}, with a redisError in place of any error reply in them.
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply line %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(body)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return buf[:length], nil
+	case '*':
+		count, err := strconv.Atoi(body)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = readRedisReply(reader); err != nil {
+				replyErr, isReplyErr := err.(redisError)
+				if !isReplyErr {
+					return nil, err
+				}
+				items[i] = replyErr
+			}
+		}
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+// redisRateLimitBackend approximates token buckets with fixed windows, which
+// only need INCRBY to stay consistent across replicas: each window lasts as
+// long as a bucket takes to refill and admits up to a full bucket.
+type redisRateLimitBackend struct {
+	client    *redisClient
+	keyPrefix string
+}
+
+func (backend *redisRateLimitBackend) windowKey(bucket bucketRef, now time.Time) (string, time.Duration) {
+	window := bucket.limits.refillTime()
+	if window < time.Second {
+		window = time.Second
+	}
+	windowIdx := now.UnixNano() / int64(window)
+	return fmt.Sprintf("%vrl:%v:%v:%v", backend.keyPrefix, bucket.family, bucket.key, windowIdx), window
+}
+
+func (backend *redisRateLimitBackend) take(buckets []bucketRef, cost int, force bool) (bool, time.Duration) {
+	now := time.Now()
+	taken := []string{}
+	costs := []int{}
+
+	refund := func() {
+		for i, key := range taken {
+			backend.client.do("DECRBY", key, strconv.Itoa(costs[i]))
+		}
+	}
+
+	for _, bucket := range buckets {
+		key, window := backend.windowKey(bucket, now)
+		bucketCost := clampCost(bucket.limits, cost)
+
+		// The expiry is set along with the count, so that no key is left
+		// behind for good. Keys of the current window keep being pushed out,
+		// but never past two windows after they were last counted on.
+		results, err := backend.client.transaction(
+			[]string{"INCRBY", key, strconv.Itoa(bucketCost)},
+			[]string{"PEXPIRE", key, strconv.FormatInt(int64(2*window/time.Millisecond), 10)},
+		)
+		if err == nil {
+			switch reply := results[0].(type) {
+			case int64:
+			case redisError:
+				err = reply
+			default:
+				err = fmt.Errorf("redis: unexpected reply to INCRBY: %v", reply)
+			}
+		}
+		if err != nil {
+			// Rather let traffic through than take the relay down with redis.
+			logBackendError("rate limit", err)
+			refund()
+			return true, 0
+		}
+		count := results[0].(int64)
+		taken = append(taken, key)
+		costs = append(costs, bucketCost)
+
+		if !force && count > int64(bucket.limits.MaxTokens) {
+			refund()
+			return false, time.Duration(int64(window) - now.UnixNano()%int64(window))
+		}
+	}
+
+	return true, 0
+}
+
+func (backend *redisRateLimitBackend) peek(bucket bucketRef) (float64, bool) {
+	key, _ := backend.windowKey(bucket, time.Now())
+
+	raw, err := backend.client.doBytes("GET", key)
+	if err != nil {
+		if err != errRedisNil {
+			logBackendError("rate limit", err)
+		}
+		return 0, false
+	}
+
+	count, err := strconv.Atoi(string(raw))
+	if err != nil {
+		return 0, false
+	}
+	return float64(bucket.limits.MaxTokens - count), true
+}
+
+func (backend *redisRateLimitBackend) close() {}
+
+// redisCacheBackend stores each cache entry under its own key, expiring along
+// with the entry (plus however long stale entries are kept around).
+type redisCacheBackend struct {
+	client    *redisClient
+	keyPrefix string
+}
+
+func (backend *redisCacheBackend) redisKey(key string) string {
+	return backend.keyPrefix + "cache:" + key
+}
+
+func (backend *redisCacheBackend) get(key string) (*cacheEntry, bool) {
+	raw, err := backend.client.doBytes("GET", backend.redisKey(key))
+	if err != nil {
+		if err != errRedisNil {
+			logBackendError("cache", err)
+		}
+		return nil, false
+	}
+
+	entry, err := decodeCacheEntry(raw)
+	if err != nil {
+		return nil, false
+	}
+	return entry, true
+}
+
+func (backend *redisCacheBackend) set(key string, entry *cacheEntry, keepFor time.Duration) {
+	raw, err := encodeCacheEntry(entry)
+	if err != nil {
+		return
+	}
+
+	millis := int64(keepFor / time.Millisecond)
+	if millis <= 0 {
+		return
+	}
+
+	_, err = backend.client.do("SET", backend.redisKey(key), string(raw), "PX", strconv.FormatInt(millis, 10))
+	if err != nil {
+		logBackendError("cache", err)
+	}
+}
+
+func (backend *redisCacheBackend) deletePrefix(prefix string) int {
+	keys, err := backend.client.scan(backend.redisKey(escapeRedisPattern(prefix))+"*", 0)
+	if err != nil {
+		logBackendError("cache", err)
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		if n, err := backend.client.doInt("DEL", key); err == nil {
+			deleted += int(n)
+		}
+	}
+	return deleted
+}
+
+func (backend *redisCacheBackend) entries(prefix string, limit int) []*cacheEntry {
+	keys, err := backend.client.scan(backend.redisKey(escapeRedisPattern(prefix))+"*", limit)
+	if err != nil {
+		logBackendError("cache", err)
+	}
+
+	retval := []*cacheEntry{}
+	for _, key := range keys {
+		if entry, ok := backend.get(key[len(backend.redisKey("")):]); ok {
+			retval = append(retval, entry)
+		}
+	}
+	return retval
+}
+
+func escapeRedisPattern(s string) string {
+	escaped := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, s[i])
+	}
+	return string(escaped)
+}
@@ -0,0 +1,379 @@
+package dohboy
+
+import (
+	"bufio"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadRedisReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    interface{}
+		wantErr string
+	}{
+		{name: "simple string", raw: "+OK\r\n", want: "OK"},
+		{name: "integer", raw: ":-42\r\n", want: int64(-42)},
+		{name: "bulk string", raw: "$5\r\nhe\r\no\r\n", want: []byte("he\r\no")},
+		{name: "empty bulk string", raw: "$0\r\n\r\n", want: []byte{}},
+		{name: "nil bulk string", raw: "$-1\r\n", want: nil},
+		{name: "array", raw: "*3\r\n:1\r\n$1\r\na\r\n*1\r\n+b\r\n", want: []interface{}{int64(1), []byte("a"), []interface{}{"b"}}},
+		{name: "error inside an array", raw: "*2\r\n-ERR nope\r\n:1\r\n", want: []interface{}{redisError("ERR nope"), int64(1)}},
+		{name: "error", raw: "-ERR wrong\r\n", wantErr: "ERR wrong"},
+		{name: "missing carriage return", raw: "+OK\n", wantErr: "malformed"},
+		{name: "unknown type", raw: "!1\r\n", wantErr: "unknown reply type"},
+		{name: "short bulk string", raw: "$10\r\nabc\r\n", wantErr: "EOF"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readRedisReply(bufio.NewReader(strings.NewReader(test.raw)))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("err = %v, want one containing [%v]", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("reply = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRedisClient(t *testing.T) {
+	t.Run("authenticates", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "sesame")
+		client := fake.client(2)
+		defer client.close()
+
+		if _, err := client.do("SET", "k", "v"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		wrong := fake.client(0)
+		wrong.password = "nope"
+		defer wrong.close()
+		if _, err := wrong.do("GET", "k"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+			t.Errorf("err = %v, want WRONGPASS", err)
+		}
+	})
+
+	t.Run("error replies keep the connection", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "")
+		client := fake.client(0)
+		defer client.close()
+
+		if _, err := client.do("BOGUS"); err == nil {
+			t.Fatalf("expected an error")
+		} else if _, isReplyErr := err.(redisError); !isReplyErr {
+			t.Fatalf("err = %#v, want a redisError", err)
+		}
+		if _, err := client.doInt("INCRBY", "n", "2"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got := fake.dialCount(); got != 1 {
+			t.Errorf("dialed %v times, want 1", got)
+		}
+
+		if _, err := client.doInt("GET", "n"); err == nil {
+			t.Errorf("expected an error for a bulk reply to doInt")
+		}
+		if _, err := client.doBytes("GET", "missing"); err != errRedisNil {
+			t.Errorf("err = %v, want errRedisNil", err)
+		}
+	})
+
+	t.Run("retries on a connection the server dropped", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "")
+		client := fake.client(0)
+		defer client.close()
+
+		if _, err := client.do("SET", "k", "v"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		fake.dropConnections()
+
+		value, err := client.doBytes("GET", "k")
+		if err != nil {
+			t.Fatalf("Unexpected error after the server dropped the connection: %v", err)
+		}
+		if string(value) != "v" {
+			t.Errorf("value = %s, want v", value)
+		}
+		if got := fake.dialCount(); got != 2 {
+			t.Errorf("dialed %v times, want 2", got)
+		}
+	})
+
+	t.Run("doesn't count twice when the reply is lost", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "")
+		client := fake.client(0)
+		defer client.close()
+
+		if _, err := client.doInt("INCRBY", "n", "1"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		fake.dropNextReplies(1)
+		if _, err := client.doInt("INCRBY", "n", "1"); err == nil {
+			t.Errorf("expected an error")
+		}
+		if count, _ := client.doBytes("GET", "n"); string(count) != "2" {
+			t.Errorf("count = %s, want 2", count)
+		}
+
+		fake.dropNextReplies(1)
+		if _, err := client.transaction([]string{"INCRBY", "n", "1"}); err == nil {
+			t.Errorf("expected an error")
+		}
+		if count, _ := client.doBytes("GET", "n"); string(count) != "3" {
+			t.Errorf("count = %s, want 3", count)
+		}
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "")
+		client := fake.client(0)
+		defer client.close()
+
+		results, err := client.transaction([]string{"INCRBY", "n", "2"}, []string{"PEXPIRE", "n", "60000"}, []string{"BOGUS"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if want := []interface{}{int64(2), int64(1), redisError("ERR unknown command 'BOGUS'")}; !reflect.DeepEqual(results, want) {
+			t.Errorf("results = %#v, want %#v", results, want)
+		}
+		if ttl, err := client.doInt("PTTL", "n"); err != nil || ttl <= 0 {
+			t.Errorf("PTTL = %v %v, want the expiry set along with the count", ttl, err)
+		}
+	})
+
+	t.Run("fails when the server is gone", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "")
+		client := fake.client(0)
+		defer client.close()
+
+		if _, err := client.do("GET", "k"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		fake.listener.Close()
+		fake.dropConnections()
+
+		if _, err := client.do("GET", "k"); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+
+	t.Run("scan pages through escaped patterns", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "")
+		client := fake.client(0)
+		defer client.close()
+
+		for _, key := range []string{"a*b:1", "a*b:2", "a*b:3", "axb:1", "a?b:1", "c:1"} {
+			if _, err := client.do("SET", key, "v"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+
+		keys, err := client.scan(escapeRedisPattern("a*b")+"*", 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		sort.Strings(keys)
+		if want := []string{"a*b:1", "a*b:2", "a*b:3"}; !reflect.DeepEqual(keys, want) {
+			t.Errorf("keys = %v, want %v", keys, want)
+		}
+
+		keys, err = client.scan("*", 4)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(keys) != 4 {
+			t.Errorf("keys = %v, want the first 4", keys)
+		}
+	})
+}
+
+func TestEscapeRedisPattern(t *testing.T) {
+	if got, want := escapeRedisPattern(`/dns-query|*.ex?mple[1]\`), `/dns-query|\*.ex\?mple\[1\]\\`; got != want {
+		t.Errorf("escapeRedisPattern = %v, want %v", got, want)
+	}
+}
+
+func TestRedisRateLimitBackend(t *testing.T) {
+	limits := BucketConfig{MaxTokens: 3, RecoverXTokensPerSec: 1}
+	ip := bucketRef{family: "ip", key: "198.51.100.1", limits: limits}
+	endpoint := bucketRef{family: "endpoint", key: "/dns-query", limits: BucketConfig{MaxTokens: 4, RecoverXTokensPerSec: 1}}
+
+	t.Run("window", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "")
+		backend := &redisRateLimitBackend{client: fake.client(0), keyPrefix: "test:"}
+		defer backend.client.close()
+
+		if _, tracked := backend.peek(ip); tracked {
+			t.Errorf("untouched bucket is tracked")
+		}
+
+		for i := 0; i < 3; i++ {
+			if ok, _ := backend.take([]bucketRef{ip}, 1, false); !ok {
+				t.Fatalf("take %v refused", i)
+			}
+		}
+		ok, retryAfter := backend.take([]bucketRef{ip}, 1, false)
+		if ok || retryAfter <= 0 || retryAfter > 3*time.Second {
+			t.Errorf("take = %v %v, want a refusal until the 3s window ends", ok, retryAfter)
+		}
+		if tokens, tracked := backend.peek(ip); !tracked || tokens != 0 {
+			t.Errorf("peek = %v %v, want 0 tokens left", tokens, tracked)
+		}
+
+		if ok, _ := backend.take([]bucketRef{ip}, 2, true); !ok {
+			t.Errorf("forced take refused")
+		}
+		if tokens, _ := backend.peek(ip); tokens != -2 {
+			t.Errorf("peek = %v, want -2 after a forced take", tokens)
+		}
+
+		key, window := backend.windowKey(ip, time.Now())
+		ttl, err := backend.client.doInt("PTTL", key)
+		if err != nil || ttl <= 0 || ttl > int64(2*window/time.Millisecond) {
+			t.Errorf("PTTL = %v %v, want the key to expire after two windows", ttl, err)
+		}
+	})
+
+	t.Run("all or nothing", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "")
+		backend := &redisRateLimitBackend{client: fake.client(0), keyPrefix: "test:"}
+		defer backend.client.close()
+
+		if ok, _ := backend.take([]bucketRef{endpoint}, 4, false); !ok {
+			t.Fatalf("take refused")
+		}
+		if ok, _ := backend.take([]bucketRef{ip, endpoint}, 1, false); ok {
+			t.Fatalf("take allowed past the full endpoint bucket")
+		}
+		if tokens, _ := backend.peek(ip); tokens != 3 {
+			t.Errorf("ip bucket has %v tokens left, want the refused take refunded", tokens)
+		}
+	})
+
+	t.Run("costs are clamped to the bucket", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "")
+		backend := &redisRateLimitBackend{client: fake.client(0), keyPrefix: "test:"}
+		defer backend.client.close()
+
+		if ok, _ := backend.take([]bucketRef{ip}, 10, false); !ok {
+			t.Errorf("expensive take refused on a full bucket")
+		}
+	})
+
+	t.Run("let through when redis fails", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "")
+		fake.failWith = "ERR out of memory"
+		backend := &redisRateLimitBackend{client: fake.client(0), keyPrefix: "test:"}
+		defer backend.client.close()
+
+		for i := 0; i < 5; i++ {
+			if ok, _ := backend.take([]bucketRef{ip}, 1, false); !ok {
+				t.Fatalf("take %v refused", i)
+			}
+		}
+		if _, tracked := backend.peek(ip); tracked {
+			t.Errorf("peek succeeded against a failing server")
+		}
+	})
+}
+
+func TestRedisCacheBackend(t *testing.T) {
+	entry := func(key string) *cacheEntry {
+		now := time.Now().Truncate(time.Second)
+		return &cacheEntry{Key: key, Wire: []byte{1, 2, 3}, StoredAt: now, ExpiresAt: now.Add(time.Minute)}
+	}
+
+	t.Run("get and set", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "")
+		backend := &redisCacheBackend{client: fake.client(0), keyPrefix: "test:"}
+		defer backend.client.close()
+
+		if _, found := backend.get("/dns-query|www.example.com.|A"); found {
+			t.Errorf("found an entry in an empty cache")
+		}
+
+		stored := entry("/dns-query|www.example.com.|A")
+		backend.set(stored.Key, stored, time.Minute)
+		got, found := backend.get(stored.Key)
+		if !found || got.Key != stored.Key || !reflect.DeepEqual(got.Wire, stored.Wire) || !got.ExpiresAt.Equal(stored.ExpiresAt) {
+			t.Errorf("get = %+v %v, want %+v", got, found, stored)
+		}
+
+		ttl, err := backend.client.doInt("PTTL", backend.redisKey(stored.Key))
+		if err != nil || ttl <= 59000 || ttl > 60000 {
+			t.Errorf("PTTL = %v %v, want about a minute", ttl, err)
+		}
+
+		backend.set("/dns-query|gone.example.com.|A", entry("gone"), 0)
+		if _, found := backend.get("/dns-query|gone.example.com.|A"); found {
+			t.Errorf("stored an entry with nothing left to keep it for")
+		}
+	})
+
+	t.Run("garbage is a miss", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "")
+		backend := &redisCacheBackend{client: fake.client(0), keyPrefix: "test:"}
+		defer backend.client.close()
+
+		backend.client.do("SET", backend.redisKey("k"), "not json")
+		if _, found := backend.get("k"); found {
+			t.Errorf("found a garbage entry")
+		}
+	})
+
+	t.Run("delete and list by prefix", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "")
+		backend := &redisCacheBackend{client: fake.client(0), keyPrefix: "test:"}
+		defer backend.client.close()
+
+		for _, key := range []string{"/a|*.example.com.|A", "/a|*.example.com.|AAAA", "/a|www.example.com.|A", "/b|*.example.com.|A"} {
+			backend.set(key, entry(key), time.Minute)
+		}
+
+		if got := len(backend.entries("/a|", 0)); got != 3 {
+			t.Errorf("entries(/a|) = %v, want 3", got)
+		}
+		if got := len(backend.entries("/a|", 2)); got != 2 {
+			t.Errorf("entries(/a|, 2) = %v, want 2", got)
+		}
+
+		if deleted := backend.deletePrefix("/a|*.example"); deleted != 2 {
+			t.Errorf("deleted %v, want only the two literal wildcard names", deleted)
+		}
+		if _, found := backend.get("/a|www.example.com.|A"); !found {
+			t.Errorf("deleted www.example.com. along with *.example.com.")
+		}
+		if _, found := backend.get("/b|*.example.com.|A"); !found {
+			t.Errorf("deleted another endpoint's entry")
+		}
+	})
+
+	t.Run("errors are misses", func(t *testing.T) {
+		fake := startFakeRedisServer(t, "")
+		backend := &redisCacheBackend{client: fake.client(0), keyPrefix: "test:"}
+		defer backend.client.close()
+
+		backend.set("k", entry("k"), time.Minute)
+		fake.failWith = "ERR out of memory"
+		if _, found := backend.get("k"); found {
+			t.Errorf("found an entry while redis fails")
+		}
+		if deleted := backend.deletePrefix(""); deleted != 0 {
+			t.Errorf("deleted %v while redis fails", deleted)
+		}
+	})
+}
@@ -2,60 +2,358 @@ package dohboy
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
 
 	"github.com/miekg/dns"
 )
 
 type relay struct {
-	upstreamMatrix     []upstream
+	upstreamMatrix     []*upstreamRule
+	defaultUpstreams   []*upstreamRule // tried in order; empty when disabled
+	refuseUnmatched    bool
+	privatePTR         bool
+	privatePTRRule     *upstreamRule // nil to answer private reverse lookups with NXDOMAIN
+	dns64              *dns64        // nil when DNS64 is disabled
+	splitQuestions     bool
+	maxQuestions       int
 	maximumTTLOverride uint32
+	cache              *responseCache // nil when response caching is disabled
+	nsec               *nsecCache     // nil when aggressive NSEC caching is disabled
+	flights            *flightGroup
+	metrics            *metrics
+	name               string
 }
 
-func (relay *relay) resolveDNSQuery(requestMsg *dns.Msg) (*dns.Msg, error) {
+const (
+	// The route of queries that no custom upstream matched.
+	defaultRoute = "default"
+	// The route of reverse lookups for private address space that no custom
+	// upstream matched.
+	privatePTRRoute = "private-ptr"
+)
+
+// answerUnforwardable answers the messages that can't be sent upstream as
+// they are, or returns nil for a plain query with a single question.
+func answerUnforwardable(requestMsg *dns.Msg) *dns.Msg {
+	responseMsg := dns.Msg{}
+
+	if requestMsg.Opcode != dns.OpcodeQuery {
+		// NOTIFY, UPDATE and friends are meant for the zone's own servers, not
+		// for a recursive resolver, let alone one relaying to a public one.
+		return responseMsg.SetRcode(requestMsg, dns.RcodeNotImplemented)
+	}
+
+	if rfc7873_isCookieOnlyQuery(requestMsg) {
+		return rfc7873_createCookieOnlyResponse(requestMsg)
+	}
+
 	if len(requestMsg.Question) != 1 {
 		// Format technically allows this (RFC1305) but in practice nobody seems to
 		// support it, including probably anything upstream of this relay. Specifics
 		// required to implement multiple questions are not universally defined.
-		responseMsg := dns.Msg{}
-		return responseMsg.SetRcodeFormatError(requestMsg), nil
+		return responseMsg.SetRcodeFormatError(requestMsg)
+	}
+
+	return nil
+}
+
+func (relay *relay) resolveDNSQuery(requestMsg *dns.Msg, client queryClient) (*dns.Msg, error) {
+	if responseMsg := answerUnforwardable(requestMsg); responseMsg != nil {
+		return responseMsg, nil
 	}
 
 	if rfc8482_canRejectForTypeAny(requestMsg) {
 		return rfc8482_createResponse(requestMsg)
 	}
 
-	for _, upstream := range relay.upstreamMatrix {
-		matched, resp, err := upstream.resolveIfMatched(requestMsg)
-		if matched {
-			if err != nil && relay.maximumTTLOverride != 0 {
-				overrideAnyLargeTTL(resp, relay.maximumTTLOverride)
+	rule, route := relay.route(requestMsg, client)
+	if route == privatePTRRoute && rule == nil {
+		return rfc6303_createResponse(requestMsg), nil
+	}
+	if route == defaultRoute && relay.refuseUnmatched {
+		responseMsg := dns.Msg{}
+		return responseMsg.SetRcode(requestMsg, dns.RcodeRefused), nil
+	}
+
+	resp, upstream, err := relay.resolveRoute(requestMsg, rule, route)
+
+	if err == nil && relay.dns64.applies(requestMsg, client) && relay.dns64.needsSynthesis(resp) {
+		// The A query goes the same way the AAAA query went.
+		aQuery := requestMsg.Copy()
+		aQuery.Question[0].Qtype = dns.TypeA
+
+		aResp, _, aErr := relay.resolveRoute(aQuery, rule, route)
+		if aErr == nil {
+			if synthesized := relay.dns64.synthesize(requestMsg, resp, aResp); synthesized != nil {
+				relay.metrics.incr("dns64_synthesized", relay.name)
+				resp = synthesized
 			}
+		}
+	}
+
+	if answered := relay.answeringRule(rule, upstream); err == nil && answered != nil {
+		answered.post.processForClient(resp, client)
+	}
+
+	return resp, err
+}
+
+// answeringRule returns the rule whose upstream, going by its name, answered a
+// query routed to the given rule. On the default route, that's whichever
+// default upstream answered. Nil means no upstream did, e.g. for synthesized
+// responses.
+func (relay *relay) answeringRule(rule *upstreamRule, upstream string) *upstreamRule {
+	if rule != nil {
+		return rule
+	}
+	for _, rule := range relay.defaultUpstreams {
+		if rule.upstream.status.Name == upstream {
+			return rule
+		}
+	}
+	return nil
+}
+
+// resolveRoute answers a query from the cache or through the route picked for
+// it, along with the name of the upstream that answered it.
+func (relay *relay) resolveRoute(requestMsg *dns.Msg, rule *upstreamRule, route string) (*dns.Msg, string, error) {
+	// Responses are cached and coalesced per route, since the same question
+	// can be answered differently depending on who asked it.
+	var stale *dns.Msg
+	var staleUpstream string
+	if relay.cache != nil {
+		cached, upstream, isStale := relay.cache.lookup(requestMsg, route)
+		if cached != nil && !isStale {
+			return cached, upstream, nil
+		}
+		stale, staleUpstream = cached, upstream
+	}
+
+	if relay.nsec != nil {
+		if synthesized := relay.nsec.synthesize(route, requestMsg); synthesized != nil {
+			relay.metrics.incr("nsec_synthesized", relay.name)
+			return synthesized, "", nil
+		}
+	}
+
+	resp, upstream, coalesced, shared, err := relay.flights.do(questionKey(requestMsg)+"|"+route, requestMsg, func() (*dns.Msg, string, error) {
+		resp, upstream, err := relay.resolveUpstream(requestMsg, rule, route)
+		if err != nil && stale != nil {
+			log.Printf("answering with stale cache entry after upstream error: %v", err)
+			return stale, staleUpstream, nil
+		}
+		return resp, upstream, err
+	})
+
+	if shared {
+		relay.metrics.incr("coalesced", relay.name)
+	} else if coalesced > 0 {
+		log.Printf("coalesced %v queries into one upstream exchange for [%v]", coalesced, describeQuestion(requestMsg))
+	}
+
+	return resp, upstream, err
+}
+
+// route picks the first custom upstream rule matching the query, along with a
+// key for the route taken. A nil rule means the query goes to the default
+// upstreams, or for private reverse lookups, is answered locally.
+func (relay *relay) route(requestMsg *dns.Msg, client queryClient) (*upstreamRule, string) {
+	for i, rule := range relay.upstreamMatrix {
+		if matched, _ := rule.matcher.match(requestMsg, client); matched {
+			return rule, strconv.Itoa(i)
+		}
+	}
+
+	if relay.privatePTR && rfc6303_isPrivateReverseName(requestMsg.Question[0].Name) {
+		return relay.privatePTRRule, privatePTRRoute
+	}
+
+	return nil, defaultRoute
+}
+
+// explain describes how a query would be routed.
+func (relay *relay) explain(requestMsg *dns.Msg, client queryClient) routeExplanation {
+	retval := routeExplanation{
+		Question: describeQuestion(requestMsg),
+		Rules:    []ruleEvaluation{},
+	}
+
+	for _, rule := range relay.upstreamMatrix {
+		matched, reason := rule.matcher.match(requestMsg, client)
+		retval.Rules = append(retval.Rules, ruleEvaluation{
+			Upstream: rule.upstream.status.Name,
+			Matched:  matched,
+			Reason:   reason,
+		})
+		if matched {
+			retval.Result = rule.upstream.status.Name
+			return retval
+		}
+	}
 
-			return resp, err
+	if relay.privatePTR && rfc6303_isPrivateReverseName(requestMsg.Question[0].Name) {
+		if relay.privatePTRRule != nil {
+			retval.Result = relay.privatePTRRule.upstream.status.Name
+		} else {
+			retval.Result = "NXDOMAIN (private reverse lookup)"
 		}
+		return retval
+	}
+
+	if relay.refuseUnmatched {
+		retval.Result = "REFUSED (no default upstream)"
+		return retval
 	}
 
-	return nil, errors.New("No matched upstreams found.")
+	names := make([]string, 0, len(relay.defaultUpstreams))
+	for _, rule := range relay.defaultUpstreams {
+		names = append(names, rule.upstream.status.Name)
+	}
+	retval.Result = fmt.Sprintf("default upstreams, in order: [%v]", strings.Join(names, ", "))
+	return retval
 }
 
-func newRelay(config *Config) *relay {
-	upstreamMatrix := make([]upstream, 0, len(config.Upstream.Custom)+1)
+// resolveUpstream answers a query through the rule's upstream, or through the
+// default upstreams if there is no rule, along with the name of the upstream
+// that answered it.
+func (relay *relay) resolveUpstream(requestMsg *dns.Msg, rule *upstreamRule, route string) (*dns.Msg, string, error) {
+	upstreamQuery := rfc7873_withoutCookie(requestMsg)
+	if relay.nsec != nil {
+		upstreamQuery = rfc8198_withDO(upstreamQuery)
+	}
 
-	for _, config := range config.Upstream.Custom {
-		us, err := createUpstream(config)
+	if rule != nil {
+		resp, err := rule.upstream.resolve(upstreamQuery)
 		if err != nil {
-			log.Printf("ERR: Configured upstream for pattern [%v] is bad. The upstream won't be included.", config.NameRegex)
+			return nil, "", err
+		}
+		return relay.finishUpstream(requestMsg, route, rule, resp), rule.upstream.status.Name, nil
+	}
+
+	var err error = errors.New("No matched upstreams found.")
+	for _, rule := range relay.defaultUpstreams {
+		var resp *dns.Msg
+		resp, err = rule.upstream.resolve(upstreamQuery)
+		if err == nil {
+			return relay.finishUpstream(requestMsg, route, rule, resp), rule.upstream.status.Name, nil
+		}
+	}
+
+	return nil, "", err
+}
+
+// finishUpstream post-processes and caches a response from the rule's
+// upstream.
+func (relay *relay) finishUpstream(requestMsg *dns.Msg, route string, rule *upstreamRule, resp *dns.Msg) *dns.Msg {
+	rfc7873_removeCookie(resp)
+	if relay.nsec != nil {
+		relay.nsec.learn(route, resp)
+		rfc8198_stripDNSSEC(resp, requestMsg)
+	}
+	rule.post.process(resp)
+	if relay.maximumTTLOverride != 0 {
+		overrideAnyLargeTTL(resp, relay.maximumTTLOverride)
+	}
+
+	if relay.cache != nil {
+		relay.cache.store(requestMsg, route, rule.upstream.status.Name, resp)
+	}
+
+	return resp
+}
+
+func (relay *relay) upstreamStatuses() []upstreamStatus {
+	retval := make([]upstreamStatus, 0, len(relay.upstreamMatrix)+len(relay.defaultUpstreams))
+	for _, rule := range relay.upstreamMatrix {
+		retval = append(retval, rule.upstream.snapshot())
+	}
+	if relay.privatePTRRule != nil {
+		retval = append(retval, relay.privatePTRRule.upstream.snapshot())
+	}
+	for _, rule := range relay.defaultUpstreams {
+		retval = append(retval, rule.upstream.snapshot())
+	}
+	return retval
+}
+
+func newRelay(name string, config *UpstreamSettings, cache *responseCache, nsec *nsecCache, cookies *cookieSecrets, metrics *metrics, stats *queryStats) *relay {
+	upstreamMatrix := make([]*upstreamRule, 0, len(config.Custom))
+
+	for _, config := range config.Custom {
+		matcher, err := newUpstreamMatcher(config)
+		if err == nil {
+			pattern := config.NameRegex
+			if pattern == "" {
+				pattern = "*"
+			}
+			name := fmt.Sprintf("%v -> %v", pattern, upstreamTarget(config))
+
+			var rule *upstreamRule
+			if rule, err = newUpstreamRule(config, name, matcher, cookies, stats); err == nil {
+				upstreamMatrix = append(upstreamMatrix, rule)
+				continue
+			}
+		}
+		log.Printf("ERR: Configured upstream for pattern [%v] is bad. The upstream won't be included.", config.NameRegex)
+		log.Printf("ERR: %v", err)
+	}
+
+	defaultUpstreams := []*upstreamRule{}
+	if config.Default.Enabled {
+		defaultConfigs := config.Default.Upstreams
+		if len(defaultConfigs) == 0 {
+			defaultConfigs = []UpstreamConfig{builtinDefaultUpstreamConfig}
+		}
+
+		for _, config := range defaultConfigs {
+			rule, err := newUpstreamRule(config, "default -> "+upstreamTarget(config), nil, cookies, stats)
+			if err != nil {
+				log.Printf("ERR: Configured default upstream [%v] is bad. The upstream won't be included.", upstreamTarget(config))
+				log.Printf("ERR: %v", err)
+				continue
+			}
+			defaultUpstreams = append(defaultUpstreams, rule)
+		}
+	}
+
+	var synthesizer *dns64
+	if config.DNS64.Enabled {
+		var err error
+		if synthesizer, err = newDNS64(&config.DNS64); err != nil {
+			log.Printf("ERR: DNS64 config is bad. DNS64 won't be enabled.")
 			log.Printf("ERR: %v", err)
-			continue
 		}
-		upstreamMatrix = append(upstreamMatrix, us)
 	}
 
-	upstreamMatrix = append(upstreamMatrix, createDefaultDnsOverHttpsUpstream())
+	var privatePTRRule *upstreamRule
+	if config.PrivatePTR.Enabled && config.PrivatePTR.Upstream != nil {
+		rule, err := newUpstreamRule(*config.PrivatePTR.Upstream, "private ptr -> "+upstreamTarget(*config.PrivatePTR.Upstream), nil, cookies, stats)
+		if err != nil {
+			// Falling back to the default upstreams would leak the lookups.
+			log.Printf("ERR: Configured private ptr upstream [%v] is bad. Private reverse lookups will get NXDOMAIN.", upstreamTarget(*config.PrivatePTR.Upstream))
+			log.Printf("ERR: %v", err)
+		} else {
+			privatePTRRule = rule
+		}
+	}
 
 	return &relay{
 		upstreamMatrix:     upstreamMatrix,
-		maximumTTLOverride: config.Upstream.MaximumTTLOverrideSeconds,
+		defaultUpstreams:   defaultUpstreams,
+		refuseUnmatched:    !config.Default.Enabled,
+		privatePTR:         config.PrivatePTR.Enabled,
+		privatePTRRule:     privatePTRRule,
+		dns64:              synthesizer,
+		splitQuestions:     config.SplitMultipleQuestions,
+		maxQuestions:       config.MaxQuestions,
+		maximumTTLOverride: config.MaximumTTLOverrideSeconds,
+		cache:              cache,
+		nsec:               nsec,
+		flights:            newFlightGroup(),
+		metrics:            metrics,
+		name:               name,
 	}
 }
@@ -0,0 +1,357 @@
+package dohboy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startAnsweringServer starts a fake DNS server answering every A query with
+// the given address.
+func startAnsweringServer(t *testing.T, ip string) *fakeDNSServer {
+	t.Helper()
+	return startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		return replyA(query, ip, 300)
+	})
+}
+
+func dnsUpstreamConfig(regex string, address string) UpstreamConfig {
+	return UpstreamConfig{NameRegex: regex, Type: "dns", Address: address, TimeoutMillis: 1000}
+}
+
+func newTestRelay(settings UpstreamSettings) *relay {
+	return newRelay("/dns-query", &settings, nil, nil, nil, newMetrics(), newQueryStats())
+}
+
+func TestRegexRoutingOrder(t *testing.T) {
+	exact := startAnsweringServer(t, "192.0.2.1")
+	suffix := startAnsweringServer(t, "192.0.2.2")
+	fallback := startAnsweringServer(t, "192.0.2.3")
+
+	tests := []struct {
+		name    string
+		custom  []UpstreamConfig
+		qname   string
+		wantIP  string
+		wantVia string
+	}{
+		{
+			name: "first matching rule wins",
+			custom: []UpstreamConfig{
+				dnsUpstreamConfig(`^www\.example\.com\.$`, exact.address),
+				dnsUpstreamConfig(`example\.com\.$`, suffix.address),
+			},
+			qname:   "www.example.com.",
+			wantIP:  "192.0.2.1",
+			wantVia: `^www\.example\.com\.$ -> ` + exact.address,
+		},
+		{
+			name: "later rule when the first doesn't match",
+			custom: []UpstreamConfig{
+				dnsUpstreamConfig(`^www\.example\.com\.$`, exact.address),
+				dnsUpstreamConfig(`example\.com\.$`, suffix.address),
+			},
+			qname:   "mail.example.com.",
+			wantIP:  "192.0.2.2",
+			wantVia: `example\.com\.$ -> ` + suffix.address,
+		},
+		{
+			name: "a broader rule first shadows the narrower one",
+			custom: []UpstreamConfig{
+				dnsUpstreamConfig(`example\.com\.$`, suffix.address),
+				dnsUpstreamConfig(`^www\.example\.com\.$`, exact.address),
+			},
+			qname:   "www.example.com.",
+			wantIP:  "192.0.2.2",
+			wantVia: `example\.com\.$ -> ` + suffix.address,
+		},
+		{
+			name: "default when nothing matches",
+			custom: []UpstreamConfig{
+				dnsUpstreamConfig(`example\.com\.$`, suffix.address),
+			},
+			qname:   "www.example.org.",
+			wantIP:  "192.0.2.3",
+			wantVia: defaultRoute,
+		},
+		{
+			name: "bad rules are skipped",
+			custom: []UpstreamConfig{
+				dnsUpstreamConfig(`(`, exact.address),
+				dnsUpstreamConfig(`example\.com\.$`, suffix.address),
+			},
+			qname:   "www.example.com.",
+			wantIP:  "192.0.2.2",
+			wantVia: `example\.com\.$ -> ` + suffix.address,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			relay := newTestRelay(UpstreamSettings{
+				Custom:  test.custom,
+				Default: DefaultUpstreamSettings{Enabled: true, Upstreams: []UpstreamConfig{dnsUpstreamConfig("", fallback.address)}},
+			})
+			query := newTestQuery(test.qname, dns.TypeA)
+
+			resp, err := relay.resolveDNSQuery(query, queryClient{})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := answeredIP(resp); got != test.wantIP {
+				t.Errorf("answered %v, want %v", got, test.wantIP)
+			}
+
+			via := defaultRoute
+			if rule, _ := relay.route(query, queryClient{}); rule != nil {
+				via = rule.upstream.status.Name
+			}
+			if via != test.wantVia {
+				t.Errorf("routed via %v, want %v", via, test.wantVia)
+			}
+		})
+	}
+}
+
+func TestDefaultUpstreams(t *testing.T) {
+	dead := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		// A response for some other question, over both udp and tcp.
+		resp.Question[0].Name = "elsewhere.example."
+		return resp
+	})
+	alive := startAnsweringServer(t, "192.0.2.1")
+	doh := startFakeDoHServer(t, func(query *dns.Msg) *dns.Msg {
+		return replyA(query, "192.0.2.9", 300)
+	})
+
+	t.Run("tried in order until one answers", func(t *testing.T) {
+		relay := newTestRelay(UpstreamSettings{
+			Default: DefaultUpstreamSettings{Enabled: true, Upstreams: []UpstreamConfig{
+				dnsUpstreamConfig("", dead.address),
+				dnsUpstreamConfig("", alive.address),
+			}},
+		})
+
+		resp, err := relay.resolveDNSQuery(newTestQuery("www.example.com.", dns.TypeA), queryClient{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got := answeredIP(resp); got != "192.0.2.1" {
+			t.Errorf("answered %v, want 192.0.2.1", got)
+		}
+
+		statuses := relay.upstreamStatuses()
+		if len(statuses) != 2 || statuses[0].Healthy || !statuses[1].Healthy {
+			t.Errorf("statuses = %+v, want the first unhealthy and the second healthy", statuses)
+		}
+	})
+
+	t.Run("doh", func(t *testing.T) {
+		relay := newTestRelay(UpstreamSettings{
+			Default: DefaultUpstreamSettings{Enabled: true, Upstreams: []UpstreamConfig{
+				{Type: "doh", Address: doh.URL + "/dns-query", TimeoutMillis: 1000},
+			}},
+		})
+		relay.defaultUpstreams[0].upstream.upstream = doh.upstream(t)
+
+		resp, err := relay.resolveDNSQuery(newTestQuery("www.example.com.", dns.TypeA), queryClient{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got := answeredIP(resp); got != "192.0.2.9" {
+			t.Errorf("answered %v, want 192.0.2.9", got)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		relay := newTestRelay(UpstreamSettings{
+			Custom:  []UpstreamConfig{dnsUpstreamConfig(`example\.com\.$`, alive.address)},
+			Default: DefaultUpstreamSettings{Enabled: false},
+		})
+
+		resp, err := relay.resolveDNSQuery(newTestQuery("www.example.org.", dns.TypeA), queryClient{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if resp.Rcode != dns.RcodeRefused {
+			t.Errorf("rcode = %v, want REFUSED", dns.RcodeToString[resp.Rcode])
+		}
+	})
+}
+
+func TestRelayCachesResponses(t *testing.T) {
+	fake := startAnsweringServer(t, "192.0.2.1")
+	config, err := parseConfigFile("")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	backends := newBackends(config)
+	defer backends.close()
+	cache := newResponseCache(backends.newCacheBackend(), "/dns-query", &config.Caching)
+
+	settings := UpstreamSettings{
+		Default: DefaultUpstreamSettings{Enabled: true, Upstreams: []UpstreamConfig{dnsUpstreamConfig("", fake.address)}},
+	}
+	relay := newRelay("/dns-query", &settings, cache, nil, nil, newMetrics(), newQueryStats())
+
+	for i := 0; i < 3; i++ {
+		query := newTestQuery("www.example.com.", dns.TypeA)
+		resp, err := relay.resolveDNSQuery(query, queryClient{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if resp.Id != query.Id {
+			t.Errorf("Id = %v, want %v", resp.Id, query.Id)
+		}
+		if got := answeredIP(resp); got != "192.0.2.1" {
+			t.Errorf("answered %v, want 192.0.2.1", got)
+		}
+	}
+
+	if got := fake.queryCount("udp"); got != 1 {
+		t.Errorf("upstream got %v queries, want 1", got)
+	}
+}
+
+func TestDefaultUpstreamPostProcessing(t *testing.T) {
+	dead := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.Question[0].Name = "elsewhere.example."
+		return resp
+	})
+	alive := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.Answer = append(resp.Answer, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 300},
+			AAAA: net.ParseIP("2001:db8::1"),
+		})
+		return resp
+	})
+	ipv4Only := PostProcessConfig{FilterAAAAClients: []string{"198.51.100.0/24"}}
+
+	tests := []struct {
+		name       string
+		deadPost   PostProcessConfig
+		alivePost  PostProcessConfig
+		wantAnswer int
+	}{
+		{name: "the answering upstream filters", alivePost: ipv4Only, wantAnswer: 0},
+		{name: "only an upstream that failed filters", deadPost: ipv4Only, wantAnswer: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := parseConfigFile("")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			backends := newBackends(config)
+			defer backends.close()
+			cache := newResponseCache(backends.newCacheBackend(), "/dns-query", &config.Caching)
+
+			deadConfig := dnsUpstreamConfig("", dead.address)
+			deadConfig.PostProcessing = test.deadPost
+			aliveConfig := dnsUpstreamConfig("", alive.address)
+			aliveConfig.PostProcessing = test.alivePost
+			settings := UpstreamSettings{
+				Default: DefaultUpstreamSettings{Enabled: true, Upstreams: []UpstreamConfig{deadConfig, aliveConfig}},
+			}
+			relay := newRelay("/dns-query", &settings, cache, nil, nil, newMetrics(), newQueryStats())
+
+			before := alive.queryCount("udp")
+			client := queryClient{ip: net.ParseIP("198.51.100.7")}
+			for i := 0; i < 2; i++ {
+				resp, err := relay.resolveDNSQuery(newTestQuery("www.example.com.", dns.TypeAAAA), client)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if len(resp.Answer) != test.wantAnswer {
+					t.Errorf("query %v: answer = %v, want %v records", i+1, resp.Answer, test.wantAnswer)
+				}
+			}
+
+			if got := alive.queryCount("udp") - before; got != 1 {
+				t.Errorf("upstream got %v queries, want the second answered from the cache", got)
+			}
+		})
+	}
+}
+
+func TestRelayKeepsClientSubnetsApart(t *testing.T) {
+	fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		// Long enough for identical queries to pile up behind this one.
+		time.Sleep(100 * time.Millisecond)
+		ip := "192.0.2.100"
+		if opt := query.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+					ip = fmt.Sprintf("192.0.2.%v", ecs.Address.To4()[2])
+				}
+			}
+		}
+		return replyA(query, ip, 300)
+	})
+	relay := newTestRelay(UpstreamSettings{
+		Default: DefaultUpstreamSettings{Enabled: true, Upstreams: []UpstreamConfig{dnsUpstreamConfig("", fake.address)}},
+	})
+
+	withSubnet := func(subnet string) *dns.Msg {
+		query := newTestQuery("www.example.com.", dns.TypeA)
+		if subnet != "" {
+			query.SetEdns0(1232, false)
+			opt := query.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 24,
+				Address:       net.ParseIP(subnet),
+			})
+		}
+		return query
+	}
+
+	tests := []struct {
+		subnet string
+		wantIP string
+	}{
+		{subnet: "198.51.1.0", wantIP: "192.0.2.1"},
+		{subnet: "198.51.1.77", wantIP: "192.0.2.1"}, // the same /24
+		{subnet: "198.51.2.0", wantIP: "192.0.2.2"},
+		{subnet: "", wantIP: "192.0.2.100"},
+		{subnet: "", wantIP: "192.0.2.100"},
+	}
+
+	var wg sync.WaitGroup
+	answers := make([]string, len(tests))
+	for i, test := range tests {
+		wg.Add(1)
+		go func(i int, subnet string) {
+			defer wg.Done()
+			resp, err := relay.resolveDNSQuery(withSubnet(subnet), queryClient{})
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			answers[i] = answeredIP(resp)
+		}(i, test.subnet)
+	}
+	wg.Wait()
+
+	for i, test := range tests {
+		if answers[i] != test.wantIP {
+			t.Errorf("query from [%v] answered %v, want %v", test.subnet, answers[i], test.wantIP)
+		}
+	}
+	if got := fake.queryCount("udp"); got != 3 {
+		t.Errorf("upstream got %v queries, want one per subnet", got)
+	}
+}
@@ -0,0 +1,76 @@
+package dohboy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRFC2308(t *testing.T) {
+	const soa = "example.com. 900 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300"
+
+	tests := []struct {
+		name         string
+		notResponse  bool
+		rcode        int
+		answer       []string
+		ns           []string
+		wantNegative bool
+		wantNODATA   bool
+		wantTTL      uint32
+	}{
+		{name: "positive answer", answer: []string{"example.com. 60 IN A 192.0.2.1"}},
+		{name: "NXDOMAIN", rcode: dns.RcodeNameError, ns: []string{soa}, wantNegative: true, wantTTL: 300},
+		{name: "NODATA", ns: []string{soa}, wantNegative: true, wantNODATA: true, wantTTL: 300},
+		{
+			name:         "SOA TTL below its minimum",
+			rcode:        dns.RcodeNameError,
+			ns:           []string{"example.com. 30 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300"},
+			wantNegative: true,
+			wantTTL:      30,
+		},
+		{name: "NXDOMAIN without SOA", rcode: dns.RcodeNameError, wantNegative: true, wantTTL: 0},
+		{name: "SERVFAIL", rcode: dns.RcodeServerFailure},
+		{name: "a query rather than a response", notResponse: true, rcode: dns.RcodeNameError, ns: []string{soa}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := newTestResponse(t, test.rcode, test.answer, test.ns, nil)
+			msg.Response = !test.notResponse
+
+			if got := rfc2308_isNegativeResponse(msg); got != test.wantNegative {
+				t.Errorf("isNegativeResponse = %v, want %v", got, test.wantNegative)
+			}
+			if got := rfc2308_isNODATA(msg); got != test.wantNODATA {
+				t.Errorf("isNODATA = %v, want %v", got, test.wantNODATA)
+			}
+			if test.wantNegative {
+				if got := rfc2308_getTTLForNegativeResponse(msg); got != test.wantTTL {
+					t.Errorf("negative TTL = %v, want %v", got, test.wantTTL)
+				}
+			}
+		})
+	}
+
+	if rfc2308_isNegativeResponse(nil) || rfc2308_isNODATA(nil) {
+		t.Errorf("nil responses aren't negative")
+	}
+}
+
+func TestMinOf(t *testing.T) {
+	tests := []struct {
+		vars []uint32
+		want uint32
+	}{
+		{vars: []uint32{5}, want: 5},
+		{vars: []uint32{5, 3, 9}, want: 3},
+		{vars: []uint32{0, 3}, want: 0},
+	}
+
+	for _, test := range tests {
+		if got := minOf(test.vars...); got != test.want {
+			t.Errorf("minOf(%v) = %v, want %v", test.vars, got, test.want)
+		}
+	}
+}
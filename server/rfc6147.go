@@ -0,0 +1,160 @@
+package dohboy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// dns64 synthesizes AAAA records out of A records for names that have no IPv6
+// address, so that IPv6-only clients can reach them through a NAT64 gateway.
+type dns64 struct {
+	prefix         *net.IPNet
+	excludedIPv4   cidrList // A records that aren't synthesized from
+	excludedIPv6   cidrList // AAAA records that are treated as if they weren't there
+	clientNetworks cidrList // empty means every client
+}
+
+func newDNS64(config *DNS64Config) (*dns64, error) {
+	_, prefix, err := net.ParseCIDR(config.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC6052 2.2: these are the only prefix lengths an address can be
+	// embedded in.
+	ones, bits := prefix.Mask.Size()
+	if bits != 8*net.IPv6len || (ones != 32 && ones != 40 && ones != 48 && ones != 56 && ones != 64 && ones != 96) {
+		return nil, fmt.Errorf("NAT64 prefix [%v] must be an IPv6 prefix of length 32, 40, 48, 56, 64 or 96.", config.Prefix)
+	}
+
+	excludedIPv4, err := parseCIDRs(config.ExcludedIPv4)
+	if err != nil {
+		return nil, err
+	}
+
+	excludedIPv6, err := parseCIDRs(config.ExcludedIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	clientNetworks, err := parseCIDRs(config.ClientCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dns64{
+		prefix:         prefix,
+		excludedIPv4:   excludedIPv4,
+		excludedIPv6:   excludedIPv6,
+		clientNetworks: clientNetworks,
+	}, nil
+}
+
+// applies checks whether a query from a client is one to synthesize answers
+// for.
+func (d64 *dns64) applies(dnsQuery *dns.Msg, client queryClient) bool {
+	if d64 == nil || dnsQuery.Question[0].Qtype != dns.TypeAAAA {
+		return false
+	}
+
+	// RFC6147 5.5: a client validating DNSSEC itself would reject synthesized
+	// records, so it gets the real answer.
+	if opt := dnsQuery.IsEdns0(); dnsQuery.CheckingDisabled && opt != nil && opt.Do() {
+		return false
+	}
+
+	return len(d64.clientNetworks) == 0 || d64.clientNetworks.contains(client.ip)
+}
+
+// needsSynthesis checks whether an AAAA response has no usable AAAA records.
+// Per RFC6147 5.1.4, records in the excluded networks don't count.
+func (d64 *dns64) needsSynthesis(aaaaResponse *dns.Msg) bool {
+	if aaaaResponse == nil || aaaaResponse.Rcode != dns.RcodeSuccess {
+		return false
+	}
+
+	if rfc2308_isNODATA(aaaaResponse) {
+		return true
+	}
+
+	for _, rr := range aaaaResponse.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok && !d64.excludedIPv6.contains(aaaa.AAAA) {
+			return false
+		}
+	}
+	return true
+}
+
+// synthesize builds the AAAA response out of the A response. Nil is returned
+// if there was nothing to synthesize from.
+func (d64 *dns64) synthesize(aaaaQuery *dns.Msg, aaaaResponse *dns.Msg, aResponse *dns.Msg) *dns.Msg {
+	if aResponse == nil || aResponse.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	// RFC6147 5.1.7: synthesized records live no longer than the negative
+	// answer to the AAAA query would have.
+	maxTTL := rfc2308_getTTLForNegativeResponse(aaaaResponse)
+	if maxTTL == 0 {
+		maxTTL = 600
+	}
+
+	answer := make([]dns.RR, 0, len(aResponse.Answer))
+	synthesized := 0
+	for _, rr := range aResponse.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			// CNAMEs and DNAMEs leading up to the A records are kept as they
+			// are. Anything else, RRSIGs over the A records in particular,
+			// doesn't fit the synthesized answer.
+			if rrtype := rr.Header().Rrtype; rrtype == dns.TypeCNAME || rrtype == dns.TypeDNAME {
+				answer = append(answer, dns.Copy(rr))
+			}
+			continue
+		}
+		if d64.excludedIPv4.contains(a.A) {
+			continue
+		}
+
+		header := a.Hdr
+		header.Rrtype = dns.TypeAAAA
+		header.Rdlength = 0
+		header.Ttl = minOf(header.Ttl, maxTTL)
+		answer = append(answer, &dns.AAAA{Hdr: header, AAAA: rfc6052_embed(d64.prefix, a.A)})
+		synthesized++
+	}
+
+	if synthesized == 0 {
+		return nil
+	}
+
+	responseMsg := aResponse.Copy()
+	responseMsg.Id = aaaaQuery.Id
+	responseMsg.Question = append([]dns.Question(nil), aaaaQuery.Question...)
+	responseMsg.Answer = answer
+	responseMsg.Ns = nil
+	// RFC6147 5.5: synthesized records can't have been validated.
+	responseMsg.AuthenticatedData = false
+	return responseMsg
+}
+
+// rfc6052_embed embeds an IPv4 address in a NAT64 prefix, skipping over bits
+// 64 to 71 as RFC6052 2.2 requires.
+func rfc6052_embed(prefix *net.IPNet, ipv4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+
+	retval := make(net.IP, net.IPv6len)
+	copy(retval, prefix.IP.To16())
+
+	pos := ones / 8
+	for _, b := range ipv4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		retval[pos] = b
+		pos++
+	}
+	return retval
+}
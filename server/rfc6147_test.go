@@ -0,0 +1,218 @@
+package dohboy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newTestDNS64(t *testing.T, config DNS64Config) *dns64 {
+	t.Helper()
+	if config.Prefix == "" {
+		config.Prefix = "64:ff9b::/96"
+	}
+	d64, err := newDNS64(&config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return d64
+}
+
+func TestRFC6052Embed(t *testing.T) {
+	// RFC6052 2.4, with 192.0.2.33 embedded in every prefix length.
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{prefix: "2001:db8::/32", want: "2001:db8:c000:221::"},
+		{prefix: "2001:db8:100::/40", want: "2001:db8:1c0:2:21::"},
+		{prefix: "2001:db8:122::/48", want: "2001:db8:122:c000:2:2100::"},
+		{prefix: "2001:db8:122:300::/56", want: "2001:db8:122:3c0:0:221::"},
+		{prefix: "2001:db8:122:344::/64", want: "2001:db8:122:344:c0:2:2100:0"},
+		{prefix: "2001:db8:122:344::/96", want: "2001:db8:122:344::c000:221"},
+		{prefix: "64:ff9b::/96", want: "64:ff9b::c000:221"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.prefix, func(t *testing.T) {
+			_, prefix, err := net.ParseCIDR(test.prefix)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if got := rfc6052_embed(prefix, net.ParseIP("192.0.2.33")); !got.Equal(net.ParseIP(test.want)) {
+				t.Errorf("embedded = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewDNS64(t *testing.T) {
+	for _, prefix := range []string{"64:ff9b::/88", "64:ff9b::/128", "192.0.2.0/24", "not a prefix"} {
+		if _, err := newDNS64(&DNS64Config{Prefix: prefix}); err == nil {
+			t.Errorf("%v: expected an error", prefix)
+		}
+	}
+}
+
+func TestDNS64NeedsSynthesis(t *testing.T) {
+	d64 := newTestDNS64(t, DNS64Config{ExcludedIPv6: []string{"::ffff:0:0/96", "2001:db8:dead::/48"}})
+
+	tests := []struct {
+		name   string
+		rcode  int
+		answer []string
+		want   bool
+	}{
+		{name: "NODATA", want: true},
+		{name: "NXDOMAIN", rcode: dns.RcodeNameError},
+		{name: "SERVFAIL", rcode: dns.RcodeServerFailure},
+		{name: "usable AAAA", answer: []string{"example.com. 60 IN AAAA 2001:db8::1"}},
+		{
+			name:   "only excluded AAAA",
+			answer: []string{"example.com. 60 IN AAAA ::ffff:192.0.2.1", "example.com. 60 IN AAAA 2001:db8:dead::1"},
+			want:   true,
+		},
+		{
+			name:   "excluded and usable AAAA",
+			answer: []string{"example.com. 60 IN AAAA 2001:db8:dead::1", "example.com. 60 IN AAAA 2001:db8::1"},
+		},
+		{name: "CNAME only", answer: []string{"example.com. 60 IN CNAME cdn.example.net."}, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := newTestResponse(t, test.rcode, test.answer, nil, nil)
+			if got := d64.needsSynthesis(resp); got != test.want {
+				t.Errorf("needsSynthesis = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDNS64Synthesize(t *testing.T) {
+	d64 := newTestDNS64(t, DNS64Config{ExcludedIPv4: []string{"198.51.100.0/24"}})
+	aaaaQuery := newTestQuery("www.example.com.", dns.TypeAAAA)
+	aaaaResponse := newTestResponse(t, dns.RcodeSuccess, nil,
+		[]string{"example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300"}, nil)
+
+	tests := []struct {
+		name   string
+		answer []string
+		want   []string
+	}{
+		{
+			name:   "A records",
+			answer: []string{"www.example.com. 60 IN A 192.0.2.1", "www.example.com. 3600 IN A 192.0.2.2"},
+			want:   []string{"AAAA 64:ff9b::c000:201", "AAAA 64:ff9b::c000:202"},
+		},
+		{
+			name: "CNAME chain with signatures",
+			answer: []string{
+				"www.example.com. 60 IN CNAME cdn.example.net.",
+				"www.example.com. 60 IN RRSIG CNAME 8 3 60 20300101000000 20200101000000 12345 example.com. AAAA",
+				"cdn.example.net. 60 IN A 192.0.2.1",
+				"cdn.example.net. 60 IN RRSIG A 8 3 60 20300101000000 20200101000000 12345 example.net. AAAA",
+			},
+			want: []string{"CNAME cdn.example.net.", "AAAA 64:ff9b::c000:201"},
+		},
+		{
+			name:   "DNAME",
+			answer: []string{"example.com. 60 IN DNAME example.net.", "www.example.com. 60 IN CNAME www.example.net.", "www.example.net. 60 IN A 192.0.2.1"},
+			want:   []string{"DNAME example.net.", "CNAME www.example.net.", "AAAA 64:ff9b::c000:201"},
+		},
+		{
+			name:   "excluded A records",
+			answer: []string{"www.example.com. 60 IN A 198.51.100.1", "www.example.com. 60 IN A 192.0.2.1"},
+			want:   []string{"AAAA 64:ff9b::c000:201"},
+		},
+		{name: "only excluded A records", answer: []string{"www.example.com. 60 IN A 198.51.100.1"}},
+		{name: "no A records", answer: []string{"www.example.com. 60 IN CNAME cdn.example.net."}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			aResponse := newTestResponse(t, dns.RcodeSuccess, test.answer, nil, nil)
+			aResponse.AuthenticatedData = true
+
+			resp := d64.synthesize(aaaaQuery, aaaaResponse, aResponse)
+			if test.want == nil {
+				if resp != nil {
+					t.Errorf("synthesized %v, want nothing", resp.Answer)
+				}
+				return
+			}
+			if resp == nil {
+				t.Fatalf("nothing synthesized")
+			}
+
+			if got := rrSummaries(resp.Answer); !equalStrings(got, test.want) {
+				t.Errorf("answer = %v, want %v", got, test.want)
+			}
+			if resp.Id != aaaaQuery.Id || resp.Question[0].Qtype != dns.TypeAAAA {
+				t.Errorf("response doesn't answer the AAAA query: %v", resp.Question)
+			}
+			if resp.AuthenticatedData {
+				t.Errorf("synthesized records are flagged as validated")
+			}
+			for _, rr := range resp.Answer {
+				if rr.Header().Rrtype == dns.TypeAAAA && rr.Header().Ttl > 300 {
+					t.Errorf("TTL = %v, want no more than the AAAA response's negative TTL", rr.Header().Ttl)
+				}
+			}
+		})
+	}
+
+	if resp := d64.synthesize(aaaaQuery, aaaaResponse, newTestResponse(t, dns.RcodeNameError, nil, nil, nil)); resp != nil {
+		t.Errorf("synthesized from an NXDOMAIN A response")
+	}
+}
+
+func TestDNS64Applies(t *testing.T) {
+	d64 := newTestDNS64(t, DNS64Config{ClientCIDRs: []string{"2001:db8::/32"}})
+	client := queryClient{ip: net.ParseIP("2001:db8::53")}
+
+	if !d64.applies(newTestQuery("www.example.com.", dns.TypeAAAA), client) {
+		t.Errorf("doesn't apply to an AAAA query from a listed client")
+	}
+	if d64.applies(newTestQuery("www.example.com.", dns.TypeA), client) {
+		t.Errorf("applies to an A query")
+	}
+	if d64.applies(newTestQuery("www.example.com.", dns.TypeAAAA), queryClient{ip: net.ParseIP("2001:db9::53")}) {
+		t.Errorf("applies to a client outside the listed networks")
+	}
+
+	validating := newTestQuery("www.example.com.", dns.TypeAAAA)
+	validating.CheckingDisabled = true
+	validating.SetEdns0(1232, true)
+	if d64.applies(validating, client) {
+		t.Errorf("applies to a client validating DNSSEC itself")
+	}
+}
+
+func TestDNS64Relay(t *testing.T) {
+	fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		if query.Question[0].Qtype == dns.TypeA {
+			return replyA(query, "192.0.2.1", 3600)
+		}
+		resp := new(dns.Msg).SetReply(query)
+		resp.Ns = mustRRs(t, "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300")
+		return resp
+	})
+	relay := newTestRelay(UpstreamSettings{
+		Default: DefaultUpstreamSettings{Enabled: true, Upstreams: []UpstreamConfig{dnsUpstreamConfig("", fake.address)}},
+		DNS64:   DNS64Config{Enabled: true, Prefix: "64:ff9b::/96"},
+	})
+
+	resp, err := relay.resolveDNSQuery(newTestQuery("www.example.com.", dns.TypeAAAA), queryClient{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got, want := rrSummaries(resp.Answer), []string{"AAAA 64:ff9b::c000:201"}; !equalStrings(got, want) {
+		t.Errorf("answer = %v, want %v", got, want)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl > 300 {
+		t.Errorf("TTL = %v, want no more than the negative TTL of 300", ttl)
+	}
+}
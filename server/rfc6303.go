@@ -0,0 +1,65 @@
+package dohboy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Reverse zones for address space that is only meaningful on a local network:
+// RFC 1918, link-local, CGNAT (RFC 7793) and IPv6 ULA and link-local.
+// Following RFC 6303, lookups in them shouldn't leave the local network.
+var rfc6303_privateReverseZones = func() *set {
+	zones := newSet()
+
+	addName(zones, "10.in-addr.arpa")
+	for i := 16; i <= 31; i++ {
+		addName(zones, fmt.Sprintf("%v.172.in-addr.arpa", i))
+	}
+	addName(zones, "168.192.in-addr.arpa")
+	addName(zones, "254.169.in-addr.arpa")
+	for i := 64; i <= 127; i++ {
+		addName(zones, fmt.Sprintf("%v.100.in-addr.arpa", i))
+	}
+
+	for _, zone := range []string{"c.f", "d.f", "8.e.f", "9.e.f", "a.e.f", "b.e.f"} {
+		addName(zones, zone+".ip6.arpa")
+	}
+
+	return zones
+}()
+
+func rfc6303_isPrivateReverseName(name string) bool {
+	return matchesNameOrParent(rfc6303_privateReverseZones, name)
+}
+
+// rfc6303_findZone returns the private reverse zone a name is in.
+func rfc6303_findZone(name string) string {
+	name = strings.ToLower(dns.Fqdn(name))
+	for offset, end := 0, false; !end; offset, end = dns.NextLabel(name, offset) {
+		if rfc6303_privateReverseZones.Contains(name[offset:]) {
+			return name[offset:]
+		}
+	}
+	return name
+}
+
+// rfc6303_createResponse answers a lookup in a private reverse zone as if it
+// were served locally and empty: NXDOMAIN, or NODATA for the zone apex, with
+// the SOA record the RFC suggests so the answer can be cached.
+func rfc6303_createResponse(dnsQueryRequest *dns.Msg) *dns.Msg {
+	question := dnsQueryRequest.Question[0]
+	zone := rfc6303_findZone(question.Name)
+
+	dnsQueryResponse := dns.Msg{}
+	dnsQueryResponse.SetReply(dnsQueryRequest)
+	dnsQueryResponse.Authoritative = true
+	if strings.ToLower(dns.Fqdn(question.Name)) != zone {
+		dnsQueryResponse.Rcode = dns.RcodeNameError
+	}
+
+	soa, _ := dns.NewRR(fmt.Sprintf("%v 10800 IN SOA %v nobody.invalid. 1 3600 1200 604800 10800", zone, zone))
+	dnsQueryResponse.Ns = append(dnsQueryResponse.Ns, soa)
+	return &dnsQueryResponse
+}
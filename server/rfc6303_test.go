@@ -0,0 +1,91 @@
+package dohboy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRFC6303IsPrivateReverseName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "10.in-addr.arpa.", want: true},
+		{name: "4.3.2.10.in-addr.arpa.", want: true},
+		{name: "1.0.15.172.in-addr.arpa."},
+		{name: "1.0.16.172.in-addr.arpa.", want: true},
+		{name: "1.0.31.172.in-addr.arpa.", want: true},
+		{name: "1.0.32.172.in-addr.arpa."},
+		{name: "1.1.168.192.in-addr.arpa.", want: true},
+		{name: "1.1.169.192.in-addr.arpa."},
+		{name: "1.1.254.169.in-addr.arpa.", want: true},
+		{name: "1.1.63.100.in-addr.arpa."},
+		{name: "1.1.64.100.in-addr.arpa.", want: true},
+		{name: "1.1.127.100.in-addr.arpa.", want: true},
+		{name: "1.1.128.100.in-addr.arpa."},
+		{name: "1.2.0.192.in-addr.arpa."},
+		{name: "4.3.2.10.IN-ADDR.ARPA", want: true},
+		{name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", want: true},
+		{name: "c.f.ip6.arpa.", want: true},
+		{name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.ip6.arpa.", want: true},
+		{name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.b.e.f.ip6.arpa.", want: true},
+		{name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.c.e.f.ip6.arpa."},
+		{name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+		{name: "in-addr.arpa."},
+		{name: "www.10.example.com."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := rfc6303_isPrivateReverseName(test.name); got != test.want {
+				t.Errorf("isPrivateReverseName = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRFC6303CreateResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		qname     string
+		wantRcode int
+		wantZone  string
+	}{
+		{name: "below the apex", qname: "4.3.2.10.in-addr.arpa.", wantRcode: dns.RcodeNameError, wantZone: "10.in-addr.arpa."},
+		{name: "at the apex", qname: "10.in-addr.arpa.", wantRcode: dns.RcodeSuccess, wantZone: "10.in-addr.arpa."},
+		{name: "apex in another case", qname: "20.172.IN-ADDR.ARPA.", wantRcode: dns.RcodeSuccess, wantZone: "20.172.in-addr.arpa."},
+		{name: "below a /16 zone", qname: "9.8.20.172.in-addr.arpa.", wantRcode: dns.RcodeNameError, wantZone: "20.172.in-addr.arpa."},
+		{name: "ip6.arpa", qname: "1.0.0.0.d.f.ip6.arpa.", wantRcode: dns.RcodeNameError, wantZone: "d.f.ip6.arpa."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := newTestQuery(test.qname, dns.TypePTR)
+			resp := rfc6303_createResponse(query)
+
+			if resp.Id != query.Id || !resp.Response || !resp.Authoritative {
+				t.Errorf("header = %+v, want an authoritative reply to the query", resp.MsgHdr)
+			}
+			if resp.Rcode != test.wantRcode {
+				t.Errorf("rcode = %v, want %v", dns.RcodeToString[resp.Rcode], dns.RcodeToString[test.wantRcode])
+			}
+			if len(resp.Answer) != 0 {
+				t.Errorf("answer = %v, want none", resp.Answer)
+			}
+			if len(resp.Ns) != 1 {
+				t.Fatalf("authority = %v, want a single SOA", resp.Ns)
+			}
+			soa, ok := resp.Ns[0].(*dns.SOA)
+			if !ok {
+				t.Fatalf("authority = %v, want a SOA", resp.Ns[0])
+			}
+			if soa.Hdr.Name != test.wantZone || soa.Ns != test.wantZone || soa.Mbox != "nobody.invalid." {
+				t.Errorf("SOA = %v, want one for %v", soa, test.wantZone)
+			}
+			if soa.Hdr.Ttl != 10800 || soa.Minttl != 10800 {
+				t.Errorf("SOA TTL = %v, minimum = %v, want 10800", soa.Hdr.Ttl, soa.Minttl)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package dohboy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// The client cookie is the first 8 bytes of the option, in hex.
+const rfc7873_clientCookieLen = 16
+
+func rfc7873_getCookie(dnsMsg *dns.Msg) *dns.EDNS0_COOKIE {
+	opt := dnsMsg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, option := range opt.Option {
+		if cookie, ok := option.(*dns.EDNS0_COOKIE); ok {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// rfc7873_isCookieOnlyQuery checks for a query without a question that only
+// carries a cookie, which clients send to get hold of a server cookie.
+func rfc7873_isCookieOnlyQuery(dnsQueryRequest *dns.Msg) bool {
+	return len(dnsQueryRequest.Question) == 0 &&
+		dnsQueryRequest.Opcode == dns.OpcodeQuery &&
+		rfc7873_getCookie(dnsQueryRequest) != nil
+}
+
+// rfc7873_createCookieOnlyResponse answers a cookie-only query with an empty
+// NOERROR response carrying the client's cookie back, per RFC7873 5.4.
+func rfc7873_createCookieOnlyResponse(dnsQueryRequest *dns.Msg) *dns.Msg {
+	dnsQueryResponse := dns.Msg{}
+	dnsQueryResponse.SetReply(dnsQueryRequest)
+
+	requestOpt := dnsQueryRequest.IsEdns0()
+	dnsQueryResponse.SetEdns0(requestOpt.UDPSize(), requestOpt.Do())
+
+	cookie := rfc7873_getCookie(dnsQueryRequest).Cookie
+	if len(cookie) > rfc7873_clientCookieLen {
+		cookie = cookie[:rfc7873_clientCookieLen]
+	}
+	responseOpt := dnsQueryResponse.IsEdns0()
+	responseOpt.Option = append(responseOpt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+
+	return &dnsQueryResponse
+}
+
+// rfc7873_withoutCookie returns the message without its cookie. Cookies only
+// mean something between two hops, so the one a client sent isn't passed on.
+// The message itself is returned if it has no cookie.
+func rfc7873_withoutCookie(dnsMsg *dns.Msg) *dns.Msg {
+	if rfc7873_getCookie(dnsMsg) == nil {
+		return dnsMsg
+	}
+
+	retval := dnsMsg.Copy()
+	rfc7873_removeCookie(retval)
+	return retval
+}
+
+func rfc7873_removeCookie(dnsMsg *dns.Msg) {
+	opt := dnsMsg.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if _, isCookie := option.(*dns.EDNS0_COOKIE); !isCookie {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
+
+// rfc7873_setCookie puts a cookie in a response, in place of any other.
+func rfc7873_setCookie(dnsQueryResponse *dns.Msg, dnsQueryRequest *dns.Msg, cookie string) {
+	if dnsQueryResponse.IsEdns0() == nil {
+		requestOpt := dnsQueryRequest.IsEdns0()
+		dnsQueryResponse.SetEdns0(requestOpt.UDPSize(), requestOpt.Do())
+	}
+
+	rfc7873_removeCookie(dnsQueryResponse)
+	opt := dnsQueryResponse.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+}
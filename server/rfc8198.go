@@ -0,0 +1,392 @@
+package dohboy
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	rfc8198_maxZones          = 1000
+	rfc8198_maxRecordsPerZone = 1000
+	// RFC9276 3.2: hashing with more iterations than this isn't worth it.
+	rfc8198_maxNSEC3Iterations = 100
+)
+
+type nsecRecord struct {
+	rr      dns.RR // *dns.NSEC or *dns.NSEC3
+	sigs    []dns.RR
+	expires time.Time
+}
+
+type nsecZone struct {
+	soa     *dns.SOA
+	records map[string]*nsecRecord // by owner name
+}
+
+// nsecCache keeps the NSEC and NSEC3 records of validated NXDOMAIN responses,
+// and uses them to answer NXDOMAIN for other names they prove don't exist, as
+// RFC8198 allows. A flood of random subdomains of a signed zone then mostly
+// gets answered without going upstream.
+type nsecCache struct {
+	zones   map[string]*nsecZone // by route and zone name
+	zonesMu sync.Mutex
+}
+
+func newNSECCache() *nsecCache {
+	return &nsecCache{
+		zones: make(map[string]*nsecZone),
+	}
+}
+
+// learn picks the NSEC and NSEC3 records out of a response. Only responses the
+// upstream validated count, since the records are taken at their word.
+func (nc *nsecCache) learn(route string, resp *dns.Msg) {
+	if resp == nil || resp.Rcode != dns.RcodeNameError || !resp.AuthenticatedData {
+		return
+	}
+
+	soa, err := rfc2308_getSOARecord(resp)
+	if err != nil {
+		return
+	}
+	zone := strings.ToLower(soa.Hdr.Name)
+
+	sigs := map[string][]dns.RR{}
+	for _, rr := range resp.Ns {
+		if sig, ok := rr.(*dns.RRSIG); ok && (sig.TypeCovered == dns.TypeNSEC || sig.TypeCovered == dns.TypeNSEC3) {
+			owner := strings.ToLower(sig.Hdr.Name)
+			sigs[owner] = append(sigs[owner], sig)
+		}
+	}
+
+	now := time.Now()
+	nc.zonesMu.Lock()
+	defer nc.zonesMu.Unlock()
+
+	for _, rr := range resp.Ns {
+		header := rr.Header()
+		owner := strings.ToLower(header.Name)
+		if header.Rrtype != dns.TypeNSEC && header.Rrtype != dns.TypeNSEC3 || !dns.IsSubDomain(zone, owner) {
+			continue
+		}
+		if nsec3, ok := rr.(*dns.NSEC3); ok && nsec3.Iterations > rfc8198_maxNSEC3Iterations {
+			continue
+		}
+
+		entry, found := nc.zones[route+"|"+zone]
+		if !found {
+			if len(nc.zones) >= rfc8198_maxZones {
+				nc.dropExpired(now)
+				if len(nc.zones) >= rfc8198_maxZones {
+					return
+				}
+			}
+			entry = &nsecZone{records: make(map[string]*nsecRecord)}
+			nc.zones[route+"|"+zone] = entry
+		}
+		if len(entry.records) >= rfc8198_maxRecordsPerZone {
+			continue
+		}
+
+		// RFC8198 5.4: the records live no longer than the negative answer
+		// would.
+		ttl := minOf(header.Ttl, soa.Minttl, soa.Hdr.Ttl)
+		entry.soa = soa
+		entry.records[owner] = &nsecRecord{
+			rr:      rr,
+			sigs:    sigs[owner],
+			expires: now.Add(time.Duration(ttl) * time.Second),
+		}
+	}
+}
+
+func (nc *nsecCache) dropExpired(now time.Time) {
+	for key, zone := range nc.zones {
+		for owner, record := range zone.records {
+			if !now.Before(record.expires) {
+				delete(zone.records, owner)
+			}
+		}
+		if len(zone.records) == 0 {
+			delete(nc.zones, key)
+		}
+	}
+}
+
+// synthesize answers a query with NXDOMAIN if the cached records prove that
+// its name doesn't exist, or returns nil.
+func (nc *nsecCache) synthesize(route string, requestMsg *dns.Msg) *dns.Msg {
+	name := strings.ToLower(dns.Fqdn(requestMsg.Question[0].Name))
+	now := time.Now()
+
+	nc.zonesMu.Lock()
+	defer nc.zonesMu.Unlock()
+
+	var zone *nsecZone
+	for offset, end := 0, false; !end && zone == nil; offset, end = dns.NextLabel(name, offset) {
+		zone = nc.zones[route+"|"+name[offset:]]
+	}
+	if zone == nil {
+		return nil
+	}
+
+	live := make([]*nsecRecord, 0, len(zone.records))
+	for _, record := range zone.records {
+		if now.Before(record.expires) {
+			live = append(live, record)
+		}
+	}
+
+	sort.Slice(live, func(i, j int) bool {
+		return rfc8198_canonicalCompare(live[i].rr.Header().Name, live[j].rr.Header().Name) < 0
+	})
+
+	// A zone moving between NSEC and NSEC3 leaves both kinds around for a
+	// while. NSEC records get the first go, so the same records always make
+	// the same proof.
+	proof := rfc8198_nsecProof(live, name)
+	if proof == nil {
+		proof = rfc8198_nsec3Proof(live, name)
+	}
+	if proof == nil {
+		return nil
+	}
+
+	responseMsg := new(dns.Msg)
+	responseMsg.SetRcode(requestMsg, dns.RcodeNameError)
+	responseMsg.RecursionAvailable = true
+	responseMsg.AuthenticatedData = true
+
+	soa := dns.Copy(zone.soa).(*dns.SOA)
+	expires := proof[0].expires
+	for _, record := range proof {
+		if record.expires.Before(expires) {
+			expires = record.expires
+		}
+	}
+	soa.Hdr.Ttl = uint32(expires.Sub(now) / time.Second)
+	responseMsg.Ns = append(responseMsg.Ns, soa)
+
+	if opt := requestMsg.IsEdns0(); opt != nil {
+		responseMsg.SetEdns0(opt.UDPSize(), opt.Do())
+		if opt.Do() {
+			seen := map[dns.RR]bool{}
+			for _, record := range proof {
+				if seen[record.rr] {
+					continue
+				}
+				seen[record.rr] = true
+				for _, rr := range append([]dns.RR{record.rr}, record.sigs...) {
+					rr = dns.Copy(rr)
+					rr.Header().Ttl = soa.Hdr.Ttl
+					responseMsg.Ns = append(responseMsg.Ns, rr)
+				}
+			}
+		}
+	}
+
+	return responseMsg
+}
+
+// rfc8198_nsecProof finds an NSEC record covering the name, and one covering
+// the wildcard at its closest encloser, which together prove the name doesn't
+// exist (RFC4035 5.4).
+func rfc8198_nsecProof(records []*nsecRecord, name string) []*nsecRecord {
+	covering := rfc8198_findNSEC(records, func(nsec *dns.NSEC) bool { return rfc8198_nsecCovers(nsec, name) })
+	if covering == nil {
+		return nil
+	}
+
+	nsec := covering.rr.(*dns.NSEC)
+	owner := strings.ToLower(nsec.Hdr.Name)
+	if dns.IsSubDomain(owner, name) && rfc8198_isCutOrDname(nsec.TypeBitMap) {
+		// The name is under a delegation or a DNAME, which the NSEC says
+		// nothing about.
+		return nil
+	}
+
+	encloser := rfc8198_commonAncestor(name, owner)
+	if other := rfc8198_commonAncestor(name, strings.ToLower(nsec.NextDomain)); dns.CountLabel(other) > dns.CountLabel(encloser) {
+		encloser = other
+	}
+	wildcard := "*." + strings.TrimPrefix(encloser, ".")
+
+	wildcardExists := rfc8198_findNSEC(records, func(nsec *dns.NSEC) bool { return strings.EqualFold(nsec.Hdr.Name, wildcard) })
+	if wildcardExists != nil {
+		return nil
+	}
+
+	wildcardCovering := rfc8198_findNSEC(records, func(nsec *dns.NSEC) bool { return rfc8198_nsecCovers(nsec, wildcard) })
+	if wildcardCovering == nil {
+		return nil
+	}
+
+	return []*nsecRecord{covering, wildcardCovering}
+}
+
+func rfc8198_findNSEC(records []*nsecRecord, matches func(*dns.NSEC) bool) *nsecRecord {
+	for _, record := range records {
+		if nsec, ok := record.rr.(*dns.NSEC); ok && matches(nsec) {
+			return record
+		}
+	}
+	return nil
+}
+
+func rfc8198_nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner := strings.ToLower(nsec.Hdr.Name)
+	next := strings.ToLower(nsec.NextDomain)
+
+	if rfc8198_canonicalCompare(owner, next) < 0 {
+		return rfc8198_canonicalCompare(owner, name) < 0 && rfc8198_canonicalCompare(name, next) < 0
+	}
+	// The last NSEC of a zone wraps around to its apex.
+	return rfc8198_canonicalCompare(owner, name) < 0 || rfc8198_canonicalCompare(name, next) < 0
+}
+
+// rfc8198_nsec3Proof finds the closest encloser proof for the name (RFC5155
+// 8.4): a record matching its closest encloser, one covering the next closer
+// name, and one covering the wildcard at the closest encloser.
+func rfc8198_nsec3Proof(records []*nsecRecord, name string) []*nsecRecord {
+	find := func(matches func(*dns.NSEC3) bool) *nsecRecord {
+		for _, record := range records {
+			if nsec3, ok := record.rr.(*dns.NSEC3); ok && matches(nsec3) {
+				return record
+			}
+		}
+		return nil
+	}
+
+	if find(func(nsec3 *dns.NSEC3) bool { return nsec3.Match(name) }) != nil {
+		return nil
+	}
+
+	nextCloser := name
+	for offset, end := dns.NextLabel(name, 0); !end; offset, end = dns.NextLabel(name, offset) {
+		encloser := name[offset:]
+
+		matching := find(func(nsec3 *dns.NSEC3) bool { return nsec3.Match(encloser) })
+		if matching == nil {
+			nextCloser = encloser
+			continue
+		}
+		if rfc8198_isCutOrDname(matching.rr.(*dns.NSEC3).TypeBitMap) {
+			return nil
+		}
+
+		// Opt-out ranges may hide unsigned delegations, so they prove nothing
+		// (RFC8198 5.1).
+		covering := find(func(nsec3 *dns.NSEC3) bool { return nsec3.Flags&1 == 0 && nsec3.Cover(nextCloser) })
+		if covering == nil {
+			return nil
+		}
+
+		wildcard := "*." + strings.TrimPrefix(encloser, ".")
+		if find(func(nsec3 *dns.NSEC3) bool { return nsec3.Match(wildcard) }) != nil {
+			return nil
+		}
+		wildcardCovering := find(func(nsec3 *dns.NSEC3) bool { return nsec3.Cover(wildcard) })
+		if wildcardCovering == nil {
+			return nil
+		}
+
+		return []*nsecRecord{matching, covering, wildcardCovering}
+	}
+
+	return nil
+}
+
+func rfc8198_isCutOrDname(types []uint16) bool {
+	hasNS, hasSOA := false, false
+	for _, rrtype := range types {
+		switch rrtype {
+		case dns.TypeNS:
+			hasNS = true
+		case dns.TypeSOA:
+			hasSOA = true
+		case dns.TypeDNAME:
+			return true
+		}
+	}
+	return hasNS && !hasSOA
+}
+
+func rfc8198_commonAncestor(a string, b string) string {
+	common := dns.CompareDomainName(a, b)
+	if common == 0 {
+		return "."
+	}
+	labels := dns.SplitDomainName(a)
+	return dns.Fqdn(strings.Join(labels[len(labels)-common:], "."))
+}
+
+// rfc8198_canonicalCompare orders names canonically (RFC4034 6.1): label by
+// label from the right, with names that run out of labels first sorting first.
+func rfc8198_canonicalCompare(a string, b string) int {
+	labelsA := dns.SplitDomainName(strings.ToLower(a))
+	labelsB := dns.SplitDomainName(strings.ToLower(b))
+
+	for i := 1; i <= len(labelsA) && i <= len(labelsB); i++ {
+		labelA, labelB := labelsA[len(labelsA)-i], labelsB[len(labelsB)-i]
+		if labelA != labelB {
+			if labelA < labelB {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(labelsA) - len(labelsB)
+}
+
+// rfc8198_withDO returns the query with the DO bit set, so that the upstream
+// sends the NSEC records along. The query itself is returned if it already has
+// the bit set.
+func rfc8198_withDO(dnsQuery *dns.Msg) *dns.Msg {
+	opt := dnsQuery.IsEdns0()
+	if opt != nil && opt.Do() {
+		return dnsQuery
+	}
+
+	retval := dnsQuery.Copy()
+	if opt = retval.IsEdns0(); opt == nil {
+		retval.SetEdns0(1232, true)
+	} else {
+		opt.SetDo()
+	}
+	return retval
+}
+
+// rfc8198_stripDNSSEC takes the DNSSEC records back out of a response to a
+// query that didn't ask for them (RFC4035 3.2.1), and the OPT record too if
+// the query didn't have one.
+func rfc8198_stripDNSSEC(resp *dns.Msg, dnsQuery *dns.Msg) {
+	queryOpt := dnsQuery.IsEdns0()
+	if queryOpt != nil && queryOpt.Do() {
+		return
+	}
+
+	strip := func(rrs []dns.RR) []dns.RR {
+		retval := rrs[:0]
+		for _, rr := range rrs {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				continue
+			case dns.TypeOPT:
+				if queryOpt == nil {
+					continue
+				}
+				rr.(*dns.OPT).SetDo(false)
+			}
+			retval = append(retval, rr)
+		}
+		return retval
+	}
+
+	resp.Answer = strip(resp.Answer)
+	resp.Ns = strip(resp.Ns)
+	resp.Extra = strip(resp.Extra)
+}
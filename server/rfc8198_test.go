@@ -0,0 +1,246 @@
+package dohboy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const rfc8198TestSOA = "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300"
+
+// nsecChain links the names, given in canonical order along with their types,
+// into the NSEC records of a zone.
+func nsecChain(names ...string) []string {
+	records := []string{}
+	for i, name := range names {
+		fields := strings.Fields(name)
+		next := strings.Fields(names[(i+1)%len(names)])[0]
+		records = append(records, fmt.Sprintf("%v 3600 IN NSEC %v %v", fields[0], next, strings.Join(append(fields[1:], "RRSIG", "NSEC"), " ")))
+	}
+	return records
+}
+
+// nsec3Chain hashes the names, given along with their types, and links them
+// into the NSEC3 records of the zone. Opt-out sets the flag on every record.
+func nsec3Chain(zone string, optOut bool, names ...string) []string {
+	type hashed struct {
+		hash  string
+		types []string
+	}
+	chain := []hashed{}
+	for _, name := range names {
+		fields := strings.Fields(name)
+		chain = append(chain, hashed{dns.HashName(fields[0], dns.SHA1, 0, ""), fields[1:]})
+	}
+	sort.Slice(chain, func(i, j int) bool { return chain[i].hash < chain[j].hash })
+
+	flags := 0
+	if optOut {
+		flags = 1
+	}
+	records := []string{}
+	for i, link := range chain {
+		next := chain[(i+1)%len(chain)].hash
+		records = append(records, fmt.Sprintf("%v.%v 3600 IN NSEC3 1 %v 0 - %v %v", link.hash, zone, flags, next, strings.Join(append(link.types, "RRSIG"), " ")))
+	}
+	return records
+}
+
+func newTestNSECCache(t *testing.T, records ...[]string) *nsecCache {
+	t.Helper()
+	nc := newNSECCache()
+	for _, rrs := range records {
+		resp := newTestResponse(t, dns.RcodeNameError, nil, append([]string{rfc8198TestSOA}, rrs...), nil)
+		resp.AuthenticatedData = true
+		nc.learn("/dns-query", resp)
+	}
+	return nc
+}
+
+func TestNSECSynthesis(t *testing.T) {
+	nsec := nsecChain("example.com. NS SOA", "b.example.com. A", "d.example.com. A")
+
+	tests := []struct {
+		name    string
+		records []string
+		query   string
+		wantNX  bool
+	}{
+		{name: "NSEC covers", records: nsec, query: "c.example.com.", wantNX: true},
+		{name: "NSEC covers past the last name", records: nsec, query: "z.example.com.", wantNX: true},
+		{name: "NSEC covers below a missing name", records: nsec, query: "x.c.example.com.", wantNX: true},
+		{name: "NSEC matches the name", records: nsec, query: "b.example.com."},
+		{name: "NSEC matches the apex", records: nsec, query: "example.com."},
+		{name: "NSEC only for the name", records: nsec[1:2], query: "c.example.com."},
+		{name: "NSEC wildcard missing", records: nsec[1:], query: "c.example.com."},
+		{
+			name:    "NSEC wildcard exists",
+			records: nsecChain("example.com. NS SOA", "*.example.com. A", "b.example.com. A", "d.example.com. A"),
+			query:   "c.example.com.",
+		},
+		{
+			name:    "NSEC below a delegation",
+			records: nsecChain("example.com. NS SOA", "b.example.com. NS", "d.example.com. A"),
+			query:   "x.b.example.com.",
+		},
+		{
+			name:    "NSEC below a DNAME",
+			records: nsecChain("example.com. NS SOA", "b.example.com. DNAME", "d.example.com. A"),
+			query:   "x.b.example.com.",
+		},
+		{name: "NSEC another zone", records: nsec, query: "c.example.net."},
+		{name: "NSEC3 covers", records: nsec3Chain("example.com.", false, "example.com. NS SOA", "b.example.com. A"), query: "c.example.com.", wantNX: true},
+		{name: "NSEC3 covers the next closer", records: nsec3Chain("example.com.", false, "example.com. NS SOA", "b.example.com. A"), query: "x.c.example.com.", wantNX: true},
+		{name: "NSEC3 matches the name", records: nsec3Chain("example.com.", false, "example.com. NS SOA", "b.example.com. A"), query: "b.example.com."},
+		{name: "NSEC3 opt-out", records: nsec3Chain("example.com.", true, "example.com. NS SOA", "b.example.com. A"), query: "c.example.com."},
+		{
+			name:    "NSEC3 wildcard exists",
+			records: nsec3Chain("example.com.", false, "example.com. NS SOA", "*.example.com. A"),
+			query:   "c.example.com.",
+		},
+		{
+			name:    "NSEC3 below a delegation",
+			records: nsec3Chain("example.com.", false, "example.com. NS SOA", "b.example.com. NS"),
+			query:   "x.b.example.com.",
+		},
+		{
+			name:    "NSEC3 without the closest encloser",
+			records: nsec3Chain("example.com.", false, "b.example.com. A"),
+			query:   "c.example.com.",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nc := newTestNSECCache(t, test.records)
+
+			query := newTestQuery(test.query, dns.TypeA)
+			query.SetEdns0(1232, true)
+			resp := nc.synthesize("/dns-query", query)
+
+			if (resp != nil) != test.wantNX {
+				t.Fatalf("synthesized = %v, want %v", resp != nil, test.wantNX)
+			}
+			if resp == nil {
+				return
+			}
+			if resp.Rcode != dns.RcodeNameError || !resp.AuthenticatedData || resp.Id != query.Id {
+				t.Errorf("rcode = %v, ad = %v, want an authenticated NXDOMAIN", dns.RcodeToString[resp.Rcode], resp.AuthenticatedData)
+			}
+			if soa, ok := resp.Ns[0].(*dns.SOA); !ok || soa.Hdr.Ttl > 300 || soa.Hdr.Ttl < 299 {
+				t.Errorf("authority starts with %v, want the SOA living no longer than the negative TTL", resp.Ns[0])
+			}
+			if len(resp.Ns) < 2 {
+				t.Errorf("the proof wasn't sent along to a DO query")
+			}
+
+			query.IsEdns0().SetDo(false)
+			if resp := nc.synthesize("/dns-query", query); len(resp.Ns) != 1 {
+				t.Errorf("a query without DO got %v authority records, want only the SOA", len(resp.Ns))
+			}
+			if resp := nc.synthesize("/other", query); resp != nil {
+				t.Errorf("records learnt on one route answered another")
+			}
+		})
+	}
+}
+
+func TestNSECSynthesisExpiry(t *testing.T) {
+	nc := newTestNSECCache(t, nsecChain("example.com. NS SOA", "b.example.com. A", "d.example.com. A"))
+	query := newTestQuery("c.example.com.", dns.TypeA)
+
+	if nc.synthesize("/dns-query", query) == nil {
+		t.Fatalf("nothing synthesized before the records expired")
+	}
+
+	// The record covering the name expires, the one covering the wildcard
+	// doesn't.
+	zone := nc.zones["/dns-query|example.com."]
+	zone.records["b.example.com."].expires = time.Now().Add(-time.Second)
+	zone.records["example.com."].expires = time.Now().Add(10 * time.Second)
+
+	if resp := nc.synthesize("/dns-query", query); resp != nil {
+		t.Errorf("synthesized from an expired record")
+	}
+	if resp := nc.synthesize("/dns-query", newTestQuery("*.example.com.", dns.TypeA)); resp == nil || resp.Ns[0].Header().Ttl > 10 {
+		t.Errorf("the SOA TTL doesn't follow the record expiring first: %v", resp)
+	}
+
+	nc.dropExpired(time.Now().Add(time.Hour))
+	if len(nc.zones) != 0 {
+		t.Errorf("zones = %v, want none left", len(nc.zones))
+	}
+}
+
+func TestNSECLearn(t *testing.T) {
+	records := append([]string{rfc8198TestSOA}, nsecChain("example.com. NS SOA", "b.example.com. A", "d.example.com. A")...)
+
+	tests := []struct {
+		name      string
+		rcode     int
+		ad        bool
+		ns        []string
+		wantZones int
+	}{
+		{name: "validated NXDOMAIN", rcode: dns.RcodeNameError, ad: true, ns: records, wantZones: 1},
+		{name: "not validated", rcode: dns.RcodeNameError, ns: records},
+		{name: "NODATA", ad: true, ns: records},
+		{name: "no SOA", rcode: dns.RcodeNameError, ad: true, ns: records[1:]},
+		{
+			name:  "records outside the zone",
+			rcode: dns.RcodeNameError,
+			ad:    true,
+			ns:    append([]string{rfc8198TestSOA}, nsecChain("example.net. NS SOA", "b.example.net. A")...),
+		},
+		{
+			name:  "too many NSEC3 iterations",
+			rcode: dns.RcodeNameError,
+			ad:    true,
+			ns:    []string{rfc8198TestSOA, "0P9MHAVEQVM6T7VBL5LOP2U3T2RP3TOM.example.com. 3600 IN NSEC3 1 0 500 - 0P9MHAVEQVM6T7VBL5LOP2U3T2RP3TOM NS SOA"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nc := newNSECCache()
+			resp := newTestResponse(t, test.rcode, nil, test.ns, nil)
+			resp.AuthenticatedData = test.ad
+			nc.learn("/dns-query", resp)
+
+			if len(nc.zones) != test.wantZones {
+				t.Errorf("zones = %v, want %v", len(nc.zones), test.wantZones)
+			}
+		})
+	}
+}
+
+func TestNSECSynthesisMixedKinds(t *testing.T) {
+	nsec := nsecChain("example.com. NS SOA", "b.example.com. A", "d.example.com. A")
+	nsec3 := nsec3Chain("example.com.", false, "example.com. NS SOA", "b.example.com. A", "d.example.com. A")
+
+	for i := 0; i < 20; i++ {
+		nc := newTestNSECCache(t, nsec3, nsec)
+		query := newTestQuery("c.example.com.", dns.TypeA)
+		query.SetEdns0(1232, true)
+
+		resp := nc.synthesize("/dns-query", query)
+		if resp == nil {
+			t.Fatalf("nothing synthesized")
+		}
+		for _, rr := range resp.Ns[1:] {
+			if rrtype := rr.Header().Rrtype; rrtype != dns.TypeNSEC {
+				t.Fatalf("proof has a %v record, want only NSEC ones", dns.TypeToString[rrtype])
+			}
+		}
+
+		// Without NSEC records making a proof, NSEC3 ones still can.
+		delete(nc.zones["/dns-query|example.com."].records, "example.com.")
+		if resp := nc.synthesize("/dns-query", query); resp == nil || resp.Ns[1].Header().Rrtype != dns.TypeNSEC3 {
+			t.Fatalf("no NSEC3 proof when the NSEC records made none: %v", resp)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package dohboy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRFC8482(t *testing.T) {
+	tests := []struct {
+		name  string
+		query *dns.Msg
+		want  bool
+	}{
+		{name: "ANY", query: newTestQuery("example.com.", dns.TypeANY), want: true},
+		{name: "A", query: newTestQuery("example.com.", dns.TypeA)},
+		{name: "no question", query: new(dns.Msg)},
+		{
+			name: "ANY among several questions",
+			query: &dns.Msg{Question: []dns.Question{
+				{Name: "example.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET},
+				{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			}},
+		},
+		{name: "nil", query: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := rfc8482_canRejectForTypeAny(test.query); got != test.want {
+				t.Fatalf("canRejectForTypeAny = %v, want %v", got, test.want)
+			}
+
+			resp, err := rfc8482_createResponse(test.query)
+			if !test.want {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !resp.Response || resp.Id != test.query.Id || resp.Rcode != dns.RcodeSuccess {
+				t.Errorf("not a reply to the query: %v", resp)
+			}
+			if len(resp.Answer) != 1 {
+				t.Fatalf("answer = %v, want a single HINFO", resp.Answer)
+			}
+			hinfo, ok := resp.Answer[0].(*dns.HINFO)
+			if !ok || hinfo.Cpu != "RFC8482" || hinfo.Hdr.Name != "example.com." {
+				t.Errorf("answer = %v, want an RFC8482 HINFO for example.com.", resp.Answer[0])
+			}
+		})
+	}
+}
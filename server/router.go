@@ -5,16 +5,70 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
 )
 
+type endpoint struct {
+	path             string
+	requireAuth      bool
+	clientIP         *clientIPResolver
+	rateLimiter      rateLimiter
+	retryAfterHeader bool
+	filter           *filter
+	relay            *relay
+}
+
 type router struct {
-	rateLimiter       rateLimiter
-	relay             *relay
+	endpoints         []*endpoint
+	backends          *backends
+	cookies           *cookieSecrets // nil when cookies are disabled
+	bans              *banList
+	stats             *queryStats
+	blockingEnabled   int32 // atomic; filters are skipped while 0
+	auth              *authenticator
+	metrics           *metrics
 	terseResponses    bool
 	enableHttpCaching bool
+	logQueries        bool
+}
+
+// matchEndpoint finds the endpoint with the longest path matching the request
+// path. A request path may carry one extra segment past the endpoint's path,
+// which is returned as the path token.
+func (router *router) matchEndpoint(requestPath string) (*endpoint, string) {
+	var matched *endpoint
+	var pathToken string
+
+	for _, ep := range router.endpoints {
+		if matched != nil && len(ep.path) <= len(matched.path) {
+			continue
+		}
+
+		if requestPath == ep.path {
+			matched, pathToken = ep, ""
+			continue
+		}
+
+		prefix := strings.TrimSuffix(ep.path, "/") + "/"
+		if strings.HasPrefix(requestPath, prefix) {
+			remainder := strings.TrimPrefix(requestPath, prefix)
+			if remainder != "" && !strings.Contains(remainder, "/") {
+				matched, pathToken = ep, remainder
+			}
+		}
+	}
+
+	return matched, pathToken
 }
 
 func extractDNSWireFormat(request *http.Request) ([]byte, error) {
@@ -45,6 +99,21 @@ func extractDNSMessage(request *http.Request) (*dns.Msg, error) {
 	return retval, retval.Unpack(wireFormat)
 }
 
+func questionName(dnsQuery *dns.Msg) string {
+	if len(dnsQuery.Question) == 0 {
+		return "."
+	}
+	return strings.ToLower(dnsQuery.Question[0].Name)
+}
+
+func describeQuestion(dnsQuery *dns.Msg) string {
+	if len(dnsQuery.Question) != 1 {
+		return fmt.Sprintf("%v questions", len(dnsQuery.Question))
+	}
+	question := dnsQuery.Question[0]
+	return fmt.Sprintf("%v %v", question.Name, dns.TypeToString[question.Qtype])
+}
+
 func (router *router) ServeHTTP(response http.ResponseWriter, request *http.Request) {
 	httpError := func(httpStatusCode int, err error) {
 		if !router.terseResponses && err != nil {
@@ -54,16 +123,57 @@ func (router *router) ServeHTTP(response http.ResponseWriter, request *http.Requ
 		}
 	}
 
-	if request.URL.Path != "/dns-query" {
+	tooManyRequests := func(endpoint *endpoint, label string, retryAfter time.Duration) {
+		router.metrics.incr("rate_limited", label)
+		if endpoint.retryAfterHeader && retryAfter != rate.InfDuration {
+			response.Header().Set("Retry-After", fmt.Sprintf("%v", int(math.Ceil(retryAfter.Seconds()))))
+		}
+		httpError(http.StatusTooManyRequests, nil)
+	}
+
+	endpoint, token := router.matchEndpoint(request.URL.Path)
+	if endpoint == nil {
 		httpError(http.StatusNotFound, nil)
 		return
 	}
 
-	if !router.rateLimiter.please(router.rateLimiter.getIP(request), request.URL.Query().Get("token")) {
-		httpError(http.StatusTooManyRequests, nil)
+	if token == "" {
+		token = request.URL.Query().Get("token")
+	}
+
+	clientIP := endpoint.clientIP.getIP(request)
+
+	authResult, label := router.auth.authenticate(request, token, endpoint.requireAuth)
+	if authResult == authRejected || (authResult == authAnonymous && endpoint.requireAuth) {
+		router.metrics.incr("auth_failures", endpoint.path)
+		log.Printf("auth failed: endpoint=%v client=%v", endpoint.path, clientIP)
+		// Failed attempts are charged to the client's address, so that tokens
+		// can't be guessed at full speed. Only to the address: a flood of bad
+		// tokens mustn't drain the endpoint's bucket for everyone else.
+		if allowed, retryAfter := endpoint.rateLimiter.pleaseIP(clientIP, 1); !allowed {
+			tooManyRequests(endpoint, "anonymous", retryAfter)
+			return
+		}
+		if authResult == authAnonymous {
+			response.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(http.StatusUnauthorized, nil)
+		} else {
+			httpError(http.StatusForbidden, nil)
+		}
+		return
+	}
+	if router.bans.isBanned(clientIP, token, label) {
+		router.metrics.incr("banned", endpoint.path)
+		httpError(http.StatusForbidden, nil)
 		return
 	}
 
+	rateLimitClient := rateLimitClient{ip: clientIP, userKey: token, label: label}
+	if label == "" {
+		label = "anonymous"
+	}
+	router.metrics.incr("requests", label)
+
 	if request.Method != http.MethodGet && request.Method != http.MethodPost {
 		httpError(http.StatusMethodNotAllowed, nil)
 		return
@@ -74,18 +184,70 @@ func (router *router) ServeHTTP(response http.ResponseWriter, request *http.Requ
 		return
 	}
 
+	// Decode before rate limiting so the query can be priced by its qtype.
+	// Malformed requests are still charged the base cost.
 	requestMsg, err := extractDNSMessage(request)
-	if err != nil {
-		httpError(http.StatusBadRequest, err)
+
+	cost := 1
+	if err == nil {
+		cost = endpoint.rateLimiter.queryCost(requestMsg)
+	}
+	if allowed, retryAfter := endpoint.rateLimiter.please(rateLimitClient, cost); !allowed {
+		tooManyRequests(endpoint, label, retryAfter)
 		return
 	}
 
-	responseMsg, err := router.relay.resolveDNSQuery(requestMsg)
 	if err != nil {
-		httpError(http.StatusInternalServerError, err)
+		httpError(http.StatusBadRequest, err)
 		return
 	}
 
+	client := queryClient{ip: net.ParseIP(clientIP), label: rateLimitClient.label}
+
+	// Cookies are checked before anything is resolved, so that a query with a
+	// bad server cookie doesn't get to cost an upstream query (RFC7873 5.2).
+	serverCookie, cookieCheck := "", cookieAbsent
+	if cookie := rfc7873_getCookie(requestMsg); cookie != nil && router.cookies != nil {
+		serverCookie, cookieCheck = router.cookies.serverCookie(cookie.Cookie, client.ip)
+	}
+
+	var responseMsg *dns.Msg
+	blocked := false
+	switch cookieCheck {
+	case cookieMalformed:
+		responseMsg = new(dns.Msg).SetRcodeFormatError(requestMsg)
+	case cookieInvalid:
+		// Along with a fresh cookie to retry with.
+		responseMsg = new(dns.Msg).SetRcode(requestMsg, dns.RcodeBadCookie)
+	default:
+		if responseMsg, blocked, err = endpoint.answer(requestMsg, client, router.isBlockingEnabled()); err != nil {
+			httpError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if serverCookie != "" {
+		rfc7873_setCookie(responseMsg, requestMsg, serverCookie)
+	}
+
+	endpoint.rateLimiter.charge(rateLimitClient, endpoint.rateLimiter.responseCost(responseMsg))
+
+	statsClient := clientIP
+	if authResult == authAccepted {
+		statsClient = label
+	}
+	router.stats.recordQuery(queryEvent{
+		name:    questionName(requestMsg),
+		client:  statsClient,
+		rcode:   dns.RcodeToString[responseMsg.Rcode],
+		blocked: blocked,
+	})
+
+	if router.logQueries {
+		log.Printf("query: endpoint=%v client=%v label=%v question=[%v] rcode=%v",
+			endpoint.path, clientIP, label, describeQuestion(requestMsg), dns.RcodeToString[responseMsg.Rcode])
+	}
+
 	responseWireFormat, err := responseMsg.Pack()
 	if err != nil {
 		httpError(http.StatusInternalServerError, err)
@@ -103,18 +265,179 @@ func (router *router) ServeHTTP(response http.ResponseWriter, request *http.Requ
 	response.Write(responseWireFormat)
 }
 
-func createRouter(config *Config) *http.ServeMux {
-	rateLimiter := newRateLimiter(config)
-	relay := newRelay(config)
+// answer answers a query through the endpoint's filter and relay. The returned
+// flag tells whether the query was blocked.
+func (endpoint *endpoint) answer(requestMsg *dns.Msg, client queryClient, blockingEnabled bool) (*dns.Msg, bool, error) {
+	if requestMsg.Opcode == dns.OpcodeQuery && len(requestMsg.Question) > 1 && endpoint.relay.splitQuestions {
+		if len(requestMsg.Question) > endpoint.relay.maxQuestions {
+			responseMsg := dns.Msg{}
+			return responseMsg.SetRcodeFormatError(requestMsg), false, nil
+		}
+		return endpoint.answerEach(requestMsg, client, blockingEnabled)
+	}
+
+	if responseMsg := answerUnforwardable(requestMsg); responseMsg != nil {
+		return responseMsg, false, nil
+	}
+
+	if blockingEnabled && endpoint.filter.isBlocked(requestMsg) {
+		return endpoint.filter.createBlockedResponse(requestMsg), true, nil
+	}
+
+	responseMsg, err := endpoint.relay.resolveDNSQuery(requestMsg, client)
+	return responseMsg, false, err
+}
+
+// Questions of a single message resolved at the same time.
+const maxConcurrentQuestions = 4
+
+// answerEach answers a query with several questions by answering each of
+// them on its own, a few at a time, and merging the responses. Each question
+// goes through the filter, so one can't be used to sneak a blocked name past
+// it.
+func (endpoint *endpoint) answerEach(requestMsg *dns.Msg, client queryClient, blockingEnabled bool) (*dns.Msg, bool, error) {
+	type part struct {
+		resp    *dns.Msg
+		blocked bool
+		err     error
+	}
+	parts := make([]part, len(requestMsg.Question))
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxConcurrentQuestions)
+	for i, question := range requestMsg.Question {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, question dns.Question) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			partMsg := requestMsg.Copy()
+			partMsg.Question = []dns.Question{question}
+			parts[i].resp, parts[i].blocked, parts[i].err = endpoint.answer(partMsg, client, blockingEnabled)
+		}(i, question)
+	}
+	wg.Wait()
+
+	merged := new(dns.Msg)
+	merged.SetReply(requestMsg)
+	merged.Question = append([]dns.Question(nil), requestMsg.Question...)
+	merged.RecursionAvailable = true
+
+	anyBlocked := false
+	for _, part := range parts {
+		if part.err != nil {
+			return nil, false, part.err
+		}
+		anyBlocked = anyBlocked || part.blocked
+
+		// The first question that didn't resolve cleanly decides the rcode.
+		if merged.Rcode == dns.RcodeSuccess {
+			merged.Rcode = part.resp.Rcode
+		}
+		merged.RecursionAvailable = merged.RecursionAvailable && part.resp.RecursionAvailable
+		merged.Answer = append(merged.Answer, part.resp.Answer...)
+		merged.Ns = append(merged.Ns, part.resp.Ns...)
+		for _, rr := range part.resp.Extra {
+			if _, isOpt := rr.(*dns.OPT); isOpt && merged.IsEdns0() != nil {
+				continue
+			}
+			merged.Extra = append(merged.Extra, rr)
+		}
+	}
+
+	return merged, anyBlocked, nil
+}
+
+func createEndpoint(config EndpointConfig, caching *CacheConfig, backends *backends, cookies *cookieSecrets, metrics *metrics, stats *queryStats) (*endpoint, error) {
+	filter, err := newFilter(config.Filtering)
+	if err != nil {
+		return nil, err
+	}
+
+	var cache *responseCache
+	if caching.EnableResponseCache {
+		cache = newResponseCache(backends.newCacheBackend(), config.Path, caching)
+	}
+
+	var nsec *nsecCache
+	if caching.AggressiveNSEC {
+		nsec = newNSECCache()
+	}
+
+	return &endpoint{
+		path:             config.Path,
+		requireAuth:      *config.RequireAuth,
+		clientIP:         newClientIPResolver(config.IPRateLimit),
+		rateLimiter:      newRateLimiter(config.IPRateLimit, config.Path, backends),
+		retryAfterHeader: config.IPRateLimit.RetryAfterHeader,
+		filter:           filter,
+		relay:            newRelay(config.Path, config.Upstream, cache, nsec, cookies, metrics, stats),
+	}, nil
+}
+
+func (router *router) isBlockingEnabled() bool {
+	return atomic.LoadInt32(&router.blockingEnabled) != 0
+}
+
+func (router *router) setBlockingEnabled(enabled bool) {
+	val := int32(0)
+	if enabled {
+		val = 1
+	}
+	atomic.StoreInt32(&router.blockingEnabled, val)
+}
+
+func (router *router) findEndpoint(path string) *endpoint {
+	for _, endpoint := range router.endpoints {
+		if endpoint.path == path {
+			return endpoint
+		}
+	}
+	return nil
+}
+
+func (router *router) close() {
+	for _, endpoint := range router.endpoints {
+		endpoint.rateLimiter.close()
+	}
+	router.backends.close()
+}
+
+func createRouter(config *Config) (*router, error) {
+	auth, err := newAuthenticator(&config.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("Could not configure auth: %v", err)
+	}
+
+	var cookies *cookieSecrets
+	if config.Cookies.Enabled {
+		if cookies, err = newCookieSecrets(&config.Cookies); err != nil {
+			return nil, fmt.Errorf("Could not configure cookies: %v", err)
+		}
+	}
 
 	router := &router{
-		rateLimiter:       rateLimiter,
-		relay:             relay,
+		backends:          newBackends(config),
+		cookies:           cookies,
+		bans:              newBanList(),
+		stats:             newQueryStats(),
+		blockingEnabled:   1,
+		auth:              auth,
+		metrics:           newMetrics(),
 		terseResponses:    config.Development.TerseResponses,
 		enableHttpCaching: config.Caching.EnableHTTPCaching,
+		logQueries:        config.Logging.Queries,
+	}
+
+	for _, endpointConfig := range config.effectiveEndpoints() {
+		endpoint, err := createEndpoint(endpointConfig, &config.Caching, router.backends, router.cookies, router.metrics, router.stats)
+		if err != nil {
+			return nil, fmt.Errorf("Could not configure endpoint [%v]: %v", endpointConfig.Path, err)
+		}
+		router.endpoints = append(router.endpoints, endpoint)
 	}
 
-	mux := http.NewServeMux()
-	mux.Handle("/", router)
-	return mux
+	return router, nil
 }
@@ -0,0 +1,557 @@
+package dohboy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newTestRouter creates a router from a yaml config, going through the same
+// parsing and validation as the server does.
+func newTestConfig(t *testing.T, yaml string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatalf("Could not write config: %v", err)
+	}
+
+	config, err := FetchConfig(path)
+	if err != nil {
+		t.Fatalf("Bad config: %v", err)
+	}
+	return config
+}
+
+func newTestRouter(t *testing.T, yaml string) *router {
+	t.Helper()
+	router, err := createRouter(newTestConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("Could not create router: %v", err)
+	}
+	t.Cleanup(router.close)
+	return router
+}
+
+// upstreamYAML is a config sending everything to a plain DNS upstream.
+func upstreamYAML(address string) string {
+	return fmt.Sprintf(`
+upstream:
+  default_upstream:
+    upstreams:
+      - type: dns
+        address: %v
+        timeout: 1000
+`, address)
+}
+
+func packTestQuery(t *testing.T, name string, qtype uint16) []byte {
+	t.Helper()
+	query := newTestQuery(name, qtype)
+	query.Id = 0
+	wireFormat, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Could not pack query: %v", err)
+	}
+	return wireFormat
+}
+
+func newGetRequest(path string, wireFormat []byte) *http.Request {
+	return httptest.NewRequest(http.MethodGet, path+"?dns="+base64.RawURLEncoding.EncodeToString(wireFormat), nil)
+}
+
+func newPostRequest(path string, wireFormat []byte) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(wireFormat))
+	request.Header.Set("Content-Type", "application/dns-message")
+	return request
+}
+
+func serve(router *router, request *http.Request) (*httptest.ResponseRecorder, *dns.Msg) {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		return recorder, nil
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(recorder.Body.Bytes()); err != nil {
+		return recorder, nil
+	}
+	return recorder, resp
+}
+
+func TestServeHTTPStatusCodes(t *testing.T) {
+	fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		return replyA(query, "192.0.2.1", 300)
+	})
+	router := newTestRouter(t, upstreamYAML(fake.address))
+	query := packTestQuery(t, "www.example.com.", dns.TypeA)
+
+	tests := []struct {
+		name       string
+		request    func() *http.Request
+		wantStatus int
+	}{
+		{
+			name:       "GET",
+			request:    func() *http.Request { return newGetRequest("/dns-query", query) },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "POST",
+			request:    func() *http.Request { return newPostRequest("/dns-query", query) },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "unknown path",
+			request:    func() *http.Request { return newGetRequest("/nope", query) },
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "path nested too deep",
+			request:    func() *http.Request { return newGetRequest("/dns-query/a/b", query) },
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name: "PUT",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPut, "/dns-query", bytes.NewReader(query))
+			},
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name: "POST without content type",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(query))
+			},
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:       "GET without dns param",
+			request:    func() *http.Request { return httptest.NewRequest(http.MethodGet, "/dns-query", nil) },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "GET with padded base64",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.URLEncoding.EncodeToString(query[:len(query)-1]), nil)
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "GET with garbage",
+			request:    func() *http.Request { return newGetRequest("/dns-query", []byte{0x01, 0x02, 0x03}) },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "POST with garbage",
+			request:    func() *http.Request { return newPostRequest("/dns-query", []byte{0x01, 0x02, 0x03}) },
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := test.request()
+			// Every request from its own client, to stay clear of rate limits.
+			request.RemoteAddr = fmt.Sprintf("198.51.100.%d:1234", len(test.name))
+
+			recorder, _ := serve(router, request)
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %v, want %v (body: %v)", recorder.Code, test.wantStatus, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestServeHTTPDecodesGetAndPost(t *testing.T) {
+	fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		return replyA(query, "192.0.2.1", 300)
+	})
+	router := newTestRouter(t, upstreamYAML(fake.address))
+
+	// The example query from RFC 8484 4.1.1, for www.example.com A.
+	const rfc8484GetExample = "AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB"
+	query, err := base64.RawURLEncoding.DecodeString(rfc8484GetExample)
+	if err != nil {
+		t.Fatalf("Could not decode the example: %v", err)
+	}
+
+	for _, request := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/dns-query?dns="+rfc8484GetExample, nil),
+		newPostRequest("/dns-query", query),
+	} {
+		t.Run(request.Method, func(t *testing.T) {
+			recorder, resp := serve(router, request)
+			if resp == nil {
+				t.Fatalf("status = %v, body = %v", recorder.Code, recorder.Body.String())
+			}
+
+			if got := recorder.Header().Get("Content-Type"); got != "application/dns-message" {
+				t.Errorf("Content-Type = %v", got)
+			}
+			if resp.Id != 0 {
+				t.Errorf("Id = %v, want 0", resp.Id)
+			}
+			if len(resp.Question) != 1 || resp.Question[0].Name != "www.example.com." || resp.Question[0].Qtype != dns.TypeA {
+				t.Errorf("question = %v", resp.Question)
+			}
+			if got := answeredIP(resp); got != "192.0.2.1" {
+				t.Errorf("answered %v, want 192.0.2.1", got)
+			}
+			if got := recorder.Header().Get("Cache-Control"); got != fmt.Sprintf("max-age=%v", getOverallTTL(resp)) {
+				t.Errorf("Cache-Control = %v, want the response's TTL %v", got, getOverallTTL(resp))
+			}
+		})
+	}
+}
+
+func TestServeHTTPAnswersLocally(t *testing.T) {
+	fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		return replyA(query, "192.0.2.1", 300)
+	})
+	router := newTestRouter(t, upstreamYAML(fake.address)+`
+filtering:
+  blocklist: [blocked.example.com]
+`)
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantRcode int
+		wantType  uint16
+	}{
+		{name: "blocked name", qname: "blocked.example.com.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+		{name: "subdomain of a blocked name", qname: "www.blocked.example.com.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+		{name: "ANY", qname: "www.example.com.", qtype: dns.TypeANY, wantRcode: dns.RcodeSuccess, wantType: dns.TypeHINFO},
+		{name: "private PTR", qname: "1.0.168.192.in-addr.arpa.", qtype: dns.TypePTR, wantRcode: dns.RcodeNameError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder, resp := serve(router, newGetRequest("/dns-query", packTestQuery(t, test.qname, test.qtype)))
+			if resp == nil {
+				t.Fatalf("status = %v, body = %v", recorder.Code, recorder.Body.String())
+			}
+			if resp.Rcode != test.wantRcode {
+				t.Errorf("rcode = %v, want %v", dns.RcodeToString[resp.Rcode], dns.RcodeToString[test.wantRcode])
+			}
+			if test.wantType != 0 && (len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != test.wantType) {
+				t.Errorf("answer = %v, want a single %v", resp.Answer, dns.TypeToString[test.wantType])
+			}
+		})
+	}
+
+	if got := fake.queryCount("udp") + fake.queryCount("tcp"); got != 0 {
+		t.Errorf("upstream got %v queries, want none", got)
+	}
+}
+
+func TestServeHTTPRateLimiting(t *testing.T) {
+	fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		return replyA(query, "192.0.2.1", 300)
+	})
+	router := newTestRouter(t, upstreamYAML(fake.address)+`
+ip_rate_limit:
+  max_tokens: 3
+  recover_x_tokens_per_sec: 1
+  key_whitelist: "friend"
+  allowlist: ["203.0.113.0/24"]
+  qtype_costs: {TXT: 3}
+  retry_after_header: true
+`)
+
+	request := func(client string, query string) *http.Request {
+		request := newGetRequest("/dns-query", packTestQuery(t, "www.example.com.", dns.StringToType[query]))
+		request.RemoteAddr = client + ":1234"
+		return request
+	}
+
+	t.Run("limited after max_tokens", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			if recorder, _ := serve(router, request("198.51.100.1", "A")); recorder.Code != http.StatusOK {
+				t.Fatalf("request %v: status = %v", i, recorder.Code)
+			}
+		}
+
+		recorder, _ := serve(router, request("198.51.100.1", "A"))
+		if recorder.Code != http.StatusTooManyRequests {
+			t.Fatalf("status = %v, want %v", recorder.Code, http.StatusTooManyRequests)
+		}
+		if got := recorder.Header().Get("Retry-After"); got != "1" {
+			t.Errorf("Retry-After = %v, want 1", got)
+		}
+	})
+
+	t.Run("other clients aren't affected", func(t *testing.T) {
+		if recorder, _ := serve(router, request("198.51.100.2", "A")); recorder.Code != http.StatusOK {
+			t.Errorf("status = %v, want %v", recorder.Code, http.StatusOK)
+		}
+	})
+
+	t.Run("qtype costs", func(t *testing.T) {
+		if recorder, _ := serve(router, request("198.51.100.3", "TXT")); recorder.Code != http.StatusOK {
+			t.Fatalf("status = %v, want %v", recorder.Code, http.StatusOK)
+		}
+		if recorder, _ := serve(router, request("198.51.100.3", "A")); recorder.Code != http.StatusTooManyRequests {
+			t.Errorf("status = %v, want %v", recorder.Code, http.StatusTooManyRequests)
+		}
+	})
+
+	t.Run("allowlisted network", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			if recorder, _ := serve(router, request("203.0.113.7", "A")); recorder.Code != http.StatusOK {
+				t.Fatalf("request %v: status = %v", i, recorder.Code)
+			}
+		}
+	})
+
+	t.Run("whitelisted key", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			whitelisted := request("198.51.100.4", "A")
+			whitelisted.URL.RawQuery += "&token=friend"
+			if recorder, _ := serve(router, whitelisted); recorder.Code != http.StatusOK {
+				t.Fatalf("request %v: status = %v", i, recorder.Code)
+			}
+		}
+	})
+}
+
+func TestServeHTTPMultipleQuestions(t *testing.T) {
+	fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		return replyA(query, "192.0.2.1", 300)
+	})
+	router := newTestRouter(t, upstreamYAML(fake.address)+`
+  split_multiple_questions: true
+  max_questions: 3
+ip_rate_limit:
+  max_tokens: 4
+  recover_x_tokens_per_sec: 1
+`)
+
+	request := func(client string, count int) *http.Request {
+		query := new(dns.Msg)
+		for i := 0; i < count; i++ {
+			query.Question = append(query.Question, dns.Question{Name: fmt.Sprintf("www%v.example.com.", i), Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		}
+		wireFormat, err := query.Pack()
+		if err != nil {
+			t.Fatalf("Could not pack query: %v", err)
+		}
+		request := newPostRequest("/dns-query", wireFormat)
+		request.RemoteAddr = client + ":1234"
+		return request
+	}
+
+	t.Run("answered up to max_questions", func(t *testing.T) {
+		recorder, resp := serve(router, request("198.51.100.1", 3))
+		if resp == nil {
+			t.Fatalf("status = %v, body = %v", recorder.Code, recorder.Body.String())
+		}
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 3 {
+			t.Errorf("response = %v, want three answers", resp)
+		}
+	})
+
+	t.Run("FORMERR above max_questions", func(t *testing.T) {
+		before := fake.queryCount("udp")
+		recorder, resp := serve(router, request("198.51.100.2", 4))
+		if resp == nil {
+			t.Fatalf("status = %v, body = %v", recorder.Code, recorder.Body.String())
+		}
+		if resp.Rcode != dns.RcodeFormatError {
+			t.Errorf("rcode = %v, want FORMERR", dns.RcodeToString[resp.Rcode])
+		}
+		if got := fake.queryCount("udp"); got != before {
+			t.Errorf("upstream got %v queries, want none", got-before)
+		}
+	})
+
+	t.Run("every question is charged", func(t *testing.T) {
+		if recorder, _ := serve(router, request("198.51.100.3", 3)); recorder.Code != http.StatusOK {
+			t.Fatalf("status = %v, want %v", recorder.Code, http.StatusOK)
+		}
+		if recorder, _ := serve(router, request("198.51.100.3", 2)); recorder.Code != http.StatusTooManyRequests {
+			t.Errorf("status = %v, want %v", recorder.Code, http.StatusTooManyRequests)
+		}
+	})
+}
+
+func TestServeHTTPAuth(t *testing.T) {
+	fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		return replyA(query, "192.0.2.1", 300)
+	})
+	tokensFile := filepath.Join(t.TempDir(), "tokens.yml")
+	if err := ioutil.WriteFile(tokensFile, []byte("- {label: alice, token: s3cret}\n"), 0600); err != nil {
+		t.Fatalf("Could not write tokens: %v", err)
+	}
+	router := newTestRouter(t, upstreamYAML(fake.address)+fmt.Sprintf(`
+auth:
+  tokens_filepath: %v
+endpoints:
+  - path: /dns-query
+  - path: /private
+    require_auth: true
+ip_rate_limit:
+  max_tokens: 3
+  recover_x_tokens_per_sec: 1
+`, tokensFile))
+
+	request := func(path string, client string, authorization string) *http.Request {
+		request := newGetRequest(path, packTestQuery(t, "www.example.com.", dns.TypeA))
+		request.RemoteAddr = client + ":1234"
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		return request
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "anonymous", path: "/dns-query", wantStatus: http.StatusOK},
+		{name: "good bearer token", path: "/private", authorization: "Bearer s3cret", wantStatus: http.StatusOK},
+		{name: "bad bearer token", path: "/dns-query", authorization: "Bearer guess", wantStatus: http.StatusForbidden},
+		{name: "basic auth from a proxy", path: "/dns-query", authorization: "Basic dXNlcjpwYXNz", wantStatus: http.StatusOK},
+		{name: "basic auth where auth is required", path: "/private", authorization: "Basic dXNlcjpwYXNz", wantStatus: http.StatusUnauthorized},
+		{name: "nothing where auth is required", path: "/private", wantStatus: http.StatusUnauthorized},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder, _ := serve(router, request(test.path, fmt.Sprintf("198.51.100.%d", i+1), test.authorization))
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %v, want %v", recorder.Code, test.wantStatus)
+			}
+		})
+	}
+
+	t.Run("failed attempts are rate limited", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			if recorder, _ := serve(router, request("/private", "203.0.113.1", "Bearer guess")); recorder.Code != http.StatusForbidden {
+				t.Fatalf("attempt %v: status = %v, want %v", i, recorder.Code, http.StatusForbidden)
+			}
+		}
+		if recorder, _ := serve(router, request("/private", "203.0.113.1", "Bearer s3cret")); recorder.Code != http.StatusTooManyRequests {
+			t.Errorf("status = %v, want %v", recorder.Code, http.StatusTooManyRequests)
+		}
+	})
+}
+
+func TestServeHTTPAuthFloodSparesEndpointBucket(t *testing.T) {
+	fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		return replyA(query, "192.0.2.1", 300)
+	})
+	tokensFile := filepath.Join(t.TempDir(), "tokens.yml")
+	if err := ioutil.WriteFile(tokensFile, []byte("- {label: alice, token: s3cret}\n"), 0600); err != nil {
+		t.Fatalf("Could not write tokens: %v", err)
+	}
+	router := newTestRouter(t, upstreamYAML(fake.address)+fmt.Sprintf(`
+auth:
+  tokens_filepath: %v
+endpoints:
+  - path: /private
+    require_auth: true
+ip_rate_limit:
+  max_tokens: 3
+  recover_x_tokens_per_sec: 1
+  per_endpoint:
+    enabled: true
+    max_tokens: 5
+    recover_x_tokens_per_sec: 1
+`, tokensFile))
+
+	request := func(client string, authorization string) *http.Request {
+		request := newGetRequest("/private", packTestQuery(t, "www.example.com.", dns.TypeA))
+		request.RemoteAddr = client + ":1234"
+		request.Header.Set("Authorization", authorization)
+		return request
+	}
+
+	// Bad tokens from more addresses than the endpoint's bucket has tokens.
+	for i := 1; i <= 20; i++ {
+		if recorder, _ := serve(router, request(fmt.Sprintf("203.0.113.%d", i), "Bearer guess")); recorder.Code != http.StatusForbidden {
+			t.Fatalf("attempt %v: status = %v, want %v", i, recorder.Code, http.StatusForbidden)
+		}
+	}
+	if recorder, _ := serve(router, request("198.51.100.1", "Bearer s3cret")); recorder.Code != http.StatusOK {
+		t.Errorf("status = %v, want %v after a flood of bad tokens", recorder.Code, http.StatusOK)
+	}
+}
+
+func TestServeHTTPCookies(t *testing.T) {
+	fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		return replyA(query, "192.0.2.1", 300)
+	})
+	router := newTestRouter(t, upstreamYAML(fake.address)+`
+cookies:
+  secrets: ["000102030405060708090a0b0c0d0e0f"]
+`)
+
+	query := func(cookie string) *http.Request {
+		msg := newTestQuery("www.example.com.", dns.TypeA)
+		msg.Id = 0
+		msg.SetEdns0(1232, false)
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		wireFormat, err := msg.Pack()
+		if err != nil {
+			t.Fatalf("Could not pack query: %v", err)
+		}
+		request := newGetRequest("/dns-query", wireFormat)
+		request.RemoteAddr = "198.51.100.1:1234"
+		return request
+	}
+	exchange := func(cookie string) (*dns.Msg, string) {
+		t.Helper()
+		recorder, resp := serve(router, query(cookie))
+		if resp == nil {
+			t.Fatalf("status = %v, body = %v", recorder.Code, recorder.Body.String())
+		}
+		if got := rfc7873_getCookie(resp); got != nil {
+			return resp, got.Cookie
+		}
+		return resp, ""
+	}
+
+	resp, serverCookie := exchange(testClientCookie)
+	if resp.Rcode != dns.RcodeSuccess || len(serverCookie) != 48 {
+		t.Fatalf("rcode = %v, cookie = %v, want an answer and a server cookie", dns.RcodeToString[resp.Rcode], serverCookie)
+	}
+
+	if resp, cookie := exchange(serverCookie); resp.Rcode != dns.RcodeSuccess || cookie != serverCookie {
+		t.Errorf("rcode = %v, cookie = %v, want an answer and the same cookie back", dns.RcodeToString[resp.Rcode], cookie)
+	}
+
+	before := fake.queryCount("udp") + fake.queryCount("tcp")
+	forged := testClientCookie + strings.Repeat("ab", 16)
+	resp, cookie := exchange(forged)
+	if resp.Rcode != dns.RcodeBadCookie || len(resp.Answer) != 0 {
+		t.Errorf("rcode = %v, want BADCOOKIE without an answer", dns.RcodeToString[resp.Rcode])
+	}
+	if len(cookie) != 48 || cookie == forged {
+		t.Errorf("cookie = %v, want a fresh one to retry with", cookie)
+	}
+	if resp, _ := exchange(cookie); resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("retrying with the fresh cookie got %v", dns.RcodeToString[resp.Rcode])
+	}
+
+	if resp, cookie := exchange("0102"); resp.Rcode != dns.RcodeFormatError || cookie != "" {
+		t.Errorf("rcode = %v, cookie = %v, want FORMERR without a cookie", dns.RcodeToString[resp.Rcode], cookie)
+	}
+
+	if got := fake.queryCount("udp") + fake.queryCount("tcp") - before; got != 1 {
+		t.Errorf("upstream got %v queries, want only the retry's", got)
+	}
+}
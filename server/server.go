@@ -10,8 +10,10 @@ import (
 )
 
 type DOHServer struct {
-	HttpServer *http.Server
-	Config     *Config
+	HttpServer  *http.Server
+	AdminServer *http.Server // nil unless the admin api is enabled
+	Config      *Config
+	router      *router
 }
 
 func useTLS(config *Config) bool {
@@ -19,8 +21,6 @@ func useTLS(config *Config) bool {
 }
 
 func CreateDOHServer(config *Config) (*DOHServer, error) {
-	router := createRouter(config)
-
 	tlsConfig := &tls.Config{}
 	if useTLS(config) {
 		cert, err := tls.LoadX509KeyPair(config.Server.TLSCertPath, config.Server.TLSKeyPath)
@@ -28,11 +28,23 @@ func CreateDOHServer(config *Config) (*DOHServer, error) {
 			return nil, err
 		}
 		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+		if err := configureClientCerts(tlsConfig, &config.Auth); err != nil {
+			return nil, err
+		}
 	}
 
+	router, err := createRouter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", router)
+
 	httpServer := http.Server{
 		Addr:         fmt.Sprintf("%v:%v", config.Server.Host, config.Server.Port),
-		Handler:      router,
+		Handler:      mux,
 		ReadTimeout:  time.Duration(config.Server.TimeoutMillis.Read) * time.Millisecond,
 		WriteTimeout: time.Duration(config.Server.TimeoutMillis.Write) * time.Millisecond,
 		IdleTimeout:  time.Duration(config.Server.TimeoutMillis.Idle) * time.Millisecond,
@@ -42,12 +54,26 @@ func CreateDOHServer(config *Config) (*DOHServer, error) {
 	dohs := &DOHServer{
 		HttpServer: &httpServer,
 		Config:     config,
+		router:     router,
+	}
+
+	if config.Admin.Enabled {
+		dohs.AdminServer = createAdminServer(config, router)
 	}
 
 	return dohs, nil
 }
 
 func (dohs *DOHServer) ListenAndBlock() error {
+	if dohs.AdminServer != nil {
+		go func() {
+			log.Printf("starting admin server: [%v]", dohs.AdminServer.Addr)
+			if err := dohs.AdminServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Printf("ERR: admin server: %v", err)
+			}
+		}()
+	}
+
 	log.Printf("starting doh server: [%v]", dohs.HttpServer.Addr)
 
 	if useTLS(dohs.Config) {
@@ -68,7 +94,19 @@ func (dohs *DOHServer) Stop() error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	if err := dohs.HttpServer.Shutdown(ctx); err != nil {
+	if dohs.AdminServer != nil {
+		if err := dohs.AdminServer.Shutdown(ctx); err != nil {
+			log.Printf("error during admin sever shutdown: %v\n", err)
+		}
+	}
+
+	err := dohs.HttpServer.Shutdown(ctx)
+
+	// Done here rather than as a shutdown hook, since those run in the
+	// background and the process may well exit before they're through.
+	dohs.router.close()
+
+	if err != nil {
 		log.Printf("error during http sever shutdown: %v\n", err)
 		return err
 	}
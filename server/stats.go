@@ -0,0 +1,321 @@
+package dohboy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	statsBucketWidth = time.Minute
+	statsBuckets     = 24 * 60
+	// Queries are counted in shards, each behind a lock of its own, and
+	// folded into the day's buckets once their minute is over.
+	statsShards = 16
+	// Bound on distinct names/clients a shard tracks within a minute, so that
+	// a flood of random names can't blow up memory. Anything past it is
+	// counted as other.
+	statsMaxKeysPerShard = 1000
+	// Only the top names/clients of a minute are kept once it's over, which
+	// bounds a day's worth of buckets to 3 × 50 × 1440 keys.
+	statsTopKeysPerBucket = 50
+	statsOtherKey         = "(other)"
+)
+
+type latencySum struct {
+	count uint64
+	sumMs float64
+}
+
+// statsBucket rolls up one minute's worth of queries.
+type statsBucket struct {
+	start          time.Time
+	queries        uint64
+	blocked        uint64
+	rcodes         map[string]uint64
+	domains        map[string]uint64
+	blockedDomains map[string]uint64
+	clients        map[string]uint64
+	upstreams      map[string]*latencySum
+}
+
+func newStatsBucket(start time.Time) *statsBucket {
+	return &statsBucket{
+		start:          start,
+		rcodes:         make(map[string]uint64),
+		domains:        make(map[string]uint64),
+		blockedDomains: make(map[string]uint64),
+		clients:        make(map[string]uint64),
+		upstreams:      make(map[string]*latencySum),
+	}
+}
+
+// merge adds the counts of another bucket to this one.
+func (bucket *statsBucket) merge(other *statsBucket) {
+	bucket.queries += other.queries
+	bucket.blocked += other.blocked
+	mergeCounts(bucket.rcodes, other.rcodes)
+	mergeCounts(bucket.domains, other.domains)
+	mergeCounts(bucket.blockedDomains, other.blockedDomains)
+	mergeCounts(bucket.clients, other.clients)
+	for name, otherSum := range other.upstreams {
+		sum, exists := bucket.upstreams[name]
+		if !exists {
+			sum = &latencySum{}
+			bucket.upstreams[name] = sum
+		}
+		sum.count += otherSum.count
+		sum.sumMs += otherSum.sumMs
+	}
+}
+
+// trim keeps the top n names and clients, counting the rest as other.
+func (bucket *statsBucket) trim(n int) {
+	trimCounts(bucket.domains, n)
+	trimCounts(bucket.blockedDomains, n)
+	trimCounts(bucket.clients, n)
+}
+
+func countCapped(counts map[string]uint64, key string) {
+	if _, exists := counts[key]; !exists && len(counts) >= statsMaxKeysPerShard {
+		key = statsOtherKey
+	}
+	counts[key]++
+}
+
+func mergeCounts(counts map[string]uint64, other map[string]uint64) {
+	for key, count := range other {
+		counts[key] += count
+	}
+}
+
+func trimCounts(counts map[string]uint64, n int) {
+	other, hasOther := counts[statsOtherKey]
+	delete(counts, statsOtherKey)
+	if len(counts) > n {
+		for _, ranked := range topN(counts, len(counts))[n:] {
+			other += ranked.Count
+			delete(counts, ranked.Key)
+		}
+		hasOther = true
+	}
+	if hasOther {
+		counts[statsOtherKey] = other
+	}
+}
+
+type queryEvent struct {
+	name    string
+	client  string
+	rcode   string
+	blocked bool
+}
+
+// queryStats keeps a day of per-minute rollups in a ring buffer, for the
+// dashboard.
+type queryStats struct {
+	shards  [statsShards]statsShard
+	buckets [statsBuckets]*statsBucket // minutes that are over
+	mu      sync.Mutex                 // guards buckets; taken after a shard's lock, never before
+}
+
+// statsShard counts a share of the current minute's queries.
+type statsShard struct {
+	bucket *statsBucket // nil until the shard's first query
+	mu     sync.Mutex
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{}
+}
+
+// statsShardFor spreads keys over the shards (FNV-1a), so that each name is
+// counted in a single shard.
+func statsShardFor(key string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % statsShards)
+}
+
+func statsBucketIndex(start time.Time) int64 {
+	return (start.Unix() / int64(statsBucketWidth/time.Second)) % statsBuckets
+}
+
+// currentBucket returns the shard's bucket for the minute of now, folding the
+// one of a minute that's over into the day's buckets first. Callers hold the
+// shard's lock.
+func (stats *queryStats) currentBucket(shard *statsShard, now time.Time) *statsBucket {
+	start := now.Truncate(statsBucketWidth)
+	if shard.bucket != nil && !shard.bucket.start.Equal(start) {
+		stats.fold(shard.bucket)
+		shard.bucket = nil
+	}
+	if shard.bucket == nil {
+		shard.bucket = newStatsBucket(start)
+	}
+	return shard.bucket
+}
+
+// fold adds a shard's counts for a minute that's over to the day's bucket for
+// that minute, recycling the slot of whatever bucket held it a day ago.
+func (stats *queryStats) fold(shardBucket *statsBucket) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	idx := statsBucketIndex(shardBucket.start)
+	bucket := stats.buckets[idx]
+	if bucket != nil && bucket.start.After(shardBucket.start) {
+		// The shard sat idle for over a day; its counts are out of range.
+		return
+	}
+	if bucket == nil || !bucket.start.Equal(shardBucket.start) {
+		bucket = newStatsBucket(shardBucket.start)
+		stats.buckets[idx] = bucket
+	}
+	bucket.merge(shardBucket)
+	bucket.trim(statsTopKeysPerBucket)
+}
+
+func (stats *queryStats) recordQuery(event queryEvent) {
+	shard := &stats.shards[statsShardFor(event.name)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	bucket := stats.currentBucket(shard, time.Now())
+	bucket.queries++
+	countCapped(bucket.rcodes, event.rcode)
+	countCapped(bucket.domains, event.name)
+	countCapped(bucket.clients, event.client)
+	if event.blocked {
+		bucket.blocked++
+		countCapped(bucket.blockedDomains, event.name)
+	}
+}
+
+func (stats *queryStats) recordUpstreamLatency(name string, latency time.Duration) {
+	shard := &stats.shards[statsShardFor(name)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	bucket := stats.currentBucket(shard, time.Now())
+	sum, exists := bucket.upstreams[name]
+	if !exists {
+		sum = &latencySum{}
+		bucket.upstreams[name] = sum
+	}
+	sum.count++
+	sum.sumMs += float64(latency) / float64(time.Millisecond)
+}
+
+type statsPoint struct {
+	Time    time.Time `json:"time"`
+	Queries uint64    `json:"queries"`
+	Blocked uint64    `json:"blocked"`
+	QPS     float64   `json:"qps"`
+}
+
+type latencyPoint struct {
+	Time  time.Time `json:"time"`
+	AvgMs float64   `json:"avg_ms"`
+}
+
+type rankedCount struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+type statsSummary struct {
+	WindowSeconds   int64                     `json:"window_seconds"`
+	Queries         uint64                    `json:"queries"`
+	Blocked         uint64                    `json:"blocked"`
+	Series          []statsPoint              `json:"series"`
+	Rcodes          map[string]uint64         `json:"rcodes"`
+	TopDomains      []rankedCount             `json:"top_domains"`
+	TopBlocked      []rankedCount             `json:"top_blocked"`
+	TopClients      []rankedCount             `json:"top_clients"`
+	UpstreamLatency map[string][]latencyPoint `json:"upstream_latency"`
+}
+
+// summarize rolls up every bucket within the window, listing the top n of
+// each ranking.
+func (stats *queryStats) summarize(window time.Duration, n int) statsSummary {
+	now := time.Now()
+	current := newStatsBucket(now.Truncate(statsBucketWidth))
+	for i := range stats.shards {
+		shard := &stats.shards[i]
+		shard.mu.Lock()
+		current.merge(stats.currentBucket(shard, now))
+		shard.mu.Unlock()
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	since := now.Add(-window).Truncate(statsBucketWidth)
+
+	summary := statsSummary{
+		WindowSeconds:   int64(window / time.Second),
+		Series:          []statsPoint{},
+		UpstreamLatency: make(map[string][]latencyPoint),
+	}
+	total := newStatsBucket(since)
+
+	for start := since; !start.After(now); start = start.Add(statsBucketWidth) {
+		bucket := stats.buckets[statsBucketIndex(start)]
+		if bucket == nil || !bucket.start.Equal(start) {
+			bucket = nil
+		}
+		if start.Equal(current.start) {
+			if bucket != nil {
+				current.merge(bucket)
+			}
+			bucket = current
+		}
+		if bucket == nil {
+			summary.Series = append(summary.Series, statsPoint{Time: start})
+			continue
+		}
+
+		total.merge(bucket)
+		summary.Series = append(summary.Series, statsPoint{
+			Time:    start,
+			Queries: bucket.queries,
+			Blocked: bucket.blocked,
+			QPS:     float64(bucket.queries) / statsBucketWidth.Seconds(),
+		})
+		for name, sum := range bucket.upstreams {
+			summary.UpstreamLatency[name] = append(summary.UpstreamLatency[name],
+				latencyPoint{Time: start, AvgMs: sum.sumMs / float64(sum.count)})
+		}
+	}
+
+	summary.Queries = total.queries
+	summary.Blocked = total.blocked
+	summary.Rcodes = total.rcodes
+	summary.TopDomains = topN(total.domains, n)
+	summary.TopBlocked = topN(total.blockedDomains, n)
+	summary.TopClients = topN(total.clients, n)
+	return summary
+}
+
+func topN(counts map[string]uint64, n int) []rankedCount {
+	ranked := make([]rankedCount, 0, len(counts))
+	for key, count := range counts {
+		ranked = append(ranked, rankedCount{Key: key, Count: count})
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Count != ranked[j].Count {
+			return ranked[i].Count > ranked[j].Count
+		}
+		return ranked[i].Key < ranked[j].Key
+	})
+
+	if len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
@@ -0,0 +1,166 @@
+package dohboy
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// foldTestBucket folds a bucket with the given counts in for the minute that
+// was the given number of minutes ago.
+func foldTestBucket(stats *queryStats, minutesAgo int, domains map[string]uint64, blocked uint64) {
+	bucket := newStatsBucket(time.Now().Add(-time.Duration(minutesAgo) * statsBucketWidth).Truncate(statsBucketWidth))
+	for name, count := range domains {
+		bucket.queries += count
+		bucket.domains[name] = count
+		bucket.rcodes["NOERROR"] += count
+	}
+	bucket.blocked = blocked
+	stats.fold(bucket)
+}
+
+func TestStatsSummarize(t *testing.T) {
+	stats := newQueryStats()
+	foldTestBucket(stats, 90, map[string]uint64{"old.example.": 100}, 0)
+	foldTestBucket(stats, 30, map[string]uint64{"a.example.": 5, "b.example.": 3}, 1)
+	foldTestBucket(stats, 2, map[string]uint64{"b.example.": 4}, 0)
+
+	for i := 0; i < 3; i++ {
+		stats.recordQuery(queryEvent{name: "c.example.", client: "198.51.100.1", rcode: "NXDOMAIN"})
+	}
+	stats.recordQuery(queryEvent{name: "ads.example.", client: "198.51.100.2", rcode: "NXDOMAIN", blocked: true})
+	stats.recordUpstreamLatency("default -> dns.example", 10*time.Millisecond)
+	stats.recordUpstreamLatency("default -> dns.example", 30*time.Millisecond)
+
+	summary := stats.summarize(time.Hour, 2)
+
+	if summary.Queries != 16 || summary.Blocked != 2 {
+		t.Errorf("queries = %v, blocked = %v, want 16 and 2", summary.Queries, summary.Blocked)
+	}
+	if want := map[string]uint64{"NOERROR": 12, "NXDOMAIN": 4}; !reflect.DeepEqual(summary.Rcodes, want) {
+		t.Errorf("rcodes = %v, want %v", summary.Rcodes, want)
+	}
+	if want := []rankedCount{{"b.example.", 7}, {"a.example.", 5}}; !reflect.DeepEqual(summary.TopDomains, want) {
+		t.Errorf("top domains = %v, want %v", summary.TopDomains, want)
+	}
+	if want := []rankedCount{{"ads.example.", 1}}; !reflect.DeepEqual(summary.TopBlocked, want) {
+		t.Errorf("top blocked = %v, want %v", summary.TopBlocked, want)
+	}
+	if want := []rankedCount{{"198.51.100.1", 3}, {"198.51.100.2", 1}}; !reflect.DeepEqual(summary.TopClients, want) {
+		t.Errorf("top clients = %v, want %v", summary.TopClients, want)
+	}
+
+	if len(summary.Series) < 60 || len(summary.Series) > 61 {
+		t.Errorf("series has %v points, want one a minute", len(summary.Series))
+	}
+	var current statsPoint
+	for _, point := range summary.Series {
+		if point.Time.Equal(stats.shards[statsShardFor("c.example.")].bucket.start) {
+			current = point
+		}
+	}
+	if current.Queries != 4 || current.Blocked != 1 || current.QPS != 4.0/60 {
+		t.Errorf("current minute = %+v, want the queries recorded in it", current)
+	}
+
+	latency := summary.UpstreamLatency["default -> dns.example"]
+	if len(latency) != 1 || latency[0].AvgMs != 20 {
+		t.Errorf("latency = %+v, want a single point averaging 20ms", latency)
+	}
+
+	if summary := stats.summarize(2*time.Hour, 10); summary.Queries != 116 {
+		t.Errorf("queries over 2h = %v, want 116", summary.Queries)
+	}
+}
+
+func TestStatsFold(t *testing.T) {
+	t.Run("keeps the top keys of a minute", func(t *testing.T) {
+		stats := newQueryStats()
+		domains := map[string]uint64{}
+		total := uint64(0)
+		for i := 0; i < 3*statsTopKeysPerBucket; i++ {
+			domains[fmt.Sprintf("%03d.example.", i)] = uint64(i + 1)
+			total += uint64(i + 1)
+		}
+		foldTestBucket(stats, 5, domains, 0)
+
+		bucket := stats.buckets[statsBucketIndex(time.Now().Add(-5*statsBucketWidth).Truncate(statsBucketWidth))]
+		if len(bucket.domains) != statsTopKeysPerBucket+1 {
+			t.Fatalf("bucket keeps %v domains, want the top %v and other", len(bucket.domains), statsTopKeysPerBucket)
+		}
+		sum := uint64(0)
+		for name, count := range bucket.domains {
+			sum += count
+			if name != statsOtherKey && count <= uint64(2*statsTopKeysPerBucket) {
+				t.Errorf("kept %v with %v queries over busier names", name, count)
+			}
+		}
+		if sum != total {
+			t.Errorf("counts add up to %v, want %v", sum, total)
+		}
+	})
+
+	t.Run("drops counts over a day old", func(t *testing.T) {
+		stats := newQueryStats()
+		foldTestBucket(stats, 0, map[string]uint64{"new.example.": 1}, 0)
+		foldTestBucket(stats, statsBuckets, map[string]uint64{"old.example.": 1}, 0)
+
+		bucket := stats.buckets[statsBucketIndex(time.Now().Truncate(statsBucketWidth))]
+		if _, exists := bucket.domains["old.example."]; exists || bucket.queries != 1 {
+			t.Errorf("domains = %v, want the day-old counts dropped", bucket.domains)
+		}
+	})
+
+	t.Run("shards fold as their minute ends", func(t *testing.T) {
+		stats := newQueryStats()
+		stats.recordQuery(queryEvent{name: "a.example.", client: "198.51.100.1", rcode: "NOERROR"})
+
+		shard := &stats.shards[statsShardFor("a.example.")]
+		shard.bucket.start = shard.bucket.start.Add(-statsBucketWidth)
+		stats.recordQuery(queryEvent{name: "a.example.", client: "198.51.100.1", rcode: "NOERROR"})
+
+		if folded := stats.buckets[statsBucketIndex(shard.bucket.start.Add(-statsBucketWidth))]; folded == nil || folded.queries != 1 {
+			t.Errorf("previous minute = %+v, want its query folded in", folded)
+		}
+		if shard.bucket.queries != 1 {
+			t.Errorf("current minute has %v queries, want 1", shard.bucket.queries)
+		}
+	})
+}
+
+func TestStatsShardCap(t *testing.T) {
+	stats := newQueryStats()
+	for i := 0; i < statsMaxKeysPerShard+10; i++ {
+		stats.recordQuery(queryEvent{name: "example.com.", client: fmt.Sprintf("client-%v", i), rcode: "NOERROR"})
+	}
+
+	shard := &stats.shards[statsShardFor("example.com.")]
+	if len(shard.bucket.clients) != statsMaxKeysPerShard+1 || shard.bucket.clients[statsOtherKey] != 10 {
+		t.Errorf("shard tracks %v clients with %v as other, want %v and 10", len(shard.bucket.clients), shard.bucket.clients[statsOtherKey], statsMaxKeysPerShard)
+	}
+}
+
+func TestStatsConcurrency(t *testing.T) {
+	stats := newQueryStats()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				stats.recordQuery(queryEvent{name: fmt.Sprintf("%v.example.", j%50), client: fmt.Sprintf("client-%v", i), rcode: "NOERROR"})
+				stats.recordUpstreamLatency("default -> dns.example", time.Millisecond)
+				if j%100 == 0 {
+					stats.summarize(time.Hour, 10)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if summary := stats.summarize(time.Hour, 10); summary.Queries != 8*500 {
+		t.Errorf("queries = %v, want %v", summary.Queries, 8*500)
+	}
+}
@@ -51,9 +51,57 @@ func overrideAnyLargeTTL(dnsQueryResult *dns.Msg, maxTTL uint32) {
 	for _, rrs := range [][]dns.RR{dnsQueryResult.Answer, dnsQueryResult.Ns, dnsQueryResult.Extra} {
 		for _, rr := range rrs {
 			header := rr.Header()
-			if header != nil && header.Ttl >= maxTTL {
+			// The OPT record's TTL field holds the extended rcode and flags.
+			if header != nil && header.Rrtype != dns.TypeOPT && header.Ttl >= maxTTL {
 				header.Ttl = maxTTL
 			}
 		}
 	}
 }
+
+// ttlBounds are the TTLs records get clamped to. A max of 0 means no maximum.
+type ttlBounds struct {
+	min uint32
+	max uint32
+}
+
+func (bounds ttlBounds) isSet() bool {
+	return bounds.min != 0 || bounds.max != 0
+}
+
+func (bounds ttlBounds) clamp(ttl uint32) uint32 {
+	if ttl < bounds.min {
+		ttl = bounds.min
+	}
+	if bounds.max != 0 && ttl > bounds.max {
+		ttl = bounds.max
+	}
+	return ttl
+}
+
+// clampTTLs clamps the TTLs of every record to positive, except for the SOA
+// of a negative response, which is clamped to negative. The SOA minimum is
+// clamped along with its TTL, since the lower of the two is what the negative
+// response gets cached for (RFC 2308).
+func clampTTLs(dnsQueryResult *dns.Msg, positive ttlBounds, negative ttlBounds) {
+	if dnsQueryResult == nil {
+		return
+	}
+
+	isNegative := rfc2308_isNegativeResponse(dnsQueryResult)
+	for _, rrs := range [][]dns.RR{dnsQueryResult.Answer, dnsQueryResult.Ns, dnsQueryResult.Extra} {
+		for _, rr := range rrs {
+			header := rr.Header()
+			if header == nil || header.Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if soa, ok := rr.(*dns.SOA); ok && isNegative {
+				header.Ttl = negative.clamp(header.Ttl)
+				soa.Minttl = negative.clamp(soa.Minttl)
+				continue
+			}
+			header.Ttl = positive.clamp(header.Ttl)
+		}
+	}
+}
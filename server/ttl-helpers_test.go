@@ -0,0 +1,307 @@
+package dohboy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func mustRRs(t *testing.T, records ...string) []dns.RR {
+	t.Helper()
+	retval := []dns.RR{}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("Bad record [%v]: %v", record, err)
+		}
+		retval = append(retval, rr)
+	}
+	return retval
+}
+
+// newTestResponse builds a response to an A query for example.com, with an
+// OPT record appended to the additional section.
+func newTestResponse(t *testing.T, rcode int, answer, ns, extra []string) *dns.Msg {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Response = true
+	msg.Rcode = rcode
+	msg.Answer = mustRRs(t, answer...)
+	msg.Ns = mustRRs(t, ns...)
+	msg.Extra = mustRRs(t, extra...)
+	msg.SetEdns0(4096, true)
+	return msg
+}
+
+// ttls lists the TTLs of the records, leaving out OPT records.
+func ttls(rrs []dns.RR) []uint32 {
+	retval := []uint32{}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			retval = append(retval, rr.Header().Ttl)
+		}
+	}
+	return retval
+}
+
+func equalTTLs(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func soaMinimum(msg *dns.Msg) uint32 {
+	soa, err := rfc2308_getSOARecord(msg)
+	if err != nil {
+		return 0
+	}
+	return soa.Minttl
+}
+
+func optIsIntact(t *testing.T, msg *dns.Msg) {
+	t.Helper()
+	opt := msg.IsEdns0()
+	if opt == nil {
+		t.Fatalf("OPT record went missing.")
+	}
+	if !opt.Do() || opt.Version() != 0 || opt.ExtendedRcode() != 0 {
+		t.Errorf("OPT record was changed: %v", opt)
+	}
+}
+
+func TestClampTTLs(t *testing.T) {
+	tests := []struct {
+		name        string
+		rcode       int
+		answer      []string
+		ns          []string
+		extra       []string
+		positive    ttlBounds
+		negative    ttlBounds
+		wantAnswer  []uint32
+		wantNs      []uint32
+		wantExtra   []uint32
+		wantMinimum uint32
+		wantOverall uint32
+	}{
+		{
+			name:        "no bounds leave the TTLs alone",
+			answer:      []string{"example.com. 5 IN A 192.0.2.1", "example.com. 90000 IN A 192.0.2.2"},
+			wantAnswer:  []uint32{5, 90000},
+			wantNs:      []uint32{},
+			wantExtra:   []uint32{},
+			wantOverall: 5,
+		},
+		{
+			name:        "minimum raises low TTLs in every section",
+			answer:      []string{"example.com. 5 IN A 192.0.2.1", "example.com. 600 IN A 192.0.2.2"},
+			ns:          []string{"example.com. 10 IN NS ns.example.com."},
+			extra:       []string{"ns.example.com. 20 IN A 192.0.2.53"},
+			positive:    ttlBounds{min: 60},
+			wantAnswer:  []uint32{60, 600},
+			wantNs:      []uint32{60},
+			wantExtra:   []uint32{60},
+			wantOverall: 60,
+		},
+		{
+			name:        "maximum lowers high TTLs in every section",
+			answer:      []string{"example.com. 5 IN A 192.0.2.1", "example.com. 90000 IN A 192.0.2.2"},
+			ns:          []string{"example.com. 172800 IN NS ns.example.com."},
+			extra:       []string{"ns.example.com. 172800 IN A 192.0.2.53"},
+			positive:    ttlBounds{max: 3600},
+			wantAnswer:  []uint32{5, 3600},
+			wantNs:      []uint32{3600},
+			wantExtra:   []uint32{3600},
+			wantOverall: 5,
+		},
+		{
+			name:        "minimum and maximum together",
+			answer:      []string{"example.com. 5 IN A 192.0.2.1", "example.com. 300 IN A 192.0.2.2", "example.com. 90000 IN A 192.0.2.3"},
+			positive:    ttlBounds{min: 60, max: 3600},
+			wantAnswer:  []uint32{60, 300, 3600},
+			wantNs:      []uint32{},
+			wantExtra:   []uint32{},
+			wantOverall: 60,
+		},
+		{
+			name:        "positive bounds don't apply to the SOA of NXDOMAIN",
+			rcode:       dns.RcodeNameError,
+			ns:          []string{"example.com. 900 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300"},
+			positive:    ttlBounds{min: 3600},
+			wantAnswer:  []uint32{},
+			wantNs:      []uint32{900},
+			wantExtra:   []uint32{},
+			wantMinimum: 300,
+			wantOverall: 300,
+		},
+		{
+			name:        "negative maximum lowers the SOA TTL and minimum of NXDOMAIN",
+			rcode:       dns.RcodeNameError,
+			ns:          []string{"example.com. 900 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 86400"},
+			negative:    ttlBounds{max: 60},
+			wantAnswer:  []uint32{},
+			wantNs:      []uint32{60},
+			wantExtra:   []uint32{},
+			wantMinimum: 60,
+			wantOverall: 60,
+		},
+		{
+			name:        "negative minimum raises the SOA TTL and minimum of NODATA",
+			ns:          []string{"example.com. 5 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 0"},
+			negative:    ttlBounds{min: 30, max: 600},
+			wantAnswer:  []uint32{},
+			wantNs:      []uint32{30},
+			wantExtra:   []uint32{},
+			wantMinimum: 30,
+			wantOverall: 30,
+		},
+		{
+			name:        "the SOA of a positive answer gets the positive bounds",
+			answer:      []string{"example.com. 300 IN A 192.0.2.1"},
+			ns:          []string{"example.com. 900 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 86400"},
+			positive:    ttlBounds{max: 120},
+			negative:    ttlBounds{max: 10},
+			wantAnswer:  []uint32{120},
+			wantNs:      []uint32{120},
+			wantExtra:   []uint32{},
+			wantMinimum: 86400,
+			wantOverall: 120,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := newTestResponse(t, test.rcode, test.answer, test.ns, test.extra)
+			clampTTLs(msg, test.positive, test.negative)
+
+			if got := ttls(msg.Answer); !equalTTLs(got, test.wantAnswer) {
+				t.Errorf("answer TTLs = %v, want %v", got, test.wantAnswer)
+			}
+			if got := ttls(msg.Ns); !equalTTLs(got, test.wantNs) {
+				t.Errorf("authority TTLs = %v, want %v", got, test.wantNs)
+			}
+			if got := ttls(msg.Extra); !equalTTLs(got, test.wantExtra) {
+				t.Errorf("additional TTLs = %v, want %v", got, test.wantExtra)
+			}
+			if got := soaMinimum(msg); got != test.wantMinimum {
+				t.Errorf("SOA minimum = %v, want %v", got, test.wantMinimum)
+			}
+			if got := getOverallTTL(msg); got != test.wantOverall {
+				t.Errorf("overall TTL = %v, want %v", got, test.wantOverall)
+			}
+			optIsIntact(t, msg)
+		})
+	}
+}
+
+func TestOverrideAnyLargeTTL(t *testing.T) {
+	tests := []struct {
+		name       string
+		rcode      int
+		answer     []string
+		ns         []string
+		extra      []string
+		maxTTL     uint32
+		wantAnswer []uint32
+		wantNs     []uint32
+		wantExtra  []uint32
+	}{
+		{
+			name:       "lowers only TTLs above the maximum",
+			answer:     []string{"example.com. 30 IN A 192.0.2.1", "example.com. 90000 IN A 192.0.2.2"},
+			ns:         []string{"example.com. 172800 IN NS ns.example.com."},
+			extra:      []string{"ns.example.com. 10 IN A 192.0.2.53"},
+			maxTTL:     60,
+			wantAnswer: []uint32{30, 60},
+			wantNs:     []uint32{60},
+			wantExtra:  []uint32{10},
+		},
+		{
+			name:       "negative responses",
+			rcode:      dns.RcodeNameError,
+			ns:         []string{"example.com. 900 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300"},
+			maxTTL:     60,
+			wantAnswer: []uint32{},
+			wantNs:     []uint32{60},
+			wantExtra:  []uint32{},
+		},
+		{
+			name:       "zero zeroes everything",
+			answer:     []string{"example.com. 30 IN A 192.0.2.1"},
+			extra:      []string{"ns.example.com. 10 IN A 192.0.2.53"},
+			maxTTL:     0,
+			wantAnswer: []uint32{0},
+			wantNs:     []uint32{},
+			wantExtra:  []uint32{0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := newTestResponse(t, test.rcode, test.answer, test.ns, test.extra)
+			overrideAnyLargeTTL(msg, test.maxTTL)
+
+			if got := ttls(msg.Answer); !equalTTLs(got, test.wantAnswer) {
+				t.Errorf("answer TTLs = %v, want %v", got, test.wantAnswer)
+			}
+			if got := ttls(msg.Ns); !equalTTLs(got, test.wantNs) {
+				t.Errorf("authority TTLs = %v, want %v", got, test.wantNs)
+			}
+			if got := ttls(msg.Extra); !equalTTLs(got, test.wantExtra) {
+				t.Errorf("additional TTLs = %v, want %v", got, test.wantExtra)
+			}
+			optIsIntact(t, msg)
+		})
+	}
+
+	overrideAnyLargeTTL(nil, 60)
+}
+
+func TestMaximumTTLOverrideAppliesToUpstreamResponses(t *testing.T) {
+	relay := &relay{maximumTTLOverride: 60}
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	resp := newTestResponse(t, dns.RcodeSuccess, []string{"example.com. 3600 IN A 192.0.2.1"}, nil, nil)
+
+	rule := &upstreamRule{upstream: monitorUpstream(nil, "default -> test", nil)}
+
+	got := relay.finishUpstream(query, defaultRoute, rule, resp)
+	if ttl := getOverallTTL(got); ttl != 60 {
+		t.Errorf("overall TTL = %v, want 60", ttl)
+	}
+}
+
+func TestPostProcessorTTLBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  PostProcessConfig
+		wantErr bool
+		wantNil bool
+	}{
+		{name: "nothing configured", wantNil: true},
+		{name: "minimum only", config: PostProcessConfig{MinTTL: 60}},
+		{name: "negative maximum only", config: PostProcessConfig{MaxNegativeTTL: 60}},
+		{name: "minimum above maximum", config: PostProcessConfig{MinTTL: 600, MaxTTL: 60}, wantErr: true},
+		{name: "negative minimum above maximum", config: PostProcessConfig{MinNegativeTTL: 600, MaxNegativeTTL: 60}, wantErr: true},
+		{name: "minimum with no maximum", config: PostProcessConfig{MinTTL: 600}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pp, err := newPostProcessor(&test.config)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && (pp == nil) != test.wantNil {
+				t.Errorf("processor = %v, wantNil %v", pp, test.wantNil)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package dohboy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type upstreamStatus struct {
+	Name          string    `json:"name"`
+	Healthy       bool      `json:"healthy"`
+	Exchanges     uint64    `json:"exchanges"`
+	Failures      uint64    `json:"failures"`
+	AvgLatencyMs  float64   `json:"avg_latency_ms"`
+	LastSuccessAt time.Time `json:"last_success_at,omitempty"`
+	LastFailureAt time.Time `json:"last_failure_at,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// monitoredUpstream wraps an upstream to keep track of how its exchanges go.
+type monitoredUpstream struct {
+	upstream
+	status   upstreamStatus
+	statusMu sync.Mutex
+	stats    *queryStats
+}
+
+func monitorUpstream(us upstream, name string, stats *queryStats) *monitoredUpstream {
+	return &monitoredUpstream{
+		upstream: us,
+		status:   upstreamStatus{Name: name, Healthy: true},
+		stats:    stats,
+	}
+}
+
+func (mu *monitoredUpstream) resolve(dnsQuery *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := mu.upstream.resolve(dnsQuery)
+
+	latency := time.Since(start)
+	mu.record(latency, err)
+	if err == nil && mu.stats != nil {
+		mu.stats.recordUpstreamLatency(mu.status.Name, latency)
+	}
+	return resp, err
+}
+
+func (mu *monitoredUpstream) record(latency time.Duration, err error) {
+	mu.statusMu.Lock()
+	defer mu.statusMu.Unlock()
+
+	status := &mu.status
+	status.Exchanges++
+
+	if err != nil {
+		status.Failures++
+		status.Healthy = false
+		status.LastFailureAt = time.Now()
+		status.LastError = err.Error()
+		return
+	}
+
+	status.Healthy = true
+	status.LastSuccessAt = time.Now()
+
+	// Exponentially weighted, so the average follows recent behaviour.
+	latencyMs := float64(latency) / float64(time.Millisecond)
+	if status.AvgLatencyMs == 0 {
+		status.AvgLatencyMs = latencyMs
+	} else {
+		status.AvgLatencyMs = 0.8*status.AvgLatencyMs + 0.2*latencyMs
+	}
+}
+
+func (mu *monitoredUpstream) snapshot() upstreamStatus {
+	mu.statusMu.Lock()
+	defer mu.statusMu.Unlock()
+	return mu.status
+}
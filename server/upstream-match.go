@@ -0,0 +1,150 @@
+package dohboy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// queryClient is who a query came from, as far as routing is concerned.
+type queryClient struct {
+	ip    net.IP
+	label string // token label; empty for anonymous clients
+}
+
+// upstreamMatcher decides whether a query is routed to a custom upstream.
+type upstreamMatcher struct {
+	regex          *regexp.Regexp
+	qtypes         map[uint16]bool // nil matches any qtype
+	suffixes       *set            // nil matches any name
+	clientNetworks cidrList        // empty matches any client
+	clientLabels   *set            // nil matches any client
+	negate         bool
+}
+
+func newUpstreamMatcher(config UpstreamConfig) (*upstreamMatcher, error) {
+	regex, err := regexp.Compile(config.NameRegex)
+	if err != nil {
+		return nil, err
+	}
+
+	matcher := &upstreamMatcher{
+		regex:  regex,
+		negate: config.Match.Negate,
+	}
+
+	if len(config.Match.Qtypes) > 0 {
+		matcher.qtypes = make(map[uint16]bool, len(config.Match.Qtypes))
+		for _, qtype := range config.Match.Qtypes {
+			val, known := dns.StringToType[strings.ToUpper(qtype)]
+			if !known {
+				return nil, fmt.Errorf("Unknown qtype [%v].", qtype)
+			}
+			matcher.qtypes[val] = true
+		}
+	}
+
+	if len(config.Match.Suffixes) > 0 || len(config.Match.SuffixFiles) > 0 {
+		matcher.suffixes = newSet()
+		for _, suffix := range config.Match.Suffixes {
+			addName(matcher.suffixes, suffix)
+		}
+		for _, filepath := range config.Match.SuffixFiles {
+			if err := readNamesFile(matcher.suffixes, filepath); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	matcher.clientNetworks, err = parseCIDRs(config.Match.ClientCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.Match.ClientLabels) > 0 {
+		matcher.clientLabels = newSet()
+		for _, label := range config.Match.ClientLabels {
+			matcher.clientLabels.Add(label)
+		}
+	}
+
+	return matcher, nil
+}
+
+// match checks a query against the matcher, along with the reason why it did
+// or didn't match.
+func (matcher *upstreamMatcher) match(dnsQuery *dns.Msg, client queryClient) (bool, string) {
+	matched, reason := matcher.matchCriteria(dnsQuery, client)
+	if matcher.negate {
+		return !matched, "negated: " + reason
+	}
+	return matched, reason
+}
+
+func (matcher *upstreamMatcher) matchCriteria(dnsQuery *dns.Msg, client queryClient) (bool, string) {
+	question := dnsQuery.Question[0]
+
+	if !matcher.regex.MatchString(question.Name) {
+		return false, fmt.Sprintf("name doesn't match regex [%v]", matcher.regex)
+	}
+
+	if matcher.qtypes != nil && !matcher.qtypes[question.Qtype] {
+		return false, fmt.Sprintf("qtype %v isn't one of the matched qtypes", dns.TypeToString[question.Qtype])
+	}
+
+	if matcher.suffixes != nil && !matchesNameOrParent(matcher.suffixes, question.Name) {
+		return false, "name isn't under any of the matched suffixes"
+	}
+
+	if len(matcher.clientNetworks) > 0 && !matcher.clientNetworks.contains(client.ip) {
+		return false, fmt.Sprintf("client [%v] isn't in any of the matched networks", client.ip)
+	}
+
+	if matcher.clientLabels != nil && !matcher.clientLabels.Contains(client.label) {
+		return false, fmt.Sprintf("client label [%v] isn't one of the matched labels", client.label)
+	}
+
+	return true, "all criteria met"
+}
+
+// upstreamRule routes the queries its matcher matches to its upstream.
+type upstreamRule struct {
+	matcher  *upstreamMatcher // nil for rules that aren't matched against
+	upstream *monitoredUpstream
+	post     *postProcessor // nil when there's no post-processing
+}
+
+func newUpstreamRule(config UpstreamConfig, name string, matcher *upstreamMatcher, cookies *cookieSecrets, stats *queryStats) (*upstreamRule, error) {
+	us, err := createUpstream(config, cookies)
+	if err != nil {
+		return nil, err
+	}
+
+	post, err := newPostProcessor(&config.PostProcessing)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upstreamRule{
+		matcher:  matcher,
+		upstream: monitorUpstream(us, name, stats),
+		post:     post,
+	}, nil
+}
+
+type ruleEvaluation struct {
+	Upstream string `json:"upstream"`
+	Matched  bool   `json:"matched"`
+	Reason   string `json:"reason"`
+}
+
+// routeExplanation describes how a query would be routed, without sending it
+// anywhere.
+type routeExplanation struct {
+	Question string           `json:"question"`
+	Rules    []ruleEvaluation `json:"rules"`
+	Result   string           `json:"result"`
+}
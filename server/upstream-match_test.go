@@ -0,0 +1,170 @@
+package dohboy
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamMatcher(t *testing.T) {
+	suffixFile := filepath.Join(t.TempDir(), "suffixes.txt")
+	if err := ioutil.WriteFile(suffixFile, []byte("# internal zones\nlab.example\n\nBuild.Example.\n"), 0600); err != nil {
+		t.Fatalf("Could not write suffixes: %v", err)
+	}
+
+	office := queryClient{ip: net.ParseIP("10.1.2.3"), label: "alice"}
+	outsider := queryClient{ip: net.ParseIP("203.0.113.9")}
+
+	tests := []struct {
+		name       string
+		regex      string
+		match      MatchConfig
+		qname      string
+		qtype      uint16
+		client     queryClient
+		want       bool
+		wantReason string
+	}{
+		{name: "regex only", regex: `corp\.example\.$`, qname: "www.corp.example.", want: true, wantReason: "all criteria met"},
+		{name: "regex mismatch", regex: `corp\.example\.$`, qname: "www.example.com.", wantReason: "doesn't match regex"},
+		{name: "qtype listed", match: MatchConfig{Qtypes: []string{"ptr", "SRV"}}, qname: "1.2.0.192.in-addr.arpa.", qtype: dns.TypePTR, want: true},
+		{name: "qtype not listed", match: MatchConfig{Qtypes: []string{"PTR", "SRV"}}, qname: "www.example.com.", qtype: dns.TypeA, wantReason: "qtype A isn't one"},
+		{name: "suffix itself", match: MatchConfig{Suffixes: []string{"corp.example"}}, qname: "corp.example.", want: true},
+		{name: "below a suffix", match: MatchConfig{Suffixes: []string{"corp.example"}}, qname: "WWW.Corp.Example.", want: true},
+		{name: "suffix is a label boundary", match: MatchConfig{Suffixes: []string{"corp.example"}}, qname: "notcorp.example.", wantReason: "isn't under any"},
+		{name: "suffix from a file", match: MatchConfig{SuffixFiles: []string{suffixFile}}, qname: "ci.build.example.", want: true},
+		{name: "comment in a file", match: MatchConfig{SuffixFiles: []string{suffixFile}}, qname: "internal.zones.", wantReason: "isn't under any"},
+		{name: "suffixes and files together", match: MatchConfig{Suffixes: []string{"corp.example"}, SuffixFiles: []string{suffixFile}}, qname: "x.lab.example.", want: true},
+		{name: "client in network", match: MatchConfig{ClientCIDRs: []string{"10.0.0.0/8"}}, qname: "www.example.com.", client: office, want: true},
+		{name: "client outside network", match: MatchConfig{ClientCIDRs: []string{"10.0.0.0/8"}}, qname: "www.example.com.", client: outsider, wantReason: "isn't in any of the matched networks"},
+		{name: "client without address", match: MatchConfig{ClientCIDRs: []string{"10.0.0.0/8"}}, qname: "www.example.com.", wantReason: "isn't in any of the matched networks"},
+		{name: "client label", match: MatchConfig{ClientLabels: []string{"alice", "bob"}}, qname: "www.example.com.", client: office, want: true},
+		{name: "anonymous client", match: MatchConfig{ClientLabels: []string{"alice"}}, qname: "www.example.com.", client: outsider, wantReason: "client label [] isn't one"},
+		{
+			name:   "every criterion met",
+			regex:  `^www\.`,
+			match:  MatchConfig{Qtypes: []string{"A"}, Suffixes: []string{"corp.example"}, ClientCIDRs: []string{"10.0.0.0/8"}, ClientLabels: []string{"alice"}},
+			qname:  "www.corp.example.",
+			client: office,
+			want:   true,
+		},
+		{
+			name:       "one criterion missed",
+			regex:      `^www\.`,
+			match:      MatchConfig{Qtypes: []string{"A"}, Suffixes: []string{"corp.example"}, ClientCIDRs: []string{"10.0.0.0/8"}, ClientLabels: []string{"bob"}},
+			qname:      "www.corp.example.",
+			client:     office,
+			wantReason: "client label [alice] isn't one",
+		},
+		{name: "negated match", match: MatchConfig{Suffixes: []string{"corp.example"}, Negate: true}, qname: "www.corp.example.", wantReason: "negated: all criteria met"},
+		{name: "negated mismatch", match: MatchConfig{Suffixes: []string{"corp.example"}, Negate: true}, qname: "www.example.com.", want: true, wantReason: "negated: name isn't under any"},
+		{name: "negated regex", regex: `corp\.example\.$`, match: MatchConfig{Negate: true}, qname: "www.example.com.", want: true, wantReason: "negated: name doesn't match regex"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matcher, err := newUpstreamMatcher(UpstreamConfig{NameRegex: test.regex, Match: test.match})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			qtype := test.qtype
+			if qtype == 0 {
+				qtype = dns.TypeA
+			}
+			matched, reason := matcher.match(newTestQuery(test.qname, qtype), test.client)
+			if matched != test.want {
+				t.Errorf("matched = %v (%v), want %v", matched, reason, test.want)
+			}
+			if !strings.Contains(reason, test.wantReason) {
+				t.Errorf("reason = %v, want one containing [%v]", reason, test.wantReason)
+			}
+		})
+	}
+}
+
+func TestNewUpstreamMatcherErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config UpstreamConfig
+	}{
+		{name: "bad regex", config: UpstreamConfig{NameRegex: "("}},
+		{name: "unknown qtype", config: UpstreamConfig{Match: MatchConfig{Qtypes: []string{"BOGUS"}}}},
+		{name: "missing suffix file", config: UpstreamConfig{Match: MatchConfig{SuffixFiles: []string{"/nonexistent/suffixes.txt"}}}},
+		{name: "bad client network", config: UpstreamConfig{Match: MatchConfig{ClientCIDRs: []string{"10.0.0.0/33"}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newUpstreamMatcher(test.config); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestRelayExplain(t *testing.T) {
+	fake := startAnsweringServer(t, "192.0.2.1")
+
+	ptrUpstream := dnsUpstreamConfig("", fake.address)
+	ptrUpstream.Match = MatchConfig{Qtypes: []string{"PTR"}, ClientLabels: []string{"alice"}}
+	corpUpstream := dnsUpstreamConfig(`corp\.example\.$`, fake.address)
+
+	settings := UpstreamSettings{
+		Custom:     []UpstreamConfig{ptrUpstream, corpUpstream},
+		Default:    DefaultUpstreamSettings{Enabled: true, Upstreams: []UpstreamConfig{dnsUpstreamConfig("", fake.address)}},
+		PrivatePTR: PrivatePTRConfig{Enabled: true},
+	}
+	relay := newTestRelay(settings)
+
+	t.Run("first matching rule", func(t *testing.T) {
+		got := relay.explain(newTestQuery("www.corp.example.", dns.TypeA), queryClient{label: "alice"})
+
+		if got.Question != "www.corp.example. A" {
+			t.Errorf("question = %v, want www.corp.example. A", got.Question)
+		}
+		if len(got.Rules) != 2 || got.Rules[0].Matched || !got.Rules[1].Matched {
+			t.Fatalf("rules = %+v, want the first one missed and the second one matched", got.Rules)
+		}
+		if !strings.Contains(got.Rules[0].Reason, "qtype A") {
+			t.Errorf("reason = %v, want the qtype named", got.Rules[0].Reason)
+		}
+		if got.Result != got.Rules[1].Upstream || !strings.Contains(got.Result, fake.address) {
+			t.Errorf("result = %v, want the second rule's upstream", got.Result)
+		}
+	})
+
+	t.Run("evaluation stops at the match", func(t *testing.T) {
+		got := relay.explain(newTestQuery("1.2.0.10.in-addr.arpa.", dns.TypePTR), queryClient{label: "alice"})
+		if len(got.Rules) != 1 || !got.Rules[0].Matched {
+			t.Errorf("rules = %+v, want only the first one, matched", got.Rules)
+		}
+	})
+
+	t.Run("private reverse lookup", func(t *testing.T) {
+		got := relay.explain(newTestQuery("1.2.0.10.in-addr.arpa.", dns.TypePTR), queryClient{})
+		if len(got.Rules) != 2 || got.Result != "NXDOMAIN (private reverse lookup)" {
+			t.Errorf("explanation = %+v, want NXDOMAIN after both rules missed", got)
+		}
+	})
+
+	t.Run("default upstreams", func(t *testing.T) {
+		got := relay.explain(newTestQuery("www.example.com.", dns.TypeA), queryClient{})
+		if !strings.HasPrefix(got.Result, "default upstreams, in order: [") {
+			t.Errorf("result = %v, want the default upstreams", got.Result)
+		}
+	})
+
+	t.Run("no default upstream", func(t *testing.T) {
+		settings := settings
+		settings.Default.Enabled = false
+		got := newTestRelay(settings).explain(newTestQuery("www.example.com.", dns.TypeA), queryClient{})
+		if got.Result != "REFUSED (no default upstream)" {
+			t.Errorf("result = %v, want REFUSED", got.Result)
+		}
+	})
+}
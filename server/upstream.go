@@ -5,63 +5,94 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
-	"regexp"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
 type upstream interface {
-	resolveIfMatched(dnsQuery *dns.Msg) (bool, *dns.Msg, error) // (was_matched, resp_msg_if_matched, err)
+	resolve(dnsQuery *dns.Msg) (*dns.Msg, error)
 }
 
-func createUpstream(config UpstreamConfig) (upstream, error) {
+// createUpstream creates an upstream from its config. Plain DNS upstreams use
+// cookies made with the given secrets, unless they're nil.
+func createUpstream(config UpstreamConfig, cookies *cookieSecrets) (upstream, error) {
 	timeout := time.Duration(config.TimeoutMillis) * time.Millisecond
 
-	regex, err := regexp.Compile(config.NameRegex)
+	kind, err := upstreamType(config)
 	if err != nil {
 		return nil, err
 	}
 
-	if config.UseDOH {
-		return createDnsOverHttpsUpstream(regex, config.Address, timeout, config.HttpTransportConfig)
-	} else {
-		return createTraditionalUpstream(regex, config.Address, timeout), nil
+	switch kind {
+	case "doh":
+		return createDnsOverHttpsUpstream(config.Address, timeout, config.HttpTransportConfig, config.Bootstrap)
+	case "dns":
+		return createTraditionalUpstream(config.Address, timeout, config.RandomizeCase, cookies), nil
+	case "recursive":
+		return createRecursiveUpstream(config.Recursive, timeout)
+	default:
+		return nil, fmt.Errorf("Unknown upstream type [%v].", kind)
 	}
 }
 
-func createDefaultTraditionalUpstream() upstream {
-	defaultUpstreamConfig := UpstreamConfig{
-		NameRegex:     ".*",
-		UseDOH:        false,
-		Address:       "8.8.8.8:53",
-		TimeoutMillis: 5000,
+// upstreamType works out an upstream's type: its type if given, then use_doh,
+// then whatever its address looks like. An address that could go either way is
+// an error rather than a guess.
+func upstreamType(config UpstreamConfig) (string, error) {
+	if config.Type != "" {
+		switch config.Type {
+		case "doh", "dns", "recursive":
+			return config.Type, nil
+		}
+		return "", fmt.Errorf("Unknown upstream type [%v]; must be one of [doh|dns|recursive].", config.Type)
 	}
-	defaultUpstream, _ := createUpstream(defaultUpstreamConfig)
-	return defaultUpstream
+
+	switch {
+	case config.UseDOH != nil && *config.UseDOH:
+		return "doh", nil
+	case config.UseDOH != nil:
+		return "dns", nil
+	case strings.HasPrefix(config.Address, "https://") || strings.HasPrefix(config.Address, "http://"):
+		return "doh", nil
+	}
+
+	if _, _, err := net.SplitHostPort(config.Address); err == nil {
+		return "dns", nil
+	}
+	return "", fmt.Errorf("Can't tell whether upstream [%v] is doh or dns; give it a type.", config.Address)
 }
 
-func createDefaultDnsOverHttpsUpstream() upstream {
-	defaultUpstreamConfig := UpstreamConfig{
-		NameRegex:     ".*",
-		UseDOH:        true,
-		Address:       "https://dns.google/dns-query",
-		TimeoutMillis: 5000,
+// upstreamTarget describes where an upstream sends its queries.
+func upstreamTarget(config UpstreamConfig) string {
+	if config.Type == "recursive" {
+		return "recursive"
 	}
-	defaultUpstream, _ := createUpstream(defaultUpstreamConfig)
-	return defaultUpstream
+	return config.Address
+}
+
+// The upstream used when no default upstreams are configured.
+var builtinDefaultUpstreamConfig = UpstreamConfig{
+	Type:          "doh",
+	Address:       "https://dns.google/dns-query",
+	TimeoutMillis: 5000,
 }
 
 type traditionalUpstream struct {
-	regex     *regexp.Regexp
 	address   string
 	tcpClient *dns.Client
 	udpClient *dns.Client
+	cookies   *upstreamCookies // nil when cookies are disabled
+	// Randomize the case of the question name (DNS 0x20), which a response
+	// has to echo exactly.
+	randomizeCase bool
 }
 
-func createTraditionalUpstream(regex *regexp.Regexp, address string, timeout time.Duration) upstream {
+func createTraditionalUpstream(address string, timeout time.Duration, randomizeCase bool, cookies *cookieSecrets) upstream {
 	tcpClient := &dns.Client{
 		Net:     "tcp",
 		Timeout: timeout,
@@ -72,39 +103,148 @@ func createTraditionalUpstream(regex *regexp.Regexp, address string, timeout tim
 		Timeout: timeout,
 	}
 
+	var upstreamCookies *upstreamCookies
+	if cookies != nil {
+		upstreamCookies = newUpstreamCookies(cookies, address)
+	}
+
 	return &traditionalUpstream{
-		regex:     regex,
-		address:   address,
-		tcpClient: tcpClient,
-		udpClient: udpClient,
+		address:       address,
+		tcpClient:     tcpClient,
+		udpClient:     udpClient,
+		cookies:       upstreamCookies,
+		randomizeCase: randomizeCase,
 	}
 }
 
-func (upstream *traditionalUpstream) resolveIfMatched(dnsQuery *dns.Msg) (bool, *dns.Msg, error) {
-	if !upstream.regex.MatchString(dnsQuery.Question[0].Name) {
-		return false, nil, nil
+// resolve exchanges a query over udp, falling back to tcp if the response is
+// truncated or looks spoofed. Every exchange dials a new socket, so each query
+// goes out from its own random source port.
+func (upstream *traditionalUpstream) resolve(dnsQuery *dns.Msg) (*dns.Msg, error) {
+	query := dnsQuery
+	if upstream.randomizeCase {
+		query = randomizeQuestionCase(dnsQuery)
 	}
 
-	udpResp, _, err := upstream.udpClient.Exchange(dnsQuery, upstream.address)
+	resp, err := upstream.exchangeUDP(query)
 	if err != nil {
-		return true, nil, err
+		return nil, err
+	}
+
+	if resp == nil || resp.Truncated {
+		if resp, err = upstream.exchangeTCP(query); err != nil {
+			return nil, err
+		}
+	}
+
+	// Hand back the question the way it was asked.
+	resp.Question = append([]dns.Question(nil), dnsQuery.Question...)
+	return resp, nil
+}
+
+// exchangeUDP returns a nil response, rather than an error, if the response
+// looks spoofed: if its question doesn't match the query's to the letter, or it
+// doesn't carry our cookie back when it should have.
+func (upstream *traditionalUpstream) exchangeUDP(query *dns.Msg) (*dns.Msg, error) {
+	if upstream.cookies == nil {
+		resp, _, err := upstream.udpClient.Exchange(query, upstream.address)
+		if err != nil || !questionMatches(query, resp, true) {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		resp, _, err := upstream.udpClient.Exchange(upstream.cookies.attach(query), upstream.address)
+		if err != nil {
+			return nil, err
+		}
+
+		if !questionMatches(query, resp, true) || !upstream.cookies.check(resp) {
+			return nil, nil
+		}
+
+		// RFC7873 5.3: a BADCOOKIE response carries a fresh server cookie, so
+		// the query is worth one more try.
+		if resp.Rcode != dns.RcodeBadCookie {
+			return upstream.detachCookie(query, resp), nil
+		}
+	}
+
+	return nil, nil
+}
+
+// exchangeTCP doesn't insist on the question's case being echoed, since some
+// servers don't, and a tcp response can't be spoofed off-path anyway.
+func (upstream *traditionalUpstream) exchangeTCP(query *dns.Msg) (*dns.Msg, error) {
+	outgoing := query
+	if upstream.cookies != nil {
+		outgoing = upstream.cookies.attach(query)
+	}
+
+	resp, _, err := upstream.tcpClient.Exchange(outgoing, upstream.address)
+	if err != nil {
+		return nil, err
 	}
 
-	if !udpResp.Truncated {
-		return true, udpResp, nil
+	if !questionMatches(query, resp, false) {
+		return nil, fmt.Errorf("Question in upstream response doesn't match the query [%v].", describeQuestion(query))
 	}
 
-	tcpResp, _, err := upstream.tcpClient.Exchange(dnsQuery, upstream.address)
-	return true, tcpResp, err
+	if upstream.cookies != nil {
+		upstream.cookies.check(resp)
+		resp = upstream.detachCookie(query, resp)
+	}
+	return resp, nil
+}
+
+func (upstream *traditionalUpstream) detachCookie(query *dns.Msg, resp *dns.Msg) *dns.Msg {
+	rfc7873_removeCookie(resp)
+	if query.IsEdns0() == nil {
+		// The OPT record was only added to carry the cookie.
+		extra := resp.Extra[:0]
+		for _, rr := range resp.Extra {
+			if _, isOpt := rr.(*dns.OPT); !isOpt {
+				extra = append(extra, rr)
+			}
+		}
+		resp.Extra = extra
+	}
+	return resp
+}
+
+// questionMatches checks that a response is for the question that was asked.
+// A FORMERR response may leave out the question.
+func questionMatches(query *dns.Msg, resp *dns.Msg, exactCase bool) bool {
+	if len(resp.Question) == 0 && resp.Rcode == dns.RcodeFormatError {
+		return true
+	}
+
+	if len(resp.Question) != len(query.Question) {
+		return false
+	}
+
+	for i, question := range query.Question {
+		answered := resp.Question[i]
+		if answered.Qtype != question.Qtype || answered.Qclass != question.Qclass {
+			return false
+		}
+		if exactCase && answered.Name != question.Name {
+			return false
+		}
+		if !exactCase && !strings.EqualFold(answered.Name, question.Name) {
+			return false
+		}
+	}
+	return true
 }
 
 type dnsOverHttpsUpstream struct {
-	regex      *regexp.Regexp
 	address    string
 	httpClient *http.Client
 }
 
-func createDnsOverHttpsUpstream(regex *regexp.Regexp, address string, timeout time.Duration, transportConfig HttpTransportConfig) (upstream, error) {
+func createDnsOverHttpsUpstream(address string, timeout time.Duration, transportConfig HttpTransportConfig, bootstrap BootstrapConfig) (upstream, error) {
 	validUrl, err := url.ParseRequestURI(address)
 	if err != nil {
 		return nil, err
@@ -119,26 +259,31 @@ func createDnsOverHttpsUpstream(regex *regexp.Regexp, address string, timeout ti
 		IdleConnTimeout: time.Duration(transportConfig.IdleConnTimeoutMillis) * time.Millisecond,
 	}
 
+	if len(bootstrap.Servers) > 0 || len(bootstrap.StaticIPs) > 0 {
+		dialer, err := newBootstrapDialer(validUrl.Hostname(), bootstrap, timeout)
+		if err != nil {
+			return nil, err
+		}
+		transport.DialContext = dialer.DialContext
+		// A custom dialer otherwise turns off http/2.
+		transport.ForceAttemptHTTP2 = true
+	}
+
 	httpClient := &http.Client{
 		Transport: transport,
 		Timeout:   timeout,
 	}
 
 	return &dnsOverHttpsUpstream{
-		regex:      regex,
 		address:    address,
 		httpClient: httpClient,
 	}, nil
 }
 
-func (upstream *dnsOverHttpsUpstream) resolveIfMatched(dnsQuery *dns.Msg) (bool, *dns.Msg, error) {
-	if !upstream.regex.MatchString(dnsQuery.Question[0].Name) {
-		return false, nil, nil
-	}
-
+func (upstream *dnsOverHttpsUpstream) resolve(dnsQuery *dns.Msg) (*dns.Msg, error) {
 	wireformat, err := dnsQuery.Pack()
 	if err != nil {
-		return true, nil, err
+		return nil, err
 	}
 
 	encodedQuery := base64.RawURLEncoding.EncodeToString(wireformat)
@@ -146,36 +291,41 @@ func (upstream *dnsOverHttpsUpstream) resolveIfMatched(dnsQuery *dns.Msg) (bool,
 
 	requestToUpstream, err := http.NewRequestWithContext(context.Background(), http.MethodGet, uri, nil)
 	if err != nil {
-		return true, nil, err
+		return nil, err
 	}
 	requestToUpstream.Header.Set("Accept", "application/dns-message")
 
 	responseFromUpstream, err := upstream.httpClient.Do(requestToUpstream)
 	if err != nil {
-		return true, nil, err
+		return nil, err
 	}
 	defer responseFromUpstream.Body.Close()
 
 	if responseFromUpstream.StatusCode != http.StatusOK {
 		err := fmt.Errorf("HTTP status code returned from upstream was [%v: %v]",
 			responseFromUpstream.StatusCode, http.StatusText(responseFromUpstream.StatusCode))
-		return true, nil, err
+		return nil, err
 	}
 
 	body, err := ioutil.ReadAll(responseFromUpstream.Body)
 	if err != nil {
-		return true, nil, err
+		return nil, err
 	}
 
 	dnsResultFromUpstream := new(dns.Msg)
 	if err := dnsResultFromUpstream.Unpack(body); err != nil {
-		return true, nil, err
+		return nil, err
 	}
 
 	if dnsQuery.Id != dnsResultFromUpstream.Id {
 		err := fmt.Errorf("DNS query ID mismatch: sent=%v received=%v", dnsQuery.Id, dnsResultFromUpstream.Id)
-		return true, nil, err
+		return nil, err
+	}
+
+	if !questionMatches(dnsQuery, dnsResultFromUpstream, false) {
+		err := fmt.Errorf("DNS question mismatch: sent=[%v] received=[%v]", describeQuestion(dnsQuery), describeQuestion(dnsResultFromUpstream))
+		return nil, err
 	}
 
-	return true, dnsResultFromUpstream, nil
+	return dnsResultFromUpstream, nil
 }
@@ -0,0 +1,238 @@
+package dohboy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTraditionalUpstreamFallsBackToTCP(t *testing.T) {
+	tests := []struct {
+		name        string
+		udpReply    func(query *dns.Msg) *dns.Msg
+		wantUDP     int
+		wantTCP     int
+		wantIP      string
+		withCookies bool
+	}{
+		{
+			name:     "answered over udp",
+			udpReply: func(query *dns.Msg) *dns.Msg { return replyA(query, "192.0.2.1", 300) },
+			wantUDP:  1,
+			wantTCP:  0,
+			wantIP:   "192.0.2.1",
+		},
+		{
+			name: "truncated over udp",
+			udpReply: func(query *dns.Msg) *dns.Msg {
+				resp := new(dns.Msg)
+				resp.SetReply(query)
+				resp.Truncated = true
+				return resp
+			},
+			wantUDP: 1,
+			wantTCP: 1,
+			wantIP:  "192.0.2.2",
+		},
+		{
+			name: "udp answer for another question",
+			udpReply: func(query *dns.Msg) *dns.Msg {
+				return replyA(newTestQuery("spoofed.example.", dns.TypeA), "203.0.113.66", 300)
+			},
+			wantUDP: 1,
+			wantTCP: 1,
+			wantIP:  "192.0.2.2",
+		},
+		{
+			name: "truncated over udp, with cookies",
+			udpReply: func(query *dns.Msg) *dns.Msg {
+				resp := new(dns.Msg)
+				resp.SetReply(query)
+				resp.Truncated = true
+				return resp
+			},
+			wantUDP:     1,
+			wantTCP:     1,
+			wantIP:      "192.0.2.2",
+			withCookies: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+				if network == "udp" {
+					resp := test.udpReply(query)
+					resp.Id = query.Id
+					return resp
+				}
+				return replyA(query, "192.0.2.2", 300)
+			})
+
+			var cookies *cookieSecrets
+			if test.withCookies {
+				var err error
+				if cookies, err = newCookieSecrets(&CookieConfig{Enabled: true, RotationSeconds: 86400}); err != nil {
+					t.Fatalf("Could not create cookie secrets: %v", err)
+				}
+			}
+
+			us := createTraditionalUpstream(fake.address, time.Second, false, cookies)
+			query := newTestQuery("www.example.com.", dns.TypeA)
+			resp, err := us.resolve(query)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if got := answeredIP(resp); got != test.wantIP {
+				t.Errorf("answered %v, want %v", got, test.wantIP)
+			}
+			if got := fake.queryCount("udp"); got != test.wantUDP {
+				t.Errorf("udp queries = %v, want %v", got, test.wantUDP)
+			}
+			if got := fake.queryCount("tcp"); got != test.wantTCP {
+				t.Errorf("tcp queries = %v, want %v", got, test.wantTCP)
+			}
+			if resp.Question[0].Name != "www.example.com." {
+				t.Errorf("question = %v, want the one asked", resp.Question[0].Name)
+			}
+			if test.withCookies && rfc7873_getCookie(resp) != nil {
+				t.Errorf("cookie wasn't taken off the response")
+			}
+		})
+	}
+}
+
+func TestTraditionalUpstreamRandomizedCase(t *testing.T) {
+	fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		if network == "udp" {
+			// Echo the question lower-cased, the way a server ignoring 0x20
+			// (or a spoofer guessing) would.
+			resp := replyA(query, "203.0.113.66", 300)
+			resp.Question[0].Name = strings.ToLower(resp.Question[0].Name)
+			return resp
+		}
+		return replyA(query, "192.0.2.2", 300)
+	})
+
+	us := createTraditionalUpstream(fake.address, time.Second, true, nil)
+	// Long enough that randomizing it leaves it lower-case only once in a
+	// blue moon.
+	resp, err := us.resolve(newTestQuery("a-rather-long-name-to-randomize.example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := answeredIP(resp); got != "192.0.2.2" {
+		t.Errorf("answered %v, want the tcp answer", got)
+	}
+	if resp.Question[0].Name != "a-rather-long-name-to-randomize.example.com." {
+		t.Errorf("question = %v, want the one asked", resp.Question[0].Name)
+	}
+}
+
+func TestTraditionalUpstreamTimeout(t *testing.T) {
+	fake := startFakeDNSServer(t, func(network string, query *dns.Msg) *dns.Msg {
+		return nil
+	})
+
+	us := createTraditionalUpstream(fake.address, 100*time.Millisecond, false, nil)
+	if _, err := us.resolve(newTestQuery("www.example.com.", dns.TypeA)); err == nil {
+		t.Errorf("expected an error from an upstream that doesn't answer")
+	}
+}
+
+func TestDnsOverHttpsUpstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   func(query *dns.Msg) *dns.Msg
+		wantIP  string
+		wantErr string
+	}{
+		{
+			name:   "answered",
+			reply:  func(query *dns.Msg) *dns.Msg { return replyA(query, "192.0.2.1", 300) },
+			wantIP: "192.0.2.1",
+		},
+		{
+			name:    "http error",
+			reply:   func(query *dns.Msg) *dns.Msg { return nil },
+			wantErr: "502",
+		},
+		{
+			name: "id mismatch",
+			reply: func(query *dns.Msg) *dns.Msg {
+				resp := replyA(query, "192.0.2.1", 300)
+				resp.Id = query.Id + 1
+				return resp
+			},
+			wantErr: "ID mismatch",
+		},
+		{
+			name: "question mismatch",
+			reply: func(query *dns.Msg) *dns.Msg {
+				resp := replyA(query, "192.0.2.1", 300)
+				resp.Question[0].Qtype = dns.TypeAAAA
+				return resp
+			},
+			wantErr: "question mismatch",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := startFakeDoHServer(t, test.reply)
+			resp, err := fake.upstream(t).resolve(newTestQuery("www.example.com.", dns.TypeA))
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("err = %v, want one containing [%v]", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := answeredIP(resp); got != test.wantIP {
+				t.Errorf("answered %v, want %v", got, test.wantIP)
+			}
+		})
+	}
+}
+
+func TestCreateUpstream(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name     string
+		config   UpstreamConfig
+		wantType string
+		wantErr  bool
+	}{
+		{name: "use_doh", config: UpstreamConfig{UseDOH: &yes, Address: "https://dns.example/dns-query"}, wantType: "*dohboy.dnsOverHttpsUpstream"},
+		{name: "use_doh off", config: UpstreamConfig{UseDOH: &no, Address: "192.0.2.53:53"}, wantType: "*dohboy.traditionalUpstream"},
+		{name: "type wins over use_doh", config: UpstreamConfig{Type: "dns", UseDOH: &yes, Address: "192.0.2.53:53"}, wantType: "*dohboy.traditionalUpstream"},
+		{name: "doh going by the address", config: UpstreamConfig{Address: "https://dns.example/dns-query"}, wantType: "*dohboy.dnsOverHttpsUpstream"},
+		{name: "dns going by the address", config: UpstreamConfig{Address: "[2001:db8::53]:53"}, wantType: "*dohboy.traditionalUpstream"},
+		{name: "address could be either", config: UpstreamConfig{Address: "dns.example"}, wantErr: true},
+		{name: "no address", config: UpstreamConfig{}, wantErr: true},
+		{name: "recursive", config: UpstreamConfig{Type: "recursive"}, wantType: "*dohboy.recursiveUpstream"},
+		{name: "doh over http", config: UpstreamConfig{Type: "doh", Address: "http://dns.example/dns-query"}, wantErr: true},
+		{name: "unknown type", config: UpstreamConfig{Type: "dot", Address: "192.0.2.53:853"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			us, err := createUpstream(test.config, nil)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, test.wantErr)
+			}
+			if err == nil {
+				if got := fmt.Sprintf("%T", us); got != test.wantType {
+					t.Errorf("type = %v, want %v", got, test.wantType)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,521 @@
+package test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// benchOptions is what a bench command line asks for:
+//
+//	@server queryfile [+option...]
+type benchOptions struct {
+	server      string
+	queryFile   string // "-" for stdin
+	qps         int    // 0 for as fast as the connections go
+	connections int
+	duration    time.Duration // 0 for no limit, as long as count is set
+	count       int           // 0 for no limit, as long as duration is set
+	post        bool
+	insecure    bool
+	json        bool
+	// Responses faster than this are counted as cache hits. 0 to infer it
+	// from the latencies.
+	hitThreshold time.Duration
+	timeout      time.Duration
+}
+
+func parseBenchArgs(args []string) (*benchOptions, error) {
+	opts := &benchOptions{
+		server:      defaultQueryServer,
+		connections: 8,
+		timeout:     5 * time.Second,
+	}
+	durationGiven := false
+
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			opts.server = strings.TrimPrefix(arg, "@")
+
+		case strings.HasPrefix(arg, "+"):
+			option := strings.TrimPrefix(arg, "+")
+			name, value := option, ""
+			if i := strings.Index(option, "="); i >= 0 {
+				name, value = option[:i], option[i+1:]
+			}
+
+			var err error
+			switch name {
+			case "qps":
+				opts.qps, err = parseCount(name, value, true)
+			case "connections":
+				opts.connections, err = parseCount(name, value, false)
+			case "count":
+				opts.count, err = parseCount(name, value, false)
+			case "duration":
+				opts.duration, err = parseDuration(name, value)
+				durationGiven = true
+			case "hit-threshold":
+				opts.hitThreshold, err = parseDuration(name, value)
+			case "timeout":
+				opts.timeout, err = parseDuration(name, value)
+			case "post":
+				opts.post = true
+			case "get":
+				opts.post = false
+			case "insecure":
+				opts.insecure = true
+			case "json":
+				opts.json = true
+			default:
+				err = fmt.Errorf("Unknown option [+%v].", option)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+		case opts.queryFile == "":
+			opts.queryFile = arg
+
+		default:
+			return nil, fmt.Errorf("Unexpected argument [%v].", arg)
+		}
+	}
+
+	if opts.queryFile == "" {
+		return nil, fmt.Errorf("No query file given.")
+	}
+	if !strings.HasPrefix(opts.server, "https://") && !strings.HasPrefix(opts.server, "http://") {
+		return nil, fmt.Errorf("Bench server must be a DoH URL. Provided: [%v].", opts.server)
+	}
+	if !durationGiven && opts.count == 0 {
+		opts.duration = 10 * time.Second
+	}
+	if opts.duration == 0 && opts.count == 0 {
+		// Every sample is kept for the report, so an endless run would only
+		// end when it ran out of memory.
+		return nil, fmt.Errorf("A bench run needs a limit: give +duration above 0 or +count.")
+	}
+
+	return opts, nil
+}
+
+func parseCount(name string, value string, zeroAllowed bool) (int, error) {
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 || (count == 0 && !zeroAllowed) {
+		return 0, fmt.Errorf("+%v must be a positive number. Provided: [%v].", name, value)
+	}
+	return count, nil
+}
+
+func parseDuration(name string, value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("+%v must be a duration such as 10s or 5ms. Provided: [%v].", name, value)
+	}
+	return duration, nil
+}
+
+type benchQuery struct {
+	name  string
+	qtype uint16
+}
+
+// readQueryList reads queries in dnsperf's format, a name and a type per line,
+// or as a plain list of names, which are queried for A records. Empty lines
+// and lines starting with '#' are skipped.
+func readQueryList(reader io.Reader) ([]benchQuery, error) {
+	retval := []benchQuery{}
+
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		query := benchQuery{name: dns.Fqdn(fields[0]), qtype: dns.TypeA}
+		if _, ok := dns.IsDomainName(query.name); !ok {
+			return nil, fmt.Errorf("Bad domain name [%v] on line %v.", fields[0], line)
+		}
+		if len(fields) > 1 {
+			qtype, exists := dns.StringToType[strings.ToUpper(fields[1])]
+			if !exists {
+				return nil, fmt.Errorf("Unknown type [%v] on line %v.", fields[1], line)
+			}
+			query.qtype = qtype
+		}
+		retval = append(retval, query)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(retval) == 0 {
+		return nil, fmt.Errorf("The query list is empty.")
+	}
+	return retval, nil
+}
+
+// benchSample is the outcome of a single query.
+type benchSample struct {
+	latency    time.Duration
+	httpStatus int // 0 if the request didn't get a response
+	rcode      string
+}
+
+// benchJob is a query to send, along with when it was due to go out under
+// +qps; zero when it goes out as soon as a connection is free.
+type benchJob struct {
+	query     benchQuery
+	scheduled time.Time
+}
+
+func runBench(opts *benchOptions, queries []benchQuery) ([]benchSample, time.Duration) {
+	jobs := make(chan benchJob, opts.connections)
+	results := make(chan benchSample, opts.connections)
+
+	var workers sync.WaitGroup
+	for i := 0; i < opts.connections; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			// Every worker keeps to its own connection, with a single query
+			// in flight.
+			httpClient := &http.Client{
+				Timeout: opts.timeout,
+				Transport: &http.Transport{
+					TLSClientConfig:     &tls.Config{InsecureSkipVerify: opts.insecure},
+					MaxConnsPerHost:     1,
+					MaxIdleConnsPerHost: 1,
+					ForceAttemptHTTP2:   true,
+				},
+			}
+			for job := range jobs {
+				results <- benchExchange(httpClient, opts, job)
+			}
+		}()
+	}
+
+	start := time.Now()
+	go func() {
+		defer close(jobs)
+		for i := 0; opts.count == 0 || i < opts.count; i++ {
+			job := benchJob{query: queries[i%len(queries)]}
+			if opts.qps > 0 {
+				job.scheduled = start.Add(time.Duration(i) * time.Second / time.Duration(opts.qps))
+				time.Sleep(time.Until(job.scheduled))
+			}
+			if opts.duration > 0 && time.Since(start) >= opts.duration {
+				return
+			}
+			jobs <- job
+		}
+	}()
+
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	samples := []benchSample{}
+	for sample := range results {
+		samples = append(samples, sample)
+	}
+	return samples, time.Since(start)
+}
+
+// benchExchange sends a query and times the answer. Under +qps, the time is
+// taken from when the query was due to go out rather than from when a
+// connection was free to send it: a server falling behind the schedule would
+// otherwise hold back the very queries that would show it (coordinated
+// omission).
+func benchExchange(httpClient *http.Client, opts *benchOptions, job benchJob) benchSample {
+	msg := createQueryMsg(job.query.name, job.query.qtype, dns.ClassINET)
+	msg.Id = 0
+	wireFormat, err := msg.Pack()
+	if err != nil {
+		return benchSample{}
+	}
+
+	method := http.MethodGet
+	if opts.post {
+		method = http.MethodPost
+	}
+	request, err := newDOHRequest(method, opts.server, wireFormat)
+	if err != nil {
+		return benchSample{}
+	}
+
+	start := time.Now()
+	if !job.scheduled.IsZero() && job.scheduled.Before(start) {
+		start = job.scheduled
+	}
+	resp, err := httpClient.Do(request)
+	if err != nil {
+		return benchSample{latency: time.Since(start)}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	sample := benchSample{latency: time.Since(start), httpStatus: resp.StatusCode}
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return sample
+	}
+
+	dnsResp := new(dns.Msg)
+	if err := dnsResp.Unpack(body); err != nil {
+		sample.rcode = "unparsable"
+		return sample
+	}
+	sample.rcode = dns.RcodeToString[dnsResp.Rcode]
+	return sample
+}
+
+// benchReport sums up a bench run.
+type benchReport struct {
+	Server          string             `json:"server"`
+	Connections     int                `json:"connections"`
+	TargetQPS       int                `json:"target_qps"`
+	Queries         int                `json:"queries"`
+	ElapsedSeconds  float64            `json:"elapsed_seconds"`
+	AchievedQPS     float64            `json:"achieved_qps"`
+	LatencyMs       map[string]float64 `json:"latency_ms"`
+	HTTPStatuses    map[string]int     `json:"http_statuses"`
+	Rcodes          map[string]int     `json:"rcodes"`
+	TransportErrors int                `json:"transport_errors"`
+	// Inferred from response times, over the queries answered with a 200.
+	CacheHitThresholdMs float64 `json:"cache_hit_threshold_ms,omitempty"`
+	CacheHitRatio       float64 `json:"cache_hit_ratio"`
+	CacheHitsInferred   bool    `json:"cache_hits_inferred"`
+}
+
+func newBenchReport(opts *benchOptions, samples []benchSample, elapsed time.Duration) *benchReport {
+	report := &benchReport{
+		Server:         opts.server,
+		Connections:    opts.connections,
+		TargetQPS:      opts.qps,
+		Queries:        len(samples),
+		ElapsedSeconds: elapsed.Seconds(),
+		LatencyMs:      map[string]float64{},
+		HTTPStatuses:   map[string]int{},
+		Rcodes:         map[string]int{},
+	}
+	if elapsed > 0 {
+		report.AchievedQPS = float64(len(samples)) / elapsed.Seconds()
+	}
+
+	all := []time.Duration{}
+	answered := []time.Duration{}
+	for _, sample := range samples {
+		if sample.httpStatus == 0 {
+			report.TransportErrors++
+			continue
+		}
+		all = append(all, sample.latency)
+		report.HTTPStatuses[strconv.Itoa(sample.httpStatus)]++
+		if sample.rcode != "" {
+			report.Rcodes[sample.rcode]++
+		}
+		if sample.httpStatus == http.StatusOK {
+			answered = append(answered, sample.latency)
+		}
+	}
+
+	sortDurations(all)
+	if len(all) > 0 {
+		report.LatencyMs["min"] = milliseconds(all[0])
+		report.LatencyMs["max"] = milliseconds(all[len(all)-1])
+		var sum time.Duration
+		for _, latency := range all {
+			sum += latency
+		}
+		report.LatencyMs["mean"] = milliseconds(sum / time.Duration(len(all)))
+		for _, p := range []float64{50, 90, 95, 99, 99.9} {
+			report.LatencyMs["p"+strconv.FormatFloat(p, 'f', -1, 64)] = milliseconds(percentile(all, p))
+		}
+	}
+
+	threshold, ok := opts.hitThreshold, opts.hitThreshold > 0
+	if !ok {
+		threshold, ok = inferHitThreshold(answered)
+	}
+	if ok && len(answered) > 0 {
+		hits := 0
+		for _, latency := range answered {
+			if latency < threshold {
+				hits++
+			}
+		}
+		report.CacheHitsInferred = true
+		report.CacheHitThresholdMs = milliseconds(threshold)
+		report.CacheHitRatio = float64(hits) / float64(len(answered))
+	}
+
+	return report
+}
+
+func sortDurations(durations []time.Duration) {
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+}
+
+// percentile picks the nearest-rank percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
+
+// inferHitThreshold splits response times into fast ones, taken to be cache
+// hits, and slow ones, taken to have gone upstream. It clusters the log of the
+// latencies around two centers and puts the threshold halfway between them.
+// If the centers are less than 3x apart, hits and misses can't be told apart.
+func inferHitThreshold(latencies []time.Duration) (time.Duration, bool) {
+	if len(latencies) < 2 {
+		return 0, false
+	}
+
+	logs := make([]float64, 0, len(latencies))
+	for _, latency := range latencies {
+		logs = append(logs, math.Log(math.Max(float64(latency), 1)))
+	}
+	sort.Float64s(logs)
+
+	fast, slow := logs[0], logs[len(logs)-1]
+	for iteration := 0; iteration < 100; iteration++ {
+		boundary := (fast + slow) / 2
+		var fastSum, slowSum float64
+		var fastCount, slowCount int
+		for _, value := range logs {
+			if value < boundary {
+				fastSum, fastCount = fastSum+value, fastCount+1
+			} else {
+				slowSum, slowCount = slowSum+value, slowCount+1
+			}
+		}
+		if fastCount == 0 || slowCount == 0 {
+			return 0, false
+		}
+
+		newFast, newSlow := fastSum/float64(fastCount), slowSum/float64(slowCount)
+		if newFast == fast && newSlow == slow {
+			break
+		}
+		fast, slow = newFast, newSlow
+	}
+
+	if slow-fast < math.Log(3) {
+		return 0, false
+	}
+	return time.Duration(math.Exp((fast + slow) / 2)), true
+}
+
+func formatBenchReport(report *benchReport) string {
+	var builder strings.Builder
+
+	target := "unthrottled"
+	if report.TargetQPS > 0 {
+		target = fmt.Sprintf("target %v qps", report.TargetQPS)
+	}
+	fmt.Fprintf(&builder, "Server:            %v (%v connections)\n", report.Server, report.Connections)
+	fmt.Fprintf(&builder, "Queries:           %v in %.1fs, %.1f qps (%v)\n", report.Queries, report.ElapsedSeconds, report.AchievedQPS, target)
+
+	if len(report.LatencyMs) > 0 {
+		stats := []string{}
+		for _, stat := range []string{"min", "mean", "p50", "p90", "p95", "p99", "p99.9", "max"} {
+			stats = append(stats, fmt.Sprintf("%v %.2f", stat, report.LatencyMs[stat]))
+		}
+		fmt.Fprintf(&builder, "Latency (ms):      %v\n", strings.Join(stats, "  "))
+	}
+
+	fmt.Fprintf(&builder, "HTTP statuses:     %v\n", formatCounts(report.HTTPStatuses))
+	fmt.Fprintf(&builder, "Rcodes:            %v\n", formatCounts(report.Rcodes))
+	fmt.Fprintf(&builder, "Transport errors:  %v\n", report.TransportErrors)
+
+	if report.CacheHitsInferred {
+		fmt.Fprintf(&builder, "Cache hits:        %.1f%% (inferred; answered in under %.2f ms)\n", 100*report.CacheHitRatio, report.CacheHitThresholdMs)
+	} else {
+		builder.WriteString("Cache hits:        unknown (response times don't split into hits and misses)\n")
+	}
+	return builder.String()
+}
+
+func formatCounts(counts map[string]int) string {
+	if len(counts) == 0 {
+		return "-"
+	}
+
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%v: %v", key, counts[key]))
+	}
+	return strings.Join(parts, "  ")
+}
+
+// Bench replays a query list against a DoH endpoint and reports on how it
+// held up.
+func Bench(args []string) error {
+	opts, err := parseBenchArgs(args)
+	if err != nil {
+		return err
+	}
+
+	reader := io.Reader(os.Stdin)
+	if opts.queryFile != "-" {
+		file, err := os.Open(opts.queryFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	queries, err := readQueryList(reader)
+	if err != nil {
+		return err
+	}
+
+	samples, elapsed := runBench(opts, queries)
+	report := newBenchReport(opts, samples, elapsed)
+
+	if opts.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	fmt.Print(formatBenchReport(report))
+	return nil
+}
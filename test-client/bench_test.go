@@ -0,0 +1,303 @@
+package test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseBenchArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    benchOptions
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			args: []string{"queries.txt"},
+			want: benchOptions{server: defaultQueryServer, queryFile: "queries.txt", connections: 8, duration: 10 * time.Second, timeout: 5 * time.Second},
+		},
+		{
+			name: "count without a duration runs until done",
+			args: []string{"@https://dns.example/dns-query", "-", "+count=1000", "+qps=500", "+connections=2", "+post", "+json", "+insecure"},
+			want: benchOptions{server: "https://dns.example/dns-query", queryFile: "-", count: 1000, qps: 500, connections: 2, post: true, json: true, insecure: true, timeout: 5 * time.Second},
+		},
+		{
+			name: "durations",
+			args: []string{"queries.txt", "+duration=1m", "+hit-threshold=2ms", "+timeout=1s"},
+			want: benchOptions{server: defaultQueryServer, queryFile: "queries.txt", connections: 8, duration: time.Minute, hitThreshold: 2 * time.Millisecond, timeout: time.Second},
+		},
+		{name: "no query file", args: []string{"+qps=10"}, wantErr: true},
+		{name: "not a DoH server", args: []string{"@tls://1.1.1.1", "queries.txt"}, wantErr: true},
+		{name: "no connections", args: []string{"queries.txt", "+connections=0"}, wantErr: true},
+		{name: "bad qps", args: []string{"queries.txt", "+qps=lots"}, wantErr: true},
+		{
+			name: "count with no duration limit",
+			args: []string{"queries.txt", "+duration=0", "+count=5"},
+			want: benchOptions{server: defaultQueryServer, queryFile: "queries.txt", connections: 8, count: 5, timeout: 5 * time.Second},
+		},
+		{name: "no limit at all", args: []string{"queries.txt", "+duration=0"}, wantErr: true},
+		{name: "bad duration", args: []string{"queries.txt", "+duration=10"}, wantErr: true},
+		{name: "unknown option", args: []string{"queries.txt", "+bogus"}, wantErr: true},
+		{name: "too many arguments", args: []string{"queries.txt", "more.txt"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := parseBenchArgs(test.args)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, test.wantErr)
+			}
+			if err == nil && *opts != test.want {
+				t.Errorf("options = %+v, want %+v", *opts, test.want)
+			}
+		})
+	}
+}
+
+func TestReadQueryList(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []benchQuery
+		wantErr bool
+	}{
+		{
+			name:  "dnsperf format",
+			input: "www.example.com A\nexample.com mx\n\n# comment\nexample.org. AAAA\n",
+			want:  []benchQuery{{"www.example.com.", dns.TypeA}, {"example.com.", dns.TypeMX}, {"example.org.", dns.TypeAAAA}},
+		},
+		{
+			name:  "plain names",
+			input: "www.example.com\nexample.org\n",
+			want:  []benchQuery{{"www.example.com.", dns.TypeA}, {"example.org.", dns.TypeA}},
+		},
+		{name: "unknown type", input: "example.com BOGUS\n", wantErr: true},
+		{name: "empty", input: "# nothing here\n", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readQueryList(strings.NewReader(test.input))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, test.wantErr)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("queries = %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("query %v = %v, want %v", i, got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{}
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+
+	for p, want := range map[float64]time.Duration{0: time.Millisecond, 50: 50 * time.Millisecond, 99: 99 * time.Millisecond, 99.9: 100 * time.Millisecond, 100: 100 * time.Millisecond} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("p%v = %v, want %v", p, got, want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("p50 of nothing = %v, want 0", got)
+	}
+}
+
+func TestInferHitThreshold(t *testing.T) {
+	repeat := func(latency time.Duration, n int) []time.Duration {
+		retval := []time.Duration{}
+		for i := 0; i < n; i++ {
+			retval = append(retval, latency+time.Duration(i)*time.Microsecond)
+		}
+		return retval
+	}
+
+	t.Run("hits and misses", func(t *testing.T) {
+		latencies := append(repeat(300*time.Microsecond, 90), repeat(25*time.Millisecond, 10)...)
+		threshold, ok := inferHitThreshold(latencies)
+		if !ok || threshold <= 400*time.Microsecond || threshold >= 25*time.Millisecond {
+			t.Errorf("threshold = %v %v, want one between the hits and the misses", threshold, ok)
+		}
+	})
+
+	t.Run("all alike", func(t *testing.T) {
+		if threshold, ok := inferHitThreshold(repeat(time.Millisecond, 100)); ok {
+			t.Errorf("threshold = %v, want none", threshold)
+		}
+	})
+
+	t.Run("too few", func(t *testing.T) {
+		if threshold, ok := inferHitThreshold(repeat(time.Millisecond, 1)); ok {
+			t.Errorf("threshold = %v, want none", threshold)
+		}
+	})
+}
+
+// startCachingDOHServer starts a DoH server that is slow to answer a name the
+// first time it's asked, like a relay going upstream on a cache miss. Names
+// starting with "refuse" get a 503.
+func startCachingDOHServer(t *testing.T, missLatency time.Duration) *httptest.Server {
+	t.Helper()
+	var lock sync.Mutex
+	seen := map[string]bool{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		wireFormat, _ := base64.RawURLEncoding.DecodeString(request.URL.Query().Get("dns"))
+		query := new(dns.Msg)
+		if err := query.Unpack(wireFormat); err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := query.Question[0].Name
+		if strings.HasPrefix(name, "refuse") {
+			http.Error(response, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		lock.Lock()
+		cached := seen[name]
+		seen[name] = true
+		lock.Unlock()
+		if !cached {
+			time.Sleep(missLatency)
+		}
+
+		resp := answerTestQuery(query)
+		if strings.HasPrefix(name, "nx") {
+			resp.Rcode = dns.RcodeNameError
+			resp.Answer = nil
+		}
+		packed, _ := resp.Pack()
+		response.Header().Set("Content-Type", "application/dns-message")
+		response.Write(packed)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRunBench(t *testing.T) {
+	server := startCachingDOHServer(t, 50*time.Millisecond)
+	queries := []benchQuery{
+		{"a.example.com.", dns.TypeA},
+		{"b.example.com.", dns.TypeA},
+		{"nx.example.com.", dns.TypeA},
+		{"refuse.example.com.", dns.TypeA},
+	}
+
+	opts, err := parseBenchArgs([]string{"@" + server.URL + "/dns-query", "queries.txt", "+count=200", "+connections=4"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	samples, elapsed := runBench(opts, queries)
+	report := newBenchReport(opts, samples, elapsed)
+
+	if report.Queries != 200 || report.TransportErrors != 0 {
+		t.Fatalf("report = %+v, want 200 queries without transport errors", report)
+	}
+	if report.HTTPStatuses["200"] != 150 || report.HTTPStatuses["503"] != 50 {
+		t.Errorf("HTTP statuses = %v", report.HTTPStatuses)
+	}
+	if report.Rcodes["NOERROR"] != 100 || report.Rcodes["NXDOMAIN"] != 50 {
+		t.Errorf("rcodes = %v", report.Rcodes)
+	}
+	if report.LatencyMs["max"] < 50 || report.LatencyMs["p50"] >= 50 {
+		t.Errorf("latencies = %v, want the misses to stand out", report.LatencyMs)
+	}
+
+	// Three names to miss on, each of them possibly missed by every
+	// connection at once before the first answer comes back.
+	if !report.CacheHitsInferred || report.CacheHitRatio < float64(150-3*4)/150 || report.CacheHitRatio > float64(150-3)/150 {
+		t.Errorf("cache hit ratio = %v (inferred: %v)", report.CacheHitRatio, report.CacheHitsInferred)
+	}
+
+	output := formatBenchReport(report)
+	for _, want := range []string{"200: 150  503: 50", "NOERROR: 100  NXDOMAIN: 50", "Cache hits:"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output = %v, want it to contain [%v]", output, want)
+		}
+	}
+}
+
+func TestRunBenchCoordinatedOmission(t *testing.T) {
+	server := startCachingDOHServer(t, 50*time.Millisecond)
+	queries := []benchQuery{}
+	for i := 0; i < 10; i++ {
+		queries = append(queries, benchQuery{fmt.Sprintf("%v.example.com.", i), dns.TypeA})
+	}
+
+	// A single connection can do about 20 qps against 50ms responses, so
+	// the schedule of 100 qps falls further and further behind.
+	opts, err := parseBenchArgs([]string{"@" + server.URL + "/dns-query", "queries.txt", "+count=10", "+qps=100", "+connections=1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	samples, elapsed := runBench(opts, queries)
+	report := newBenchReport(opts, samples, elapsed)
+
+	if report.Queries != 10 {
+		t.Fatalf("report = %+v, want 10 queries", report)
+	}
+	if report.LatencyMs["min"] < 50 || report.LatencyMs["max"] < 300 {
+		t.Errorf("latencies = %v, want the time spent waiting on the schedule counted", report.LatencyMs)
+	}
+}
+
+func TestFakeUpstreamAnswers(t *testing.T) {
+	fake, err := parseFakeUpstreamArgs([]string{"127.0.0.1:0", "+ttl=60", "+latency=0s"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		qname      string
+		qtype      uint16
+		wantRcode  int
+		wantAnswer bool
+	}{
+		{qname: "www.example.com.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantAnswer: true},
+		{qname: "www.example.com.", qtype: dns.TypeAAAA, wantRcode: dns.RcodeSuccess, wantAnswer: true},
+		{qname: "www.example.com.", qtype: dns.TypeMX, wantRcode: dns.RcodeSuccess},
+		{qname: "nx1.example.com.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+	}
+
+	for _, test := range tests {
+		resp := fake.answer(createQueryMsg(test.qname, test.qtype, dns.ClassINET))
+		if resp.Rcode != test.wantRcode || (len(resp.Answer) == 1) != test.wantAnswer {
+			t.Errorf("%v %v: answered %v", test.qname, dns.TypeToString[test.qtype], resp)
+			continue
+		}
+		if test.wantAnswer && resp.Answer[0].Header().Ttl != 60 {
+			t.Errorf("%v %v: TTL = %v, want 60", test.qname, dns.TypeToString[test.qtype], resp.Answer[0].Header().Ttl)
+		}
+		if !test.wantAnswer && (len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA) {
+			t.Errorf("%v %v: authority = %v, want an SOA", test.qname, dns.TypeToString[test.qtype], resp.Ns)
+		}
+	}
+
+	first := fake.answer(createQueryMsg("www.example.com.", dns.TypeA, dns.ClassINET))
+	again := fake.answer(createQueryMsg("WWW.example.com.", dns.TypeA, dns.ClassINET))
+	if first.Answer[0].String() != strings.Replace(again.Answer[0].String(), "WWW", "www", 1) {
+		t.Errorf("answers differ: %v, %v", first.Answer[0], again.Answer[0])
+	}
+
+	for _, args := range [][]string{{"+ttl=forever"}, {"+latency=5"}, {"nowhere"}, {"+bogus"}} {
+		if _, err := parseFakeUpstreamArgs(args); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package test
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultFakeUpstreamAddress = "127.0.0.1:5353"
+
+// fakeUpstream is a plain DNS server that makes up its answers, so that dohboy
+// can be benched without going out to the internet. Every query is answered
+// after a fixed delay, standing in for a real upstream's round trip:
+//   - names whose first label starts with "nx" get NXDOMAIN
+//   - A and AAAA queries get an address picked from the name's hash
+//   - anything else gets NODATA
+type fakeUpstream struct {
+	address string
+	latency time.Duration
+	ttl     uint32
+}
+
+func parseFakeUpstreamArgs(args []string) (*fakeUpstream, error) {
+	fake := &fakeUpstream{
+		address: defaultFakeUpstreamAddress,
+		latency: 20 * time.Millisecond,
+		ttl:     300,
+	}
+	addressGiven := false
+
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "+latency="):
+			latency, err := parseDuration("latency", strings.TrimPrefix(arg, "+latency="))
+			if err != nil {
+				return nil, err
+			}
+			fake.latency = latency
+
+		case strings.HasPrefix(arg, "+ttl="):
+			ttl, err := strconv.ParseUint(strings.TrimPrefix(arg, "+ttl="), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("+ttl must be a number of seconds. Provided: [%v].", arg)
+			}
+			fake.ttl = uint32(ttl)
+
+		case strings.HasPrefix(arg, "+"):
+			return nil, fmt.Errorf("Unknown option [%v].", arg)
+
+		case !addressGiven:
+			if _, _, err := net.SplitHostPort(arg); err != nil {
+				return nil, fmt.Errorf("Bad listen address [%v]. Expected host:port.", arg)
+			}
+			fake.address = arg
+			addressGiven = true
+
+		default:
+			return nil, fmt.Errorf("Unexpected argument [%v].", arg)
+		}
+	}
+
+	return fake, nil
+}
+
+func (fake *fakeUpstream) answer(query *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.RecursionAvailable = true
+	if len(query.Question) != 1 {
+		resp.Rcode = dns.RcodeFormatError
+		return resp
+	}
+
+	question := query.Question[0]
+	header := dns.RR_Header{Name: question.Name, Class: dns.ClassINET, Rrtype: question.Qtype, Ttl: fake.ttl}
+	labels := dns.SplitDomainName(question.Name)
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.ToLower(question.Name)))
+	host := byte(hash.Sum32()%254) + 1
+
+	switch {
+	case len(labels) > 0 && strings.HasPrefix(strings.ToLower(labels[0]), "nx"):
+		resp.Rcode = dns.RcodeNameError
+		resp.Ns = append(resp.Ns, fake.soa())
+	case question.Qtype == dns.TypeA:
+		resp.Answer = append(resp.Answer, &dns.A{Hdr: header, A: net.IPv4(192, 0, 2, host)})
+	case question.Qtype == dns.TypeAAAA:
+		ip := net.ParseIP("2001:db8::")
+		ip[net.IPv6len-1] = host
+		resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+	default:
+		resp.Ns = append(resp.Ns, fake.soa())
+	}
+	return resp
+}
+
+func (fake *fakeUpstream) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: ".", Class: dns.ClassINET, Rrtype: dns.TypeSOA, Ttl: fake.ttl},
+		Ns:      "fake-upstream.",
+		Mbox:    "hostmaster.fake-upstream.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  fake.ttl,
+	}
+}
+
+func (fake *fakeUpstream) ServeDNS(writer dns.ResponseWriter, query *dns.Msg) {
+	time.Sleep(fake.latency)
+	writer.WriteMsg(fake.answer(query))
+}
+
+// FakeUpstream serves made up answers over udp and tcp until interrupted.
+func FakeUpstream(args []string) error {
+	fake, err := parseFakeUpstreamArgs(args)
+	if err != nil {
+		return err
+	}
+
+	errors := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{Addr: fake.address, Net: network, Handler: fake}
+		go func() { errors <- server.ListenAndServe() }()
+	}
+	log.Printf("fake upstream listening on %v (udp and tcp), answering after %v.", fake.address, fake.latency)
+
+	onSignalInterrupt := make(chan os.Signal, 1)
+	signal.Notify(onSignalInterrupt, os.Interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT)
+
+	select {
+	case err := <-errors:
+		return err
+	case <-onSignalInterrupt:
+		return nil
+	}
+}
@@ -0,0 +1,113 @@
+package test
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// jsonMsg is a DNS message laid out for JSON output.
+type jsonMsg struct {
+	ID         uint16         `json:"id"`
+	Opcode     string         `json:"opcode"`
+	Rcode      string         `json:"rcode"`
+	Flags      []string       `json:"flags"`
+	Question   []jsonQuestion `json:"question"`
+	Answer     []jsonRR       `json:"answer"`
+	Authority  []jsonRR       `json:"authority"`
+	Additional []jsonRR       `json:"additional"`
+	EDNS       *jsonEDNS      `json:"edns,omitempty"`
+}
+
+type jsonQuestion struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+}
+
+type jsonRR struct {
+	Name  string `json:"name"`
+	TTL   uint32 `json:"ttl"`
+	Class string `json:"class"`
+	Type  string `json:"type"`
+	Data  string `json:"data"`
+}
+
+type jsonEDNS struct {
+	Version uint8    `json:"version"`
+	UDPSize uint16   `json:"udp_size"`
+	DO      bool     `json:"do"`
+	Options []string `json:"options"`
+}
+
+func newJSONMsg(msg *dns.Msg) *jsonMsg {
+	retval := &jsonMsg{
+		ID:         msg.Id,
+		Opcode:     dns.OpcodeToString[msg.Opcode],
+		Rcode:      dns.RcodeToString[msg.Rcode],
+		Flags:      []string{},
+		Question:   []jsonQuestion{},
+		Answer:     newJSONRRs(msg.Answer),
+		Authority:  newJSONRRs(msg.Ns),
+		Additional: newJSONRRs(msg.Extra),
+	}
+
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{
+		{"qr", msg.Response},
+		{"aa", msg.Authoritative},
+		{"tc", msg.Truncated},
+		{"rd", msg.RecursionDesired},
+		{"ra", msg.RecursionAvailable},
+		{"ad", msg.AuthenticatedData},
+		{"cd", msg.CheckingDisabled},
+	} {
+		if flag.set {
+			retval.Flags = append(retval.Flags, flag.name)
+		}
+	}
+
+	for _, question := range msg.Question {
+		retval.Question = append(retval.Question, jsonQuestion{
+			Name:  question.Name,
+			Type:  dns.TypeToString[question.Qtype],
+			Class: dns.ClassToString[question.Qclass],
+		})
+	}
+
+	if opt := msg.IsEdns0(); opt != nil {
+		retval.EDNS = &jsonEDNS{
+			Version: opt.Version(),
+			UDPSize: opt.UDPSize(),
+			DO:      opt.Do(),
+			Options: []string{},
+		}
+		for _, option := range opt.Option {
+			retval.EDNS.Options = append(retval.EDNS.Options, option.String())
+		}
+	}
+
+	return retval
+}
+
+// newJSONRRs lays out records, leaving out the OPT record, which is shown as
+// edns instead.
+func newJSONRRs(rrs []dns.RR) []jsonRR {
+	retval := []jsonRR{}
+	for _, rr := range rrs {
+		header := rr.Header()
+		if header.Rrtype == dns.TypeOPT {
+			continue
+		}
+		retval = append(retval, jsonRR{
+			Name:  header.Name,
+			TTL:   header.Ttl,
+			Class: dns.ClassToString[header.Class],
+			Type:  dns.TypeToString[header.Rrtype],
+			Data:  strings.TrimPrefix(rr.String(), header.String()),
+		})
+	}
+	return retval
+}
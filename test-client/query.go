@@ -0,0 +1,434 @@
+package test
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultQueryServer = testAddress
+
+// queryOptions is what a query command line asks for, dig style:
+//
+//	@server name [type] [class] [+option...]
+type queryOptions struct {
+	server           string
+	name             string
+	qtype            uint16
+	qclass           uint16
+	post             bool // DoH only
+	dnssec           bool
+	checkingDisabled bool
+	recurse          bool
+	subnet           *net.IPNet
+	paddingBlockSize int // 0 for no padding
+	json             bool
+	insecure         bool
+	timeout          time.Duration
+}
+
+func parseQueryArgs(args []string) (*queryOptions, error) {
+	opts := &queryOptions{
+		server:  defaultQueryServer,
+		recurse: true,
+		timeout: 5 * time.Second,
+	}
+
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			opts.server = strings.TrimPrefix(arg, "@")
+
+		case strings.HasPrefix(arg, "+"):
+			if err := opts.setOption(strings.TrimPrefix(arg, "+")); err != nil {
+				return nil, err
+			}
+
+		case opts.name == "":
+			opts.name = dns.Fqdn(arg)
+			if _, ok := dns.IsDomainName(opts.name); !ok {
+				return nil, fmt.Errorf("Bad domain name [%v].", arg)
+			}
+
+		case opts.qtype == 0 && dns.StringToType[strings.ToUpper(arg)] != 0:
+			opts.qtype = dns.StringToType[strings.ToUpper(arg)]
+
+		case opts.qclass == 0 && dns.StringToClass[strings.ToUpper(arg)] != 0:
+			opts.qclass = dns.StringToClass[strings.ToUpper(arg)]
+
+		default:
+			return nil, fmt.Errorf("Unexpected argument [%v].", arg)
+		}
+	}
+
+	if opts.name == "" {
+		return nil, fmt.Errorf("No name to query given.")
+	}
+	if opts.qtype == 0 {
+		opts.qtype = dns.TypeA
+	}
+	if opts.qclass == 0 {
+		opts.qclass = dns.ClassINET
+	}
+
+	return opts, nil
+}
+
+func (opts *queryOptions) setOption(option string) error {
+	name, value := option, ""
+	if i := strings.Index(option, "="); i >= 0 {
+		name, value = option[:i], option[i+1:]
+	}
+
+	switch name {
+	case "post":
+		opts.post = true
+	case "get":
+		opts.post = false
+	case "dnssec":
+		opts.dnssec = true
+	case "nodnssec":
+		opts.dnssec = false
+	case "cd", "cdflag":
+		opts.checkingDisabled = true
+	case "nocd", "nocdflag":
+		opts.checkingDisabled = false
+	case "rec", "recurse":
+		opts.recurse = true
+	case "norec", "norecurse":
+		opts.recurse = false
+	case "json":
+		opts.json = true
+	case "insecure":
+		opts.insecure = true
+	case "subnet":
+		subnet, err := parseSubnet(value)
+		if err != nil {
+			return err
+		}
+		opts.subnet = subnet
+	case "padding":
+		// RFC 8467 recommends padding queries to a multiple of 128 bytes.
+		opts.paddingBlockSize = 128
+		if value != "" {
+			blockSize, err := strconv.Atoi(value)
+			if err != nil || blockSize <= 0 || blockSize > 512 {
+				return fmt.Errorf("Padding block size must be within [1, 512]. Provided: [%v].", value)
+			}
+			opts.paddingBlockSize = blockSize
+		}
+	case "nopadding":
+		opts.paddingBlockSize = 0
+	case "timeout":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("Timeout must be a positive number of seconds. Provided: [%v].", value)
+		}
+		opts.timeout = time.Duration(seconds) * time.Second
+	default:
+		return fmt.Errorf("Unknown option [+%v].", option)
+	}
+	return nil
+}
+
+// parseSubnet parses an ECS subnet. A plain address is taken as a /24 or /56,
+// the prefixes RFC 7871 recommends sending.
+func parseSubnet(subnet string) (*net.IPNet, error) {
+	if !strings.Contains(subnet, "/") {
+		ip := net.ParseIP(subnet)
+		if ip == nil {
+			return nil, fmt.Errorf("Bad subnet [%v].", subnet)
+		}
+		if ip.To4() != nil {
+			subnet += "/24"
+		} else {
+			subnet += "/56"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("Bad subnet [%v].", subnet)
+	}
+	return network, nil
+}
+
+// parseServer works out how to talk to a server: https:// and http:// URLs
+// are DoH, tls:// is DoT, and udp://, tcp:// or a bare address is plain DNS.
+// Any other scheme is turned down.
+func parseServer(server string) (protocol string, address string, err error) {
+	if strings.HasPrefix(server, "https://") || strings.HasPrefix(server, "http://") {
+		return "doh", server, nil
+	}
+
+	protocol, defaultPort := "udp", "53"
+	for _, scheme := range []struct{ prefix, protocol, port string }{
+		{"tls://", "dot", "853"},
+		{"udp://", "udp", "53"},
+		{"tcp://", "tcp", "53"},
+	} {
+		if strings.HasPrefix(server, scheme.prefix) {
+			server = strings.TrimPrefix(server, scheme.prefix)
+			protocol, defaultPort = scheme.protocol, scheme.port
+			break
+		}
+	}
+
+	if strings.Contains(server, "://") {
+		return "", "", fmt.Errorf("Unsupported server scheme [%v].", server)
+	}
+	if server == "" {
+		return "", "", fmt.Errorf("No server address given.")
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), defaultPort)
+	}
+	return protocol, server, nil
+}
+
+func (opts *queryOptions) createMsg() (*dns.Msg, error) {
+	msg := createQueryMsg(opts.name, opts.qtype, opts.qclass)
+	msg.RecursionDesired = opts.recurse
+	msg.CheckingDisabled = opts.checkingDisabled
+
+	if !opts.dnssec && opts.subnet == nil && opts.paddingBlockSize == 0 {
+		return msg, nil
+	}
+
+	msg.SetEdns0(dns.DefaultMsgSize, opts.dnssec)
+	opt := msg.IsEdns0()
+
+	if opts.subnet != nil {
+		ones, _ := opts.subnet.Mask.Size()
+		ecs := &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: uint8(ones),
+			Address:       opts.subnet.IP,
+		}
+		if opts.subnet.IP.To4() == nil {
+			ecs.Family = 2
+		}
+		opt.Option = append(opt.Option, ecs)
+	}
+
+	if opts.paddingBlockSize > 0 {
+		// RFC 7830: the padding option goes last, sized so the whole message
+		// comes out at a multiple of the block size.
+		padding := &dns.EDNS0_PADDING{}
+		opt.Option = append(opt.Option, padding)
+		packed, err := msg.Pack()
+		if err != nil {
+			return nil, err
+		}
+		if remainder := len(packed) % opts.paddingBlockSize; remainder != 0 {
+			padding.Padding = make([]byte, opts.paddingBlockSize-remainder)
+		}
+	}
+
+	return msg, nil
+}
+
+// queryResult is the outcome of a single query, as printed.
+type queryResult struct {
+	Server      string            `json:"server"`
+	Protocol    string            `json:"protocol"`
+	Method      string            `json:"method,omitempty"`
+	QueryTimeMs float64           `json:"query_time_ms"`
+	Size        int               `json:"size"`
+	HTTPStatus  string            `json:"http_status,omitempty"`
+	HTTPHeaders map[string]string `json:"http_headers,omitempty"`
+	Response    *jsonMsg          `json:"response,omitempty"`
+	Error       string            `json:"error,omitempty"`
+
+	msg  *dns.Msg
+	when time.Time
+}
+
+func exchange(opts *queryOptions, msg *dns.Msg) *queryResult {
+	protocol, address, err := parseServer(opts.server)
+	result := &queryResult{Server: address, Protocol: protocol, when: time.Now()}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.insecure}
+
+	switch protocol {
+	case "doh":
+		result.Method = http.MethodGet
+		if opts.post {
+			result.Method = http.MethodPost
+		}
+		exchangeDOH(opts, tlsConfig, msg, result)
+
+	default:
+		client := &dns.Client{Net: protocol, Timeout: opts.timeout}
+		if protocol == "dot" {
+			host, _, _ := net.SplitHostPort(address)
+			tlsConfig.ServerName = host
+			client.Net, client.TLSConfig = "tcp-tls", tlsConfig
+		}
+
+		resp, rtt, err := client.Exchange(msg, address)
+		if err == nil && resp.Truncated && protocol == "udp" {
+			// Retry over tcp, the way dig does.
+			result.Protocol = "tcp"
+			client.Net = "tcp"
+			resp, rtt, err = client.Exchange(msg, address)
+		}
+		result.QueryTimeMs = float64(rtt) / float64(time.Millisecond)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		result.msg = resp
+		if packed, err := resp.Pack(); err == nil {
+			result.Size = len(packed)
+		}
+	}
+
+	return result
+}
+
+func exchangeDOH(opts *queryOptions, tlsConfig *tls.Config, msg *dns.Msg, result *queryResult) {
+	// RFC 8484 4.1: the id should be 0, so that GET requests cache well.
+	msg.Id = 0
+	wireFormat, err := msg.Pack()
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+
+	httpClient := &http.Client{
+		Timeout: opts.timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: true,
+		},
+	}
+
+	request, err := newDOHRequest(result.Method, opts.server, wireFormat)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+
+	start := time.Now()
+	resp, err := httpClient.Do(request)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	result.QueryTimeMs = float64(time.Since(start)) / float64(time.Millisecond)
+
+	result.HTTPStatus = fmt.Sprintf("%v %v", resp.Proto, resp.Status)
+	result.HTTPHeaders = map[string]string{}
+	for name, values := range resp.Header {
+		result.HTTPHeaders[name] = strings.Join(values, ", ")
+	}
+
+	if err != nil {
+		result.Error = fmt.Sprintf("Couldn't read response body: %v", err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		result.Error = fmt.Sprintf("http status was not 200. Returned %v", resp.Status)
+		return
+	}
+
+	result.Size = len(body)
+	dnsResp := new(dns.Msg)
+	if err := dnsResp.Unpack(body); err != nil {
+		result.Error = fmt.Sprintf("Couldn't unpack dns msg: %v", err)
+		return
+	}
+	result.msg = dnsResp
+}
+
+// Query sends a single query, dig style, and prints the response. It returns
+// an error if there's no response to show.
+func Query(args []string) error {
+	opts, err := parseQueryArgs(args)
+	if err != nil {
+		return err
+	}
+
+	msg, err := opts.createMsg()
+	if err != nil {
+		return err
+	}
+
+	result := exchange(opts, msg)
+	if result.msg != nil {
+		result.Response = newJSONMsg(result.msg)
+	}
+
+	if opts.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	} else {
+		fmt.Print(formatResult(args, result))
+	}
+
+	if result.Error != "" {
+		return fmt.Errorf("%v", result.Error)
+	}
+	return nil
+}
+
+func formatResult(args []string, result *queryResult) string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "\n; <<>> dohboy <<>> %v\n", strings.Join(args, " "))
+
+	if result.msg != nil {
+		builder.WriteString(";; Got answer:\n")
+		builder.WriteString(result.msg.String())
+		builder.WriteString("\n")
+	}
+
+	fmt.Fprintf(&builder, ";; Query time: %.0f msec\n", result.QueryTimeMs)
+	if result.Method != "" {
+		fmt.Fprintf(&builder, ";; SERVER: %v (%v, %v)\n", result.Server, result.Protocol, result.Method)
+	} else {
+		fmt.Fprintf(&builder, ";; SERVER: %v (%v)\n", result.Server, result.Protocol)
+	}
+	fmt.Fprintf(&builder, ";; WHEN: %v\n", result.when.Format(time.RFC1123))
+	if result.msg != nil {
+		fmt.Fprintf(&builder, ";; MSG SIZE  rcvd: %v\n", result.Size)
+	}
+
+	if result.HTTPStatus != "" {
+		fmt.Fprintf(&builder, ";; HTTP: %v\n", result.HTTPStatus)
+		names := make([]string, 0, len(result.HTTPHeaders))
+		for name := range result.HTTPHeaders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&builder, ";;   %v: %v\n", name, result.HTTPHeaders[name])
+		}
+	}
+
+	if result.Error != "" {
+		fmt.Fprintf(&builder, ";; ERROR: %v\n", result.Error)
+	}
+	builder.WriteString("\n")
+	return builder.String()
+}
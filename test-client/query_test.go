@@ -0,0 +1,299 @@
+package test
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseQueryArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    queryOptions
+		wantErr bool
+	}{
+		{
+			name: "name only",
+			args: []string{"example.com"},
+			want: queryOptions{server: defaultQueryServer, name: "example.com.", qtype: dns.TypeA, qclass: dns.ClassINET, recurse: true},
+		},
+		{
+			name: "type and class",
+			args: []string{"@tls://1.1.1.1", "example.com", "mx", "CH", "+dnssec", "+cd", "+norec"},
+			want: queryOptions{server: "tls://1.1.1.1", name: "example.com.", qtype: dns.TypeMX, qclass: dns.ClassCHAOS, dnssec: true, checkingDisabled: true},
+		},
+		{
+			name: "ANY is a type before it's a class",
+			args: []string{"example.com", "ANY"},
+			want: queryOptions{server: defaultQueryServer, name: "example.com.", qtype: dns.TypeANY, qclass: dns.ClassINET, recurse: true},
+		},
+		{
+			name: "DoH options",
+			args: []string{"+post", "+json", "+padding=64", "+insecure", "example.com", "AAAA"},
+			want: queryOptions{server: defaultQueryServer, name: "example.com.", qtype: dns.TypeAAAA, qclass: dns.ClassINET, recurse: true, post: true, json: true, paddingBlockSize: 64, insecure: true},
+		},
+		{name: "no name", args: []string{"+dnssec"}, wantErr: true},
+		{name: "unknown option", args: []string{"example.com", "+bogus"}, wantErr: true},
+		{name: "too many arguments", args: []string{"example.com", "A", "IN", "extra"}, wantErr: true},
+		{name: "bad subnet", args: []string{"example.com", "+subnet=nope"}, wantErr: true},
+		{name: "bad padding", args: []string{"example.com", "+padding=0"}, wantErr: true},
+		{name: "bad timeout", args: []string{"example.com", "+timeout=-1"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := parseQueryArgs(test.args)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			got := *opts
+			got.timeout = 0
+			if got != test.want {
+				t.Errorf("options = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseServer(t *testing.T) {
+	tests := []struct {
+		server       string
+		wantProtocol string
+		wantAddress  string
+	}{
+		{server: "https://dns.example/dns-query", wantProtocol: "doh", wantAddress: "https://dns.example/dns-query"},
+		{server: "http://127.0.0.1:8080/dns-query", wantProtocol: "doh", wantAddress: "http://127.0.0.1:8080/dns-query"},
+		{server: "192.0.2.53", wantProtocol: "udp", wantAddress: "192.0.2.53:53"},
+		{server: "192.0.2.53:5353", wantProtocol: "udp", wantAddress: "192.0.2.53:5353"},
+		{server: "2001:db8::53", wantProtocol: "udp", wantAddress: "[2001:db8::53]:53"},
+		{server: "tcp://[2001:db8::53]", wantProtocol: "tcp", wantAddress: "[2001:db8::53]:53"},
+		{server: "tls://dns.example", wantProtocol: "dot", wantAddress: "dns.example:853"},
+	}
+
+	for _, test := range tests {
+		protocol, address, err := parseServer(test.server)
+		if err != nil {
+			t.Errorf("parseServer(%v): %v", test.server, err)
+			continue
+		}
+		if protocol != test.wantProtocol || address != test.wantAddress {
+			t.Errorf("parseServer(%v) = %v %v, want %v %v", test.server, protocol, address, test.wantProtocol, test.wantAddress)
+		}
+	}
+
+	for _, server := range []string{"quic://dns.example:853", "sdns://AQcAAAAAAAAA", "tls://"} {
+		if _, _, err := parseServer(server); err == nil {
+			t.Errorf("parseServer(%v): expected an error", server)
+		}
+	}
+}
+
+func TestCreateMsg(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantEDNS    bool
+		wantDO      bool
+		wantSubnet  string
+		wantPadding int // block size the packed query has to come out at
+	}{
+		{name: "plain", args: []string{"example.com"}},
+		{name: "dnssec", args: []string{"example.com", "+dnssec"}, wantEDNS: true, wantDO: true},
+		{name: "ipv4 subnet", args: []string{"example.com", "+subnet=192.0.2.77"}, wantEDNS: true, wantSubnet: "192.0.2.0/24"},
+		{name: "ipv6 subnet", args: []string{"example.com", "+subnet=2001:db8::/48"}, wantEDNS: true, wantSubnet: "2001:db8::/48"},
+		{name: "padding", args: []string{"example.com", "+padding"}, wantEDNS: true, wantPadding: 128},
+		{name: "padding with everything", args: []string{"a-longer-name.example.com", "+padding=32", "+dnssec", "+subnet=192.0.2.1"}, wantEDNS: true, wantDO: true, wantSubnet: "192.0.2.0/24", wantPadding: 32},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := parseQueryArgs(test.args)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			msg, err := opts.createMsg()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			opt := msg.IsEdns0()
+			if (opt != nil) != test.wantEDNS {
+				t.Fatalf("EDNS = %v, want %v", opt, test.wantEDNS)
+			}
+			if opt == nil {
+				return
+			}
+			if opt.Do() != test.wantDO {
+				t.Errorf("DO = %v, want %v", opt.Do(), test.wantDO)
+			}
+
+			subnet := ""
+			for _, option := range opt.Option {
+				if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+					bits := 8 * net.IPv6len
+					if ecs.Family == 1 {
+						bits = 8 * net.IPv4len
+					}
+					network := net.IPNet{IP: ecs.Address, Mask: net.CIDRMask(int(ecs.SourceNetmask), bits)}
+					subnet = network.String()
+				}
+			}
+			if subnet != test.wantSubnet {
+				t.Errorf("subnet = %v, want %v", subnet, test.wantSubnet)
+			}
+
+			if test.wantPadding > 0 {
+				packed, err := msg.Pack()
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if len(packed)%test.wantPadding != 0 {
+					t.Errorf("packed query is %v bytes, want a multiple of %v", len(packed), test.wantPadding)
+				}
+				if _, isPadding := opt.Option[len(opt.Option)-1].(*dns.EDNS0_PADDING); !isPadding {
+					t.Errorf("padding isn't the last option")
+				}
+			}
+		})
+	}
+}
+
+func answerTestQuery(query *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	rr, _ := dns.NewRR(query.Question[0].Name + " 300 IN A 192.0.2.1")
+	resp.Answer = append(resp.Answer, rr)
+	return resp
+}
+
+// startTestDNSServer starts an in-process DNS server over udp, tcp or
+// tcp-tls and returns its address.
+func startTestDNSServer(t *testing.T, network string, tlsConfig *tls.Config) string {
+	t.Helper()
+	server := &dns.Server{
+		Addr:      "127.0.0.1:0",
+		Net:       network,
+		TLSConfig: tlsConfig,
+		Handler: dns.HandlerFunc(func(writer dns.ResponseWriter, query *dns.Msg) {
+			writer.WriteMsg(answerTestQuery(query))
+		}),
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ListenAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	if server.PacketConn != nil {
+		return server.PacketConn.LocalAddr().String()
+	}
+	return server.Listener.Addr().String()
+}
+
+func startTestDOHServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/dns-query" {
+			http.NotFound(response, request)
+			return
+		}
+
+		var wireFormat []byte
+		var err error
+		if request.Method == http.MethodGet {
+			wireFormat, err = base64.RawURLEncoding.DecodeString(request.URL.Query().Get("dns"))
+		} else {
+			wireFormat, err = ioutil.ReadAll(request.Body)
+		}
+
+		query := new(dns.Msg)
+		if err == nil {
+			err = query.Unpack(wireFormat)
+		}
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		packed, _ := answerTestQuery(query).Pack()
+		response.Header().Set("Content-Type", "application/dns-message")
+		response.Header().Set("Cache-Control", "max-age=300")
+		response.Write(packed)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestExchange(t *testing.T) {
+	doh := startTestDOHServer(t)
+	udp := startTestDNSServer(t, "udp", nil)
+	tcp := startTestDNSServer(t, "tcp", nil)
+	dot := startTestDNSServer(t, "tcp-tls", &tls.Config{Certificates: doh.TLS.Certificates})
+
+	tests := []struct {
+		name         string
+		args         []string
+		wantProtocol string
+		wantErr      string
+	}{
+		{name: "DoH GET", args: []string{"@" + doh.URL + "/dns-query", "+insecure"}, wantProtocol: "doh"},
+		{name: "DoH POST", args: []string{"@" + doh.URL + "/dns-query", "+insecure", "+post", "+padding", "+dnssec"}, wantProtocol: "doh"},
+		{name: "DoH with an untrusted certificate", args: []string{"@" + doh.URL + "/dns-query"}, wantErr: "certificate"},
+		{name: "DoH error status", args: []string{"@" + doh.URL + "/nope", "+insecure"}, wantErr: "404"},
+		{name: "udp", args: []string{"@" + udp}, wantProtocol: "udp"},
+		{name: "tcp", args: []string{"@tcp://" + tcp}, wantProtocol: "tcp"},
+		{name: "DoT", args: []string{"@tls://" + dot, "+insecure"}, wantProtocol: "dot"},
+		{name: "DoQ", args: []string{"@quic://" + udp}, wantErr: "Unsupported server scheme"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := parseQueryArgs(append(test.args, "www.example.com"))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			msg, err := opts.createMsg()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			result := exchange(opts, msg)
+			if test.wantErr != "" {
+				if !strings.Contains(result.Error, test.wantErr) {
+					t.Errorf("error = %v, want one containing [%v]", result.Error, test.wantErr)
+				}
+				return
+			}
+
+			if result.Error != "" {
+				t.Fatalf("Unexpected error: %v", result.Error)
+			}
+			if result.Protocol != test.wantProtocol {
+				t.Errorf("protocol = %v, want %v", result.Protocol, test.wantProtocol)
+			}
+			if result.msg == nil || len(result.msg.Answer) != 1 || result.Size == 0 {
+				t.Fatalf("response = %v (%v bytes)", result.msg, result.Size)
+			}
+			if test.wantProtocol == "doh" && result.HTTPHeaders["Cache-Control"] != "max-age=300" {
+				t.Errorf("headers = %v, want the Cache-Control header", result.HTTPHeaders)
+			}
+
+			output := formatResult(test.args, result)
+			if !strings.Contains(output, "www.example.com.\t300\tIN\tA\t192.0.2.1") || !strings.Contains(output, ";; Query time:") {
+				t.Errorf("output = %v", output)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/miekg/dns"
 )
@@ -38,12 +39,10 @@ func postFromMsg(address string, msg *dns.Msg) (*dns.Msg, *http.Response, error)
 }
 
 func postFromWireFormat(address string, data []byte) (*dns.Msg, *http.Response, error) {
-	req, err := http.NewRequest(http.MethodPost, address, bytes.NewReader(data))
+	req, err := newDOHRequest(http.MethodPost, address, data)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Couldn't create http request: %v", err)
+		return nil, nil, err
 	}
-	req.Header.Set("Content-Type", "application/dns-message")
-	req.Header.Set("Accept", "application/dns-message")
 
 	httpClient := &http.Client{}
 	resp, err := httpClient.Do(req)
@@ -53,6 +52,31 @@ func postFromWireFormat(address string, data []byte) (*dns.Msg, *http.Response,
 	return parseResponse(resp)
 }
 
+// newDOHRequest creates a DoH request carrying a wire format query, either in
+// the dns param of a GET or as the body of a POST.
+func newDOHRequest(method string, address string, data []byte) (*http.Request, error) {
+	var req *http.Request
+	var err error
+	if method == http.MethodGet {
+		separator := "?"
+		if strings.Contains(address, "?") {
+			separator = "&"
+		}
+		req, err = http.NewRequest(http.MethodGet, address+separator+"dns="+base64.RawURLEncoding.EncodeToString(data), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, address, bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create http request: %v", err)
+	}
+
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/dns-message")
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	return req, nil
+}
+
 func parseResponse(resp *http.Response) (*dns.Msg, *http.Response, error) {
 	if resp.StatusCode != 200 {
 		return nil, resp, fmt.Errorf("http status was not 200. Returned %v", resp.Status)
@@ -78,6 +102,6 @@ func createQueryMsg(host string, dnsType uint16, dnsClass uint16) *dns.Msg {
 	m.Id = dns.Id()
 	m.RecursionDesired = true
 	m.Question = make([]dns.Question, 1)
-	m.Question[0] = dns.Question{host, dnsType, dnsClass}
+	m.Question[0] = dns.Question{Name: host, Qtype: dnsType, Qclass: dnsClass}
 	return m
 }